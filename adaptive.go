@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// LatencyStats provides statistics about the latencies of the last
+// successful remote calls to a method of a peer made by a Client.
+type LatencyStats struct {
+	// Samples is the number of latencies the statistics are based on.
+	Samples int
+
+	P50Latency time.Duration
+	P90Latency time.Duration
+	P99Latency time.Duration
+}
+
+// adaptiveTimeout holds the settings of WithAdaptiveTimeout.
+type adaptiveTimeout struct {
+	percentile float64
+	factor     float64
+	fallback   time.Duration
+}
+
+// WithAdaptiveTimeout sets the timeout of the call from the latencies of
+// the last successful calls to the same method of the same peer made by
+// the Client: it is their given percentile (between 0 and 1) multiplied
+// by factor, i.e. 0.99 and 3 to allow three times the 99th percentile.
+// The fallback timeout is used until enough calls have been observed,
+// and a zero or negative fallback means no timeout then. Like with
+// WithTimeout, the deadline is applied on top of the context of the call
+// and the earliest one wins.
+func WithAdaptiveTimeout(percentile, factor float64, fallback time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.adaptiveTimeout = &adaptiveTimeout{
+			percentile: percentile,
+			factor:     factor,
+			fallback:   fallback,
+		}
+	}
+}
+
+// peerMethodKey returns the key of the latencies of a method of a peer.
+func peerMethodKey(p peer.ID, svcName, svcMethod string) string {
+	return string(p) + "/" + svcName + "." + svcMethod
+}
+
+// timeout returns the adaptive timeout for a call to the given method of
+// the given peer, or the fallback timeout.
+func (lt *latencyTracker) timeout(p peer.ID, svcID ServiceID, at *adaptiveTimeout) time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	r, ok := lt.peerSamples[peerMethodKey(p, svcID.Name, svcID.Method)]
+	if !ok || r.count < minLatencySamples {
+		return at.fallback
+	}
+	return time.Duration(float64(r.percentiles(at.percentile)[0]) * at.factor)
+}
+
+// Latencies returns the statistics about the latencies of the last
+// successful remote calls to the given method of the given peer, or false
+// when none has been observed.
+func (c *Client) Latencies(p peer.ID, svcName, svcMethod string) (LatencyStats, bool) {
+	lt := c.latencies
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	r, ok := lt.peerSamples[peerMethodKey(p, svcName, svcMethod)]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	ps := r.percentiles(0.5, 0.9, 0.99)
+	return LatencyStats{
+		Samples:    r.count,
+		P50Latency: ps[0],
+		P90Latency: ps[1],
+		P99Latency: ps[2],
+	}, true
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Respond completes an asynchronous call with the given reply or error.
+//
+// Methods taking a Respond function instead of a reply pointer, and
+// returning nothing, are asynchronous:
+//
+//	func (t *T) MethodName(ctx context.Context, argType T1, respond rpc.Respond)
+//
+// Such methods may return immediately and call respond later, from any
+// goroutine, to send the reply to the caller. Only the first call to
+// respond has any effect. The method must eventually call respond, or
+// the caller will wait until its context is cancelled, unless a timeout
+// is set for it (see WithMethodTimeout). The reply should
+// have the type that callers expect (usually a pointer to it). Requests
+// to asynchronous methods are not deduplicated (see WithDeduplication).
+type Respond func(reply interface{}, err error)
+
+var typeOfRespond = reflect.TypeOf((*Respond)(nil)).Elem()
+
+// asyncCall invokes an asynchronous method. The response is sent when
+// the method calls respond, or when the timeout passes, after which
+// finish is called with the result of sending it. The handler duration
+// and the returned error are recorded in the given CallEvent.
+func (s *service) asyncCall(sWrap *streamWrap, mtype *methodType, svcID ServiceID, ctxv, argv reflect.Value, timeout time.Duration, ev *CallEvent, finish func(error)) {
+	start := time.Now()
+	var once sync.Once
+	send := func(reply interface{}, err error) {
+		once.Do(func() {
+			ev.HandlerDuration = time.Since(start)
+			ev.Error = err
+			resp := &Response{
+				Service: svcID,
+				ErrType: nonRPCErr,
+			}
+			if err != nil {
+				resp = newErrorResponse(svcID, err)
+			}
+			resp.Duration = ev.HandlerDuration
+			finish(sendResponse(sWrap, resp, reply))
+		})
+	}
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			s.logger.Warnw("method did not respond in time", "service", svcID.Name, "method", svcID.Method, "timeout", timeout)
+			send(nil, errServerDeadline)
+		})
+	}
+	respond := Respond(func(reply interface{}, err error) {
+		if timer != nil {
+			timer.Stop()
+		}
+		send(reply, err)
+	})
+	s.call(mtype, []reflect.Value{s.rcvr, ctxv, argv, reflect.ValueOf(respond)})
+}
+
+type asyncResult struct {
+	reply interface{}
+	err   error
+}
+
+// localAsyncCall invokes an asynchronous method for a local call and
+// waits for its response, which is set on the given reply.
+func (s *service) localAsyncCall(mtype *methodType, ctx context.Context, ctxv, argv reflect.Value, reply interface{}) error {
+	results := make(chan asyncResult, 1)
+	var once sync.Once
+	respond := Respond(func(reply interface{}, err error) {
+		once.Do(func() {
+			results <- asyncResult{reply, err}
+		})
+	})
+	mtype.method.Func.Call([]reflect.Value{s.rcvr, ctxv, argv, reflect.ValueOf(respond)})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-results:
+		if res.err != nil {
+			return res.err
+		}
+		return setReply(reply, res.reply)
+	}
+}
+
+// setReply sets the value of a reply pointer to the given reply, which
+// may be a value or a pointer to a value of the same type.
+func setReply(dst, reply interface{}) error {
+	if reply == nil {
+		return nil
+	}
+	dstv := reflect.ValueOf(dst).Elem()
+	replyv := reflect.ValueOf(reply)
+	if replyv.Kind() == reflect.Ptr && replyv.Type().Elem().AssignableTo(dstv.Type()) {
+		if replyv.IsNil() {
+			return nil
+		}
+		replyv = replyv.Elem()
+	}
+	if !replyv.Type().AssignableTo(dstv.Type()) {
+		return fmt.Errorf("rpc: cannot use reply of type %s as %s", replyv.Type(), dstv.Type())
+	}
+	dstv.Set(replyv)
+	return nil
+}
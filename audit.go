@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// AuditRecord describes a call handled by a Server, for auditing.
+type AuditRecord struct {
+	// Time is the time when the call was received.
+	Time time.Time
+	// Peer is the caller. It is empty for local calls.
+	Peer    peer.ID
+	Service string
+	Method  string
+	// Error is the error returned by the call, empty when it
+	// succeeded.
+	Error string
+	// BytesSent and BytesReceived are the sizes of the response and
+	// the request. They are only set for remote calls.
+	BytesSent     int64
+	BytesReceived int64
+	// Duration is the total duration of the call.
+	Duration time.Duration
+	// ArgsHash is the SHA-256 hash of the arguments encoded with
+	// MsgpackCodec, when requested with AuditConfig.HashArgs.
+	ArgsHash []byte
+}
+
+// AuditSink receives the audit records of a Server (see WithAuditSink).
+// Records are written from a single goroutine, in the order the calls
+// finished.
+type AuditSink interface {
+	WriteAudit(AuditRecord) error
+}
+
+// AuditConfig configures the auditing of the calls handled by a Server.
+type AuditConfig struct {
+	// SampleRate is the fraction of the calls which are audited,
+	// between 0 and 1. Zero audits every call.
+	SampleRate float64
+	// HashArgs adds the hash of the arguments to the records.
+	HashArgs bool
+	// BufferSize is the number of records buffered while the sink
+	// writes previous ones. Records are dropped when the buffer is
+	// full. It defaults to 1024.
+	BufferSize int
+}
+
+// WithAuditSink makes the Server write a record for every call it handles
+// to the given sink, asynchronously. Records which cannot be written
+// because the buffer is full, or because the sink fails, are logged and
+// counted (see Server.AuditDropped).
+func WithAuditSink(sink AuditSink, cfg AuditConfig) ServerOption {
+	return func(s *Server) {
+		if cfg.BufferSize <= 0 {
+			cfg.BufferSize = 1024
+		}
+		s.audit = &auditor{
+			sink:    sink,
+			cfg:     cfg,
+			records: make(chan auditItem, cfg.BufferSize),
+		}
+	}
+}
+
+// auditItem is a record waiting to be written, or a request to signal
+// when all the previous records have been written.
+type auditItem struct {
+	rec     AuditRecord
+	flushed chan struct{}
+}
+
+// auditor writes the audit records of a Server to its sink.
+type auditor struct {
+	sink    AuditSink
+	cfg     AuditConfig
+	records chan auditItem
+	dropped int64
+}
+
+// run writes the records to the sink until the process exits.
+func (a *auditor) run(logger Logger) {
+	for item := range a.records {
+		if item.flushed != nil {
+			close(item.flushed)
+			continue
+		}
+		if err := a.sink.WriteAudit(item.rec); err != nil {
+			atomic.AddInt64(&a.dropped, 1)
+			logger.Errorw("error writing audit record", "peer", item.rec.Peer, "service", item.rec.Service, "method", item.rec.Method, "error", err)
+		}
+	}
+}
+
+// record queues the record of a finished call, unless it is not sampled.
+func (a *auditor) record(ev *CallEvent, logger Logger) {
+	if a.cfg.SampleRate > 0 && rand.Float64() >= a.cfg.SampleRate {
+		return
+	}
+	rec := AuditRecord{
+		Time:          ev.Start,
+		Peer:          ev.Peer,
+		Service:       ev.Service,
+		Method:        ev.Method,
+		BytesSent:     ev.BytesSent,
+		BytesReceived: ev.BytesReceived,
+		Duration:      ev.Duration,
+	}
+	if ev.Error != nil {
+		rec.Error = ev.Error.Error()
+	}
+	if a.cfg.HashArgs && ev.args != nil {
+		if data, err := MsgpackCodec.Marshal(ev.args); err == nil {
+			sum := sha256.Sum256(data)
+			rec.ArgsHash = sum[:]
+		}
+	}
+
+	select {
+	case a.records <- auditItem{rec: rec}:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+		logger.Warnw("audit buffer full, dropping record", ev.logFields()...)
+	}
+}
+
+// FlushAudit waits until the audit records of the calls finished so far
+// have been written to the sink (see WithAuditSink), or until the context
+// is cancelled.
+func (server *Server) FlushAudit(ctx context.Context) error {
+	if server.audit == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case server.audit.records <- auditItem{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AuditDropped returns the number of audit records which could not be
+// written, because the buffer was full or the sink failed.
+func (server *Server) AuditDropped() int64 {
+	if server.audit == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&server.audit.dropped)
+}
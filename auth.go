@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Besides the identity of peers, which is established by libp2p, Servers
+// can require the clients to authenticate at the application level at
+// the start of every stream (see WithAuthenticator), and Clients can
+// present credentials to do so (see WithCredentials). The exchange goes:
+//
+//   - the client sends a request header with Authenticate set,
+//   - the server answers with a challenge, which may be empty,
+//   - the client sends its credentials for that challenge,
+//   - the server answers with an empty response, or with an error
+//     response when the credentials are not valid,
+//
+// after which the requests are sent as usual. The exchange takes two
+// round trips before the first request of every stream: clients making
+// many calls to the same peer should use pipelining (see WithPipelining),
+// which authenticates once per pipelined stream. Servers without an
+// Authenticator accept any credentials.
+
+// Authenticator authenticates the clients of a Server (see
+// WithAuthenticator).
+type Authenticator interface {
+	// Challenge returns the challenge sent to the given peer, to be
+	// answered with its credentials (i.e. a random nonce to sign).
+	// It may return nil when the credentials do not depend on it
+	// (i.e. bearer tokens).
+	Challenge(p peer.ID) ([]byte, error)
+	// Authenticate checks the credentials presented by the given
+	// peer in answer to the challenge. It returns the identity of
+	// the client, which the methods called over the stream obtain
+	// with GetIdentity, or an error when the credentials are not
+	// valid.
+	Authenticate(ctx context.Context, p peer.ID, challenge, credentials []byte) (interface{}, error)
+}
+
+// CredentialsProvider provides the credentials presented by a Client
+// (see WithCredentials).
+type CredentialsProvider interface {
+	// Credentials returns the credentials to present to the given
+	// peer in answer to the challenge.
+	Credentials(ctx context.Context, p peer.ID, challenge []byte) ([]byte, error)
+}
+
+// StaticCredentials are credentials which do not depend on the
+// challenge, such as bearer tokens.
+type StaticCredentials []byte
+
+// Credentials returns the credentials.
+func (sc StaticCredentials) Credentials(ctx context.Context, p peer.ID, challenge []byte) ([]byte, error) {
+	return sc, nil
+}
+
+// WithAuthenticator makes the Server require the clients to authenticate
+// with the given Authenticator at the start of every stream. Calls from
+// clients which do not present valid credentials fail with an error
+// matching ErrUnauthenticated.
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(s *Server) {
+		s.authenticator = a
+	}
+}
+
+// WithCredentials makes the Client present credentials from the given
+// provider at the start of every stream to a remote server.
+func WithCredentials(cp CredentialsProvider) ClientOption {
+	return func(c *Client) {
+		c.credentials = cp
+	}
+}
+
+// ErrUnauthenticated is the authorization error returned by calls from
+// clients which failed to authenticate. Errors returned by such calls
+// match it with errors.Is.
+var ErrUnauthenticated error = &authorizationError{"rpc: authentication failed"}
+
+// newUnauthenticatedError returns the error for credentials which were
+// rejected with the given error.
+func newUnauthenticatedError(err error) error {
+	return &authorizationError{ErrUnauthenticated.Error() + ": " + err.Error()}
+}
+
+// errNoCredentials is the reason of the failure of calls from clients
+// which did not present credentials.
+var errNoCredentials = errors.New("no credentials presented")
+
+// authMessage carries the challenge sent by the server and the
+// credentials sent by the client.
+type authMessage struct {
+	Data []byte `codec:",omitempty"`
+}
+
+// GetIdentity returns the identity of the client calling the method, as
+// returned by the Authenticator of the Server (see WithAuthenticator).
+// It is meant to be used by server methods on the context they receive.
+func GetIdentity(ctx context.Context) (interface{}, bool) {
+	id := ctx.Value(identityKey)
+	return id, id != nil
+}
+
+// withIdentity returns a context carrying the identity of the client
+// authenticated on the given stream, if any.
+func withIdentity(ctx context.Context, s *streamWrap) context.Context {
+	if s.identity == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, identityKey, s.identity)
+}
+
+// readFirstHeader reads the header of the first request of a stream,
+// authenticating the client before when it presents credentials or when
+// the server requires them.
+func (server *Server) readFirstHeader(s *streamWrap, svcID *ServiceID) error {
+	if err := s.readHeader(svcID); err != nil {
+		return err
+	}
+	if !svcID.Authenticate {
+		if server.authenticator != nil {
+			return newUnauthenticatedError(errNoCredentials)
+		}
+		return nil
+	}
+	if err := server.authenticate(s); err != nil {
+		return err
+	}
+	*svcID = ServiceID{}
+	return s.readHeader(svcID)
+}
+
+// authenticate performs the exchange authenticating the client of the
+// stream, once it sent a header with Authenticate set.
+func (server *Server) authenticate(s *streamWrap) error {
+	p := s.remotePeer()
+	var challenge []byte
+	if a := server.authenticator; a != nil {
+		c, err := a.Challenge(p)
+		if err != nil {
+			return newServerError(err)
+		}
+		challenge = c
+	}
+	if err := s.writeHeader(&authMessage{Data: challenge}); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	var creds authMessage
+	if err := s.readHeader(&creds); err != nil {
+		return err
+	}
+	if a := server.authenticator; a != nil {
+		id, err := a.Authenticate(context.Background(), p, challenge, creds.Data)
+		if err != nil {
+			server.streamLogger.Debugw("authentication failed", "peer", p, "error", err)
+			return newUnauthenticatedError(err)
+		}
+		s.identity = id
+	}
+	if err := s.writeHeader(&Response{}); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// authenticate performs the exchange authenticating the Client on a
+// stream opened for the given call, when it has credentials.
+func (c *Client) authenticate(call *Call, s *streamWrap) error {
+	if c.credentials == nil {
+		return nil
+	}
+	if err := s.writeHeader(ServiceID{Authenticate: true}); err != nil {
+		return newClientError(err)
+	}
+	if err := s.w.Flush(); err != nil {
+		return newClientError(err)
+	}
+	var challenge authMessage
+	if err := s.readHeader(&challenge); err != nil {
+		return newClientError(err)
+	}
+	creds, err := c.credentials.Credentials(call.ctx, call.Dest, challenge.Data)
+	if err != nil {
+		return newClientError(err)
+	}
+	if err := s.writeHeader(&authMessage{Data: creds}); err != nil {
+		return newClientError(err)
+	}
+	if err := s.w.Flush(); err != nil {
+		return newClientError(err)
+	}
+	var resp Response
+	if err := s.readHeader(&resp); err != nil {
+		return newClientError(err)
+	}
+	if err := responseToError(&resp); err != nil {
+		return err
+	}
+	c.streamLogger.Debugw("authenticated", "peer", call.Dest)
+	return nil
+}
@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Clients and Servers can report the bytes of their calls to a libp2p
+// metrics.Reporter, i.e. the one given to the host with
+// libp2p.BandwidthReporter, attributing them to the methods called: the
+// bytes of every call are reported for its peer and for the protocol
+// "<protocol>/<Service>.<Method>", where <protocol> is the protocol of
+// the Client or Server, so that bandwidth dashboards can tell which
+// methods use the most. Only the per-stream methods of the reporter are
+// called, so that the totals of a reporter also used by the host do not
+// count the traffic twice.
+
+// WithClientBandwidthReporter makes the Client report the bytes sent
+// and received by its remote calls to the given reporter.
+func WithClientBandwidthReporter(r metrics.Reporter) ClientOption {
+	return func(c *Client) {
+		c.bwReporter = r
+	}
+}
+
+// WithServerBandwidthReporter makes the Server report the bytes
+// received and sent by the calls it handles to the given reporter.
+func WithServerBandwidthReporter(r metrics.Reporter) ServerOption {
+	return func(s *Server) {
+		s.bwReporter = r
+	}
+}
+
+// BandwidthProtocol returns the protocol the bytes of the calls to the
+// given method are reported under (see WithClientBandwidthReporter).
+func BandwidthProtocol(p protocol.ID, svcName, svcMethod string) protocol.ID {
+	return protocol.ID(string(p) + "/" + svcName + "." + svcMethod)
+}
+
+// reportBandwidth reports the bytes of a finished call, if any.
+func reportBandwidth(r metrics.Reporter, p protocol.ID, ev *CallEvent) {
+	if r == nil || ev.Peer == "" || (ev.BytesSent == 0 && ev.BytesReceived == 0) {
+		return
+	}
+	mp := BandwidthProtocol(p, ev.Service, ev.Method)
+	if ev.BytesSent > 0 {
+		r.LogSentMessageStream(ev.BytesSent, mp, ev.Peer)
+	}
+	if ev.BytesReceived > 0 {
+		r.LogRecvMessageStream(ev.BytesReceived, mp, ev.Peer)
+	}
+}
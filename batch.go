@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Request is a call to be performed as part of a batch. See
+// Client.Batch().
+type Request struct {
+	Service string
+	Method  string
+	Args    interface{}
+	Reply   interface{}
+}
+
+// Result is the outcome of a Request in a batch. Reply is the reply
+// given in the Request.
+type Result struct {
+	Reply interface{}
+	Error error
+}
+
+// errBatchIncomplete is set for the requests in a batch that could not
+// be performed because the stream failed before.
+var errBatchIncomplete = errors.New("batch interrupted before the request was handled")
+
+// Batch performs several calls to the same destination over a single
+// stream, saving the cost of opening a stream for every call. Requests
+// are sent without waiting for responses, and handled by the server one
+// after another, in order. The returned results correspond to the given
+// requests. The given CallOptions apply to every request, although
+// WithTimeout and WithRetries apply to the whole batch: the batch is
+// retried when its stream cannot be opened. Like other calls, the
+// requests are adapted to the features of the destination (see
+// WithHandshake), count as one call against the in-flight limit (see
+// WithMaxInFlightPerPeer) and are reported to the hooks and stats of the
+// Client.
+//
+// When the destination is the local peer, the calls are performed in
+// order using the local Server (see NewClientWithServer).
+func (c *Client) Batch(ctx context.Context, dest peer.ID, reqs []Request, opts ...CallOption) []Result {
+	results := make([]Result, len(reqs))
+	if len(reqs) == 0 {
+		return results
+	}
+	for i, r := range reqs {
+		results[i].Reply = r.Reply
+	}
+
+	if c.conn != nil || dest == "" || c.host == nil || dest == c.host.ID() {
+		for i, r := range reqs {
+			results[i].Error = c.CallContext(ctx, dest, r.Service, r.Method, r.Args, r.Reply, opts...)
+		}
+		return results
+	}
+
+	calls := make([]*Call, len(reqs))
+	for i, r := range reqs {
+		calls[i] = newCall(ctx, dest, r.Service, r.Method, r.Args, r.Reply, make(chan *Call, 1), opts...)
+		calls[i].logger = c.logger
+		c.prepareCall(calls[i])
+	}
+	start := time.Now()
+	if !c.pending.addAll(calls, start) {
+		for i, call := range calls {
+			call.doneWithError(ErrClientClosed)
+			results[i].Error = ErrClientClosed
+		}
+		return results
+	}
+	evs := make([]*CallEvent, len(calls))
+	for i, call := range calls {
+		evs[i] = c.startCall(call, start)
+	}
+
+	// Streams for a batch mixing services are opened with
+	// the base protocols.
+	first := calls[0]
+	for _, call := range calls[1:] {
+		if call.SvcID.Name != first.SvcID.Name {
+			first = newCall(ctx, dest, "", "", nil, nil, nil, opts...)
+			break
+		}
+	}
+	defer first.cancel()
+
+	c.sendBatch(first, calls)
+	for i, call := range calls {
+		var err error
+		if call.getError() == nil {
+			err = c.hooks.reply(evs[i], call.Reply)
+		}
+		c.finishCall(call, evs[i], err)
+		results[i].Error = call.getError()
+	}
+	return results
+}
+
+// sendBatch sends the requests of a batch over a stream opened for the
+// given call, once adapted to the features of the destination, and
+// reads the responses into every call. Errors are set in the calls.
+func (c *Client) sendBatch(first *Call, calls []*Call) {
+	setErrors := func(calls []*Call, err error) {
+		for _, call := range calls {
+			call.setError(err)
+		}
+	}
+	if c.inFlight != nil {
+		release, err := c.inFlight.acquire(first.ctx, first.Dest, first.opts.priority)
+		if err != nil {
+			setErrors(calls, err)
+			return
+		}
+		defer release()
+	}
+
+	f := c.negotiate(first)
+	send := make([]*Call, 0, len(calls))
+	for _, call := range calls {
+		if err := c.adapt(call, f); err != nil {
+			call.setError(err)
+			continue
+		}
+		send = append(send, call)
+	}
+	if len(send) == 0 {
+		return
+	}
+	send[0].SvcID.Batch = len(send)
+
+	err := c.retry(first, func() (bool, error) {
+		return c.sendBatchStream(first, send)
+	})
+	if err != nil {
+		setErrors(send, err)
+	}
+}
+
+// sendBatchStream sends the requests of a batch over a new stream. It
+// returns an error, and whether the batch can be retried, when the
+// stream cannot be opened or the client fails to authenticate. Otherwise
+// errors are set in the calls.
+func (c *Client) sendBatchStream(first *Call, calls []*Call) (bool, error) {
+	start := time.Now()
+	s, err := c.openStream(first)
+	if err != nil {
+		return true, newClientError(err)
+	}
+	c.setPeerProtocol(first.Dest, s.Protocol())
+	for _, call := range calls {
+		call.markReached()
+	}
+
+	// The batch is interrupted when its first request is cancelled,
+	// i.e. by closing the Client.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-first.ctx.Done():
+			s.Reset()
+		case <-calls[0].ctx.Done():
+			s.Reset()
+		case <-stop:
+		}
+	}()
+
+	sWrap := c.wrap(s, codecFor(c.codecs, s.Protocol()))
+	defer sWrap.release()
+	if err := c.authenticate(first, sWrap); err != nil {
+		s.Reset()
+		return false, err
+	}
+
+	c.logger.Debugw("sending batch", "peer", first.Dest, "requests", len(calls), "protocol", s.Protocol())
+
+	// Requests are written while responses are read, so that
+	// neither side blocks the other when the buffers fill up.
+	written := make(chan error, 1)
+	go func() {
+		for _, call := range calls {
+			if err := sWrap.writeRequest(call.SvcID, call.Args, call.signKey, call.compressAbove); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- sWrap.w.Flush()
+	}()
+
+	for i, call := range calls {
+		err := receiveResponse(sWrap, call)
+		if err == nil {
+			continue
+		}
+		s.Reset()
+		<-written
+		if ctxErr := call.contextError(); ctxErr != nil {
+			err = ctxErr
+		} else if ctxErr := first.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		call.setError(err)
+		for _, rest := range calls[i+1:] {
+			rest.setError(newClientError(errBatchIncomplete))
+		}
+		return false, nil
+	}
+	// All the requests were read by the server.
+	<-written
+	go helpers.FullClose(s)
+	c.logger.Debugw("batch finished", "peer", first.Dest, "requests", len(calls), "duration", time.Since(start))
+	return false, nil
+}
+
+// serveBatch handles the requests of a batch, the first of which has
+// been read already, sending the responses in order.
+func (server *Server) serveBatch(s *streamWrap, svcID ServiceID, svcName string) error {
+	n := svcID.Batch
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			svcID = ServiceID{}
+			if err := s.readHeader(&svcID); err != nil {
+				return newServerError(err)
+			}
+		}
+
+		pending, err := server.serveRequest(context.Background(), s, svcID, svcName, true, nil)
+		if err != nil {
+			server.logger.Errorw("error handling RPC", "peer", s.remotePeer(), "service", svcID.Name, "method", svcID.Method, "error", err)
+			resp := newErrorResponse(svcID, err)
+			if err := sendResponse(s, resp, nil); err != nil {
+				return err
+			}
+		}
+		// Responses must be sent in order.
+		if pending {
+			s.inflight.Wait()
+		}
+	}
+	return nil
+}
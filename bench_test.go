@@ -0,0 +1,172 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// The benchmarks below run over in-memory libp2p hosts (see mocknet), so
+// that they measure the cost of the package rather than of the network.
+// Changes affecting performance are evaluated by comparing the results of
+// several runs before and after them, i.e. with benchstat:
+//
+//	go test -run '^$' -bench . -count 10 > old.txt
+//	go test -run '^$' -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+
+type Echo struct{}
+
+func (Echo) Echo(ctx context.Context, in []byte, out *[]byte) error {
+	*out = in
+	return nil
+}
+
+// makeBenchNodes returns n connected in-memory hosts.
+func makeBenchNodes(b *testing.B, n int) []host.Host {
+	mn, err := mocknet.FullMeshConnected(context.Background(), n)
+	if err != nil {
+		b.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	b.Cleanup(func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	})
+	return hosts
+}
+
+// benchServers starts a server with the Arith, Echo and Feed services on
+// every given host.
+func benchServers(hosts []host.Host, opts ...ServerOption) []*Server {
+	var servers []*Server
+	for _, h := range hosts {
+		s := NewServer(h, "/rpc/bench", opts...)
+		s.Register(&Arith{})
+		s.Register(Echo{})
+		s.Register(&Feed{})
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func BenchmarkUnaryCall(b *testing.B) {
+	hosts := makeBenchNodes(b, 2)
+	benchServers(hosts[:1])
+
+	for _, bc := range []struct {
+		name string
+		opts []ClientOption
+	}{
+		{"stream", nil},
+		{"pipelined", []ClientOption{WithPipelining()}},
+	} {
+		c := NewClient(hosts[1], "/rpc/bench", bc.opts...)
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var r int
+			for i := 0; i < b.N; i++ {
+				if err := c.Call(hosts[0].ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bc.name+"/parallel", func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				var r int
+				for pb.Next() {
+					if err := c.Call(hosts[0].ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPayloadSize(b *testing.B) {
+	hosts := makeBenchNodes(b, 2)
+	var opts []ServerOption
+	for _, c := range benchCodecs {
+		opts = append(opts, WithServerProtocols(protoFor(c)), WithServerCodec(protoFor(c), c))
+	}
+	benchServers(hosts[:1], opts...)
+
+	for _, c := range benchCodecs {
+		cl := NewClient(hosts[1], protoFor(c), WithClientCodec(protoFor(c), c))
+		for _, size := range []int{64, 1 << 10, 64 << 10, 1 << 20} {
+			payload := make([]byte, size)
+			b.Run(fmt.Sprintf("%s/%d", c.Name(), size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(2 * size))
+				var r []byte
+				for i := 0; i < b.N; i++ {
+					if err := cl.Call(hosts[0].ID(), "Echo", "Echo", payload, &r); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMultiCall(b *testing.B) {
+	hosts := makeBenchNodes(b, 17)
+	benchServers(hosts[1:])
+	c := NewClient(hosts[0], "/rpc/bench")
+
+	for _, n := range []int{1, 4, 16} {
+		dests := make([]peer.ID, n)
+		for i := range dests {
+			dests[i] = hosts[i+1].ID()
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			replies := make([]interface{}, n)
+			for i := range replies {
+				replies[i] = new(int)
+			}
+			ctxs := make([]context.Context, n)
+			for i := range ctxs {
+				ctxs[i] = context.Background()
+			}
+			for i := 0; i < b.N; i++ {
+				for _, err := range c.MultiCall(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSubscription(b *testing.B) {
+	hosts := makeBenchNodes(b, 2)
+	s := benchServers(hosts[:1])[0]
+	c := NewClient(hosts[1], "/rpc/bench")
+
+	events := make(chan string)
+	sub, err := c.Subscribe(context.Background(), hosts[0].ID(), "Feed", "Events", "topic", events)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	sender := s.EventSender("Feed", "Events")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if sender.Send("event") != 1 {
+			b.Fatal("subscriber dropped")
+		}
+		<-events
+	}
+}
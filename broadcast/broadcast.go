@@ -0,0 +1,93 @@
+// Package broadcast delivers one-way go-libp2p-gorpc requests to all the
+// peers subscribed to a go-libp2p-pubsub topic, which run them with their
+// Server. It is useful for cluster-wide notifications like cache
+// invalidations or configuration pushes, where no replies are needed.
+//
+// Clients publish requests with Client.Broadcast(), given a Publisher
+// (see NewPublisher and rpc.WithPublisher), or with Publish(). Requests
+// are serialized with rpc.EncodeRequest() and run with
+// Server.HandleRequest(), on behalf of the peer which published them, so
+// the peer filter, the authorization function and the capability tokens
+// required by the Server apply as for any remote call.
+package broadcast
+
+import (
+	"context"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+var logger = logging.Logger("p2p-gorpc-broadcast")
+
+// Publisher publishes the requests broadcast by Clients in the topics of
+// a PubSub (see rpc.WithPublisher).
+type Publisher struct {
+	ps *pubsub.PubSub
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewPublisher returns a Publisher publishing in the topics of the given
+// PubSub. Topics are joined when first published in, unless given here
+// because they were already joined, i.e. to serve them (see Serve()).
+func NewPublisher(ps *pubsub.PubSub, joined ...*pubsub.Topic) *Publisher {
+	p := &Publisher{
+		ps:     ps,
+		topics: make(map[string]*pubsub.Topic),
+	}
+	for _, t := range joined {
+		p.topics[t.String()] = t
+	}
+	return p
+}
+
+// Publish publishes data in the given topic.
+func (p *Publisher) Publish(ctx context.Context, topic string, data []byte) error {
+	p.mu.Lock()
+	t, ok := p.topics[topic]
+	if !ok {
+		var err error
+		if t, err = p.ps.Join(topic); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		p.topics[topic] = t
+	}
+	p.mu.Unlock()
+	return t.Publish(ctx, data)
+}
+
+// Publish publishes a request to the given service method in the topic.
+// Every Server serving the topic (see Serve()) will run it. Only the
+// WithMetadata, WithPriority and WithToken call options are honored.
+func Publish(ctx context.Context, topic *pubsub.Topic, svcName, svcMethod string, args interface{}, opts ...rpc.CallOption) error {
+	data, err := rpc.EncodeRequest(svcName, svcMethod, args, opts...)
+	if err != nil {
+		return err
+	}
+	return topic.Publish(ctx, data)
+}
+
+// Serve runs the requests received in the subscription with the given
+// Server, one at a time and in order, until the context is cancelled or
+// the subscription is closed. Errors running the requests are logged.
+func Serve(ctx context.Context, s *rpc.Server, sub *pubsub.Subscription) error {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+
+		from := msg.GetFrom()
+		if err := s.HandleRequest(ctx, from, msg.GetData()); err != nil {
+			logger.Errorf("error running request from %s: %s", from, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package broadcast
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+type Cache struct {
+	mu          sync.Mutex
+	invalidated []string
+}
+
+func (c *Cache) Invalidate(ctx context.Context, key string, r *struct{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidated = append(c.invalidated, key)
+	return nil
+}
+
+func (c *Cache) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.invalidated...)
+}
+
+type node struct {
+	host  host.Host
+	cache *Cache
+	ps    *pubsub.PubSub
+	topic *pubsub.Topic
+}
+
+func newNode(ctx context.Context, t *testing.T, opts ...rpc.ServerOption) *node {
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pubsub.NewFloodSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic, err := ps.Join("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rpc.NewServer(h, "rpc", opts...)
+	cache := &Cache{}
+	s.Register(cache)
+	go Serve(ctx, s, sub)
+	return &node{h, cache, ps, topic}
+}
+
+func connect(ctx context.Context, t *testing.T, n1, n2 *node) {
+	err := n2.host.Connect(ctx, peer.AddrInfo{ID: n1.host.ID(), Addrs: n1.host.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasPeer(n1.topic, n2.host.ID()) || !hasPeer(n2.topic, n1.host.ID()) {
+		if time.Now().After(deadline) {
+			t.Fatal("peers did not join the topic")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasPeer(topic *pubsub.Topic, p peer.ID) bool {
+	for _, tp := range topic.ListPeers() {
+		if tp == p {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n1 := newNode(ctx, t)
+	defer n1.host.Close()
+	n2 := newNode(ctx, t)
+	defer n2.host.Close()
+	connect(ctx, t, n1, n2)
+	deadline := time.Now().Add(5 * time.Second)
+
+	err := Publish(ctx, n1.topic, "Cache", "Invalidate", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []*node{n1, n2} {
+		for len(n.cache.keys()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("the request was not run in", n.host.ID())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if keys := n.cache.keys(); len(keys) != 1 || keys[0] != "foo" {
+			t.Error("unexpected keys:", keys)
+		}
+	}
+
+	c := rpc.NewClient(n2.host, "rpc", rpc.WithPublisher(NewPublisher(n2.ps, n2.topic)))
+	if err := c.Broadcast("cache", "Cache", "Invalidate", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*node{n1, n2} {
+		if keys := waitKeys(t, n, 2); len(keys) != 2 || keys[1] != "bar" {
+			t.Error("unexpected keys:", keys)
+		}
+	}
+	if err := rpc.NewClient(n2.host, "rpc").Broadcast("cache", "Cache", "Invalidate", "baz"); !rpc.IsClientError(err) {
+		t.Error("expected a client error without a publisher:", err)
+	}
+}
+
+// waitKeys waits until the cache of the node has the given number of
+// keys, and returns them.
+func waitKeys(t *testing.T, n *node, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.cache.keys()) < count {
+		if time.Now().After(deadline) {
+			t.Fatal("the requests were not run in", n.host.ID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n.cache.keys()
+}
+
+func TestBroadcastChecks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authority, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1 := newNode(ctx, t)
+	defer n1.host.Close()
+	n2 := newNode(ctx, t, rpc.WithTokenAuthority(pub))
+	defer n2.host.Close()
+	ends := make(chan rpc.CallEvent, 3)
+	n3 := newNode(ctx, t,
+		rpc.WithServerPeerFilter(rpc.DenyPeers(n1.host.ID())),
+		rpc.WithServerHooks(rpc.Hooks{OnCallEnd: func(ev rpc.CallEvent) { ends <- ev }}),
+	)
+	defer n3.host.Close()
+	connect(ctx, t, n1, n2)
+	connect(ctx, t, n1, n3)
+
+	// Requests from the same publisher are delivered in order: the
+	// rejected ones are published first.
+	if err := Publish(ctx, n1.topic, "Cache", "Invalidate", "denied"); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := rpc.IssueToken(authority, rpc.TokenClaims{Subject: n1.host.ID(), Scopes: []string{"Cache.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish(ctx, n1.topic, "Cache", "Invalidate", "allowed", rpc.WithToken(tok)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := waitKeys(t, n2, 1); len(keys) != 1 || keys[0] != "allowed" {
+		t.Error("expected the request without token to be rejected:", keys)
+	}
+
+	// The filtered peer is rejected, the others are not.
+	if err := Publish(ctx, n3.topic, "Cache", "Invalidate", "own"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-ends:
+			if ev.Peer == n1.host.ID() && !rpc.IsAuthorizationError(ev.Error) {
+				t.Error("expected the requests of the filtered peer to be rejected:", ev.Error)
+			}
+			if ev.Peer == n3.host.ID() && ev.Error != nil {
+				t.Error(ev.Error)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the requests were not handled")
+		}
+	}
+	if keys := n3.cache.keys(); len(keys) != 1 || keys[0] != "own" {
+		t.Error("unexpected keys:", keys)
+	}
+}
@@ -0,0 +1,139 @@
+package rpc
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// Every stream is read and written through buffers, defaultBufferSize
+// bytes each by default. Larger buffers suit large messages, which are
+// then read and written with fewer system calls. Messages are written to
+// the stream as soon as they are complete, unless a flush delay is set:
+// the messages written to pipelined streams (see WithPipelining) within
+// the delay are then coalesced into fewer writes, as TCP does with
+// Nagle's algorithm, which favours throughput over latency when many
+// small calls share a stream.
+
+// defaultBufferSize is the default size of the read and write buffers
+// of streams.
+const defaultBufferSize = 4096
+
+// WithServerBufferSizes sets the sizes of the buffers used to read and
+// write the streams of the Server. Zero or negative sizes keep the
+// default size.
+func WithServerBufferSizes(readSize, writeSize int) ServerOption {
+	return func(s *Server) {
+		s.readBuffer = readSize
+		s.writeBuffer = writeSize
+	}
+}
+
+// WithClientBufferSizes sets the sizes of the buffers used to read and
+// write the streams of the Client. Zero or negative sizes keep the
+// default size.
+func WithClientBufferSizes(readSize, writeSize int) ClientOption {
+	return func(c *Client) {
+		c.readBuffer = readSize
+		c.writeBuffer = writeSize
+	}
+}
+
+// WithServerFlushDelay makes the Server wait up to d before writing the
+// responses sent over pipelined streams, so that the responses sent in
+// the meantime are written at once. A zero or negative delay writes every
+// response right away, which is the default.
+func WithServerFlushDelay(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.flushDelay = d
+	}
+}
+
+// WithClientFlushDelay makes the Client wait up to d before writing the
+// requests sent over pipelined streams (see WithPipelining), so that the
+// requests sent in the meantime are written at once. A zero or negative
+// delay writes every request right away, which is the default.
+func WithClientFlushDelay(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.flushDelay = d
+	}
+}
+
+// wrap wraps a stream or connection of the Server with the given codec.
+func (server *Server) wrap(rwc io.ReadWriteCloser, c *Codec) *streamWrap {
+	return wrapConn(rwc, c).
+		withMaxSize(server.maxMessageSize).
+		withCompression(server.compressAbove).
+		withBufferSizes(server.readBuffer, server.writeBuffer)
+}
+
+// wrap wraps a stream or connection of the Client with the given codec.
+func (c *Client) wrap(rwc io.ReadWriteCloser, codec *Codec) *streamWrap {
+	return wrapConn(rwc, codec).
+		withMaxSize(c.maxMessageSize).
+		withBufferSizes(c.readBuffer, c.writeBuffer)
+}
+
+// withBufferSizes sets the sizes of the buffers of the stream, which must
+// not have been used yet, and returns the streamWrap.
+func (sw *streamWrap) withBufferSizes(readSize, writeSize int) *streamWrap {
+	if readSize <= 0 {
+		readSize = defaultBufferSize
+	}
+	if writeSize <= 0 {
+		writeSize = defaultBufferSize
+	}
+	if sw.r.Size() != readSize {
+		sw.r = bufio.NewReaderSize(sw.cr, readSize)
+		sw.fr.r = sw.r
+	}
+	if sw.w.Size() != writeSize {
+		sw.w = bufio.NewWriterSize(sw.cw, writeSize)
+		sw.enc.Reset(sw.w)
+	}
+	return sw
+}
+
+// withFlushDelay sets the delay of the flushes of the messages written to
+// the stream (see flushMessage) and returns the streamWrap.
+func (sw *streamWrap) withFlushDelay(d time.Duration) *streamWrap {
+	sw.flushDelay = d
+	return sw
+}
+
+// flushMessage flushes a message written to the stream, right away or
+// after the flush delay of the stream, along with the messages written
+// in the meantime. It must be called with wmu locked. Delayed flushes
+// which fail reset the stream.
+func (sw *streamWrap) flushMessage() error {
+	if sw.flushDelay <= 0 {
+		return sw.w.Flush()
+	}
+	if sw.flushPending {
+		return nil
+	}
+	sw.flushPending = true
+	sw.flushTimer = time.AfterFunc(sw.flushDelay, func() {
+		sw.wmu.Lock()
+		defer sw.wmu.Unlock()
+		if !sw.flushPending {
+			return
+		}
+		sw.flushPending = false
+		if err := sw.w.Flush(); err != nil {
+			sw.reset()
+		}
+	})
+	return nil
+}
+
+// flushNow flushes the messages waiting for a delayed flush. It must be
+// called with wmu locked.
+func (sw *streamWrap) flushNow() error {
+	if !sw.flushPending {
+		return nil
+	}
+	sw.flushPending = false
+	sw.flushTimer.Stop()
+	return sw.w.Flush()
+}
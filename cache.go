@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// cacheEntry is a memoized reply, stored in its serialized form so that
+// every cache hit obtains its own copy.
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// responseCache memoizes the replies to cacheable methods, indexed by
+// destination, service, method and a hash of the arguments.
+type responseCache struct {
+	mu        sync.Mutex
+	ttls      map[string]time.Duration
+	entries   map[string]cacheEntry
+	nextSweep time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		ttls:    make(map[string]time.Duration),
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (rc *responseCache) setTTL(svcName, svcMethod string, ttl time.Duration) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.ttls[svcName+"."+svcMethod] = ttl
+}
+
+func (rc *responseCache) ttl(svcID ServiceID) time.Duration {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.ttls[svcID.Name+"."+svcID.Method]
+}
+
+// key returns the cache key for the given call, or an empty
+// string if the call is not cacheable.
+func (rc *responseCache) key(local peer.ID, call *Call) (string, error) {
+	if rc.ttl(call.SvcID) <= 0 {
+		return "", nil
+	}
+	// Forwarded calls (see Proxy) are not cached.
+	if _, ok := call.Args.(*encodedBody); ok {
+		return "", nil
+	}
+
+	args, err := MsgpackCodec.Marshal(call.Args)
+	if err != nil {
+		return "", fmt.Errorf("cannot hash arguments: %w", err)
+	}
+	sum := sha256.Sum256(args)
+
+	dest := call.Dest
+	if dest == "" {
+		dest = local
+	}
+	// Versions of a service and codecs may give different replies to
+	// the same arguments.
+	svc := serviceKey(call.SvcID.Name, call.SvcID.Version)
+	return string(dest) + "/" + svc + "/" + call.SvcID.Method + "/" + call.SvcID.Codec + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+// get decodes a cached reply into reply. It returns false if there
+// is no valid entry for the given key.
+func (rc *responseCache) get(key string, reply interface{}) (bool, error) {
+	rc.mu.Lock()
+	entry, ok := rc.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(rc.entries, key)
+		ok = false
+	}
+	rc.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	if err := MsgpackCodec.Unmarshal(entry.data, reply); err != nil {
+		return false, fmt.Errorf("cannot decode cached reply: %w", err)
+	}
+	return true, nil
+}
+
+// put stores a reply in the cache.
+func (rc *responseCache) put(key string, svcID ServiceID, reply interface{}) error {
+	data, err := MsgpackCodec.Marshal(reply)
+	if err != nil {
+		return fmt.Errorf("cannot encode reply: %w", err)
+	}
+
+	ttl := rc.ttl(svcID)
+	now := time.Now()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries[key] = cacheEntry{
+		data:    data,
+		expires: now.Add(ttl),
+	}
+
+	// Sweep expired entries from time to time so that the cache
+	// does not grow with entries which are never requested again.
+	if now.After(rc.nextSweep) {
+		for k, e := range rc.entries {
+			if now.After(e.expires) {
+				delete(rc.entries, k)
+			}
+		}
+		rc.nextSweep = now.Add(ttl)
+	}
+	return nil
+}
+
+func (rc *responseCache) purge() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = make(map[string]cacheEntry)
+}
@@ -3,21 +3,148 @@ package rpc
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
+// CallOption allows for functional setting of options on a Call.
+type CallOption func(*callOptions)
+
+// callOptions holds the per-call settings provided with CallOptions.
+type callOptions struct {
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+	metadata     map[string]string
+	idemKey      string
+	progress     ProgressFunc
+	concurrency  int
+	priority     Priority
+	noDial       bool
+	noRelay      bool
+	transports   []string
+	info         *CallInfo
+	codec        *Codec
+	token        *Token
+	version      string
+	proxy        peer.ID
+
+	cursor             uint64
+	resubscribe        int
+	resubscribeBackoff time.Duration
+
+	heartbeat        time.Duration
+	heartbeatTimeout time.Duration
+
+	adaptiveTimeout *adaptiveTimeout
+
+	signedResponse *SignedMessage
+}
+
+// newCallOptions applies the given CallOptions.
+func newCallOptions(opts []CallOption) callOptions {
+	var cOpts callOptions
+	for _, opt := range opts {
+		opt(&cOpts)
+	}
+	return cOpts
+}
+
+// WithTimeout sets a maximum duration for the call. The deadline is applied
+// on top of the context provided by the caller (the earliest one wins), so
+// callers do not need to derive and cancel their own contexts. When used
+// with MultiCall or MultiGo, the timeout applies to each destination
+// separately. A zero or negative duration means no timeout.
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = d
+	}
+}
+
+// WithConcurrency limits the number of calls performed simultaneously by
+// MultiCall and MultiStream to n, so that calling many destinations does not open
+// as many streams at once. Destinations are called in order as
+// previous calls finish. It has no effect on single calls. A zero or
+// negative n means no limit.
+func WithConcurrency(n int) CallOption {
+	return func(o *callOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithRetries allows a remote call to be retried up to n times when it
+// fails before the request has been sent to the server (i.e. the stream
+// to the destination could not be opened). Calls which reached the server
+// are never retried, as the method may have already run. The backoff
+// duration is waited before the first retry and doubled after every
+// attempt.
+func WithRetries(n int, backoff time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.retries = n
+		o.retryBackoff = backoff
+	}
+}
+
+// WithMetadata attaches a key-value pair to the call. Metadata is sent
+// along with the request and made available to the server method through
+// GetMetadata(). This option can be given several times.
+func WithMetadata(key, value string) CallOption {
+	return func(o *callOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string)
+		}
+		o.metadata[key] = value
+	}
+}
+
+// WithIdempotencyKey attaches an idempotency key to the call. Servers with
+// deduplication enabled (see WithDeduplication) will run the method only
+// once for all the requests from this peer carrying the same key,
+// returning the original response to any repetitions. This makes it safe
+// to retry calls to methods which are not idempotent.
+func WithIdempotencyKey(key string) CallOption {
+	return func(o *callOptions) {
+		o.idemKey = key
+	}
+}
+
 // Call represents an active RPC. Calls are used to indicate completion
 // of RPC requests and are returned within the provided channel in
 // the Go() functions.
 type Call struct {
 	ctx    context.Context
 	cancel func()
+	opts   callOptions
+	logger Logger
 
 	finishedMu sync.RWMutex
 	finished   bool
+	// finishedCh is closed once the call is done.
+	finishedCh chan struct{}
+
+	// reached is set once a stream to the destination has been
+	// opened, or the call has been handed to the local server.
+	reached int32
+
+	// signKey signs the request, when the client signs requests.
+	signKey crypto.PrivKey
+	// compressAbove is the size from which the arguments are
+	// compressed, when the client compresses them.
+	compressAbove int
+	// streamDeadline is set when the deadline of the context is set
+	// on the stream of the call (see watchStream).
+	streamDeadline bool
+	// localMode is how local calls pass the arguments and the reply
+	// to the method (see WithLocalCallMode).
+	localMode LocalCallMode
+	// maxChunkedReply is the maximum size of the reply when it is
+	// received in chunks (see WithReplyChunking).
+	maxChunkedReply int64
 
 	Dest  peer.ID
 	SvcID ServiceID   // The name of the service and method to call.
@@ -27,25 +154,84 @@ type Call struct {
 
 	errorMu sync.Mutex
 	Error   error // After completion, the error status.
+
+	Info CallInfo // After completion, size and timing information.
 }
 
-func newCall(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
-	ctx2, cancel := context.WithCancel(ctx)
+func newCall(ctx context.Context, dest peer.ID, svcName, svcMethod string, args interface{}, reply interface{}, done chan *Call, opts ...CallOption) *Call {
+	cOpts := newCallOptions(opts)
+
+	var ctx2 context.Context
+	var cancel func()
+	if cOpts.timeout > 0 {
+		ctx2, cancel = context.WithTimeout(ctx, cOpts.timeout)
+	} else {
+		ctx2, cancel = context.WithCancel(ctx)
+	}
+	var codecName string
+	if cOpts.codec != nil {
+		codecName = cOpts.codec.name
+	}
+	var proxied peer.ID
+	if cOpts.proxy != "" && dest != "" {
+		proxied, dest = dest, cOpts.proxy
+	}
 	return &Call{
 		ctx:    ctx2,
 		cancel: cancel,
+		opts:   cOpts,
+		logger: clientLogger,
 		Dest:   dest,
-		SvcID:  ServiceID{svcName, svcMethod},
-		Args:   args,
-		Reply:  reply,
-		Error:  nil,
-		Done:   done,
+		SvcID: ServiceID{
+			Name:           svcName,
+			Method:         svcMethod,
+			Metadata:       cOpts.metadata,
+			IdempotencyKey: cOpts.idemKey,
+			Progress:       cOpts.progress != nil,
+			Heartbeat:      cOpts.heartbeat,
+			Priority:       cOpts.priority,
+			Codec:          codecName,
+			Raw:            isRawBody(args),
+			Token:          cOpts.token,
+			Version:        cOpts.version,
+			Destination:    proxied,
+		},
+		Args:       args,
+		Reply:      reply,
+		Error:      nil,
+		Done:       done,
+		finishedCh: make(chan struct{}),
 	}
 }
 
-// done places the completed call in the done channel.
+// Cancel cancels the call, which finishes with a context.Canceled error
+// unless it had already finished. The server may still run the method
+// when the request had been sent already.
+func (call *Call) Cancel() {
+	call.cancel()
+}
+
+// Finished returns a channel which is closed once the call is complete,
+// regardless of the Done channel given when starting it, which may be
+// shared by several calls.
+func (call *Call) Finished() <-chan struct{} {
+	return call.finishedCh
+}
+
+// Wait waits for the call to complete and returns its error.
+func (call *Call) Wait() error {
+	<-call.finishedCh
+	return call.getError()
+}
+
+// done places the completed call in the done channel. It does
+// nothing if the call was already done.
 func (call *Call) done() {
 	call.finishedMu.Lock()
+	if call.finished {
+		call.finishedMu.Unlock()
+		return
+	}
 	call.finished = true
 	call.finishedMu.Unlock()
 
@@ -53,33 +239,58 @@ func (call *Call) done() {
 	case call.Done <- call:
 		// ok
 	default:
-		logger.Debugf("discarding %s.%s call reply",
-			call.SvcID.Name, call.SvcID.Method)
+		call.logger.Debugw("discarding call reply", "service", call.SvcID.Name, "method", call.SvcID.Method)
 	}
+	close(call.finishedCh)
 	call.cancel()
 }
 
 func (call *Call) doneWithError(err error) {
 	if err != nil {
-		logger.Error(err)
 		call.setError(err)
 	}
 	call.done()
 }
 
+// contextError returns the error of the context of the call when it is
+// done or past its deadline. Stream errors caused by the deadline (see
+// watchStream) are reported as this error.
+func (call *Call) contextError() error {
+	if err := call.ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := call.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
 func (call *Call) isFinished() bool {
 	call.finishedMu.RLock()
 	defer call.finishedMu.RUnlock()
 	return call.finished
 }
 
+// watchStream sets the deadline of the context of the call, if any, on
+// the stream, so that reads and writes to a stalled peer fail at the
+// transport level once it passes, and watches the context in a new
+// goroutine until stop is closed (see watchContextWithStream).
+func (call *Call) watchStream(s network.Stream, stop <-chan struct{}) {
+	if deadline, ok := call.ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+		call.streamDeadline = true
+	}
+	go call.watchContextWithStream(s, stop)
+}
+
 // watch context will wait for a context cancellation
-// and close the stream.
-func (call *Call) watchContextWithStream(s network.Stream) {
+// and close the stream. It returns when stop is closed.
+func (call *Call) watchContextWithStream(s network.Stream, stop <-chan struct{}) {
 	select {
+	case <-stop:
 	case <-call.ctx.Done():
 		if !call.isFinished() { // context was cancelled not by us
-			logger.Debug("call context is done before finishing")
+			call.logger.Debugw("call context is done before finishing", "peer", call.Dest, "service", call.SvcID.Name, "method", call.SvcID.Method)
 			// FullClose() instead of Reset(). This lets the other
 			// write to the stream without printing errors to
 			// the console (graceful fail) and eventually will
@@ -90,6 +301,17 @@ func (call *Call) watchContextWithStream(s network.Stream) {
 	}
 }
 
+// markReached records that the destination of the call was reached.
+func (call *Call) markReached() {
+	atomic.StoreInt32(&call.reached, 1)
+}
+
+// wasReached returns true when the destination of the call was reached,
+// even if the call failed afterwards.
+func (call *Call) wasReached() bool {
+	return atomic.LoadInt32(&call.reached) == 1
+}
+
 func (call *Call) setError(err error) {
 	call.errorMu.Lock()
 	defer call.errorMu.Unlock()
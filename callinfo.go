@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// CallInfo provides size, timing and connection information about a
+// finished call. Sizes, stream setup time and connection information are
+// only known for remote calls.
+type CallInfo struct {
+	// BytesSent is the size of the request as sent over the stream.
+	BytesSent int64
+	// BytesReceived is the size of the response as read from the stream.
+	BytesReceived int64
+	// StreamSetup is the time taken to open the stream to the
+	// destination, including dialing and protocol negotiation.
+	StreamSetup time.Duration
+	// ServerDuration is the time the server spent running the method,
+	// as reported by it.
+	ServerDuration time.Duration
+	// Latency is the total duration of the call.
+	Latency time.Duration
+
+	// Transport is the transport of the connection carrying the
+	// call, i.e. "tcp", "quic" or "ws" (see TransportName), and
+	// Relayed is true when the connection goes through a relay.
+	Transport string
+	Relayed   bool
+	// Direction is the direction of the connection: outbound when
+	// it was dialed by the Client, inbound when it was dialed by
+	// the destination.
+	Direction network.Direction
+	// Security is the security protocol of the connection, when it
+	// is known, and Encrypted is true when it encrypts the traffic.
+	// libp2p does not tell the security protocol negotiated for
+	// connections, so that it is only known for transports which
+	// imply one, such as QUIC, always secured with TLS 1.3.
+	Security  string
+	Encrypted bool
+}
+
+// TransportName returns the name of the transport of a connection with
+// the given remote address, that is, the name of the last protocol of
+// the address before the peer ID and relay parts, i.e. "tcp" for
+// /ip4/1.2.3.4/tcp/4001, "quic" for /ip4/1.2.3.4/udp/4001/quic and "ws"
+// for /ip4/1.2.3.4/tcp/4001/ws. The transport of relayed connections is
+// the one of the connection to the relay.
+func TransportName(addr ma.Multiaddr) string {
+	if addr == nil {
+		return ""
+	}
+	name := ""
+	for _, p := range addr.Protocols() {
+		switch p.Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR, ma.P_IP6ZONE:
+		case ma.P_P2P, ma.P_CIRCUIT:
+			return name
+		default:
+			name = p.Name
+		}
+	}
+	return name
+}
+
+// transportSecurity returns the security protocol implied by the given
+// transport, if any.
+func transportSecurity(transport string) string {
+	if transport == "quic" {
+		return "tls"
+	}
+	return ""
+}
+
+// setConnInfo records in the CallInfo of a call the information about
+// the connection carrying it.
+func (call *Call) setConnInfo(conn network.Conn) {
+	addr := conn.RemoteMultiaddr()
+	transport := TransportName(addr)
+	security := transportSecurity(transport)
+	call.setInfo(func(info *CallInfo) {
+		info.Transport = transport
+		info.Relayed = isRelayed(addr)
+		info.Direction = conn.Stat().Direction
+		info.Security = security
+		info.Encrypted = security != ""
+	})
+}
+
+// WithCallInfo makes the call fill in the given CallInfo when it
+// finishes. This is mostly useful with Call() and CallContext(), since
+// the CallInfo is also available in the Info field of the Call.
+func WithCallInfo(info *CallInfo) CallOption {
+	return func(o *callOptions) {
+		o.info = info
+	}
+}
+
+// setInfo updates the CallInfo of a call, unless the call is already
+// done and may be being read by the caller.
+func (call *Call) setInfo(f func(info *CallInfo)) {
+	call.finishedMu.Lock()
+	defer call.finishedMu.Unlock()
+	if !call.finished {
+		f(&call.Info)
+	}
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) count() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
+
+// countingWriter counts the bytes written to a writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+func (cw *countingWriter) count() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Clients accepting replies in chunks (see WithReplyChunking) send their
+// maximum message size in the ChunkSize field of their requests. Servers
+// split the encoded replies larger than that in chunks, each of them a
+// raw value (see Raw) no larger than the maximum message size. All the
+// chunks but the last one are sent in frames marked by the Chunk field
+// of their header, before the final response, whose body is the last
+// chunk. Clients reassemble the chunks and decode the reply from them.
+// Replies to pipelined requests and signed replies are not chunked.
+
+// minChunkSize is the smallest maximum message size of the clients
+// accepting replies in chunks.
+const minChunkSize = 1 << 10
+
+// WithReplyChunking makes the Client accept the replies exceeding its
+// maximum message size (see WithClientMaxMessageSize), which servers
+// then split in chunks that the Client reassembles, as long as the
+// whole reply does not exceed maxSize bytes. This keeps the memory used
+// to read every message bounded while allowing a few larger replies.
+// Calls with larger replies fail.
+func WithReplyChunking(maxSize int64) ClientOption {
+	return func(c *Client) {
+		c.maxChunkedReply = maxSize
+	}
+}
+
+// chunkSize returns the maximum size of the data of the chunks of the
+// reply to the given request, leaving room for their length prefix.
+func chunkSize(svcID ServiceID) int {
+	return int(svcID.ChunkSize) - binary.MaxVarintLen64
+}
+
+// chunksReply returns true when the given reply may be sent in chunks.
+func (sw *streamWrap) chunksReply(resp *Response, body interface{}) bool {
+	return resp.Service.ChunkSize >= minChunkSize &&
+		resp.Service.RequestID == 0 &&
+		resp.Error == "" &&
+		body != nil &&
+		!sw.signsResponse(resp)
+}
+
+// writeChunkedResponse writes an encoded reply in chunks, before the
+// final response carrying the last one, and flushes the stream.
+func writeChunkedResponse(s *streamWrap, resp *Response, body []byte) error {
+	size := chunkSize(resp.Service)
+	for len(body) > size {
+		chunk := Response{Service: resp.Service, Chunk: true}
+		if err := s.writeHeader(&chunk); err != nil {
+			s.reset()
+			return fmt.Errorf("error encoding response: %w", err)
+		}
+		if err := s.writeRaw(body[:size]); err != nil {
+			s.reset()
+			return fmt.Errorf("error writing body: %w", err)
+		}
+		body = body[size:]
+	}
+	if err := s.writeHeader(resp); err != nil {
+		s.reset()
+		return fmt.Errorf("error encoding response: %w", err)
+	}
+	if err := s.writeRaw(body); err != nil {
+		s.reset()
+		return fmt.Errorf("error writing body: %w", err)
+	}
+	if err := s.flushMessage(); err != nil {
+		s.reset()
+		return fmt.Errorf("error flushing response: %w", err)
+	}
+	return nil
+}
+
+// replyChunks holds the chunks of a reply received so far.
+type replyChunks struct {
+	data []byte
+}
+
+// read reads the next chunk of the reply from the stream, failing when
+// the reply exceeds maxSize.
+func (rc *replyChunks) read(s *streamWrap, maxSize int64) error {
+	var chunk []byte
+	if err := s.readRaw(&chunk); err != nil {
+		return err
+	}
+	if maxSize <= 0 || int64(len(rc.data)+len(chunk)) > maxSize {
+		return fmt.Errorf("chunked reply larger than %d bytes", maxSize)
+	}
+	rc.data = append(rc.data, chunk...)
+	return nil
+}
+
+// body returns a stream reading the reassembled reply.
+func (rc *replyChunks) body(s *streamWrap) *streamWrap {
+	return wrapConn(bodyConn{bytes.NewReader(rc.data)}, s.codec).withMaxSize(int64(len(rc.data)))
+}
@@ -2,11 +2,16 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/discovery"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 
@@ -24,13 +29,160 @@ func WithClientStatsHandler(h stats.Handler) ClientOption {
 	}
 }
 
+// WithClientProtocols provides additional protocols which the Client will
+// try, in order, when the destination does not support the protocol given
+// to NewClient. The protocol used with every peer can be obtained with
+// PeerProtocol().
+func WithClientProtocols(ps ...protocol.ID) ClientOption {
+	return func(c *Client) {
+		c.extraProtocols = append(c.extraProtocols, ps...)
+	}
+}
+
+// WithClientServiceProtocols makes the Client open streams using the protocol
+// specific to the service being called (see ServiceProtocol() and the
+// server-side WithServerServiceProtocols()). The generic protocols are still
+// tried afterwards, so that servers not using per-service protocols can
+// be called.
+func WithClientServiceProtocols() ClientOption {
+	return func(c *Client) {
+		c.serviceProtocols = true
+	}
+}
+
+// WithCacheableMethod marks the given service method as cacheable. The
+// replies to successful calls to that method will be memoized by the
+// Client during the given ttl and returned to any subsequent call to the
+// same destination with the same arguments, without contacting the server.
+// It should only be used for idempotent methods. This option can be given
+// several times.
+func WithCacheableMethod(svcName, svcMethod string, ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		if c.cache == nil {
+			c.cache = newResponseCache()
+		}
+		c.cache.setTTL(svcName, svcMethod, ttl)
+	}
+}
+
 // Client represents an RPC client which can perform calls to a remote
 // (or local, see below) Server.
 type Client struct {
-	host         host.Host
-	protocol     protocol.ID
-	server       *Server
-	statsHandler stats.Handler
+	host           host.Host
+	protocol       protocol.ID
+	extraProtocols []protocol.ID
+	server         *Server
+	statsHandler   stats.Handler
+	logger         Logger
+	streamLogger   Logger // logs the handling of streams
+	hooks          Hooks
+	cache          *responseCache
+	discovery      discovery.Discoverer
+	latencies      *latencyTracker
+	stats          *callStats
+
+	// serviceProtocols makes calls use per-service protocols.
+	serviceProtocols bool
+
+	// preconnectValidation makes Preconnect open a stream to peers.
+	preconnectValidation bool
+
+	// noDial prevents calls from dialing peers (see WithClientNoDial).
+	noDial bool
+
+	// latencyRanking orders the destinations of hedged calls by
+	// latency (see WithLatencyRanking).
+	latencyRanking bool
+
+	// compressAbove is the size from which arguments are
+	// compressed (see WithClientCompression).
+	compressAbove int
+
+	// maxChunkedReply is the maximum size of the replies received in
+	// chunks (see WithReplyChunking).
+	maxChunkedReply int64
+
+	// bwReporter is reported the bytes of the calls (see
+	// WithClientBandwidthReporter).
+	bwReporter metrics.Reporter
+
+	// credentials provides the credentials presented at the start
+	// of every stream (see WithCredentials).
+	credentials CredentialsProvider
+
+	// inFlight limits the calls sent to every peer at the same
+	// time (see WithMaxInFlightPerPeer).
+	inFlight *peerQueues
+
+	// slowCall is the duration from which calls are logged as slow
+	// (see WithClientSlowCallThreshold).
+	slowCall time.Duration
+
+	// readBuffer and writeBuffer are the sizes of the buffers of
+	// the streams (see WithClientBufferSizes), and flushDelay the
+	// delay of the flushes of requests on pipelined streams (see
+	// WithClientFlushDelay).
+	readBuffer  int
+	writeBuffer int
+	flushDelay  time.Duration
+
+	// contextValues holds the context keys of the values propagated
+	// to servers, keyed by name (see WithClientContextValue).
+	contextValues map[string]interface{}
+
+	// token is attached to every call (see WithClientToken).
+	token *Token
+	// publisher publishes broadcast requests (see WithPublisher).
+	publisher Publisher
+
+	// signing makes the client sign its requests (see
+	// WithRequestSigning).
+	signing bool
+
+	// peerFilter restricts the peers that can be called (see
+	// WithClientPeerFilter).
+	peerFilter PeerFilter
+
+	// openTimeout limits the time taken to open streams (see
+	// WithStreamOpenTimeout).
+	openTimeout time.Duration
+
+	// maxMessageSize limits the size of the replies (see
+	// WithClientMaxMessageSize).
+	maxMessageSize int64
+
+	// features holds the features of the peers when the handshake
+	// is enabled (see WithHandshake).
+	features *featureCache
+
+	// codecs holds the codecs used for some protocols.
+	codecs map[protocol.ID]*Codec
+	// callCodec is the codec of the arguments and replies of the
+	// calls, when set (see WithClientCallCodec).
+	callCodec *Codec
+
+	// localMode is how local calls pass the arguments and the reply
+	// to the method (see WithLocalCallMode).
+	localMode LocalCallMode
+
+	// pending tracks the calls in progress (see PendingCalls).
+	pending pendingCalls
+
+	// loopback sends the local calls to the Server of the peer
+	// when it runs in another process (see WithLocalDialer).
+	loopback *loopback
+
+	// conn is used for all calls when set (see NewClientFromConn).
+	conn      *streamCaller
+	keepalive keepaliveConfig
+
+	// pipelines holds the pipelined stream to every peer when
+	// pipelining is enabled (see WithPipelining).
+	pipelinesMu sync.Mutex
+	pipelines   map[peer.ID]*pipeline
+
+	peerProtocolsMu sync.RWMutex
+	peerProtocols   map[peer.ID]protocol.ID
 }
 
 // NewClient returns a new Client which uses the given LibP2P host
@@ -43,8 +195,14 @@ type Client struct {
 // if this is a usecase.
 func NewClient(h host.Host, p protocol.ID, opts ...ClientOption) *Client {
 	c := &Client{
-		host:     h,
-		protocol: p,
+		host:           h,
+		protocol:       p,
+		logger:         clientLogger,
+		streamLogger:   streamLogger,
+		latencies:      newLatencyTracker(),
+		stats:          newClientStats(),
+		peerProtocols:  make(map[peer.ID]protocol.ID),
+		maxMessageSize: DefaultMaxMessageSize,
 	}
 
 	for _, opt := range opts {
@@ -63,6 +221,28 @@ func NewClientWithServer(h host.Host, p protocol.ID, s *Server, opts ...ClientOp
 	return c
 }
 
+// PurgeCache removes all the responses memoized by this client (see
+// WithCacheableMethod).
+func (c *Client) PurgeCache() {
+	if c.cache != nil {
+		c.cache.purge()
+	}
+}
+
+// PeerProtocol returns the protocol negotiated in the last remote call
+// to the given peer, or an empty protocol.ID if no calls have been made.
+func (c *Client) PeerProtocol(p peer.ID) protocol.ID {
+	c.peerProtocolsMu.RLock()
+	defer c.peerProtocolsMu.RUnlock()
+	return c.peerProtocols[p]
+}
+
+func (c *Client) setPeerProtocol(p peer.ID, proto protocol.ID) {
+	c.peerProtocolsMu.Lock()
+	defer c.peerProtocolsMu.Unlock()
+	c.peerProtocols[p] = proto
+}
+
 // ID returns the peer.ID of the host associated with this client.
 func (c *Client) ID() peer.ID {
 	if c.host == nil {
@@ -78,9 +258,10 @@ func (c *Client) Call(
 	dest peer.ID,
 	svcName, svcMethod string,
 	args, reply interface{},
+	opts ...CallOption,
 ) error {
 	ctx := context.Background()
-	return c.CallContext(ctx, dest, svcName, svcMethod, args, reply)
+	return c.CallContext(ctx, dest, svcName, svcMethod, args, reply, opts...)
 }
 
 // CallContext performs a Call() with a user provided context. This gives
@@ -90,9 +271,11 @@ func (c *Client) CallContext(
 	dest peer.ID,
 	svcName, svcMethod string,
 	args, reply interface{},
+	opts ...CallOption,
 ) error {
 	done := make(chan *Call, 1)
-	call := newCall(ctx, dest, svcName, svcMethod, args, reply, done)
+	call := newCall(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+	call.logger = c.logger
 	go c.makeCall(call)
 	<-done
 	return call.getError()
@@ -102,7 +285,7 @@ func (c *Client) CallContext(
 // in the provided channel upon completion, holding any Reply or Errors.
 //
 // The provided done channel must be nil, or have capacity for 1 element
-// at least, or a panic will be triggered.
+// at least, or an error is returned.
 //
 // If dest is empty ("") or matches the Client's host ID, it will
 // attempt to use the local configured Server when possible.
@@ -111,9 +294,10 @@ func (c *Client) Go(
 	svcName, svcMethod string,
 	args, reply interface{},
 	done chan *Call,
+	opts ...CallOption,
 ) error {
 	ctx := context.Background()
-	return c.GoContext(ctx, dest, svcName, svcMethod, args, reply, done)
+	return c.GoContext(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
 }
 
 // GoContext performs a Go() call with the provided context, allowing
@@ -121,39 +305,61 @@ func (c *Client) Go(
 // information.
 //
 // The provided done channel must be nil, or have capacity for 1 element
-// at least, or a panic will be triggered.
+// at least, or an error is returned.
 func (c *Client) GoContext(
 	ctx context.Context,
 	dest peer.ID,
 	svcName, svcMethod string,
 	args, reply interface{},
 	done chan *Call,
+	opts ...CallOption,
 ) error {
 	if done == nil {
 		done = make(chan *Call, 1)
 	} else {
 		if cap(done) == 0 {
-			panic("done channel has no capacity")
+			return newClientError(errNoCapacity)
 		}
 	}
-	call := newCall(ctx, dest, svcName, svcMethod, args, reply, done)
+	call := newCall(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+	call.logger = c.logger
 	go c.makeCall(call)
 	return nil
 }
 
+// Start performs a GoContext() call and returns it, so that it can be
+// cancelled (see Call.Cancel) or waited for (see Call.Wait) on its own.
+func (c *Client) Start(
+	ctx context.Context,
+	dest peer.ID,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) *Call {
+	call := newCall(ctx, dest, svcName, svcMethod, args, reply, make(chan *Call, 1), opts...)
+	call.logger = c.logger
+	go c.makeCall(call)
+	return call
+}
+
 // MultiCall performs a CallContext() to multiple destinations, using the same
 // service name, method and arguments. It will not return until all calls have
 // done so. The contexts, destinations and replies must match in length and
 // will be used in order (ctxs[i] is used for dests[i] which obtains
-// replies[i] and error[i]).
+// replies[i] and error[i]). When they do not, every call fails with a
+// client error.
 //
-// The calls will be triggered in parallel (with one goroutine for each).
+// The calls will be triggered in parallel (with one goroutine for each),
+// unless limited with WithConcurrency. The given CallOptions are applied
+// to every call (i.e. WithTimeout sets a per-destination timeout). See
+// MultiCallContext to make all the calls with the same context.
 func (c *Client) MultiCall(
 	ctxs []context.Context,
 	dests []peer.ID,
 	svcName, svcMethod string,
 	args interface{},
 	replies []interface{},
+	opts ...CallOption,
 ) []error {
 
 	ok := checkMatchingLengths(
@@ -162,29 +368,166 @@ func (c *Client) MultiCall(
 		len(replies),
 	)
 
+	errs := make([]error, len(dests), len(dests))
 	if !ok {
-		panic("ctxs, dests and replies must match in length")
+		for i := range errs {
+			errs[i] = newClientError(errMismatchedLengths)
+		}
+		return errs
 	}
 
-	var wg sync.WaitGroup
-	errs := make([]error, len(dests), len(dests))
+	runBounded(len(dests), newCallOptions(opts).concurrency, func(i int) {
+		// Calls waiting for a worker may have been
+		// cancelled in the meantime.
+		if err := ctxs[i].Err(); err != nil {
+			errs[i] = err
+			return
+		}
+		errs[i] = c.CallContext(
+			ctxs[i],
+			dests[i],
+			svcName,
+			svcMethod,
+			args,
+			replies[i],
+			opts...,
+		)
+	})
+	return errs
+}
 
-	for i := range dests {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			err := c.CallContext(
+// MultiCallContext works like MultiCall() but makes all the calls with
+// the given context, so that cancelling it cancels the calls still
+// running. Every call derives its own context from it, which is
+// cancelled when the call returns, with the timeout set by WithTimeout
+// if any, which counts from the start of the call when the calls are
+// limited with WithConcurrency:
+//
+//	errs := client.MultiCallContext(ctx, dests, "Arith", "Multiply", args, replies,
+//		rpc.WithTimeout(time.Second))
+//
+// The destinations and replies must match in length, or every call fails
+// with a client error.
+func (c *Client) MultiCallContext(
+	ctx context.Context,
+	dests []peer.ID,
+	svcName, svcMethod string,
+	args interface{},
+	replies []interface{},
+	opts ...CallOption,
+) []error {
+	ctxs := make([]context.Context, len(dests))
+	for i := range ctxs {
+		ctxs[i] = ctx
+	}
+	return c.MultiCall(ctxs, dests, svcName, svcMethod, args, replies, opts...)
+}
+
+// MultiResult is the outcome of one of the calls made by MultiStream(),
+// MultiCallResults() or MultiCallDeadline().
+type MultiResult struct {
+	// Index is the position of the destination in the given slice.
+	Index   int
+	Peer    peer.ID
+	Reply   interface{}
+	Error   error
+	Latency time.Duration
+}
+
+// MultiStream works like MultiCall() but returns immediately, delivering
+// the result of every call on the returned channel as soon as it finishes.
+// The channel is closed once all the calls have finished. When the lengths
+// of the contexts, destinations and replies do not match, every result
+// carries a client error.
+func (c *Client) MultiStream(
+	ctxs []context.Context,
+	dests []peer.ID,
+	svcName, svcMethod string,
+	args interface{},
+	replies []interface{},
+	opts ...CallOption,
+) <-chan *MultiResult {
+
+	ok := checkMatchingLengths(
+		len(ctxs),
+		len(dests),
+		len(replies),
+	)
+
+	results := make(chan *MultiResult, len(dests))
+	if !ok {
+		for i, dest := range dests {
+			results <- &MultiResult{
+				Index: i,
+				Peer:  dest,
+				Error: newClientError(errMismatchedLengths),
+			}
+		}
+		close(results)
+		return results
+	}
+
+	go func() {
+		defer close(results)
+		runBounded(len(dests), newCallOptions(opts).concurrency, func(i int) {
+			res := &MultiResult{
+				Index: i,
+				Peer:  dests[i],
+				Reply: replies[i],
+			}
+			if err := ctxs[i].Err(); err != nil {
+				res.Error = err
+				results <- res
+				return
+			}
+			start := time.Now()
+			res.Error = c.CallContext(
 				ctxs[i],
 				dests[i],
 				svcName,
 				svcMethod,
 				args,
-				replies[i])
-			errs[i] = err
-		}(i)
+				replies[i],
+				opts...,
+			)
+			res.Latency = time.Since(start)
+			results <- res
+		})
+	}()
+	return results
+}
+
+// runBounded calls f for every index up to count, with at most n
+// simultaneous calls (no limit if n <= 0), and waits for them to finish.
+func runBounded(count, n int, f func(i int)) {
+	var wg sync.WaitGroup
+	if n <= 0 || n >= count {
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+		wg.Wait()
+		return
+	}
+
+	next := make(chan int)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
 	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
 	wg.Wait()
-	return errs
 }
 
 // MultiGo performs a GoContext() call to multiple destinations, using the same
@@ -192,11 +535,11 @@ func (c *Client) MultiCall(
 // performing all the calls. See the Go() documentation for more information.
 //
 // The provided done channels must be nil, or have capacity for 1 element
-// at least, or a panic will be triggered.
+// at least, or an error is returned and no call is performed.
 //
-// The contexts, destinations, replies and done channels  must match in length
-// and will be used in order (ctxs[i] is used for dests[i] which obtains
-// replies[i] with dones[i] signalled upon completion).
+// The contexts, destinations, replies and done channels must match in length,
+// or an error is returned, and will be used in order (ctxs[i] is used for
+// dests[i] which obtains replies[i] with dones[i] signalled upon completion).
 func (c *Client) MultiGo(
 	ctxs []context.Context,
 	dests []peer.ID,
@@ -204,6 +547,7 @@ func (c *Client) MultiGo(
 	args interface{},
 	replies []interface{},
 	dones []chan *Call,
+	opts ...CallOption,
 ) error {
 
 	ok := checkMatchingLengths(
@@ -213,7 +557,12 @@ func (c *Client) MultiGo(
 		len(dones),
 	)
 	if !ok {
-		panic("ctxs, dests, replies and dones must match in length")
+		return newClientError(errMismatchedLengths)
+	}
+	for _, done := range dones {
+		if done != nil && cap(done) == 0 {
+			return newClientError(errNoCapacity)
+		}
 	}
 
 	for i := range ctxs {
@@ -225,12 +574,22 @@ func (c *Client) MultiGo(
 			args,
 			replies[i],
 			dones[i],
+			opts...,
 		)
 	}
 
 	return nil
 }
 
+var (
+	// errNoCapacity is returned when a done channel given to the
+	// client has no capacity.
+	errNoCapacity = errors.New("done channel has no capacity")
+	// errMismatchedLengths is returned when the slices given to
+	// the Multi* methods do not match in length.
+	errMismatchedLengths = errors.New("contexts, destinations, replies and done channels must match in length")
+)
+
 func checkMatchingLengths(l ...int) bool {
 	if len(l) <= 1 {
 		return true
@@ -244,110 +603,371 @@ func checkMatchingLengths(l ...int) bool {
 	return true
 }
 
+// prepareCall adds to the request of a call the values that the Client
+// attaches to every call.
+func (c *Client) prepareCall(call *Call) {
+	call.SvcID.Values = c.contextValuesOf(call.ctx)
+	call.localMode = c.localMode
+	if call.SvcID.Codec == "" && c.callCodec != nil {
+		call.SvcID.Codec = c.callCodec.name
+	}
+	if call.SvcID.Token == nil {
+		call.SvcID.Token = c.token
+	}
+	if c.signing && c.host != nil {
+		call.signKey = c.host.Peerstore().PrivKey(c.host.ID())
+	}
+	if c.compressAbove > 0 {
+		call.compressAbove = c.compressAbove
+		call.SvcID.AcceptCompression = []string{gzipCompression}
+	}
+	if c.maxChunkedReply > 0 && c.maxMessageSize > minChunkSize {
+		call.maxChunkedReply = c.maxChunkedReply
+		call.SvcID.ChunkSize = c.maxMessageSize
+	}
+}
+
 // makeCall decides if a call can be performed. If it's a local
 // call it will use the configured server if set.
 func (c *Client) makeCall(call *Call) {
-	logger.Debugf(
-		"makeCall: %s.%s",
-		call.SvcID.Name,
-		call.SvcID.Method,
-	)
+	if at := call.opts.adaptiveTimeout; at != nil {
+		if d := c.latencies.timeout(call.Dest, call.SvcID, at); d > 0 {
+			var cancel context.CancelFunc
+			call.ctx, cancel = context.WithTimeout(call.ctx, d)
+			defer cancel()
+		}
+	}
+	c.prepareCall(call)
+	start := time.Now()
+	if !c.pending.add(call, start) {
+		call.doneWithError(ErrClientClosed)
+		return
+	}
+	ev := c.startCall(call, start)
+
+	var cacheKey string
+	if c.cache != nil {
+		var err error
+		cacheKey, err = c.cache.key(c.ID(), call)
+		if err != nil {
+			c.logger.Debugw("not caching", ev.logFields("error", err)...)
+		}
+		hit := false
+		if cacheKey != "" {
+			hit, err = c.cache.get(cacheKey, call.Reply)
+			if err != nil {
+				c.logger.Debugw("ignoring cached response", ev.logFields("error", err)...)
+			}
+		}
+		if hit {
+			c.logger.Debugw("cached response", ev.logFields()...)
+			c.finishCall(call, ev, nil)
+			return
+		}
+	}
+
+	err := c.dispatch(call)
+	if err == nil && call.getError() == nil {
+		err = c.hooks.reply(ev, call.Reply)
+	}
+	if err == nil && cacheKey != "" && call.getError() == nil {
+		if err := c.cache.put(cacheKey, call.SvcID, call.Reply); err != nil {
+			c.logger.Debugw("not caching", ev.logFields("error", err)...)
+		}
+	}
+	c.finishCall(call, ev, err)
+}
+
+// startCall records the start of a call and returns its event.
+func (c *Client) startCall(call *Call, start time.Time) *CallEvent {
+	ev := &CallEvent{
+		Peer:     call.Dest,
+		Service:  call.SvcID.Name,
+		Method:   call.SvcID.Method,
+		Metadata: call.SvcID.Metadata,
+		Codec:    call.SvcID.Codec,
+		Start:    start,
+	}
+	c.stats.callStart(ev)
+	c.hooks.callStart(ev)
+	c.logger.Debugw("making call", ev.logFields()...)
+	return ev
+}
+
+// finishCall records the outcome of a call and marks it as done.
+func (c *Client) finishCall(call *Call, ev *CallEvent, err error) {
+	if err != nil {
+		call.setError(err)
+	}
+	ev.Duration = time.Since(ev.Start)
+	ev.Error = call.getError()
+	// The codec falls back to the stream codec with peers not
+	// supporting it (see WithHandshake).
+	ev.Codec = call.SvcID.Codec
+	call.setInfo(func(info *CallInfo) {
+		info.Latency = ev.Duration
+		ev.BytesSent = info.BytesSent
+		ev.BytesReceived = info.BytesReceived
+		if call.opts.info != nil {
+			*call.opts.info = *info
+		}
+	})
+
+	fields := ev.logFields("duration", ev.Duration, "error", ev.Error)
+	if ev.Error != nil {
+		c.logger.Errorw("call failed", fields...)
+	} else {
+		c.logger.Debugw("call finished", fields...)
+	}
+	logSlowCall(c.logger, c.slowCall, ev)
+	reportBandwidth(c.bwReporter, c.protocol, ev)
+	c.stats.callEnd(ev)
+	c.hooks.callEnd(ev)
+	c.pending.remove(call)
+	call.done()
+}
+
+// dispatch performs the call using the local server or by
+// sending it to the remote destination.
+func (c *Client) dispatch(call *Call) error {
+	if c.conn != nil {
+		call.markReached()
+		return c.conn.call(call)
+	}
 
 	// Handle local RPC calls
 	if call.Dest == "" || c.host == nil || call.Dest == c.host.ID() {
-		logger.Debugf(
-			"local call: %s.%s",
-			call.SvcID.Name,
-			call.SvcID.Method,
-		)
+		c.logger.Debugw("local call", "service", call.SvcID.Name, "method", call.SvcID.Method)
 		if c.server == nil {
-			err := &clientError{"Cannot make local calls: server not set"}
-			call.doneWithError(err)
-			return
+			if c.loopback != nil {
+				return c.callLoopback(call)
+			}
+			return &clientError{"Cannot make local calls: server not set"}
 		}
-		err := c.server.Call(call)
-		call.doneWithError(err)
-		return
+		call.markReached()
+		return c.server.Call(call)
 	}
 
 	// Handle remote RPC calls
 	if c.host == nil {
-		panic("no host set: cannot perform remote call")
+		return &clientError{"no host set: cannot perform remote call"}
 	}
 	if c.protocol == "" {
-		panic("no protocol set: cannot perform remote call")
+		return &clientError{"no protocol set: cannot perform remote call"}
+	}
+	if c.inFlight != nil {
+		release, err := c.inFlight.acquire(call.ctx, call.Dest, call.opts.priority)
+		if err != nil {
+			return err
+		}
+		defer release()
 	}
-	c.send(call)
+	return c.sendWithRetries(call)
 }
 
-// send makes a REMOTE RPC call by initiating a libP2P stream to the
-// destination and waiting for a response.
-func (c *Client) send(call *Call) {
-	logger.Debug("sending remote call")
+// protocols returns the list of protocols to negotiate, in order
+// of preference, when calling the given service.
+func (c *Client) protocols(svcName string) []protocol.ID {
+	protos := append([]protocol.ID{c.protocol}, c.extraProtocols...)
+	if !c.serviceProtocols || svcName == "" {
+		return protos
+	}
+	svcProtos := make([]protocol.ID, 0, 2*len(protos))
+	for _, p := range protos {
+		svcProtos = append(svcProtos, ServiceProtocol(p, svcName))
+	}
+	return append(svcProtos, protos...)
+}
 
-	s, err := c.host.NewStream(call.ctx, call.Dest, c.protocol)
-	if err != nil {
-		call.doneWithError(newClientError(err))
-		return
+// sendWithRetries performs send() and retries it as many times as allowed
+// by the call options, as long as the request did not reach the server.
+func (c *Client) sendWithRetries(call *Call) error {
+	if err := c.adapt(call, c.negotiate(call)); err != nil {
+		return err
+	}
+	return c.retry(call, func() (bool, error) {
+		return c.send(call)
+	})
+}
+
+// retry runs the given function, which sends the request of the call and
+// returns whether it can be retried when failing, as many times as
+// allowed by the call options.
+func (c *Client) retry(call *Call, send func() (bool, error)) error {
+	backoff := call.opts.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retriable, err := send()
+		if err == nil || !retriable || attempt >= call.opts.retries {
+			return err
+		}
+
+		c.logger.Debugw(
+			"retrying call",
+			"peer", call.Dest,
+			"service", call.SvcID.Name,
+			"method", call.SvcID.Method,
+			"attempt", attempt+1,
+			"error", err,
+		)
+		t := time.NewTimer(backoff)
+		select {
+		case <-call.ctx.Done():
+			t.Stop()
+			return call.ctx.Err()
+		case <-t.C:
+		}
+		backoff *= 2
 	}
+}
 
-	go call.watchContextWithStream(s)
-	sWrap := wrapStream(s)
+// send makes a REMOTE RPC call by initiating a libP2P stream to the
+// destination and waiting for a response. It returns whether the
+// call can be safely retried when failing, that is, when the request
+// was not fully sent to the server.
+func (c *Client) send(call *Call) (bool, error) {
+	if c.pipelines != nil && c.pipelinesSupported(call.Dest) {
+		return c.sendPipelined(call)
+	}
 
-	logger.Debugf(
-		"sending RPC %s.%s to %s",
-		call.SvcID.Name,
-		call.SvcID.Method,
-		call.Dest,
-	)
-	if err := sWrap.enc.Encode(call.SvcID); err != nil {
-		call.doneWithError(newClientError(err))
+	start := time.Now()
+	s, err := c.openStream(call)
+	if err != nil {
+		return true, newClientError(err)
+	}
+	setup := time.Since(start)
+	call.markReached()
+	c.setPeerProtocol(call.Dest, s.Protocol())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	call.watchStream(s, stop)
+	sWrap := c.wrap(s, codecFor(c.codecs, s.Protocol()))
+	defer sWrap.release()
+	defer func() {
+		call.setInfo(func(info *CallInfo) {
+			info.StreamSetup = setup
+			info.BytesSent = sWrap.cw.count()
+			info.BytesReceived = sWrap.cr.count()
+		})
+	}()
+	if err := c.authenticate(call, sWrap); err != nil {
 		s.Reset()
-		return
+		return false, err
 	}
-	if err := sWrap.enc.Encode(call.Args); err != nil {
-		call.doneWithError(newClientError(err))
+
+	c.logger.Debugw(
+		"sending remote call",
+		"peer", call.Dest,
+		"service", call.SvcID.Name,
+		"method", call.SvcID.Method,
+		"protocol", s.Protocol(),
+	)
+	if err := sWrap.writeRequest(call.SvcID, call.Args, call.signKey, call.compressAbove); err != nil {
 		s.Reset()
-		return
+		return true, newClientError(err)
 	}
 
 	if err := sWrap.w.Flush(); err != nil {
-		call.doneWithError(newClientError(err))
 		s.Reset()
-		return
+		return true, newClientError(err)
 	}
 	err = receiveResponse(sWrap, call)
 	if err != nil {
 		s.Reset()
-		return
+		if ctxErr := call.contextError(); ctxErr != nil {
+			return false, ctxErr
+		}
+		return false, err
 	}
 	go helpers.FullClose(s)
+	if call.getError() == nil {
+		c.latencies.record(call.Dest, call.SvcID, time.Since(start))
+	}
+	return false, nil
 }
 
-// receiveResponse reads a response to an RPC call
+// receiveResponse reads a response to an RPC call. Errors sent by the
+// server are set in the call, while the returned error indicates a
+// problem reading the response.
 func receiveResponse(s *streamWrap, call *Call) error {
-	logger.Debugf(
-		"waiting response for %s.%s to %s",
-		call.SvcID.Name,
-		call.SvcID.Method,
-		call.Dest,
+	call.logger.Debugw(
+		"waiting for response",
+		"peer", call.Dest,
+		"service", call.SvcID.Name,
+		"method", call.SvcID.Method,
 	)
 	var resp Response
-	if err := s.dec.Decode(&resp); err != nil {
-		call.doneWithError(newClientError(err))
-		return err
+	var chunks replyChunks
+	for {
+		hb := s.awaitHeartbeat(call)
+		if err := s.readHeader(&resp); err != nil {
+			if hb.missed() && call.contextError() == nil {
+				err = errNoHeartbeat
+			}
+			return newClientError(err)
+		}
+		if resp.Heartbeat {
+			resp = Response{}
+			continue
+		}
+		if resp.Chunk {
+			if err := chunks.read(s, call.maxChunkedReply); err != nil {
+				return newClientError(err)
+			}
+			resp = Response{}
+			continue
+		}
+		if resp.Progress == nil {
+			hb.done()
+			break
+		}
+		if f := call.opts.progress; f != nil {
+			f(*resp.Progress)
+		}
+		resp = Response{}
+	}
+	if chunks.data != nil {
+		// The body of the final response is the last chunk.
+		if err := chunks.read(s, call.maxChunkedReply); err != nil {
+			return newClientError(err)
+		}
+		body := chunks.body(s)
+		defer body.release()
+		return readReply(body, call, &resp)
 	}
+	return readReply(s, call, &resp)
+}
 
-	defer call.done()
-	if e := resp.Error; e != "" {
-		call.setError(responseError(resp.ErrType, e))
+// readReply sets the outcome of the given response in the call and
+// reads the reply that follows it.
+func readReply(s *streamWrap, call *Call, resp *Response) error {
+	if err := s.responseToError(resp); err != nil {
+		call.setError(err)
+	}
+	call.setInfo(func(info *CallInfo) {
+		info.ServerDuration = resp.Duration
+	})
+
+	// Responses to signed requests which cannot be verified, because
+	// they are not signed (or compressed, which is not verified), are
+	// read into a discarded value, so that the reply only holds
+	// verified data.
+	reply := call.Reply
+	unsigned := call.signKey != nil && (resp.Signature == nil || resp.Compression != "")
+	if unsigned {
+		var discard interface{}
+		reply = &discard
+		call.setError(newClientError(errors.New("the response is not signed")))
 	}
 
 	// Even on error we sent the reply so it needs to be
 	// read
-	if err := s.dec.Decode(call.Reply); err != nil && err != io.EOF {
-		call.setError(newClientError(err))
-		return err
+	signed, err := s.decodeResponseBody(resp, reply)
+	if err != nil && err != io.EOF {
+		return newClientError(fmt.Errorf("cannot decode reply as %T: %w", call.Reply, err))
+	}
+	if signed != nil && call.opts.signedResponse != nil {
+		*call.opts.signedResponse = *signed
 	}
 	return nil
 }
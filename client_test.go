@@ -0,0 +1,2149 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type Counter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *Counter) Incr(ctx context.Context, n int, r *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count += n
+	*r = c.count
+	return nil
+}
+
+func TestCacheableMethod(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s,
+		WithCacheableMethod("Counter", "Incr", time.Second),
+	)
+	var counter Counter
+	s.Register(&counter)
+
+	var r int
+	for i := 0; i < 3; i++ {
+		err := c.Call(h1.ID(), "Counter", "Incr", 1, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != 1 {
+			t.Fatal("expected a cached response:", r)
+		}
+	}
+
+	// Different arguments are not cached
+	err := c.Call(h1.ID(), "Counter", "Incr", 2, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 3 {
+		t.Error("expected a fresh response:", r)
+	}
+
+	c.PurgeCache()
+	err = c.Call(h1.ID(), "Counter", "Incr", 1, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 4 {
+		t.Error("expected a fresh response after purge:", r)
+	}
+
+	// Other versions and codecs are not served from the cache.
+	s.Register(&Counter{}, WithVersion("v2"))
+	err = c.Call(h1.ID(), "Counter", "Incr", 1, &r, WithServiceVersion("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 1 {
+		t.Error("expected a fresh response from v2:", r)
+	}
+	err = c.Call(h1.ID(), "Counter", "Incr", 1, &r, WithCodec(JSONCodec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 5 {
+		t.Error("expected a fresh response with another codec:", r)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithDeduplication(time.Second))
+	c := NewClient(h2, "rpc")
+	var counter Counter
+	s.Register(&counter)
+
+	var r int
+	for i := 0; i < 3; i++ {
+		err := c.Call(h1.ID(), "Counter", "Incr", 1, &r, WithIdempotencyKey("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != 1 {
+			t.Fatal("expected the original response:", r)
+		}
+	}
+
+	err := c.Call(h1.ID(), "Counter", "Incr", 1, &r, WithIdempotencyKey("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 2 {
+		t.Error("expected a new response:", r)
+	}
+
+	err = c.Call(h1.ID(), "Counter", "Incr", 1, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 3 {
+		t.Error("expected a new response:", r)
+	}
+
+	// Keys are scoped by service version.
+	s.Register(&Counter{count: 10}, WithVersion("v2"))
+	err = c.Call(h1.ID(), "Counter", "Incr", 1, &r, WithIdempotencyKey("a"), WithServiceVersion("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 11 {
+		t.Error("expected a response from v2:", r)
+	}
+}
+
+func TestTypedCall(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s)
+	var arith Arith
+	s.Register(&arith)
+
+	divide, err := NewTypedCall[*Args, Quotient](c, "Arith", "Divide")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := divide(context.Background(), h1.ID(), &Args{20, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Quo != 3 || q.Rem != 2 {
+		t.Error("bad division")
+	}
+
+	_, err = NewTypedCall[*Args, Quotient](c, "Arith", "Divid")
+	if err == nil {
+		t.Error("expected an error for a wrong method name")
+	}
+
+	_, err = NewTypedCall[Args, Quotient](c, "Arith", "Divide")
+	if err == nil {
+		t.Error("expected an error for a wrong argument type")
+	}
+
+	_, err = NewTypedCall[*Args, int](c, "Arith", "Divide")
+	if err == nil {
+		t.Error("expected an error for a wrong reply type")
+	}
+
+	// Methods published under other names, and versions.
+	if err := s.Register(&arith, WithVersion("v2"), WithMethodNames(SnakeCase)); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterFunc("Funcs", "ping", func(ctx context.Context, in string, out *string) error {
+		*out = in
+		return nil
+	})
+	add, err := NewTypedCall[Args, int](c, "Arith", "add", WithServiceVersion("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := add(context.Background(), h1.ID(), Args{2, 3}); err != nil || r != 5 {
+		t.Error("unexpected result:", r, err)
+	}
+	_, err = NewTypedCall[Args, int](c, "Arith", "add")
+	if err == nil {
+		t.Error("expected an error for a method of another version")
+	}
+	ping, err := NewTypedCall[string, string](c, "Funcs", "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := ping(context.Background(), h1.ID(), "pong"); err != nil || r != "pong" {
+		t.Error("unexpected result:", r, err)
+	}
+}
+
+func TestMultiCallT(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+	c := NewClient(h2, "rpc")
+
+	// The local peer has no server.
+	dests := []peer.ID{h1.ID(), h2.ID(), h1.ID()}
+	results, err := MultiCallT[Quotient](context.Background(), c, dests, "Arith", "Divide", &Args{20, 6}, WithConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(dests) {
+		t.Fatal("unexpected number of results:", len(results))
+	}
+	for i, res := range results {
+		if res.Index != i || res.Peer != dests[i] {
+			t.Errorf("unexpected result %d: %+v", i, res)
+		}
+		if dests[i] == h2.ID() {
+			if res.Error == nil {
+				t.Error("expected the call to the local peer to fail")
+			}
+			continue
+		}
+		if res.Error != nil || res.Reply.Quo != 3 || res.Reply.Rem != 2 || res.Latency <= 0 {
+			t.Errorf("unexpected result %d: %+v", i, res)
+		}
+	}
+
+	withServer := NewClientWithServer(h2, "rpc", s)
+	if _, err := MultiCallT[int](context.Background(), withServer, dests, "Arith", "Divide", &Args{20, 6}); err == nil {
+		t.Error("expected an error for a wrong reply type")
+	}
+	if _, err := MultiCallT[Quotient](context.Background(), c, dests, "Arith", "", &Args{20, 6}); err == nil {
+		t.Error("expected an error for an empty method name")
+	}
+
+	// Methods published under other names, and versions.
+	if err := s.Register(&Arith{}, WithVersion("v2"), WithMethodNames(SnakeCase)); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterFunc("Funcs", "ping", func(ctx context.Context, in string, out *string) error {
+		*out = in
+		return nil
+	})
+	sums, err := MultiCallT[int](context.Background(), withServer, []peer.ID{h1.ID()}, "Arith", "add", Args{2, 3}, WithServiceVersion("v2"))
+	if err != nil || sums[0].Error != nil || sums[0].Reply != 5 {
+		t.Error("unexpected result:", sums, err)
+	}
+	if _, err := MultiCallT[int](context.Background(), withServer, []peer.ID{h1.ID()}, "Arith", "add", Args{2, 3}); err == nil {
+		t.Error("expected an error for a method of another version")
+	}
+	pongs, err := MultiCallT[string](context.Background(), withServer, []peer.ID{h1.ID()}, "Funcs", "ping", "pong")
+	if err != nil || pongs[0].Error != nil || pongs[0].Reply != "pong" {
+		t.Error("unexpected result:", pongs, err)
+	}
+}
+
+func TestDecodingErrors(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", "six", &r)
+	if !IsServerError(err) || !strings.Contains(err.Error(), "*rpc.Args") {
+		t.Error("expected an error naming the argument type:", err)
+	}
+
+	var s2 string
+	err = c.Call(h1.ID(), "Arith", "Divide", &Args{20, 6}, &s2)
+	if !IsClientError(err) || !strings.Contains(err.Error(), "*string") {
+		t.Error("expected an error naming the reply type:", err)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "/rpc/1.0.0", WithServerProtocols("/rpc/1.1.0"))
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "/rpc/2.0.0", WithClientProtocols("/rpc/1.1.0", "/rpc/1.0.0"))
+	if p := c.PeerProtocol(h1.ID()); p != "" {
+		t.Error("expected no protocol:", p)
+	}
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+	if p := c.PeerProtocol(h1.ID()); p != "/rpc/1.1.0" {
+		t.Error("unexpected protocol:", p)
+	}
+}
+
+func TestPreconnect(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	NewServer(h1, "/rpc/1.0.0")
+	c := NewClient(h2, "/rpc/2.0.0",
+		WithClientProtocols("/rpc/1.0.0"),
+		WithPreconnectValidation(),
+	)
+
+	errs := c.Preconnect(context.Background(), h1.ID(), h2.ID(), test.RandPeerIDFatal(t))
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if errs[1] != nil {
+		t.Error("local peer should be skipped:", errs[1])
+	}
+	if !IsClientError(errs[2]) {
+		t.Error("expected a client error for an unknown peer:", errs[2])
+	}
+	if len(h2.Network().ConnsToPeer(h1.ID())) == 0 {
+		t.Error("expected a connection to the server")
+	}
+	if p := c.PeerProtocol(h1.ID()); p != "/rpc/1.0.0" {
+		t.Error("unexpected protocol:", p)
+	}
+}
+
+func TestNoDial(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	c := NewClient(h2, "rpc")
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithNoDial())
+	if !IsClientError(err) {
+		t.Fatal("expected a client error:", err)
+	}
+	noDialClient := NewClient(h2, "rpc", WithClientNoDial())
+	err = noDialClient.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if !IsClientError(err) {
+		t.Fatal("expected a client error:", err)
+	}
+	noDial := NewClient(h2, "rpc", WithClientNoDial(), WithHandshake())
+	err = noDial.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if !errors.Is(err, ErrNotConnected) || !IsClientError(err) {
+		t.Fatal("expected ErrNotConnected:", err)
+	}
+
+	// Direct connections are dialed when relays are disabled.
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithNoRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = noDialClient.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithNoRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = noDial.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "/rpc/1.0.0",
+		WithServerProtocols("/rpc/json/1.0.0"),
+		WithServerCodec("/rpc/json/1.0.0", JSONCodec),
+	)
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "/rpc/json/1.0.0", WithClientCodec("/rpc/json/1.0.0", JSONCodec))
+	var q Quotient
+	err := c.Call(h1.ID(), "Arith", "Divide", &Args{20, 6}, &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Quo != 3 || q.Rem != 2 {
+		t.Error("bad division")
+	}
+	err = c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &q)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("expected different error:", err)
+	}
+
+	// A peer speaking plain JSON.
+	stream, err := h2.NewStream(context.Background(), h1.ID(), "/rpc/json/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Write([]byte(`{"Name":"Arith","Method":"Multiply"} {"A":2,"B":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var header map[string]interface{}
+	var r int
+	if err := dec.Decode(&header); err != nil {
+		t.Fatal(err, string(data))
+	}
+	if err := dec.Decode(&r); err != nil {
+		t.Fatal(err, string(data))
+	}
+	if header["Error"] != "" || r != 6 {
+		t.Error("unexpected response:", string(data))
+	}
+}
+
+func TestRoutingHeaders(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	routing := MsgpackCodec.WithRoutingHeaders()
+	if JSONCodec.WithRoutingHeaders() != JSONCodec {
+		t.Error("expected JSON headers to be kept")
+	}
+	s := NewServer(h1, "rpc", WithServerCodec("rpc", routing))
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "rpc", WithClientCodec("rpc", routing), WithPipelining())
+	var r int
+	for i := 0; i < 3; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, i}, &r, WithProgress(func(Progress) {})); err != nil {
+			t.Fatal(err)
+		}
+		if r != 2*i {
+			t.Error("result is:", r)
+		}
+	}
+	var q Quotient
+	err := c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &q)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("expected different error:", err)
+	}
+
+	// A peer reading the service and method without the codec.
+	stream, err := h2.NewStream(context.Background(), h1.ID(), "rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := MsgpackCodec.Marshal(ServiceID{})
+	args, _ := MsgpackCodec.Marshal(Args{2, 3})
+	var req []byte
+	for _, field := range [][]byte{[]byte("Arith"), []byte("Multiply"), rest} {
+		req = binary.AppendUvarint(req, uint64(len(field)))
+		req = append(req, field...)
+	}
+	if _, err := stream.Write(append(req, args...)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for i := 0; i < 3; i++ {
+		n, k := binary.Uvarint(data)
+		if k <= 0 || uint64(len(data)-k) < n {
+			t.Fatal("bad header:", data)
+		}
+		fields = append(fields, string(data[k:k+int(n)]))
+		data = data[k+int(n):]
+	}
+	var resp Response
+	if err := MsgpackCodec.Unmarshal([]byte(fields[2]), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := MsgpackCodec.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if fields[0] != "Arith" || fields[1] != "Multiply" || resp.Error != "" || r != 6 {
+		t.Error("unexpected response:", fields[:2], resp, r)
+	}
+}
+
+func TestCBORCodec(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "/rpc/cbor/1.0.0", WithServerCodec("/rpc/cbor/1.0.0", CBORCodec))
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "/rpc/cbor/1.0.0", WithClientCodec("/rpc/cbor/1.0.0", CBORCodec))
+	var value string
+	err := c.Call(h1.ID(), "Arith", "Metadata", "b", &value, WithMetadata("a", "1"), WithMetadata("b", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "2" {
+		t.Error("unexpected value:", value)
+	}
+
+	data, err := CBORCodec.Marshal(map[string]int{"b": 1, "a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xa2, 0x61, 'a', 0x02, 0x61, 'b', 0x01}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("encoding is not canonical: %x", data)
+	}
+	var m map[string]int
+	if err := CBORCodec.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["a"] != 2 || m["b"] != 1 {
+		t.Error("unexpected map:", m)
+	}
+}
+
+func TestCallCodec(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMethodCodec("Arith", "Divide", JSONCodec))
+	var arith Arith
+	s.Register(&arith)
+
+	for _, c := range []*Client{NewClient(h2, "rpc"), NewClient(h2, "rpc", WithPipelining())} {
+		var r int
+		err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithCodec(JSONCodec))
+		if err != nil || r != 6 {
+			t.Error("unexpected result:", err, r)
+		}
+		err = c.Call(h1.ID(), "Arith", "Add", Args{2, 3}, &r, WithCodec(CBORCodec))
+		if err != nil || r != 5 {
+			t.Error("unexpected result:", err, r)
+		}
+
+		var quo Quotient
+		err = c.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &quo, WithCodec(JSONCodec))
+		if err != nil || quo.Quo != 3 || quo.Rem != 1 {
+			t.Error("unexpected result:", err, quo)
+		}
+		err = c.Call(h1.ID(), "Arith", "Divide", &Args{7, 0}, &quo, WithCodec(JSONCodec))
+		if err == nil || err.Error() != "divide by zero" {
+			t.Error("expected divide by zero error:", err)
+		}
+		err = c.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &quo)
+		if !IsServerError(err) || !strings.Contains(err.Error(), "requires the json codec") {
+			t.Error("expected a codec error:", err)
+		}
+
+		err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r)
+		if err != nil || r != 8 {
+			t.Error("unexpected result:", err, r)
+		}
+	}
+}
+
+func TestClientCallCodec(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	codecs := make(map[string]int)
+	s := NewServer(h1, "rpc", WithMethodCodec("Arith", "Divide", CBORCodec), WithServerHooks(Hooks{
+		OnCallEnd: func(ev CallEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			codecs[ev.Codec]++
+		},
+	}))
+	s.Register(&Arith{})
+
+	var clientCodec string
+	old := NewClient(h2, "rpc")
+	migrated := NewClient(h2, "rpc", WithClientCallCodec(CBORCodec), WithClientHooks(Hooks{
+		OnCallEnd: func(ev CallEvent) {
+			clientCodec = ev.Codec
+		},
+	}))
+
+	var quo Quotient
+	if err := migrated.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &quo); err != nil || quo.Quo != 3 {
+		t.Error("unexpected result:", err, quo)
+	}
+	if clientCodec != "cbor" {
+		t.Error("unexpected codec in the client hooks:", clientCodec)
+	}
+	err := old.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &quo)
+	if !strings.Contains(fmt.Sprint(err), "requires the cbor codec") {
+		t.Error("expected a codec error:", err)
+	}
+	// WithCodec takes precedence.
+	err = migrated.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &quo, WithCodec(JSONCodec))
+	if !strings.Contains(fmt.Sprint(err), "requires the cbor codec") {
+		t.Error("expected a codec error:", err)
+	}
+
+	var r int
+	if err := migrated.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+	if err := old.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r); err != nil || r != 8 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if codecs["cbor"] != 2 || codecs[""] != 2 || codecs["json"] != 1 {
+		t.Error("unexpected codecs in the server hooks:", codecs)
+	}
+}
+
+type Blob struct{}
+
+func (b *Blob) Reverse(ctx context.Context, in Raw, out *Raw) error {
+	*out = make(Raw, len(in))
+	for i, c := range in {
+		(*out)[len(in)-1-i] = c
+	}
+	return nil
+}
+
+func TestRaw(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "/rpc/1.0.0",
+		WithServerProtocols("/rpc/json/1.0.0"),
+		WithServerCodec("/rpc/json/1.0.0", JSONCodec),
+	)
+	s.Register(&Blob{})
+	var arith Arith
+	s.Register(&arith)
+
+	clients := []*Client{
+		NewClient(h2, "/rpc/1.0.0"),
+		NewClient(h2, "/rpc/1.0.0", WithPipelining()),
+		NewClient(h2, "/rpc/json/1.0.0", WithClientCodec("/rpc/json/1.0.0", JSONCodec)),
+		NewClient(h2, "/rpc/json/1.0.0", WithClientCodec("/rpc/json/1.0.0", JSONCodec), WithPipelining()),
+	}
+	for _, c := range clients {
+		for _, in := range []Raw{Raw("abc\n"), {}} {
+			var out Raw
+			err := c.Call(h1.ID(), "Blob", "Reverse", in, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(in) || (len(in) > 0 && string(out) != "\ncba") {
+				t.Errorf("unexpected reply: %q", out)
+			}
+		}
+
+		// Raw values can be decoded as byte slices.
+		var b []byte
+		err := c.Call(h1.ID(), "Blob", "Reverse", Raw{1, 2}, &b)
+		if err != nil || len(b) != 2 || b[0] != 2 {
+			t.Error("unexpected reply:", err, b)
+		}
+		var out Raw
+		err = c.Call(h1.ID(), "Blob", "Reverse", []byte{1, 2}, &out)
+		if err != nil || len(out) != 2 || out[0] != 2 {
+			t.Error("unexpected reply:", err, out)
+		}
+
+		var r int
+		err = c.Call(h1.ID(), "Arith", "Add", Raw{1, 2}, &r)
+		if !IsServerError(err) {
+			t.Error("expected a server error:", err)
+		}
+		err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+		if err != nil || r != 6 {
+			t.Error("unexpected result:", err, r)
+		}
+	}
+}
+
+func TestStreamOpenTimeout(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	// A peer which accepts connections but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	silent, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	h2.Peerstore().AddAddr(silent, addr, time.Hour)
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	arith.ctxTracker = &ctxTracker{}
+	s.Register(&arith)
+
+	c := NewClient(h2, "rpc", WithStreamOpenTimeout(200*time.Millisecond))
+	var r int
+	start := time.Now()
+	err = c.Call(silent, "Arith", "Multiply", &Args{2, 3}, &r, WithTimeout(10*time.Second))
+	if !IsClientError(err) || !strings.Contains(err.Error(), "timed out opening") {
+		t.Error("expected a stream open timeout:", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("stream open timeout not applied:", d)
+	}
+
+	// Methods may take longer than the stream open timeout.
+	err = c.Call(h1.ID(), "Arith", "Sleep", 1, &struct{}{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type tenantKey struct{}
+
+type Tenants struct{}
+
+func (t *Tenants) Current(ctx context.Context, in int, out *string) error {
+	*out, _ = ctx.Value(tenantKey{}).(string)
+	return nil
+}
+
+func TestContextValues(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerContextValue("tenant", tenantKey{}))
+	s.Register(&Tenants{})
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	c := NewClient(h2, "rpc", WithClientContextValue("tenant", tenantKey{}))
+	var out string
+	err := c.CallContext(ctx, h1.ID(), "Tenants", "Current", 0, &out)
+	if err != nil || out != "acme" {
+		t.Error("unexpected result:", err, out)
+	}
+	res := c.Batch(ctx, h1.ID(), []Request{{"Tenants", "Current", 0, new(string)}})
+	if res[0].Error != nil || *res[0].Reply.(*string) != "acme" {
+		t.Error("unexpected result:", res[0].Error, res[0].Reply)
+	}
+
+	// Values are only sent when registered on the client.
+	c = NewClient(h2, "rpc")
+	err = c.CallContext(ctx, h1.ID(), "Tenants", "Current", 0, &out)
+	if err != nil || out != "" {
+		t.Error("unexpected result:", err, out)
+	}
+
+	// and only accepted when registered on the server.
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Tenants{})
+	c = NewClient(h1, "rpc", WithClientContextValue("tenant", tenantKey{}))
+	err = c.CallContext(ctx, h2.ID(), "Tenants", "Current", 0, &out)
+	if err != nil || out != "" {
+		t.Error("unexpected result:", err, out)
+	}
+}
+
+// Notary answers with the signer of signed requests.
+type Notary struct{}
+
+func (n *Notary) Signer(ctx context.Context, in string, out *string) error {
+	m := GetSignedRequest(ctx)
+	if m == nil {
+		return errors.New("unsigned request")
+	}
+	if err := m.Verify(); err != nil {
+		return err
+	}
+	*out = in + m.Signer.Pretty()
+	return nil
+}
+
+func TestRequestSigning(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "/rpc/1.0.0",
+		WithServerProtocols("/rpc/json/1.0.0"),
+		WithServerCodec("/rpc/json/1.0.0", JSONCodec),
+		WithRequiredSignatures(),
+	)
+	s.Register(&Notary{})
+	var arith Arith
+	s.Register(&arith)
+
+	clients := []*Client{
+		NewClient(h2, "/rpc/1.0.0", WithRequestSigning()),
+		NewClient(h2, "/rpc/1.0.0", WithRequestSigning(), WithPipelining()),
+		NewClient(h2, "/rpc/json/1.0.0", WithRequestSigning(), WithClientCodec("/rpc/json/1.0.0", JSONCodec)),
+	}
+	for _, c := range clients {
+		var out string
+		var signed SignedMessage
+		err := c.Call(h1.ID(), "Notary", "Signer", "by ", &out, WithSignedResponse(&signed), WithMetadata("k", "v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != "by "+h2.ID().Pretty() {
+			t.Error("unexpected reply:", out)
+		}
+		if signed.Signer != h1.ID() || signed.Verify() != nil {
+			t.Error("unexpected signed response:", signed.Signer, signed.Verify())
+		}
+		signed.Data[len(signed.Data)-1]++
+		if signed.Verify() == nil {
+			t.Error("expected an invalid signature")
+		}
+
+		var quo Quotient
+		err = c.Call(h1.ID(), "Arith", "Divide", &Args{7, 0}, &quo)
+		if err == nil || err.Error() != "divide by zero" {
+			t.Error("expected divide by zero error:", err)
+		}
+		res := c.Batch(context.Background(), h1.ID(), []Request{
+			{"Arith", "Divide", &Args{7, 2}, &quo},
+			{"Notary", "Signer", "", &out},
+		})
+		if res[0].Error != nil || res[1].Error != nil || quo.Quo != 3 {
+			t.Error("unexpected results:", res[0].Error, res[1].Error, quo)
+		}
+	}
+
+	var r int
+	err := NewClient(h2, "/rpc/1.0.0").Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if !IsAuthorizationError(err) {
+		t.Error("expected an authorization error:", err)
+	}
+
+	// Servers answer unsigned responses to clients which do
+	// not sign requests.
+	s2 := NewServer(h2, "/rpc/1.0.0")
+	s2.Register(&arith)
+	err = NewClient(h1, "/rpc/1.0.0").Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	// Unsigned responses to signed requests are not decoded into
+	// the reply.
+	h1.SetStreamHandler("/rpc/unsigned", func(st network.Stream) {
+		sw := wrapStream(st, MsgpackCodec)
+		var svcID ServiceID
+		var args interface{}
+		if sw.readHeader(&svcID) != nil || sw.decode(&args) != nil {
+			st.Reset()
+			return
+		}
+		sendResponse(sw, &Response{Service: svcID}, 42)
+		st.Close()
+	})
+	r = 0
+	err = NewClient(h2, "/rpc/unsigned", WithRequestSigning()).Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err == nil || err.Error() != "the response is not signed" {
+		t.Error("expected an unsigned response error:", err)
+	}
+	if r != 0 {
+		t.Error("the unsigned reply was decoded:", r)
+	}
+}
+
+func FuzzClientReply(f *testing.F) {
+	resp := &Response{Service: ServiceID{Name: "Lag", Method: "Echo"}}
+	reply, err := MsgpackCodec.marshal(resp, "hello")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(reply)
+	f.Add(reply[:len(reply)-2])
+	progress, err := MsgpackCodec.Marshal(&Response{Progress: &Progress{Percent: 50}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(append(progress, reply...))
+	f.Add(append(progress, 0xc6, 0xff, 0xff, 0xff, 0xff))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := NewClientFromConn(fuzzConn{bytes.NewReader(data)}, WithClientMaxMessageSize(1<<20))
+		var out string
+		c.Call("", "Lag", "Echo", "hello", &out)
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerMaxMessageSize(1024))
+	var arith Arith
+	s.Register(&arith)
+	s.Register(&Blob{})
+	c := NewClient(h2, "rpc", WithHandshake())
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := c.PeerFeatures(h1.ID())
+	if !ok || f.Version != ProtocolVersion || !f.Pipelining || !f.SupportsCodec("json") || f.MaxMessageSize != 1024 {
+		t.Fatalf("unexpected features: %+v", f)
+	}
+	if f, ok := s.PeerFeatures(h2.ID()); !ok || f.Version != ProtocolVersion || f.MaxMessageSize != DefaultMaxMessageSize {
+		t.Errorf("unexpected client features: %+v", f)
+	}
+
+	var out Raw
+	err := c.Call(h1.ID(), "Blob", "Reverse", Raw(make([]byte, 2000)), &out)
+	if !IsClientError(err) {
+		t.Error("expected a client error sending arguments over the limit of the peer:", err)
+	}
+
+	// Simulate a peer which predates the handshake.
+	h1.RemoveStreamHandler(HandshakeProtocol("rpc"))
+	c2 := NewClient(h2, "rpc", WithHandshake(), WithPipelining())
+	err = c2.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r, WithCodec(JSONCodec))
+	if err != nil || r != 8 {
+		t.Fatal("unexpected result:", r, err)
+	}
+	if f, ok := c2.PeerFeatures(h1.ID()); !ok || f.Version != 0 {
+		t.Errorf("unexpected features: %+v", f)
+	}
+	if len(c2.pipelines) != 0 {
+		t.Error("pipelining should not be used with legacy peers")
+	}
+	events := make(chan struct{})
+	_, err = c2.Subscribe(context.Background(), h1.ID(), "Arith", "Multiply", &Args{}, events)
+	if !IsClientError(err) {
+		t.Error("expected a client error subscribing with a legacy peer:", err)
+	}
+}
+
+func TestLatencyRanking(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	c := NewClient(h2, "rpc", WithLatencyRanking())
+	rtt, err := c.Ping(context.Background(), h1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || h2.Peerstore().LatencyEWMA(h1.ID()) <= 0 {
+		t.Error("latency was not recorded:", rtt)
+	}
+
+	slow := test.RandPeerIDFatal(t)
+	h2.Peerstore().RecordLatency(slow, time.Hour)
+	unknown := test.RandPeerIDFatal(t)
+	ranked := c.RankPeers([]peer.ID{unknown, slow, h1.ID(), h2.ID()})
+	expected := []peer.ID{h2.ID(), h1.ID(), slow, unknown}
+	for i := range expected {
+		if ranked[i] != expected[i] {
+			t.Fatal("unexpected ranking:", ranked)
+		}
+	}
+
+	// Unknown peers are not dialed without connections.
+	nc := NewClient(h2, "rpc", WithConnectedOnly())
+	if _, err := nc.Ping(context.Background(), unknown); err != ErrNotConnected {
+		t.Error("expected ErrNotConnected:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The peerstore averages the latencies.
+	h1.Peerstore().RecordLatency(h2.ID(), time.Hour)
+	NewClient(h1, "rpc").ProbeLatencies(ctx, 50*time.Millisecond, h2.ID())
+	time.Sleep(200 * time.Millisecond)
+	if l := h1.Peerstore().LatencyEWMA(h2.ID()); l > 55*time.Minute {
+		t.Error("latency was not refreshed:", l)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Lag{delay: 5 * time.Second})
+	c := NewClient(h2, "rpc")
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Lag{delay: 5 * time.Second})
+	lc := NewClientWithServer(h2, "rpc", s2)
+
+	for _, call := range []*Call{
+		c.Start(context.Background(), h1.ID(), "Lag", "Echo", "a", new(string)),
+		lc.Start(context.Background(), h2.ID(), "Lag", "Echo", "a", new(string)),
+	} {
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-call.Finished():
+			t.Fatal("call finished early:", call.Error)
+		default:
+		}
+		call.Cancel()
+		select {
+		case <-call.Finished():
+		case <-time.After(time.Second):
+			t.Fatal("call was not cancelled")
+		}
+		if err := call.Wait(); !errors.Is(err, context.Canceled) {
+			t.Error("expected a cancellation error:", err)
+		}
+		if <-call.Done != call {
+			t.Error("call was not sent on its done channel")
+		}
+	}
+
+	s.Register(&Arith{})
+	var r int
+	call := c.Start(context.Background(), h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err := call.Wait(); err != nil || r != 6 {
+		t.Error("unexpected result:", r, err)
+	}
+	call.Cancel()
+	if call.Error != nil {
+		t.Error("cancelling a finished call changed its error:", call.Error)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerCompression(100), WithServerMaxMessageSize(5000))
+	s.Register(&Lag{})
+	s.Register(&Blob{})
+	c := NewClient(h2, "rpc", WithClientCompression(100), WithHandshake())
+
+	long := strings.Repeat("a", 2000)
+	var out string
+	var info CallInfo
+	if err := c.Call(h1.ID(), "Lag", "Echo", long, &out, WithCallInfo(&info)); err != nil || out != long {
+		t.Fatal("unexpected reply:", len(out), err)
+	}
+	if info.BytesSent >= 1000 || info.BytesReceived >= 1000 {
+		t.Error("the call was not compressed:", info.BytesSent, info.BytesReceived)
+	}
+	if err := c.Call(h1.ID(), "Lag", "Echo", "a", &out, WithCallInfo(&info)); err != nil || out != "a" {
+		t.Fatal("unexpected reply:", out, err)
+	}
+	var rawOut Raw
+	raw := Raw(bytes.Repeat([]byte("ab"), 1000))
+	if err := c.Call(h1.ID(), "Blob", "Reverse", raw, &rawOut, WithCodec(JSONCodec)); err != nil || !bytes.Equal(rawOut, bytes.Repeat([]byte("ba"), 1000)) {
+		t.Fatal("unexpected raw reply:", len(rawOut), err)
+	}
+
+	// Decompressed arguments are limited too.
+	if err := c.Call(h1.ID(), "Lag", "Echo", strings.Repeat("a", 10000), &out); err == nil {
+		t.Error("expected an error decompressing arguments over the limit")
+	}
+
+	// Replies are not compressed for clients not accepting them.
+	plain := NewClient(h2, "rpc")
+	if err := plain.Call(h1.ID(), "Lag", "Echo", long, &out, WithCallInfo(&info)); err != nil || out != long {
+		t.Fatal("unexpected reply:", len(out), err)
+	}
+	if info.BytesReceived < 2000 {
+		t.Error("the reply was compressed:", info.BytesReceived)
+	}
+}
+
+func TestShardedClient(t *testing.T) {
+	peers := make([]peer.ID, 5)
+	for i := range peers {
+		peers[i] = test.RandPeerIDFatal(t)
+	}
+	sc := NewShardedClient(nil, peers)
+
+	owners := make(map[string]peer.ID)
+	counts := make(map[peer.ID]int)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		p, ok := sc.PeerFor(key)
+		if !ok {
+			t.Fatal("expected an owner for", key)
+		}
+		owners[key] = p
+		counts[p]++
+		replicas := sc.PeersFor(key, 3)
+		if len(replicas) != 3 || replicas[0] != p || replicas[1] == replicas[2] || replicas[1] == p || replicas[2] == p {
+			t.Fatal("unexpected replicas:", replicas)
+		}
+	}
+	for _, p := range peers {
+		if counts[p] < 100 {
+			t.Errorf("peer %s owns %d keys out of 1000", p, counts[p])
+		}
+	}
+
+	// Only the keys of the removed peer move, and they come back
+	// with it.
+	sc.RemovePeer(peers[0])
+	for key, owner := range owners {
+		p, _ := sc.PeerFor(key)
+		if (owner == peers[0]) == (p == owner) {
+			t.Fatal("unexpected owner after removing a peer:", key, owner, p)
+		}
+	}
+	sc.AddPeer(peers[0])
+	for key, owner := range owners {
+		if p, _ := sc.PeerFor(key); p != owner {
+			t.Fatal("unexpected owner after adding a peer:", key, owner, p)
+		}
+	}
+	if len(sc.PeersFor("key", 10)) != 5 || len(sc.Peers()) != 5 {
+		t.Error("expected 5 peers")
+	}
+
+	// Calls go to the owner of the key.
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+	for _, h := range []host.Host{h1, h2} {
+		id := h.ID()
+		s := NewServer(h, "rpc")
+		s.RegisterFunc("Shard", "Owner", func(ctx context.Context, key string, r *peer.ID) error {
+			*r = id
+			return nil
+		})
+		if h == h2 {
+			sc = NewShardedClient(NewClientWithServer(h2, "rpc", s), []peer.ID{h1.ID(), h2.ID()}, WithShardReplicas(16))
+		}
+	}
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		var r peer.ID
+		if err := sc.Call(key, "Shard", "Owner", key, &r); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := sc.PeerFor(key); r != p {
+			t.Error("call not routed to the owner of", key)
+		}
+	}
+	sc.SetPeers(nil)
+	if err := sc.Call("key", "Shard", "Owner", "key", new(peer.ID)); !IsClientError(err) {
+		t.Error("expected a client error without peers:", err)
+	}
+}
+
+func TestMaxInFlightPerPeer(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	unblock := make(chan struct{})
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Gate", "Pass", func(ctx context.Context, n int, r *int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-unblock
+		mu.Lock()
+		running--
+		mu.Unlock()
+		*r = n
+		return nil
+	})
+
+	c := NewClient(h2, "rpc", WithMaxInFlightPerPeer(2))
+	done := make(chan *Call, 6)
+	for i := 0; i < 6; i++ {
+		if err := c.Go(h1.ID(), "Gate", "Pass", i, new(int), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Calls waiting for their turn give up with their context.
+	time.Sleep(200 * time.Millisecond)
+	err := c.Call(h1.ID(), "Gate", "Pass", 0, new(int), WithTimeout(50*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", err)
+	}
+
+	close(unblock)
+	for i := 0; i < 6; i++ {
+		if call := <-done; call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+	if maxRunning != 2 {
+		t.Error("expected 2 calls running at most, got", maxRunning)
+	}
+	if len(c.inFlight.queues) != 0 {
+		t.Error("expected the queues to be removed")
+	}
+}
+
+func TestBuffersAndFlushDelay(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	const delay = 50 * time.Millisecond
+	s := NewServer(h1, "rpc", WithServerBufferSizes(64<<10, 64<<10), WithServerFlushDelay(delay))
+	s.Register(&Blob{})
+	s.Register(&Arith{})
+	c := NewClient(h2, "rpc", WithPipelining(), WithClientBufferSizes(64<<10, 64<<10), WithClientFlushDelay(delay))
+
+	// Streams get the configured buffers, and the default ones
+	// otherwise.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	sw := c.wrap(local, MsgpackCodec)
+	if sw.r.Size() != 64<<10 || sw.w.Size() != 64<<10 {
+		t.Error("unexpected buffer sizes:", sw.r.Size(), sw.w.Size())
+	}
+	sw.release()
+	sw = NewClient(h2, "rpc").wrap(local, MsgpackCodec)
+	if sw.r.Size() != defaultBufferSize || sw.w.Size() != defaultBufferSize {
+		t.Error("unexpected buffer sizes:", sw.r.Size(), sw.w.Size())
+	}
+	sw.release()
+
+	// Requests and responses sent together are coalesced, and wait
+	// for the delay.
+	start := time.Now()
+	done := make(chan *Call, 10)
+	for i := 0; i < 10; i++ {
+		if err := c.Go(h1.ID(), "Arith", "Add", Args{i, 1}, new(int), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		call := <-done
+		if call.Error != nil || *call.Reply.(*int) != call.Args.(Args).A+1 {
+			t.Error("unexpected result:", call.Reply, call.Error)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Error("calls did not wait for the flush delay:", elapsed)
+	}
+
+	in := make(Raw, 1<<20)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	var out Raw
+	if err := c.Call(h1.ID(), "Blob", "Reverse", in, &out); err != nil || len(out) != len(in) || out[0] != in[len(in)-1] {
+		t.Error("unexpected result:", len(out), err)
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Timer", "Sleep", func(ctx context.Context, d time.Duration, r *struct{}) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	})
+	c := NewClient(h2, "rpc")
+
+	if _, ok := c.Latencies(h1.ID(), "Timer", "Sleep"); ok {
+		t.Error("expected no latencies before calling")
+	}
+
+	// The fallback timeout is used until enough calls are observed.
+	opt := WithAdaptiveTimeout(0.99, 3, time.Second)
+	for i := 0; i < minLatencySamples; i++ {
+		if err := c.Call(h1.ID(), "Timer", "Sleep", 20*time.Millisecond, &struct{}{}, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, ok := c.Latencies(h1.ID(), "Timer", "Sleep")
+	if !ok || st.Samples != minLatencySamples || st.P50Latency < 20*time.Millisecond || st.P99Latency < st.P50Latency {
+		t.Fatal("unexpected latencies:", st, ok)
+	}
+
+	// Calls taking much longer than usual time out.
+	if err := c.Call(h1.ID(), "Timer", "Sleep", 20*time.Millisecond, &struct{}{}, opt); err != nil {
+		t.Error(err)
+	}
+	err := c.Call(h1.ID(), "Timer", "Sleep", 10*st.P99Latency, &struct{}{}, opt)
+	if err != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", err)
+	}
+
+	// Latencies are kept by peer.
+	if _, ok := c.Latencies(h2.ID(), "Timer", "Sleep"); ok {
+		t.Error("expected no latencies for another peer")
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	dir := t.TempDir()
+	s := NewServer(h1, "rpc")
+	if err := s.ReceiveFile("Files", DirStore(dir)); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(h2, "rpc")
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	var sent []int64
+	progress := WithFileProgress(func(n, total int64) {
+		if total != int64(len(data)) {
+			t.Error("unexpected total size:", total)
+		}
+		sent = append(sent, n)
+	})
+	err := c.SendFile(context.Background(), h1.ID(), "Files", "a", bytes.NewReader(data), WithChunkSize(30000), progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[0 30000 60000 90000 100000]" {
+		t.Error("unexpected progress:", sent)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "a")); err != nil || !bytes.Equal(b, data) {
+		t.Error("the file was not received:", err)
+	}
+
+	// Transfers resume from the partial file.
+	if err := os.WriteFile(filepath.Join(dir, "b.part"), data[:40000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	sent = nil
+	err = c.SendFile(context.Background(), h1.ID(), "Files", "b", bytes.NewReader(data), WithChunkSize(30000), progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[40000 70000 100000]" {
+		t.Error("unexpected progress:", sent)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "b")); err != nil || !bytes.Equal(b, data) {
+		t.Error("the file was not received:", err)
+	}
+
+	// Partial files not matching the file are removed.
+	if err := os.WriteFile(filepath.Join(dir, "c.part"), make([]byte, 40000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendFile(context.Background(), h1.ID(), "Files", "c", bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatal("expected a checksum error:", err)
+	}
+	err = c.SendFile(context.Background(), h1.ID(), "Files", "c", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "c")); err != nil || !bytes.Equal(b, data) {
+		t.Error("the file was not received:", err)
+	}
+
+	err = c.SendFile(context.Background(), h1.ID(), "Files", "../d", bytes.NewReader(data))
+	if err == nil {
+		t.Error("expected an error for a path")
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	// The peer reads the request but never answers.
+	h1.SetStreamHandler("stall", func(s network.Stream) {
+		io.Copy(io.Discard, s)
+	})
+	s, err := h2.NewStream(context.Background(), h1.ID(), "stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	call := newCall(ctx, h1.ID(), "Svc", "Method", struct{}{}, &struct{}{}, make(chan *Call, 1))
+	call.logger = clientLogger
+	// The context is not watched, so that only the deadline of the
+	// stream makes reads fail.
+	stop := make(chan struct{})
+	close(stop)
+	call.watchStream(s, stop)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("expected a read error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the read did not time out")
+	}
+	if call.contextError() != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", call.contextError())
+	}
+}
+
+func TestPendingCalls(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Timer", "Wait", func(ctx context.Context, in struct{}, out *struct{}) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	c := NewClient(h2, "rpc")
+	if calls := c.PendingCalls(); len(calls) != 0 {
+		t.Fatal("expected no pending calls:", calls)
+	}
+
+	done := make(chan *Call, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := c.GoContext(ctx, h1.ID(), "Timer", "Wait", struct{}{}, &struct{}{}, done); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	calls := c.PendingCalls()
+	if len(calls) != 1 {
+		t.Fatal("expected a pending call:", calls)
+	}
+	pc := calls[0]
+	deadline, _ := ctx.Deadline()
+	if pc.Dest != h1.ID() || pc.Service != "Timer" || pc.Method != "Wait" || !pc.Deadline.Equal(deadline) || pc.Elapsed() <= 0 {
+		t.Error("unexpected pending call:", pc)
+	}
+
+	pc.Cancel()
+	select {
+	case call := <-done:
+		if call.Error != context.Canceled {
+			t.Error("expected a cancellation error:", call.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the call was not cancelled")
+	}
+	if calls := c.PendingCalls(); len(calls) != 0 {
+		t.Error("expected no pending calls:", calls)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Timer", "Sleep", func(ctx context.Context, d time.Duration, r *struct{}) error {
+		time.Sleep(d)
+		return nil
+	})
+	s.RegisterFunc("Timer", "Wait", func(ctx context.Context, in struct{}, out *struct{}) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// Calls in progress are waited for.
+	c := NewClient(h2, "rpc", WithPipelining())
+	done := make(chan *Call, 1)
+	if err := c.Go(h1.ID(), "Timer", "Sleep", 200*time.Millisecond, &struct{}{}, done); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-done:
+		if call.Error != nil {
+			t.Error(call.Error)
+		}
+	default:
+		t.Error("Close returned before the call finished")
+	}
+	err := c.Call(h1.ID(), "Timer", "Sleep", time.Millisecond, &struct{}{})
+	if err != ErrClientClosed {
+		t.Error("expected ErrClientClosed:", err)
+	}
+	if len(c.pipelines) != 0 {
+		t.Error("expected the pipelines to be closed")
+	}
+
+	// Calls still in progress when the context is done are cancelled.
+	c = NewClient(h2, "rpc")
+	if err := c.Go(h1.ID(), "Timer", "Wait", struct{}{}, &struct{}{}, done); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Close(ctx); err != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", err)
+	}
+	select {
+	case call := <-done:
+		if call.Error != context.Canceled {
+			t.Error("expected the call to be cancelled:", call.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the call was not cancelled")
+	}
+
+	// Subscriptions are ended, and new batches and subscriptions
+	// fail.
+	s.Register(&Feed{})
+	for _, c := range []*Client{NewClient(h2, "rpc"), NewClientWithServer(h1, "rpc", s)} {
+		events := make(chan string)
+		sub, err := c.Subscribe(context.Background(), h1.ID(), "Feed", "Events", "a", events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-events:
+		default:
+			t.Fatal("Close returned before the subscription ended")
+		}
+		if err := sub.Err(); err != ErrClientClosed {
+			t.Error("expected ErrClientClosed:", err)
+		}
+		if len(c.PendingCalls()) != 0 {
+			t.Error("unexpected pending calls:", c.PendingCalls())
+		}
+
+		_, err = c.Subscribe(context.Background(), h1.ID(), "Feed", "Events", "a", make(chan string))
+		if err != ErrClientClosed {
+			t.Error("expected ErrClientClosed:", err)
+		}
+		res := c.Batch(context.Background(), h1.ID(), []Request{
+			{"Timer", "Sleep", time.Millisecond, &struct{}{}},
+			{"Timer", "Sleep", time.Millisecond, &struct{}{}},
+		})
+		if res[0].Error != ErrClientClosed || res[1].Error != ErrClientClosed {
+			t.Error("expected ErrClientClosed:", res)
+		}
+	}
+}
+
+type ListArgs struct {
+	Limit     int
+	PageToken string
+}
+
+type ListReply struct {
+	Items         []int
+	NextPageToken string
+}
+
+func TestPages(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Numbers", "List", func(ctx context.Context, args ListArgs, reply *ListReply) error {
+		start, _ := strconv.Atoi(args.PageToken)
+		for i := start; i < 10 && i < start+args.Limit; i++ {
+			reply.Items = append(reply.Items, i)
+		}
+		if start+args.Limit < 10 {
+			reply.NextPageToken = strconv.Itoa(start + args.Limit)
+		}
+		return nil
+	})
+	s.RegisterFunc("Numbers", "Stuck", func(ctx context.Context, args *ListArgs, reply *ListReply) error {
+		reply.NextPageToken = "again"
+		return nil
+	})
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	args := ListArgs{Limit: 4}
+	pages := NewPages[ListArgs, ListReply](ctx, c, h1.ID(), "Numbers", "List", args)
+	var items []int
+	n := 0
+	for pages.Next() {
+		items = append(items, pages.Page().Items...)
+		n++
+	}
+	if err := pages.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(items) != 10 || items[9] != 9 || pages.Token() != "" || args.PageToken != "" {
+		t.Error("unexpected pages:", n, items, pages.Token())
+	}
+
+	pages = NewPages[ListArgs, ListReply](ctx, c, h1.ID(), "Numbers", "List", ListArgs{Limit: 5, PageToken: "8"})
+	if !pages.Next() || len(pages.Page().Items) != 2 || pages.Next() {
+		t.Error("expected a single page from the token:", pages.Page(), pages.Err())
+	}
+
+	stuck := NewPages[*ListArgs, ListReply](ctx, c, h1.ID(), "Numbers", "Stuck", &ListArgs{PageToken: "again"})
+	if stuck.Next() || stuck.Err() == nil {
+		t.Error("expected an error when the token does not change")
+	}
+	bad := NewPages[Args, ListReply](ctx, c, h1.ID(), "Numbers", "List", Args{})
+	if bad.Next() || bad.Err() == nil {
+		t.Error("expected an error without a page token")
+	}
+}
+
+func TestReplyChunking(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerCodec("rpc/json", JSONCodec), WithServerProtocols("rpc/json"))
+	s.RegisterFunc("Blob", "Make", func(ctx context.Context, n int, r *[]byte) error {
+		*r = make([]byte, n)
+		for i := range *r {
+			(*r)[i] = byte(i)
+		}
+		return nil
+	})
+	s.RegisterFunc("Blob", "MakeRaw", func(ctx context.Context, n int, r *Raw) error {
+		*r = bytes.Repeat([]byte{7}, n)
+		return nil
+	})
+
+	for _, proto := range []protocol.ID{"rpc", "rpc/json"} {
+		c := NewClient(h2, proto, WithClientCodec("rpc/json", JSONCodec), WithClientMaxMessageSize(4096), WithReplyChunking(64<<10))
+		var r []byte
+		if err := c.Call(h1.ID(), "Blob", "Make", 20000, &r); err != nil {
+			t.Fatal(proto, err)
+		}
+		if len(r) != 20000 || r[19999] != byte(19999%256) {
+			t.Error("unexpected reply:", len(r))
+		}
+		var raw Raw
+		if err := c.Call(h1.ID(), "Blob", "MakeRaw", 10000, &raw); err != nil || len(raw) != 10000 || raw[9999] != 7 {
+			t.Error("unexpected raw reply:", len(raw), err)
+		}
+		// Small replies are sent as usual.
+		if err := c.Call(h1.ID(), "Blob", "Make", 10, &r); err != nil || len(r) != 10 {
+			t.Error("unexpected reply:", len(r), err)
+		}
+		if err := c.Call(h1.ID(), "Blob", "Make", 100000, &r); err == nil || !strings.Contains(err.Error(), "chunked reply larger than") {
+			t.Error("expected the reply to exceed the limit:", err)
+		}
+	}
+
+	c := NewClient(h2, "rpc", WithClientMaxMessageSize(4096))
+	var r []byte
+	if err := c.Call(h1.ID(), "Blob", "Make", 20000, &r); err == nil {
+		t.Error("expected the reply to exceed the maximum message size")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+	c := NewClient(h2, "rpc")
+
+	var r int
+	start := time.Now()
+	done := make(chan *Call, 1)
+	sc, err := c.Schedule(context.Background(), start.Add(100*time.Millisecond), h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Call() != nil {
+		t.Error("the call should not be made yet")
+	}
+	call := <-done
+	if call.Error != nil || r != 6 {
+		t.Fatal("unexpected result:", r, call.Error)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Error("the call was made too early:", d)
+	}
+	if sc.Call() != call {
+		t.Error("expected the call of the scheduled call")
+	}
+
+	sc, _ = c.After(context.Background(), time.Hour, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, done)
+	sc.Cancel()
+	sc.Cancel()
+	if call := <-done; call.Error != context.Canceled {
+		t.Error("expected the call to be cancelled:", call.Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.After(ctx, time.Hour, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, done)
+	cancel()
+	if call := <-done; call.Error != context.Canceled {
+		t.Error("expected the call to fail with the context:", call.Error)
+	}
+
+	// Calls in the past are made right away.
+	c.Schedule(context.Background(), start, h1.ID(), "Arith", "Multiply", &Args{3, 3}, &r, done)
+	if call := <-done; call.Error != nil || r != 9 {
+		t.Error("unexpected result:", r, call.Error)
+	}
+
+	if _, err := c.After(context.Background(), 0, h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, make(chan *Call)); err == nil {
+		t.Error("expected an error with an unbuffered channel")
+	}
+}
+
+func TestEvery(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var n int32
+	s.RegisterFunc("Counter", "Next", func(ctx context.Context, in struct{}, out *int) error {
+		*out = int(atomic.AddInt32(&n, 1))
+		if *out == 4 {
+			return errors.New("fourth call")
+		}
+		return nil
+	})
+	c := NewClient(h2, "rpc")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := c.Every(ctx, 20*time.Millisecond, 10*time.Millisecond, h1.ID(), Request{
+		Service: "Counter",
+		Method:  "Next",
+		Args:    struct{}{},
+		Reply:   new(int),
+	})
+	for p.Calls() < 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	res, at := p.Latest()
+	if res.Error != nil || *res.Reply.(*int) != 1 || at.IsZero() {
+		t.Fatal("unexpected result of the first call:", res, at)
+	}
+
+	for p.Calls() < 4 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if res, _ := p.Latest(); res.Error == nil || p.Failures() != 1 {
+		t.Error("expected the fourth call to fail:", res, p.Failures())
+	}
+	for p.Calls() < 5 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if res, _ := p.Latest(); res.Error != nil || *res.Reply.(*int) != 5 || p.Failures() != 0 {
+		t.Error("expected the fifth call to succeed:", res, p.Failures())
+	}
+
+	cancel()
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the calls did not stop")
+	}
+	calls := p.Calls()
+	time.Sleep(50 * time.Millisecond)
+	if p.Calls() != calls {
+		t.Error("calls were made after stopping")
+	}
+}
+
+func TestServiceProtocols(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerServiceProtocols())
+	var arith Arith
+	s.Register(&arith)
+
+	c := NewClient(h2, "rpc", WithClientServiceProtocols())
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+	if p := c.PeerProtocol(h1.ID()); p != ServiceProtocol("rpc", "Arith") {
+		t.Error("unexpected protocol:", p)
+	}
+
+	// The service protocol cannot be used for other services.
+	var counter Counter
+	s.Register(&counter)
+	c2 := NewClient(h2, ServiceProtocol("rpc", "Arith"))
+	err = c2.Call(h1.ID(), "Counter", "Incr", 1, &r)
+	if !IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+}
+
+func TestReverseCall(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	// h2 offers the Arith service to h1 through a reverse session.
+	s := NewServer(h1, "rpc")
+	s2 := NewServer(nil, "")
+	var arith Arith
+	s2.Register(&arith)
+	c := NewClientWithServer(h2, "rpc", s2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- c.ServeReverse(ctx, h1.ID())
+	}()
+
+	for i := 0; len(s.ReversePeers()) == 0; i++ {
+		if i > 100 {
+			t.Fatal("reverse session was not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var r int
+	for i := 0; i < 3; i++ {
+		err := s.CallReverse(context.Background(), h2.ID(), "Arith", "Multiply", &Args{2, i}, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != 2*i {
+			t.Error("result is:", r)
+		}
+	}
+
+	err := s.CallReverse(context.Background(), h2.ID(), "Arith", "GimmeError", &Args{1, 2}, &r)
+	if err == nil || err.Error() != "an error" {
+		t.Error("expected different error:", err)
+	}
+
+	err = s.CallReverse(context.Background(), h2.ID(), "Arith", "ThisIsNotAMethod", &Args{1, 2}, &r)
+	if !IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+
+	// the session is still usable after errors
+	err = s.CallReverse(context.Background(), h2.ID(), "Arith", "Add", Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 5 {
+		t.Error("result is:", r)
+	}
+
+	cancel()
+	if err := <-serveErr; err != context.Canceled {
+		t.Error("expected context cancellation:", err)
+	}
+
+	err = s.CallReverse(context.Background(), h2.ID(), "Arith", "Add", Args{2, 3}, &r)
+	if err == nil {
+		t.Error("expected an error after the session was closed")
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	s := NewServer(nil, "")
+	var arith Arith
+	s.Register(&arith)
+
+	cliConn, srvConn := net.Pipe()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ServeConn(context.Background(), srvConn)
+	}()
+
+	c := NewClientFromConn(cliConn)
+	var r int
+	for i := 0; i < 3; i++ {
+		err := c.Call("", "Arith", "Multiply", &Args{2, i}, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != 2*i {
+			t.Error("result is:", r)
+		}
+	}
+
+	var q Quotient
+	err := c.Call("", "Arith", "Divide", &Args{1, 0}, &q)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("expected different error:", err)
+	}
+
+	cliConn.Close()
+	if err := <-serveErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalDialer(t *testing.T) {
+	s := NewServer(nil, "")
+	var arith Arith
+	s.Register(&arith)
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cliConn, srvConn := net.Pipe()
+		go s.ServeConn(context.Background(), srvConn)
+		mu.Lock()
+		conns = append(conns, srvConn)
+		mu.Unlock()
+		return cliConn, nil
+	}
+
+	var r int
+	c := NewClient(nil, "")
+	if err := c.Call("", "Arith", "Multiply", &Args{2, 3}, &r); !IsClientError(err) {
+		t.Fatal("expected a client error without a local server:", err)
+	}
+
+	c = NewClient(nil, "", WithLocalDialer(dial))
+	for i := 0; i < 3; i++ {
+		if err := c.Call("", "Arith", "Multiply", &Args{2, i}, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r != 2*i {
+			t.Error("result is:", r)
+		}
+	}
+	if len(conns) != 1 {
+		t.Fatal("expected the connection to be reused:", len(conns))
+	}
+
+	// The connection is dialed again once it fails.
+	conns[0].Close()
+	if err := c.Call("", "Arith", "Multiply", &Args{2, 3}, &r); err == nil {
+		t.Error("expected an error")
+	}
+	if err := c.Call("", "Arith", "Multiply", &Args{2, 4}, &r); err != nil || r != 8 {
+		t.Fatal("unexpected result:", r, err)
+	}
+	if len(conns) != 2 {
+		t.Error("expected a new connection:", len(conns))
+	}
+}
+
+func TestClientKeepalive(t *testing.T) {
+	s := NewServer(nil, "")
+	var arith Arith
+	s.Register(&arith)
+
+	cliConn, srvConn := net.Pipe()
+	go s.ServeConn(context.Background(), srvConn)
+
+	c := NewClientFromConn(cliConn, WithClientKeepalive(20*time.Millisecond, 100*time.Millisecond))
+	defer cliConn.Close()
+	time.Sleep(200 * time.Millisecond)
+	c.conn.mu.Lock()
+	idle := time.Since(c.conn.lastUsed)
+	c.conn.mu.Unlock()
+	if idle > 100*time.Millisecond {
+		t.Error("no keepalive pings were answered")
+	}
+
+	var r int
+	if err := c.Call("", "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	// Nobody answers on the other side.
+	deadConn, _ := net.Pipe()
+	c = NewClientFromConn(deadConn, WithClientKeepalive(20*time.Millisecond, 50*time.Millisecond))
+	deadline := time.Now().Add(2 * time.Second)
+	for !c.conn.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("dead session was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := c.Call("", "Arith", "Multiply", &Args{2, 3}, &r)
+	if !IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+}
+
+// mockRegistry is an in-memory discovery mechanism.
+type mockRegistry struct {
+	mu    sync.Mutex
+	peers map[string][]peer.AddrInfo
+}
+
+func (r *mockRegistry) add(ns string, pi peer.AddrInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string][]peer.AddrInfo)
+	}
+	r.peers[ns] = append(r.peers[ns], pi)
+}
+
+// mockDiscovery advertises the given host in a mockRegistry.
+type mockDiscovery struct {
+	r *mockRegistry
+	h host.Host
+}
+
+func (d *mockDiscovery) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	d.r.add(ns, peer.AddrInfo{ID: d.h.ID(), Addrs: d.h.Addrs()})
+	return time.Hour, nil
+}
+
+func (d *mockDiscovery) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	d.r.mu.Lock()
+	defer d.r.mu.Unlock()
+	ch := make(chan peer.AddrInfo, len(d.r.peers[ns]))
+	for _, pi := range d.r.peers[ns] {
+		ch <- pi
+	}
+	close(ch)
+	return ch, nil
+}
+
+func TestCallService(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var registry mockRegistry
+	// A peer which cannot be dialed is found first.
+	unknown, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.add(ServiceNamespace("rpc", "Counter"), peer.AddrInfo{ID: unknown})
+
+	s := NewServer(h1, "rpc")
+	var counter Counter
+	s.Register(&counter)
+	s.Register(&Counter{}, WithVersion("v2"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = s.Advertise(ctx, &mockDiscovery{&registry, h1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Versions are advertised under the name of the service.
+	if n := len(registry.peers); n != 1 {
+		t.Error("unexpected namespaces:", n)
+	}
+	if n := len(registry.peers[ServiceNamespace("rpc", "Counter")]); n != 2 {
+		t.Error("service advertised more than once:", n)
+	}
+
+	c := NewClient(h2, "rpc", WithDiscovery(&mockDiscovery{&registry, h2}))
+	var r int
+	err = c.CallService(ctx, "Counter", "Incr", 2, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 2 {
+		t.Error("result is:", r)
+	}
+
+	err = c.CallService(ctx, "Arith", "Multiply", &Args{2, 3}, &r)
+	if !IsClientError(err) {
+		t.Error("expected a client error when no peers are found:", err)
+	}
+}
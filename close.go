@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrClientClosed is the client error returned by the calls made with a
+// Client after it has been closed (see Client.Close).
+var ErrClientClosed error = &clientError{"rpc: client is closed"}
+
+// Close closes the Client: new calls, batches and subscriptions fail with
+// ErrClientClosed right away, while the calls in progress are given until
+// the given context is done to finish, after which they are cancelled and
+// the error of the context is returned. A context which is done already
+// cancels them right away. Active subscriptions end right away with
+// ErrClientClosed (see Subscription.Err), and are waited for. The
+// pipelined streams and the sessions of the Client (see WithPipelining,
+// NewClientFromConn and WithLocalDialer) are then closed. Closing a
+// Client does not close its host or its Server. Close can be called
+// several times.
+func (c *Client) Close(ctx context.Context) error {
+	drained := c.pending.close()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		c.pending.cancel()
+		err = ctx.Err()
+	}
+
+	c.pipelinesMu.Lock()
+	pipelines := c.pipelines
+	if pipelines != nil {
+		c.pipelines = make(map[peer.ID]*pipeline)
+	}
+	c.pipelinesMu.Unlock()
+	for _, p := range pipelines {
+		select {
+		case <-p.ready:
+			closePipeline(p)
+		default:
+			go closePipeline(p)
+		}
+	}
+	if c.conn != nil {
+		c.conn.close()
+	}
+	if lb := c.loopback; lb != nil {
+		lb.mu.Lock()
+		if lb.sc != nil {
+			lb.sc.close()
+		}
+		lb.mu.Unlock()
+	}
+	return err
+}
+
+// closePipeline makes a pipeline fail once it is open.
+func closePipeline(p *pipeline) {
+	<-p.ready
+	if p.getError() == nil {
+		p.fail(ErrClientClosed)
+	}
+}
@@ -0,0 +1,171 @@
+// The gorpc-cli command calls the methods of a go-libp2p-gorpc server from
+// the command line, for debugging.
+//
+// It connects to the peer at the given multiaddress, which must include its
+// peer ID, and either lists its services, when the server registers the
+// reflection service (see rpc.WithReflection), or calls a method with the
+// arguments given as JSON and prints the reply as JSON:
+//
+//	gorpc-cli -protocol /p2p/rpc/ping /ip4/127.0.0.1/tcp/9000/p2p/Qm... list
+//	gorpc-cli -protocol /p2p/rpc/ping /ip4/127.0.0.1/tcp/9000/p2p/Qm... call PingService.Ping '{"Data": "hello"}'
+//
+// Arguments are sent as generic values, so JSON objects must use the field
+// names of the argument types. Byte slices are given as strings, and printed
+// as strings too when they hold valid UTF-8.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+	"github.com/libp2p/go-libp2p-gorpc/internal/jsonargs"
+
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+const usage = `Usage:
+	gorpc-cli [flags] <multiaddr> list
+	gorpc-cli [flags] <multiaddr> call <Service.Method> [<json args>]
+
+Flags:
+`
+
+func main() {
+	var proto string
+	var timeout time.Duration
+	flag.StringVar(&proto, "protocol", "", "protocol of the rpc server")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "timeout of the command")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if proto == "" || flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, dest, err := connect(ctx, flag.Arg(0), protocol.ID(proto))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cmd := flag.Arg(1); cmd {
+	case "list":
+		err = list(ctx, os.Stdout, client, dest)
+	case "call":
+		if flag.NArg() < 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		args := "null"
+		if flag.NArg() > 3 {
+			args = flag.Arg(3)
+		}
+		err = call(ctx, os.Stdout, client, dest, flag.Arg(2), args)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connect creates a host without listen addresses, connects it to the peer
+// at the given address and returns a client for the given protocol.
+func connect(ctx context.Context, addr string, p protocol.ID) (*rpc.Client, peer.ID, error) {
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, "", err
+	}
+	h, err := libp2p.New(ctx, libp2p.NoListenAddrs)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return nil, "", fmt.Errorf("connecting to %s: %w", info.ID, err)
+	}
+	return rpc.NewClient(h, p), info.ID, nil
+}
+
+// list prints the services of the peer, obtained from its reflection
+// service.
+func list(ctx context.Context, w io.Writer, client *rpc.Client, dest peer.ID) error {
+	var descs []rpc.ServiceDescription
+	err := client.CallContext(ctx, dest, rpc.ReflectionService, "Describe", struct{}{}, &descs)
+	if err != nil {
+		return err
+	}
+	for _, svc := range descs {
+		fmt.Fprint(w, svc.Name)
+		if svc.Version != "" {
+			fmt.Fprint(w, "@", svc.Version)
+		}
+		if svc.Description != "" {
+			fmt.Fprint(w, ": ", svc.Description)
+		}
+		fmt.Fprintln(w)
+		for _, m := range svc.Methods {
+			reply := m.ReplyType
+			if reply == "" {
+				reply = "async"
+			}
+			fmt.Fprintf(w, "\t%s(%s) %s\n", m.Name, m.ArgType, reply)
+			if m.Description != "" {
+				fmt.Fprintf(w, "\t\t%s\n", m.Description)
+			}
+		}
+	}
+	return nil
+}
+
+// call calls the given method with the given JSON arguments and prints the
+// reply as indented JSON.
+func call(ctx context.Context, w io.Writer, client *rpc.Client, dest peer.ID, method, jsonArgs string) error {
+	svcName, svcMethod, ok := strings.Cut(method, ".")
+	if !ok {
+		return errors.New("the method must be given as Service.Method")
+	}
+	args, err := parseArgs(jsonArgs)
+	if err != nil {
+		return fmt.Errorf("parsing the arguments: %w", err)
+	}
+	var reply interface{}
+	if err := client.CallContext(ctx, dest, svcName, svcMethod, args, &reply); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(jsonargs.ToJSON(reply), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding the reply: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// parseArgs decodes JSON arguments into generic values. Integers are
+// decoded as int64, so that they can be decoded into integer fields by the
+// server.
+func parseArgs(s string) (interface{}, error) {
+	return jsonargs.Decode(strings.NewReader(s))
+}
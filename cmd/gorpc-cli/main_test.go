@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+)
+
+type Args struct {
+	A, B int
+	Name string
+}
+
+type Reply struct {
+	Sum  int
+	Name string
+	Tags []string
+}
+
+type Adder struct{}
+
+func (Adder) Add(ctx context.Context, args Args, reply *Reply) error {
+	reply.Sum = args.A + args.B
+	reply.Name = args.Name
+	reply.Tags = []string{"a", "b"}
+	return nil
+}
+
+func TestListAndCall(t *testing.T) {
+	ctx := context.Background()
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s := rpc.NewServer(h, "/rpc/cli", rpc.WithReflection())
+	if err := s.Register(Adder{}); err != nil {
+		t.Fatal(err)
+	}
+	s.Document("Adder", rpc.ServiceDoc{Description: "Adds numbers."})
+
+	addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, dest, err := connect(ctx, addrs[0].String(), "/rpc/cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := list(ctx, &out, client, dest); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Adder: Adds numbers.\n\tAdd(main.Args) main.Reply\n") {
+		t.Error("unexpected list output:", out.String())
+	}
+
+	out.Reset()
+	err = call(ctx, &out, client, dest, "Adder.Add", `{"A": 1, "B": 2, "Name": "x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Reply
+	if err := json.Unmarshal(out.Bytes(), &reply); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if reply.Sum != 3 || reply.Name != "x" || len(reply.Tags) != 2 {
+		t.Error("unexpected reply:", out.String())
+	}
+
+	if err := call(ctx, &out, client, dest, "Adder", "null"); err == nil {
+		t.Error("expected an error for a malformed method")
+	}
+	if err := call(ctx, &out, client, dest, "Adder.Add", "{"); err == nil {
+		t.Error("expected an error for malformed arguments")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gogo/protobuf/proto"
+	descriptor "github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	plugin "github.com/gogo/protobuf/protoc-gen-gogo/plugin"
+)
+
+// goType identifies a Go type generated for a protobuf message.
+type goType struct {
+	importPath string
+	pkgName    string
+	name       string
+}
+
+// generator holds the state for generating the files in a request.
+type generator struct {
+	// types maps fully-qualified protobuf message names to Go types.
+	types map[string]goType
+}
+
+// generate processes a CodeGeneratorRequest and produces the response
+// with a .gorpc.go file for every requested file declaring services.
+func generate(req *plugin.CodeGeneratorRequest) *plugin.CodeGeneratorResponse {
+	g := &generator{types: make(map[string]goType)}
+	files := make(map[string]*descriptor.FileDescriptorProto)
+	for _, f := range req.GetProtoFile() {
+		files[f.GetName()] = f
+		g.addTypes(f)
+	}
+
+	resp := &plugin.CodeGeneratorResponse{}
+	for _, name := range req.GetFileToGenerate() {
+		f, ok := files[name]
+		if !ok {
+			resp.Error = proto.String("file not found in request: " + name)
+			return resp
+		}
+		if len(f.GetService()) == 0 {
+			continue
+		}
+		content, err := g.generateFile(f)
+		if err != nil {
+			resp.Error = proto.String(name + ": " + err.Error())
+			return resp
+		}
+		resp.File = append(resp.File, &plugin.CodeGeneratorResponse_File{
+			Name:    proto.String(outputName(f)),
+			Content: proto.String(content),
+		})
+	}
+	return resp
+}
+
+// addTypes registers the messages declared in a file.
+func (g *generator) addTypes(f *descriptor.FileDescriptorProto) {
+	importPath, pkgName := goPackage(f)
+	prefix := "."
+	if f.GetPackage() != "" {
+		prefix += f.GetPackage() + "."
+	}
+
+	var add func(msgs []*descriptor.DescriptorProto, protoPrefix, goPrefix string)
+	add = func(msgs []*descriptor.DescriptorProto, protoPrefix, goPrefix string) {
+		for _, m := range msgs {
+			name := goPrefix + camelCase(m.GetName())
+			g.types[protoPrefix+m.GetName()] = goType{
+				importPath: importPath,
+				pkgName:    pkgName,
+				name:       name,
+			}
+			add(m.GetNestedType(), protoPrefix+m.GetName()+".", name+"_")
+		}
+	}
+	add(f.GetMessageType(), prefix, "")
+}
+
+// generateFile renders the code for the services in a file.
+func (g *generator) generateFile(f *descriptor.FileDescriptorProto) (string, error) {
+	importPath, pkgName := goPackage(f)
+
+	var body bytes.Buffer
+	imports := make(map[string]string)
+	typeName := func(protoName string) (string, error) {
+		t, ok := g.types[protoName]
+		if !ok {
+			return "", fmt.Errorf("unknown message type %s", protoName)
+		}
+		if t.importPath == importPath && t.pkgName == pkgName {
+			return t.name, nil
+		}
+		if t.importPath == "" {
+			return "", fmt.Errorf("message type %s has no go_package option", protoName)
+		}
+		imports[t.importPath] = t.pkgName
+		return t.pkgName + "." + t.name, nil
+	}
+
+	for _, svc := range f.GetService() {
+		svcName := camelCase(svc.GetName())
+		fmt.Fprintf(&body, "// %sServer is the server API for the %s service.\n", svcName, svc.GetName())
+		fmt.Fprintf(&body, "type %sServer interface {\n", svcName)
+
+		type method struct {
+			name, in, out string
+		}
+		var methods []method
+		for _, m := range svc.GetMethod() {
+			if m.GetClientStreaming() || m.GetServerStreaming() {
+				return "", fmt.Errorf("%s.%s: streaming methods are not supported", svc.GetName(), m.GetName())
+			}
+			in, err := typeName(m.GetInputType())
+			if err != nil {
+				return "", err
+			}
+			out, err := typeName(m.GetOutputType())
+			if err != nil {
+				return "", err
+			}
+			mt := method{camelCase(m.GetName()), in, out}
+			methods = append(methods, mt)
+			fmt.Fprintf(&body, "\t%s(ctx context.Context, in *%s, out *%s) error\n", mt.name, mt.in, mt.out)
+		}
+		fmt.Fprintf(&body, "}\n\n")
+
+		wrapper := lowerFirst(svcName) + "ServerWrapper"
+		fmt.Fprintf(&body, "// %s exposes exactly the methods of %sServer, so that\n", wrapper, svcName)
+		fmt.Fprintf(&body, "// no other methods of the implementation are registered.\n")
+		fmt.Fprintf(&body, "type %s struct {\n\tsrv %sServer\n}\n\n", wrapper, svcName)
+		for _, m := range methods {
+			fmt.Fprintf(&body, "func (w *%s) %s(ctx context.Context, in *%s, out *%s) error {\n", wrapper, m.name, m.in, m.out)
+			fmt.Fprintf(&body, "\treturn w.srv.%s(ctx, in, out)\n}\n\n", m.name)
+		}
+
+		fmt.Fprintf(&body, "// Register%sServer registers an implementation of %sServer in the\n", svcName, svcName)
+		fmt.Fprintf(&body, "// given rpc.Server under the %q service name.\n", svc.GetName())
+		fmt.Fprintf(&body, "func Register%sServer(s *rpc.Server, srv %sServer) error {\n", svcName, svcName)
+		fmt.Fprintf(&body, "\treturn s.RegisterName(%q, &%s{srv})\n}\n\n", svc.GetName(), wrapper)
+
+		fmt.Fprintf(&body, "// %sClient is the client API for the %s service.\n", svcName, svc.GetName())
+		fmt.Fprintf(&body, "type %sClient struct {\n\tc *rpc.Client\n}\n\n", svcName)
+		fmt.Fprintf(&body, "// New%sClient returns a %sClient performing calls with the given rpc.Client.\n", svcName, svcName)
+		fmt.Fprintf(&body, "func New%sClient(c *rpc.Client) *%sClient {\n\treturn &%sClient{c}\n}\n\n", svcName, svcName, svcName)
+		for _, m := range methods {
+			fmt.Fprintf(&body, "// %s calls %s.%s on the given destination.\n", m.name, svc.GetName(), m.name)
+			fmt.Fprintf(&body, "func (c *%sClient) %s(ctx context.Context, dest peer.ID, in *%s, opts ...rpc.CallOption) (*%s, error) {\n", svcName, m.name, m.in, m.out)
+			fmt.Fprintf(&body, "\tout := new(%s)\n", m.out)
+			fmt.Fprintf(&body, "\terr := c.c.CallContext(ctx, dest, %q, %q, in, out, opts...)\n", svc.GetName(), m.name)
+			fmt.Fprintf(&body, "\treturn out, err\n}\n\n")
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by protoc-gen-gorpc. DO NOT EDIT.\n")
+	fmt.Fprintf(&buf, "// source: %s\n\n", f.GetName())
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import (\n\tcontext \"context\"\n\n")
+	var paths []string
+	for p := range imports {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "\t%s %q\n", imports[p], p)
+	}
+	fmt.Fprintf(&buf, "\tpeer \"github.com/libp2p/go-libp2p-core/peer\"\n")
+	fmt.Fprintf(&buf, "\trpc \"github.com/libp2p/go-libp2p-gorpc\"\n)\n\n")
+	buf.Write(body.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("formatting generated code: %s", err)
+	}
+	return string(src), nil
+}
+
+// goPackage returns the import path and the package name for the Go
+// code generated from a file.
+func goPackage(f *descriptor.FileDescriptorProto) (string, string) {
+	goPkg := f.GetOptions().GetGoPackage()
+	if goPkg != "" {
+		if i := strings.Index(goPkg, ";"); i >= 0 {
+			return goPkg[:i], goPkg[i+1:]
+		}
+		return goPkg, path.Base(goPkg)
+	}
+	if pkg := f.GetPackage(); pkg != "" {
+		return "", strings.Replace(pkg, ".", "_", -1)
+	}
+	base := path.Base(f.GetName())
+	return "", strings.TrimSuffix(base, path.Ext(base))
+}
+
+// outputName returns the name of the generated file, next to the
+// one generated for the messages.
+func outputName(f *descriptor.FileDescriptorProto) string {
+	name := f.GetName()
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if importPath, _ := goPackage(f); importPath != "" {
+		name = path.Join(importPath, path.Base(name))
+	}
+	return name + ".gorpc.go"
+}
+
+// camelCase converts a protobuf identifier to the Go name used by
+// the protobuf code generators: underscores are removed and the letter
+// following them is capitalized.
+func camelCase(s string) string {
+	var b strings.Builder
+	upper := true
+	for i, r := range s {
+		switch {
+		case r == '_' && i == 0:
+			b.WriteRune('X')
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
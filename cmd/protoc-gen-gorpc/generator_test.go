@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	descriptor "github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	plugin "github.com/gogo/protobuf/protoc-gen-gogo/plugin"
+)
+
+func testRequest() *plugin.CodeGeneratorRequest {
+	f := &descriptor.FileDescriptorProto{
+		Name:    proto.String("arith/arith.proto"),
+		Package: proto.String("arith"),
+		Options: &descriptor.FileOptions{
+			GoPackage: proto.String("example.com/arith;arithpb"),
+		},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Args"),
+				NestedType: []*descriptor.DescriptorProto{
+					{Name: proto.String("inner_args")},
+				},
+			},
+			{Name: proto.String("Reply")},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Arith"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("Multiply"),
+						InputType:  proto.String(".arith.Args"),
+						OutputType: proto.String(".arith.Reply"),
+					},
+					{
+						Name:       proto.String("Inner"),
+						InputType:  proto.String(".arith.Args.inner_args"),
+						OutputType: proto.String(".arith.Reply"),
+					},
+				},
+			},
+		},
+	}
+	return &plugin.CodeGeneratorRequest{
+		FileToGenerate: []string{f.GetName()},
+		ProtoFile:      []*descriptor.FileDescriptorProto{f},
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	resp := generate(testRequest())
+	if resp.Error != nil {
+		t.Fatal(resp.GetError())
+	}
+	if len(resp.File) != 1 {
+		t.Fatal("expected one file")
+	}
+	if n := resp.File[0].GetName(); n != "example.com/arith/arith.gorpc.go" {
+		t.Error("unexpected file name:", n)
+	}
+
+	content := resp.File[0].GetContent()
+	expected := []string{
+		"package arithpb",
+		"type ArithServer interface",
+		"Multiply(ctx context.Context, in *Args, out *Reply) error",
+		"Inner(ctx context.Context, in *Args_InnerArgs, out *Reply) error",
+		"func RegisterArithServer(s *rpc.Server, srv ArithServer) error",
+		`s.RegisterName("Arith", &arithServerWrapper{srv})`,
+		"func (c *ArithClient) Multiply(ctx context.Context, dest peer.ID, in *Args, opts ...rpc.CallOption) (*Reply, error)",
+		`c.c.CallContext(ctx, dest, "Arith", "Multiply", in, out, opts...)`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(content, e) {
+			t.Errorf("generated code does not contain %q:\n%s", e, content)
+		}
+	}
+}
+
+func TestGenerateStreaming(t *testing.T) {
+	req := testRequest()
+	req.ProtoFile[0].Service[0].Method[0].ServerStreaming = proto.Bool(true)
+	resp := generate(req)
+	if resp.Error == nil {
+		t.Fatal("expected an error for streaming methods")
+	}
+}
@@ -0,0 +1,50 @@
+// The protoc-gen-gorpc command is a protoc plugin which generates typed
+// client stubs and server interfaces for go-libp2p-gorpc from the service
+// definitions in .proto files.
+//
+// Install it in the $PATH and run protoc with the gorpc_out flag, along
+// with the plugin generating the message types:
+//
+// 	protoc --gogo_out=. --gorpc_out=. service.proto
+//
+// For every service Foo, the generated code contains:
+//
+// 	- a FooServer interface with one method per rpc.
+// 	- a RegisterFooServer function which registers an implementation of
+// 	  FooServer in an rpc.Server under the "Foo" service name.
+// 	- a FooClient type wrapping an rpc.Client, with one method per rpc
+// 	  performing the call to a given destination.
+//
+// Streaming rpcs are not supported.
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/gogo/protobuf/proto"
+	plugin "github.com/gogo/protobuf/protoc-gen-gogo/plugin"
+)
+
+func main() {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("reading input: ", err)
+	}
+
+	var req plugin.CodeGeneratorRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		log.Fatal("parsing input: ", err)
+	}
+
+	resp := generate(&req)
+
+	data, err = proto.Marshal(resp)
+	if err != nil {
+		log.Fatal("marshaling output: ", err)
+	}
+	if _, err := os.Stdout.Write(data); err != nil {
+		log.Fatal("writing output: ", err)
+	}
+}
@@ -0,0 +1,259 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Codec is a serialization format for requests and responses. Clients and
+// Servers use MsgpackCodec unless a different codec is configured for the
+// protocol of the stream (see WithServerCodec and WithClientCodec).
+type Codec struct {
+	name   string
+	handle codec.Handle
+	// scan reads and checks a value before it is decoded, for
+	// binary encodings (see framing.go).
+	scan func(*valueReader) error
+
+	// encoders and decoders pool the codec state used by Marshal
+	// and Unmarshal, which can be reused across calls.
+	encoders sync.Pool
+	decoders sync.Pool
+	// wraps pools released streamWraps using the codec.
+	wraps sync.Pool
+	// generic, when set, is the variant of the codec used to decode
+	// values into empty interfaces (see encodedBody.value).
+	generic *Codec
+	// routing makes streams write request and response headers in
+	// the routing format (see WithRoutingHeaders).
+	routing bool
+}
+
+// genericCodec returns the codec to decode values into empty interfaces
+// with.
+func (c *Codec) genericCodec() *Codec {
+	if c.generic != nil {
+		return c.generic
+	}
+	return c
+}
+
+// Name returns the name of the codec.
+func (c *Codec) Name() string {
+	return c.name
+}
+
+// MsgpackCodec encodes requests and responses with MessagePack. It is the
+// default codec.
+var MsgpackCodec = &Codec{
+	name:   "msgpack",
+	scan:   scanMsgpack,
+	handle: &codec.MsgpackHandle{},
+	// MessagePack strings are decoded into empty interfaces as
+	// byte slices otherwise, which other codecs encode differently.
+	generic: &Codec{
+		name:   "msgpack",
+		scan:   scanMsgpack,
+		handle: &codec.MsgpackHandle{BasicHandle: codec.BasicHandle{DecodeOptions: codec.DecodeOptions{RawToString: true}}},
+	},
+}
+
+// JSONCodec encodes requests and responses as JSON, so that peers written
+// in other languages can implement compatible clients and servers. Every
+// message is a sequence of JSON values written one after another over the
+// stream, each of them followed by whitespace, so that numbers can be
+// told apart in persistent streams:
+//
+//	request:  {"Name": "Service", "Method": "Method", ...} <args>
+//	response: {"Service": {...}, "Error": "", "ErrType": 0, ...} <reply>
+//
+// The request header is a ServiceID and the response header a Response,
+// with the same field names. Optional fields are omitted when empty. The
+// reply is null when the call fails. Durations are integers in
+// nanoseconds and byte slices are base64 strings.
+var JSONCodec = &Codec{
+	name:   "json",
+	handle: &codec.JsonHandle{TermWhitespace: true},
+}
+
+// CBORCodec encodes requests and responses with CBOR (RFC 7049), using
+// its canonical form: map keys are sorted and integers use the shortest
+// encoding, so that the same value is always encoded to the same bytes.
+// This makes encoded replies suitable for hashing and signing (see
+// Codec.Marshal).
+var CBORCodec = &Codec{
+	name:   "cbor",
+	scan:   scanCBOR,
+	handle: &codec.CborHandle{BasicHandle: codec.BasicHandle{EncodeOptions: codec.EncodeOptions{Canonical: true}}},
+}
+
+// Marshal encodes a value with the codec.
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	return c.marshal(v)
+}
+
+// marshal encodes the given values one after another.
+func (c *Codec) marshal(vs ...interface{}) ([]byte, error) {
+	var data []byte
+	enc, ok := c.encoders.Get().(*codec.Encoder)
+	if ok {
+		enc.ResetBytes(&data)
+	} else {
+		enc = codec.NewEncoderBytes(&data, c.handle)
+	}
+	defer c.encoders.Put(enc)
+
+	for _, v := range vs {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Unmarshal decodes data encoded with the codec into v, which must be
+// a pointer.
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	return c.unmarshal(data, v)
+}
+
+// unmarshal decodes the values encoded one after another in data
+// into the given pointers.
+func (c *Codec) unmarshal(data []byte, vs ...interface{}) error {
+	if err := c.check(data, len(vs)); err != nil {
+		return err
+	}
+	return c.decodeChecked(data, vs...)
+}
+
+// decodeChecked works like unmarshal() for data which has been checked
+// already (see Codec.check).
+func (c *Codec) decodeChecked(data []byte, vs ...interface{}) error {
+	dec, ok := c.decoders.Get().(*codec.Decoder)
+	if ok {
+		dec.ResetBytes(data)
+	} else {
+		dec = codec.NewDecoderBytes(data, c.handle)
+	}
+	defer c.decoders.Put(dec)
+
+	for _, v := range vs {
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithServerCodec makes the Server use the given codec for the streams
+// opened with the given protocol, as well as for the per-service and
+// reverse protocols derived from it. The protocol must be one of the
+// server protocols (see WithServerProtocols).
+func WithServerCodec(p protocol.ID, c *Codec) ServerOption {
+	return func(s *Server) {
+		if s.codecs == nil {
+			s.codecs = make(map[protocol.ID]*Codec)
+		}
+		s.codecs[p] = c
+	}
+}
+
+// WithClientCodec makes the Client use the given codec when the stream to
+// the server is opened with the given protocol, or with the per-service
+// and reverse protocols derived from it. The protocol should be one of the
+// client protocols (see WithClientProtocols).
+func WithClientCodec(p protocol.ID, c *Codec) ClientOption {
+	return func(cl *Client) {
+		if cl.codecs == nil {
+			cl.codecs = make(map[protocol.ID]*Codec)
+		}
+		cl.codecs[p] = c
+	}
+}
+
+// WithCodec makes the call encode its arguments and decode its reply with
+// the given codec instead of the one used for the stream. The codec is
+// named in the request so that the server uses it as well (see also
+// WithMethodCodec), and the encoded arguments and reply are carried as
+// byte strings. It has no effect on local calls.
+func WithCodec(c *Codec) CallOption {
+	return func(o *callOptions) {
+		o.codec = c
+	}
+}
+
+// WithClientCallCodec makes every remote call of the Client work as if
+// made with WithCodec and the given codec, unless made with WithCodec.
+// Servers decode the arguments and encode the replies of every call with
+// the codec named in its request, so that a fleet can move from a codec
+// to another one client by client, without changing the protocols, and
+// Servers can tell the clients still using the older codec from the
+// Codec of the CallEvents (see WithServerHooks). With WithHandshake,
+// calls to peers not supporting the codec use the codec of the stream.
+func WithClientCallCodec(c *Codec) ClientOption {
+	return func(cl *Client) {
+		cl.callCodec = c
+	}
+}
+
+// WithMethodCodec makes the Server require the given codec for the
+// arguments and replies of the given method: callers must use WithCodec
+// with the same codec. Other methods accept any of the codecs provided
+// by this package when requested with WithCodec.
+func WithMethodCodec(svcName, svcMethod string, c *Codec) ServerOption {
+	return func(s *Server) {
+		if s.methodCodecs == nil {
+			s.methodCodecs = make(map[string]*Codec)
+		}
+		s.methodCodecs[svcName+"."+svcMethod] = c
+	}
+}
+
+// codecByName returns the codec provided by this package with the
+// given name, or nil.
+func codecByName(name string) *Codec {
+	for _, c := range []*Codec{MsgpackCodec, JSONCodec, CBORCodec} {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// checkCodec verifies that the codec requested for the arguments and
+// reply of a request is known and is the one required by the method,
+// if any.
+func (server *Server) checkCodec(svcID ServiceID) error {
+	var c *Codec
+	if svcID.Codec != "" {
+		if c = codecByName(svcID.Codec); c == nil {
+			return newServerError(fmt.Errorf("rpc: unknown codec %q", svcID.Codec))
+		}
+	}
+	required, ok := server.methodCodecs[svcID.Name+"."+svcID.Method]
+	if ok && c != required {
+		return newServerError(fmt.Errorf("rpc: %s.%s requires the %s codec", svcID.Name, svcID.Method, required.name))
+	}
+	return nil
+}
+
+// codecFor returns the codec configured for the given protocol in the
+// given map, or the default one.
+func codecFor(codecs map[protocol.ID]*Codec, proto protocol.ID) *Codec {
+	if c, ok := codecs[proto]; ok {
+		return c
+	}
+	// Use the longest protocol which proto derives from.
+	res, longest := MsgpackCodec, 0
+	for p, c := range codecs {
+		if len(p) > longest && strings.HasPrefix(string(proto), string(p)+"/") {
+			res, longest = c, len(p)
+		}
+	}
+	return res
+}
@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+var benchCodecs = []*Codec{MsgpackCodec, JSONCodec, CBORCodec}
+
+type benchMessage struct {
+	ID     int
+	Name   string
+	Tags   []string
+	Values map[string]float64
+}
+
+var benchMsg = benchMessage{
+	ID:   42,
+	Name: "benchmark",
+	Tags: []string{"a", "b", "c"},
+	Values: map[string]float64{
+		"x": 1.5,
+		"y": 2.5,
+	},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range benchCodecs {
+		data, err := c.Marshal(benchMsg)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		var msg benchMessage
+		if err := c.Unmarshal(data, &msg); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if msg.ID != benchMsg.ID || msg.Name != benchMsg.Name ||
+			len(msg.Tags) != 3 || msg.Values["y"] != 2.5 {
+			t.Errorf("%s: unexpected message: %+v", c.Name(), msg)
+		}
+	}
+}
+
+func TestCodecCheck(t *testing.T) {
+	type value struct {
+		Ints    []int64
+		Uints   []uint64
+		Floats  []float64
+		Bytes   []byte
+		Strings []string
+		Bool    bool
+		Nil     *int
+		Map     map[string]interface{}
+		Time    time.Time
+	}
+	v := value{
+		Ints:    []int64{0, -1, -100, -40000, -3000000000, 127, 200, 70000, 5000000000},
+		Uints:   []uint64{0, 255, 65535, 1 << 32, 1 << 63},
+		Floats:  []float64{0.5, -1e300},
+		Bytes:   bytes.Repeat([]byte("x"), 70000),
+		Strings: []string{"", strings.Repeat("s", 40), strings.Repeat("s", 300)},
+		Bool:    true,
+		Map:     map[string]interface{}{"a": []interface{}{1, "b", nil}},
+		Time:    time.Unix(1600000000, 0).UTC(),
+	}
+	for _, c := range []*Codec{MsgpackCodec, CBORCodec} {
+		data, err := c.Marshal(v)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		var out value
+		if err := c.Unmarshal(data, &out); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if !out.Time.Equal(v.Time) || len(out.Bytes) != len(v.Bytes) || out.Uints[4] != 1<<63 {
+			t.Errorf("%s: unexpected value: %+v", c.Name(), out)
+		}
+		if err := c.Unmarshal(data[:len(data)-1], &out); err == nil {
+			t.Errorf("%s: expected an error decoding a truncated value", c.Name())
+		}
+	}
+
+	// Collections and strings declaring more items than the message
+	// holds are rejected before decoding.
+	invalid := map[*Codec][][]byte{
+		MsgpackCodec: {
+			{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+			{0xdf, 0x00, 0x00, 0x00, 0x02, 0x01, 0x01, 0x01},
+			{0xc6, 0xff, 0xff, 0xff, 0xff, 0x01},
+		},
+		CBORCodec: {
+			{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			{0x5a, 0xff, 0xff, 0xff, 0xff, 0x01},
+		},
+	}
+	for c, values := range invalid {
+		for _, data := range values {
+			var out interface{}
+			if err := c.Unmarshal(data, &out); err != errInvalidLength {
+				t.Errorf("%s: expected errInvalidLength decoding %x: %v", c.Name(), data, err)
+			}
+		}
+	}
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	for _, c := range benchCodecs {
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Marshal(benchMsg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	for _, c := range benchCodecs {
+		data, err := c.Marshal(benchMsg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var msg benchMessage
+				if err := c.Unmarshal(data, &msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func protoFor(c *Codec) protocol.ID {
+	return protocol.ID("/rpc/bench/" + c.Name())
+}
+
+func BenchmarkCodecCall(b *testing.B) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var opts []ServerOption
+	for _, c := range benchCodecs {
+		opts = append(opts, WithServerProtocols(protoFor(c)), WithServerCodec(protoFor(c), c))
+	}
+	s := NewServer(h1, "/rpc/bench", opts...)
+	var arith Arith
+	s.Register(&arith)
+
+	for _, c := range benchCodecs {
+		cl := NewClient(h2, protoFor(c), WithClientCodec(protoFor(c), c))
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			var r int
+			for i := 0; i < b.N; i++ {
+				if err := cl.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// bufferConn is a connection reading what was written to it.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (*bufferConn) Close() error { return nil }
+
+func TestStreamWrapPool(t *testing.T) {
+	// The pool may drop released streamWraps, so try until one is
+	// reused.
+	var first, second bufferConn
+	var sw, reused *streamWrap
+	for i := 0; i < 100 && reused == nil; i++ {
+		first.Reset()
+		sw = wrapConn(&first, MsgpackCodec).withMaxSize(10)
+		sw.identity = "alice"
+		if err := sw.enc.Encode("hello"); err != nil {
+			t.Fatal(err)
+		}
+		sw.w.Flush()
+		if err := sw.readHeader(new(string)); err != nil {
+			t.Fatal(err)
+		}
+		sw.release()
+		if w := wrapConn(&second, MsgpackCodec); w == sw {
+			reused = w
+		}
+	}
+	if reused == nil {
+		t.Fatal("released streamWraps are not reused")
+	}
+
+	if reused.identity != nil || reused.maxSize != DefaultMaxMessageSize || reused.fr.left != -1 || reused.cr.n != 0 || reused.cw.n != 0 {
+		t.Error("the state of the released streamWrap was kept")
+	}
+	written := first.Len()
+	if err := reused.enc.Encode("world"); err != nil {
+		t.Fatal(err)
+	}
+	reused.w.Flush()
+	var out string
+	if err := reused.readHeader(&out); err != nil || out != "world" {
+		t.Error("unexpected value:", out, err)
+	}
+	if first.Len() != written {
+		t.Error("the released streamWrap wrote to its former connection")
+	}
+}
+
+func TestStreamWrapPoolLongLived(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+	s.Register(&Feed{})
+	c := NewClient(h2, "rpc")
+	pipelined := NewClient(h2, "rpc", WithPipelining())
+
+	// Subscriptions and pipelined streams keep their streamWraps while
+	// the ones of other calls are released and reused.
+	events := make(chan string, 100)
+	sub, err := c.Subscribe(context.Background(), h1.ID(), "Feed", "Events", "a", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	sender := s.EventSender("Feed", "Events")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, cl := range []*Client{c, pipelined} {
+				var r int
+				if err := cl.Call(h1.ID(), "Arith", "Multiply", &Args{i, 2}, &r); err != nil {
+					t.Error(err)
+				} else if r != 2*i {
+					t.Error("unexpected reply:", r)
+				}
+			}
+		}(i)
+		sender.Send(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		if ev := <-events; ev != fmt.Sprint(i) {
+			t.Fatalf("expected event %d, got %q", i, ev)
+		}
+	}
+	if err := sub.Err(); err != nil {
+		t.Error("subscription should be active:", err)
+	}
+}
+
+func BenchmarkStreamWrap(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var conn bufferConn
+			for i := 0; i < b.N; i++ {
+				sw := wrapConn(&conn, MsgpackCodec)
+				if err := sw.enc.Encode(benchMsg); err != nil {
+					b.Fatal(err)
+				}
+				sw.w.Flush()
+				var msg benchMessage
+				if err := sw.readHeader(&msg); err != nil {
+					b.Fatal(err)
+				}
+				if pooled {
+					sw.release()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Message bodies can be compressed with gzip. Compression is decided for
+// every message once its body has been encoded: only bodies of at least
+// the configured size are compressed, as compressing small ones costs
+// more than it saves. Compressed bodies are sent as raw values (see Raw)
+// holding the compressed encoded body, and marked in the header
+// (ServiceID.Compression and Response.Compression). Servers only compress
+// the responses of clients accepting it (ServiceID.AcceptCompression).
+// Signed messages are never compressed.
+
+// gzipCompression is the name of the gzip compression.
+const gzipCompression = "gzip"
+
+// WithClientCompression makes the Client compress the arguments of its
+// calls when they take at least threshold bytes once encoded, and accept
+// compressed replies. Servers of versions not supporting compression
+// cannot decode compressed arguments: when the handshake is enabled (see
+// WithHandshake), arguments are only compressed for peers supporting it.
+// A zero or negative threshold disables compression, which is the
+// default.
+func WithClientCompression(threshold int) ClientOption {
+	return func(c *Client) {
+		c.compressAbove = threshold
+	}
+}
+
+// WithServerCompression makes the Server compress the replies which take
+// at least threshold bytes once encoded, for clients accepting compressed
+// replies (see WithClientCompression). Compressed arguments are always
+// accepted. A zero or negative threshold disables compression, which is
+// the default.
+func WithServerCompression(threshold int) ServerOption {
+	return func(s *Server) {
+		s.compressAbove = threshold
+	}
+}
+
+// withCompression sets the size from which the responses written to the
+// stream are compressed (see WithServerCompression) and returns the
+// streamWrap.
+func (sw *streamWrap) withCompression(threshold int) *streamWrap {
+	sw.compressAbove = threshold
+	return sw
+}
+
+// compresses returns whether a body of the given size must be compressed
+// with the given threshold.
+func compresses(threshold, size int) bool {
+	return threshold > 0 && size >= threshold
+}
+
+// accepts returns whether the given compression is accepted for the
+// response to the given request.
+func accepts(svcID ServiceID, compression string) bool {
+	for _, c := range svcID.AcceptCompression {
+		if c == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBody compresses an encoded body.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCompressed writes an encoded body compressed with gzip.
+func (sw *streamWrap) writeCompressed(body []byte) error {
+	data, err := gzipBody(body)
+	if err != nil {
+		return err
+	}
+	return sw.writeRaw(data)
+}
+
+// readCompressed reads a body compressed with the given compression,
+// which may not exceed the maximum message size once decompressed. It
+// returns a streamWrap to decode the body from, which must be released.
+func (sw *streamWrap) readCompressed(compression string) (*streamWrap, error) {
+	if compression != gzipCompression {
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+	var data []byte
+	if err := sw.readRaw(&data); err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = zr
+	if sw.maxSize > 0 {
+		r = io.LimitReader(zr, sw.maxSize+1)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if sw.maxSize > 0 && int64(body.Len()) > sw.maxSize {
+		return nil, errMessageTooLarge
+	}
+	return wrapConn(bodyConn{bytes.NewReader(body.Bytes())}, sw.codec).withMaxSize(sw.maxSize), nil
+}
@@ -0,0 +1,38 @@
+package rpc
+
+import (
+	"context"
+	"io"
+)
+
+// ServeConn serves the requests arriving over the given connection, which
+// can be any io.ReadWriteCloser: an already established libp2p stream, a
+// relayed connection or even an in-memory pipe. Requests are handled one
+// after another, as they are sent by a Client created with
+// NewClientFromConn(). It blocks until the connection is closed by the
+// other side or the context is cancelled, and closes the connection
+// before returning.
+//
+// When the connection is not a libp2p stream, the remote peer is unknown
+// and an empty peer.ID is provided to the authorization function.
+func (server *Server) ServeConn(ctx context.Context, rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+	err := server.serveSession(ctx, server.wrap(rwc, MsgpackCodec))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// NewClientFromConn returns a Client which performs all its calls over
+// the given connection, regardless of their destination, to a Server
+// using ServeConn() on the other side. Calls are sent one at a time.
+//
+// Cancelling the context of a call while it is in progress closes the
+// connection, after which all calls fail.
+func NewClientFromConn(rwc io.ReadWriteCloser, opts ...ClientOption) *Client {
+	c := NewClient(nil, "", opts...)
+	c.conn = newStreamCaller(c.wrap(rwc, MsgpackCodec))
+	go c.conn.keepalive(c.keepalive, c.streamLogger)
+	return c
+}
@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type contextKey int
+
+const (
+	metadataKey contextKey = iota
+	progressKey
+	transportKey
+	remotePeerKey
+	identityKey
+	resumeCursorKey
+)
+
+// withMetadata returns a context carrying the given call metadata.
+func withMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metadataKey, md)
+}
+
+// GetMetadata returns the metadata attached by the client to the call
+// (see WithMetadata). It is meant to be used by server methods on the
+// context they receive. The returned map must not be modified.
+func GetMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey).(map[string]string)
+	return md
+}
+
+// remotePeer is the caller of a method, stored in its context.
+type remotePeer struct {
+	id  peer.ID
+	key crypto.PubKey
+}
+
+// withRemotePeer returns a context carrying the caller of a method.
+func withRemotePeer(ctx context.Context, id peer.ID, key crypto.PubKey) context.Context {
+	return context.WithValue(ctx, remotePeerKey, &remotePeer{id: id, key: key})
+}
+
+// GetRemotePeer returns the peer calling the method, as authenticated by
+// the secure connection carrying the call, so that methods can apply
+// per-peer rules. It is meant to be used by server methods on the context
+// they receive. Local calls are made by the peer of the Server, and
+// one-way requests by the peer given to HandleRequest. It returns false
+// for calls arriving over connections which are not libp2p streams (see
+// ServeConn).
+func GetRemotePeer(ctx context.Context) (peer.ID, bool) {
+	rp, ok := ctx.Value(remotePeerKey).(*remotePeer)
+	if !ok {
+		return "", false
+	}
+	return rp.id, true
+}
+
+// GetRemotePublicKey returns the public key of the peer calling the
+// method (see GetRemotePeer), or nil when it is not known.
+func GetRemotePublicKey(ctx context.Context) crypto.PubKey {
+	rp, ok := ctx.Value(remotePeerKey).(*remotePeer)
+	if !ok {
+		return nil
+	}
+	return rp.key
+}
+
+// WithClientContextValue makes the Client send the value stored under
+// the given key in the context of its remote calls, when it is a string,
+// along with the request, under the given name. Servers using
+// WithServerContextValue with the same name store it in the context of
+// the method. This allows propagating values such as request or tenant
+// IDs. Local calls receive the context of the caller as is. This option
+// can be given several times.
+func WithClientContextValue(name string, key interface{}) ClientOption {
+	return func(c *Client) {
+		if c.contextValues == nil {
+			c.contextValues = make(map[string]interface{})
+		}
+		c.contextValues[name] = key
+	}
+}
+
+// WithServerContextValue makes the Server store the value sent by
+// clients under the given name (see WithClientContextValue) in the
+// context of the methods, under the given key. Values sent under other
+// names are ignored. This option can be given several times.
+func WithServerContextValue(name string, key interface{}) ServerOption {
+	return func(s *Server) {
+		if s.contextValues == nil {
+			s.contextValues = make(map[string]interface{})
+		}
+		s.contextValues[name] = key
+	}
+}
+
+// contextValuesOf returns the values to send with a request made with
+// the given context.
+func (c *Client) contextValuesOf(ctx context.Context) map[string]string {
+	var values map[string]string
+	for name, key := range c.contextValues {
+		v, ok := ctx.Value(key).(string)
+		if !ok {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[name] = v
+	}
+	return values
+}
+
+// withContextValues returns a context carrying the values sent with
+// a request under the registered names.
+func (server *Server) withContextValues(ctx context.Context, values map[string]string) context.Context {
+	for name, v := range values {
+		if key, ok := server.contextValues[name]; ok {
+			ctx = context.WithValue(ctx, key, v)
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// dedupEntry holds the response to a request with an idempotency key.
+// done is closed once the response is available.
+type dedupEntry struct {
+	done    chan struct{}
+	resp    Response
+	body    []byte
+	codec   *Codec
+	failed  bool
+	expires time.Time
+}
+
+// expired returns true when a finished entry is past its expiration time.
+func (e *dedupEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// dedupCache stores the responses to requests with idempotency keys
+// during the configured window.
+type dedupCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*dedupEntry
+	nextSweep time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// begin returns the entry for the given key. The returned boolean is true
+// when the entry is new and the caller must run the request and call
+// finish() on it.
+func (dc *dedupCache) begin(key string) (*dedupEntry, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	now := time.Now()
+	if now.After(dc.nextSweep) {
+		for k, e := range dc.entries {
+			if e.expired(now) {
+				delete(dc.entries, k)
+			}
+		}
+		dc.nextSweep = now.Add(dc.window)
+	}
+
+	if e, ok := dc.entries[key]; ok && !e.expired(now) {
+		return e, false
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	dc.entries[key] = e
+	return e, true
+}
+
+// finish records the response for an entry and releases any
+// waiting duplicates. Failed entries are forgotten, so that the
+// request can be attempted again.
+func (dc *dedupCache) finish(key string, e *dedupEntry, resp *Response, body []byte, c *Codec, failed bool) {
+	dc.mu.Lock()
+	if failed {
+		delete(dc.entries, key)
+	} else {
+		e.resp = *resp
+		e.body = body
+		e.codec = c
+		e.expires = time.Now().Add(dc.window)
+	}
+	e.failed = failed
+	dc.mu.Unlock()
+	close(e.done)
+}
+
+// dedupCall runs a request carrying an idempotency key, unless it
+// is a duplicate, in which case the original response is sent.
+func (server *Server) dedupCall(s *streamWrap, svc *service, mtype *methodType, svcID ServiceID, ctx context.Context, ctxv, argv, replyv reflect.Value, timeout time.Duration, ev *CallEvent) error {
+	// Versions of a service are different methods.
+	key := s.remotePeer().String() + "/" + serviceKey(svcID.Name, svcID.Version) + "." + svcID.Method + "/" + svcID.IdempotencyKey
+
+	entry, isNew := server.dedup.begin(key)
+	if !isNew {
+		server.logger.Debugw("duplicate request", "peer", s.remotePeer(), "service", svcID.Name, "method", svcID.Method)
+		select {
+		case <-ctx.Done():
+			return newServerError(ctx.Err())
+		case <-entry.done:
+		}
+		if entry.failed {
+			return newServerError(errors.New("rpc: the original request with the same idempotency key failed"))
+		}
+		if entry.codec != s.codec || entry.resp.Service.Codec != svcID.Codec {
+			return newServerError(errors.New("rpc: the original request with the same idempotency key used a different codec"))
+		}
+		// Answer with the ID of this request when pipelined.
+		resp := entry.resp
+		resp.Service.RequestID = svcID.RequestID
+		return sendEncodedResponse(s, &resp, entry.body)
+	}
+
+	resp, ok := svc.invokeWithTimeout(mtype, svcID, ctxv, argv, replyv, timeout, ev)
+	if !ok {
+		server.dedup.finish(key, entry, nil, nil, nil, true)
+		return sendResponse(s, resp, nil)
+	}
+	body, err := s.marshalBody(svcID.Codec, replyv.Interface())
+	resp.Raw = isRawBody(replyv.Interface())
+	if err != nil {
+		server.dedup.finish(key, entry, nil, nil, nil, true)
+		return newServerError(err)
+	}
+	server.dedup.finish(key, entry, resp, body, s.codec, false)
+	return sendEncodedResponse(s, resp, body)
+}
@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// ReflectionService is the name of the service which describes the
+// services of a Server to remote peers (see WithReflection).
+const ReflectionService = "Reflection"
+
+// ServiceDoc documents a service and its methods. See Server.Document.
+type ServiceDoc struct {
+	Description string
+	// Methods documents the methods of the service, by name.
+	Methods map[string]MethodDoc
+}
+
+// MethodDoc documents a method.
+type MethodDoc struct {
+	Description string
+	// ArgsSchema and ReplySchema describe the arguments and the
+	// reply of the method, in any format understood by the tooling
+	// using them (i.e. JSON Schema).
+	ArgsSchema  string
+	ReplySchema string
+}
+
+// ServiceDescription describes a registered service. See
+// Server.Describe.
+type ServiceDescription struct {
+	Name string
+	// Version is the version of the service, if registered with
+	// WithVersion.
+	Version     string `codec:",omitempty"`
+	Description string
+	Methods     []MethodDescription
+}
+
+// MethodDescription describes a method of a registered service.
+type MethodDescription struct {
+	Name        string
+	Description string
+	// ArgType and ReplyType are the Go types of the arguments and
+	// the reply. ReplyType is empty for asynchronous methods.
+	ArgType     string
+	ReplyType   string
+	ArgsSchema  string
+	ReplySchema string
+}
+
+// Document attaches documentation to a registered service, which is
+// returned by Describe. It replaces any previous documentation of the
+// service. Versions of a service (see WithVersion) are documented
+// separately, as "Name@version".
+func (server *Server) Document(svcName string, doc ServiceDoc) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.services()[svcName]; !ok {
+		return errors.New("rpc: can't find service " + svcName)
+	}
+	if server.docs == nil {
+		server.docs = make(map[string]ServiceDoc)
+	}
+	server.docs[svcName] = doc
+	return nil
+}
+
+// Describe returns the description of the registered services and their
+// methods, sorted by name, along with their documentation.
+func (server *Server) Describe() []ServiceDescription {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	services := server.services()
+	descs := make([]ServiceDescription, 0, len(services))
+	for key, svc := range services {
+		doc := server.docs[key]
+		desc := ServiceDescription{
+			Name:        svc.name,
+			Version:     svc.version,
+			Description: doc.Description,
+			Methods:     make([]MethodDescription, 0, len(svc.method)),
+		}
+		for mname, mtype := range svc.method {
+			mdoc := doc.Methods[mname]
+			md := MethodDescription{
+				Name:        mname,
+				Description: mdoc.Description,
+				ArgType:     mtype.ArgType.String(),
+				ArgsSchema:  mdoc.ArgsSchema,
+				ReplySchema: mdoc.ReplySchema,
+			}
+			if mtype.ReplyType != nil {
+				md.ReplyType = mtype.ReplyType.Elem().String()
+			}
+			desc.Methods = append(desc.Methods, md)
+		}
+		sort.Slice(desc.Methods, func(i, j int) bool {
+			return desc.Methods[i].Name < desc.Methods[j].Name
+		})
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		if descs[i].Name != descs[j].Name {
+			return descs[i].Name < descs[j].Name
+		}
+		return descs[i].Version < descs[j].Version
+	})
+	return descs
+}
+
+// WithReflection registers the ReflectionService in the Server, which
+// lets peers obtain the result of Describe with its Describe method:
+//
+//	var descs []rpc.ServiceDescription
+//	err := client.Call(dest, rpc.ReflectionService, "Describe", struct{}{}, &descs)
+func WithReflection() ServerOption {
+	return func(s *Server) {
+		s.reflection = true
+	}
+}
+
+// registerReflection registers the ReflectionService.
+func (server *Server) registerReflection() {
+	server.RegisterName(ReflectionService, &reflectionService{server})
+	server.Document(ReflectionService, ServiceDoc{
+		Description: "Describes the services of the peer.",
+		Methods: map[string]MethodDoc{
+			"Describe": {Description: "Returns the services of the peer and their methods."},
+		},
+	})
+}
+
+// reflectionService is the ReflectionService.
+type reflectionService struct {
+	server *Server
+}
+
+func (rs *reflectionService) Describe(ctx context.Context, in struct{}, out *[]ServiceDescription) error {
+	*out = rs.server.Describe()
+	return nil
+}
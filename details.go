@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Errors returned by methods can carry a detail value of any type (see
+// WithErrorDetail), i.e. a struct describing a conflict, which is sent to
+// the client encoded with the codec of the reply, in the Detail field of
+// the response. Callers extract it with ErrorDetail.
+
+// detailedError is an error carrying a detail value (see
+// WithErrorDetail). Errors received from remote peers hold the encoded
+// detail, and the codec to decode it with, instead of the value.
+type detailedError struct {
+	err    error
+	detail interface{}
+	data   []byte
+	codec  *Codec
+}
+
+func (d *detailedError) Error() string {
+	return d.err.Error()
+}
+
+func (d *detailedError) Unwrap() error {
+	return d.err
+}
+
+// WithErrorDetail attaches a detail value to an error. When returned by a
+// method, the detail is sent to the client along with the error message,
+// so that callers can obtain it with ErrorDetail(). The detail must be
+// encodable by the codec used for the reply.
+func WithErrorDetail(err error, detail interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &detailedError{err: err, detail: detail}
+}
+
+// ErrorDetail finds the detail attached to an error with WithErrorDetail,
+// or to the error returned by a remote method, and sets target to it,
+// like errors.As does with errors. Target must be a non-nil pointer to a
+// type the detail can be assigned or decoded to. It returns false when
+// there is no such detail.
+func ErrorDetail(err error, target interface{}) bool {
+	var de *detailedError
+	if !errors.As(err, &de) {
+		return false
+	}
+	tv := reflect.ValueOf(target)
+	if tv.Kind() != reflect.Ptr || tv.IsNil() {
+		return false
+	}
+	if de.data == nil {
+		dv := reflect.ValueOf(de.detail)
+		if dv.IsValid() && dv.Type().AssignableTo(tv.Type().Elem()) {
+			tv.Elem().Set(dv)
+			return true
+		}
+		// Details of other types are converted like the remote
+		// ones.
+		data, err := MsgpackCodec.marshal(de.detail)
+		if err != nil {
+			return false
+		}
+		return MsgpackCodec.unmarshal(data, target) == nil
+	}
+	codec := de.codec
+	if codec == nil {
+		codec = MsgpackCodec
+	}
+	return codec.unmarshal(de.data, target) == nil
+}
+
+// errorDetail returns the detail attached to an error, if any. Details
+// received from remote peers are returned as generic values, so that
+// they can be sent again (see Proxy).
+func errorDetail(err error) interface{} {
+	var de *detailedError
+	if !errors.As(err, &de) {
+		return nil
+	}
+	if de.data == nil {
+		return de.detail
+	}
+	codec := de.codec
+	if codec == nil {
+		codec = MsgpackCodec
+	}
+	var v interface{}
+	if codec.genericCodec().unmarshal(de.data, &v) != nil {
+		return nil
+	}
+	return genericValue(v)
+}
+
+// encodeDetail encodes the detail of the error of a response to be sent
+// over the stream, with the codec of the reply.
+func (sw *streamWrap) encodeDetail(resp *Response) {
+	if resp.detail == nil || resp.Detail != nil {
+		return
+	}
+	data, err := sw.bodyCodec(resp.Service.Codec).marshal(resp.detail)
+	if err != nil {
+		// The error is sent without its detail.
+		return
+	}
+	resp.Detail = data
+}
+
+// responseToError works like responseToError() for a Response header
+// read from the stream.
+func (sw *streamWrap) responseToError(resp *Response) error {
+	resp.detailCodec = sw.bodyCodec(resp.Service.Codec)
+	return responseToError(resp)
+}
@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// WithClientNoDial makes all the remote calls performed by the Client use
+// existing connections only: calls to peers which are not connected fail
+// right away with ErrNotConnected, without dialing them or looking up
+// their addresses, so that upper layers decide when to connect. See also
+// WithNoDial.
+func WithClientNoDial() ClientOption {
+	return func(c *Client) {
+		c.noDial = true
+	}
+}
+
+// WithConnectedOnly restricts the remote calls performed by the Client to
+// the peers it is already connected to. It is an alias of
+// WithClientNoDial.
+func WithConnectedOnly() ClientOption {
+	return WithClientNoDial()
+}
+
+// ErrNotConnected is the client error returned by calls which cannot dial
+// their destination (see WithClientNoDial and WithNoDial) when it is not
+// connected.
+var ErrNotConnected error = &clientError{"rpc: peer not connected"}
+
+// WithStreamOpenTimeout limits the time that the Client spends opening a
+// stream for a remote call, including dialing the destination and
+// negotiating the protocol, so that unreachable peers are detected
+// quickly regardless of the context and timeout of the call. Calls fail
+// with a client error when the stream cannot be opened in time. A zero
+// or negative duration disables the limit, which is the default.
+func WithStreamOpenTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.openTimeout = d
+	}
+}
+
+// WithNoDial makes the call fail if there is no existing connection to
+// the destination, instead of dialing it. This keeps expensive dials
+// out of latency-critical paths.
+func WithNoDial() CallOption {
+	return func(o *callOptions) {
+		o.noDial = true
+	}
+}
+
+// WithNoRelay makes the call fail if the destination can only be reached
+// through a relay. When not connected to the destination, only its
+// direct addresses are dialed (unless dialing is disabled with
+// WithNoDial).
+func WithNoRelay() CallOption {
+	return func(o *callOptions) {
+		o.noRelay = true
+	}
+}
+
+// isRelayed returns true for relayed (circuit) addresses.
+func isRelayed(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// WithTransports restricts the call to connections using one of the given
+// transports (see TransportName), i.e. WithTransports("quic") to only
+// send it over QUIC. When the stream of the call is opened over another
+// transport, the call fails with a client error without being sent.
+func WithTransports(names ...string) CallOption {
+	return func(o *callOptions) {
+		o.transports = names
+	}
+}
+
+// checkTransport returns an error when the call may not be sent over the
+// given connection (see WithTransports).
+func checkTransport(call *Call, conn network.Conn) error {
+	if len(call.opts.transports) == 0 {
+		return nil
+	}
+	name := TransportName(conn.RemoteMultiaddr())
+	for _, t := range call.opts.transports {
+		if t == name {
+			return nil
+		}
+	}
+	return &clientError{"connection to " + call.Dest.Pretty() + " uses the " + name + " transport, which is not allowed for the call"}
+}
+
+// openStream opens a stream to the destination of the call, honoring
+// the dialing options of the client and the call.
+func (c *Client) openStream(call *Call) (network.Stream, error) {
+	return c.openStreamWith(call, c.protocols(call.SvcID.Name))
+}
+
+// openStreamWith works like openStream but negotiates the given
+// protocols.
+func (c *Client) openStreamWith(call *Call, protos []protocol.ID) (network.Stream, error) {
+	if err := c.checkPeer(call.Dest); err != nil {
+		return nil, err
+	}
+	ctx := call.ctx
+	if c.openTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.openTimeout)
+		defer cancel()
+	}
+	noDial := c.noDial || call.opts.noDial
+	if noDial {
+		if c.host.Network().Connectedness(call.Dest) != network.Connected {
+			return nil, ErrNotConnected
+		}
+		ctx = network.WithNoDial(ctx, "rpc: dialing disabled")
+	}
+
+	if call.opts.noRelay {
+		if !noDial && !c.directlyConnected(call.Dest) {
+			if err := c.dialDirect(ctx, call.Dest); err != nil {
+				return nil, openError(ctx, call, err)
+			}
+		}
+		// Only use the connection we have.
+		ctx = network.WithNoDial(ctx, "rpc: relays disabled")
+	}
+
+	s, err := c.host.NewStream(ctx, call.Dest, protos...)
+	if err != nil {
+		return nil, openError(ctx, call, err)
+	}
+	if call.opts.noRelay && isRelayed(s.Conn().RemoteMultiaddr()) {
+		s.Reset()
+		return nil, &clientError{"connection to " + call.Dest.Pretty() + " is relayed"}
+	}
+	if err := checkTransport(call, s.Conn()); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	call.setConnInfo(s.Conn())
+	return s, nil
+}
+
+// openError returns the error to report when opening a stream with the
+// given context failed, telling apart stream open timeouts.
+func openError(ctx context.Context, call *Call, err error) error {
+	if ctx.Err() == context.DeadlineExceeded && call.ctx.Err() == nil {
+		return &clientError{"timed out opening a stream to " + call.Dest.Pretty()}
+	}
+	return err
+}
+
+// directlyConnected returns true when there is a connection to the given
+// peer which does not use a relay.
+func (c *Client) directlyConnected(p peer.ID) bool {
+	for _, conn := range c.host.Network().ConnsToPeer(p) {
+		if !isRelayed(conn.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialDirect connects to the given peer using only its direct addresses.
+func (c *Client) dialDirect(ctx context.Context, p peer.ID) error {
+	var addrs []ma.Multiaddr
+	for _, addr := range c.host.Peerstore().Addrs(p) {
+		if !isRelayed(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return &clientError{"no direct addresses for " + p.Pretty()}
+	}
+	return c.host.Connect(ctx, peer.AddrInfo{ID: p, Addrs: addrs})
+}
@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Servers can advertise the services they provide with a libp2p
+// discovery mechanism (i.e. a rendezvous point or the DHT), so that
+// Clients can call them without knowing their peer IDs beforehand.
+
+// advertiseRetry is the time waited before advertising again
+// after a failure.
+var advertiseRetry = time.Minute
+
+// ServiceNamespace returns the discovery namespace used to advertise and
+// find the peers providing the given service with the given protocol.
+func ServiceNamespace(base protocol.ID, svcName string) string {
+	return string(ServiceProtocol(base, svcName))
+}
+
+// WithDiscovery sets the mechanism used by the Client to find the peers
+// providing a service in CallService().
+func WithDiscovery(d discovery.Discoverer) ClientOption {
+	return func(c *Client) {
+		c.discovery = d
+	}
+}
+
+// Advertise announces all the services registered in the Server using the
+// given Advertiser. Services registered at several versions (see
+// WithVersion) are advertised once, under their name. Advertisements are
+// refreshed in the background until the context is cancelled. Services
+// registered afterwards are not advertised unless Advertise is called
+// again. An error is returned if the first advertisement of any service
+// fails.
+func (server *Server) Advertise(ctx context.Context, a discovery.Advertiser, opts ...discovery.Option) error {
+	seen := make(map[string]bool)
+	var names []string
+	for key := range server.services() {
+		name, _, _ := strings.Cut(key, "@")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		ns := ServiceNamespace(server.protocol, name)
+		ttl, err := a.Advertise(ctx, ns, opts...)
+		if err != nil {
+			return err
+		}
+		go server.readvertise(ctx, a, ns, ttl, opts)
+	}
+	return nil
+}
+
+// readvertise refreshes an advertisement before it expires.
+func (server *Server) readvertise(ctx context.Context, a discovery.Advertiser, ns string, ttl time.Duration, opts []discovery.Option) {
+	wait := 7 * ttl / 8
+	for {
+		if wait <= 0 {
+			wait = advertiseRetry
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		ttl, err := a.Advertise(ctx, ns, opts...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			server.logger.Warnw("error advertising service", "namespace", ns, "error", err)
+			wait = advertiseRetry
+			continue
+		}
+		wait = 7 * ttl / 8
+	}
+}
+
+// CallService performs a call to the given service method on any peer
+// providing it, as found with the discovery mechanism set with
+// WithDiscovery(). Peers are tried in the order in which they are
+// found until one of them can be called. Errors returned by the method
+// are not retried with other peers.
+func (c *Client) CallService(
+	ctx context.Context,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) error {
+	if c.discovery == nil {
+		return &clientError{"cannot call service: discovery not set"}
+	}
+
+	findCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers, err := c.discovery.FindPeers(findCtx, ServiceNamespace(c.protocol, svcName))
+	if err != nil {
+		return newClientError(err)
+	}
+
+	var lastErr error
+	for pi := range peers {
+		if pi.ID == "" {
+			continue
+		}
+		if c.host != nil && pi.ID != c.host.ID() && len(pi.Addrs) > 0 {
+			c.host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+		}
+		err := c.CallContext(ctx, pi.ID, svcName, svcMethod, args, reply, opts...)
+		if err == nil || !IsClientError(err) {
+			return err
+		}
+		c.logger.Debugw("cannot call discovered peer", "peer", pi.ID, "service", svcName, "error", err)
+		lastErr = err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return &clientError{"no peers found providing " + svcName}
+}
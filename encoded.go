@@ -0,0 +1,140 @@
+package rpc
+
+import (
+	"bytes"
+)
+
+// encodedBody holds the arguments or the reply of a call as they were
+// read from a stream, to be decoded later or written to another stream
+// without decoding them (see WithFallback and Proxy). Decoding a body
+// into an encodedBody captures it (see captureBody), and encoding an
+// encodedBody writes the captured body.
+type encodedBody struct {
+	data  []byte
+	codec *Codec
+	name  string
+	raw   bool
+}
+
+// decode decodes the body into v.
+func (eb *encodedBody) decode(v interface{}) error {
+	body := wrapConn(bodyConn{bytes.NewReader(eb.data)}, eb.codec)
+	defer body.release()
+	return body.decodeBody(eb.name, eb.raw, v)
+}
+
+// value decodes the body into a generic value, which is a Raw value for
+// raw bodies, and nil when no body was captured. Strings are decoded as
+// strings with every codec (see Codec.generic), so byte slices encoded
+// as MessagePack strings become strings too.
+func (eb *encodedBody) value() (interface{}, error) {
+	if eb.codec == nil {
+		return nil, nil
+	}
+	var v interface{}
+	if eb.raw {
+		if err := eb.decode(&v); err != nil {
+			return nil, err
+		}
+		b, _ := v.([]byte)
+		return Raw(b), nil
+	}
+	body := wrapConn(bodyConn{bytes.NewReader(eb.data)}, eb.codec.genericCodec())
+	defer body.release()
+	c := body.bodyCodec(eb.name)
+	if c == body.codec {
+		if err := body.decode(&v); err != nil {
+			return nil, err
+		}
+		return genericValue(v), nil
+	}
+	var data []byte
+	if err := body.decode(&data); err != nil {
+		return nil, err
+	}
+	if err := c.genericCodec().unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return genericValue(v), nil
+}
+
+// genericValue prepares a value decoded into an empty interface to be
+// encoded, possibly with another codec: maps with string keys are
+// converted to map[string]interface{}, as the map[interface{}]interface{}
+// values produced by binary codecs cannot be encoded by every codec.
+func genericValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			t[k] = genericValue(e)
+			if s, ok := k.(string); ok {
+				m[s] = t[k]
+			}
+		}
+		if len(m) == len(t) {
+			return m
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = genericValue(e)
+		}
+	}
+	return v
+}
+
+// encodedFor returns the captured body when it can be written as it is
+// to the stream, as a body using the codec with the given name.
+func (eb *encodedBody) encodedFor(sw *streamWrap, name string) ([]byte, bool) {
+	if eb.codec != sw.codec || sw.bodyCodec(eb.name) != sw.bodyCodec(name) {
+		return nil, false
+	}
+	return eb.data, true
+}
+
+// isRawBody returns whether a body is sent as a raw value.
+func isRawBody(v interface{}) bool {
+	if eb, ok := v.(*encodedBody); ok {
+		return eb.raw
+	}
+	_, ok := rawBytes(v)
+	return ok
+}
+
+// captureBody reads the encoded body of a message into eb, to be decoded
+// later (see decodeBody).
+func (sw *streamWrap) captureBody(name string, raw bool, eb *encodedBody) error {
+	var data []byte
+	var err error
+	if raw {
+		var r []byte
+		if err = sw.readRaw(&r); err == nil {
+			data, err = sw.marshalBody("", Raw(r))
+		}
+	} else {
+		data, err = sw.readValue()
+	}
+	if err != nil {
+		return err
+	}
+	*eb = encodedBody{data: data, codec: sw.codec, name: name, raw: raw}
+	return nil
+}
+
+// readValue reads the next value from the stream, returning it encoded.
+// Values of codecs which cannot be read without decoding them are
+// encoded again.
+func (sw *streamWrap) readValue() ([]byte, error) {
+	if sw.codec.scan == nil {
+		var v interface{}
+		if err := sw.dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return sw.codec.marshal(v)
+	}
+	var buf bytes.Buffer
+	if err := sw.codec.scan(&valueReader{r: sw.fr, out: &buf}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,6 +1,10 @@
 package rpc
 
-import "errors"
+import (
+	"errors"
+	"strings"
+	"time"
+)
 
 // responseErr is an enum type for providing error type
 // information over the wire between rpc server and client.
@@ -16,21 +20,37 @@ const (
 	// authorizationErr is an error that has arisen because client doesn't
 	// have permissions to make the given rpc request
 	authorizationErr
+	// overloadedErr is an error that has arisen because the server
+	// is too busy to handle the request.
+	overloadedErr
 )
 
 // serverError indicates that error originated in server
 // specific code.
 type serverError struct {
 	msg string
+	// kind is the error matched by errors.Is, if any, i.e.
+	// ErrNoSuchService.
+	kind error
+	// suggestions are the names suggested by errors for unknown
+	// services and methods.
+	suggestions []string
 }
 
 func (s *serverError) Error() string {
 	return s.msg
 }
 
+func (s *serverError) Is(target error) bool {
+	return s.kind != nil && target == s.kind
+}
+
 // newServerError wraps an error in the serverError type.
 func newServerError(err error) error {
-	return &serverError{err.Error()}
+	if se, ok := err.(*serverError); ok {
+		return se
+	}
+	return &serverError{msg: err.Error()}
 }
 
 // clientError indicates that error originated in client
@@ -45,6 +65,9 @@ func (c *clientError) Error() string {
 
 // newClientError wraps an error in the clientError type.
 func newClientError(err error) error {
+	if ce, ok := err.(*clientError); ok {
+		return ce
+	}
 	return &clientError{err.Error()}
 }
 
@@ -58,21 +81,86 @@ func (a *authorizationError) Error() string {
 	return a.msg
 }
 
+// Is makes authorization errors for failed authentications match
+// ErrUnauthenticated.
+func (a *authorizationError) Is(target error) bool {
+	return target == ErrUnauthenticated && strings.HasPrefix(a.msg, ErrUnauthenticated.Error())
+}
+
 // newAuthorizationError wraps an error in the authorizationError type.
 func newAuthorizationError(err error) error {
 	return &authorizationError{err.Error()}
 }
 
+// overloadedError indicates that the server rejected the request
+// because it is overloaded. The request was not run and can be
+// retried after the suggested time.
+type overloadedError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (o *overloadedError) Error() string {
+	return o.msg
+}
+
+// codedError is an error carrying an application-defined code (see
+// WithErrorCode).
+type codedError struct {
+	err  error
+	code int
+}
+
+func (c *codedError) Error() string {
+	return c.err.Error()
+}
+
+func (c *codedError) Unwrap() error {
+	return c.err
+}
+
+// WithErrorCode attaches an application-defined code to an error. When
+// returned by a method, the code is sent to the client along with the
+// error message, so that callers can tell errors apart without looking
+// at their messages. See ErrorCode().
+func WithErrorCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{err: err, code: code}
+}
+
+// ErrorCode returns the code attached to an error with WithErrorCode, or
+// to the error returned by a remote method, or 0 when there is none.
+func ErrorCode(err error) int {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return 0
+}
+
 // responseError converts an responseErr and error message string
 // into the appropriate error type.
 func responseError(errType responseErr, errMsg string) error {
 	switch errType {
 	case serverErr:
-		return &serverError{errMsg}
+		if errMsg == ErrUnsupportedVersion.Error() {
+			return ErrUnsupportedVersion
+		}
+		if errMsg == ErrEventsLost.Error() {
+			return ErrEventsLost
+		}
+		return &serverError{msg: errMsg, kind: noSuchKind(errMsg)}
 	case clientErr:
+		if strings.HasPrefix(errMsg, ErrInvalidArgs.Error()+":") {
+			return &invalidArgsError{msg: errMsg}
+		}
 		return &clientError{errMsg}
 	case authorizationErr:
 		return &authorizationError{errMsg}
+	case overloadedErr:
+		return &overloadedError{msg: errMsg}
 	default:
 		return errors.New(errMsg)
 	}
@@ -85,20 +173,86 @@ func responseErrorType(err error) responseErr {
 	switch err.(type) {
 	case *serverError:
 		return serverErr
-	case *clientError:
+	case *clientError, *invalidArgsError:
 		return clientErr
 	case *authorizationError:
 		return authorizationErr
+	case *overloadedError:
+		return overloadedErr
 	default:
 		return nonRPCErr
 	}
 }
 
+// newErrorResponse returns the Response header reporting
+// the given error.
+func newErrorResponse(svcID ServiceID, err error) *Response {
+	resp := &Response{
+		Service: svcID,
+		Error:   err.Error(),
+		ErrType: responseErrorType(err),
+		Code:    ErrorCode(err),
+		detail:  errorDetail(err),
+	}
+	if oe, ok := err.(*overloadedError); ok {
+		resp.RetryAfter = oe.retryAfter
+	}
+	switch e := err.(type) {
+	case *serverError:
+		if len(e.suggestions) > 0 {
+			resp.detail = e.suggestions
+		}
+	case *invalidArgsError:
+		if len(e.fields) > 0 {
+			resp.detail = e.fields
+		}
+	}
+	return resp
+}
+
+// responseToError returns the error reported in a Response
+// header, if any.
+func responseToError(resp *Response) error {
+	if resp.Error == "" {
+		return nil
+	}
+	err := responseError(resp.ErrType, resp.Error)
+	if oe, ok := err.(*overloadedError); ok {
+		oe.retryAfter = resp.RetryAfter
+	}
+	// The detail of some errors of the package holds their own
+	// fields, i.e. the suggestions of ErrNoSuchService errors.
+	var fields interface{}
+	switch e := err.(type) {
+	case *serverError:
+		if e.kind != nil {
+			fields = &e.suggestions
+		}
+	case *invalidArgsError:
+		fields = &e.fields
+	}
+	if len(resp.Detail) > 0 {
+		if fields == nil {
+			err = &detailedError{err: err, data: resp.Detail, codec: resp.detailCodec}
+		} else {
+			codec := resp.detailCodec
+			if codec == nil {
+				codec = MsgpackCodec
+			}
+			codec.unmarshal(resp.Detail, fields)
+		}
+	}
+	if resp.Code != 0 {
+		return &codedError{err: err, code: resp.Code}
+	}
+	return err
+}
+
 // IsRPCError returns whether an error is either a serverError
 // or clientError.
 func IsRPCError(err error) bool {
 	switch err.(type) {
-	case *serverError, *clientError, *authorizationError:
+	case *serverError, *clientError, *invalidArgsError, *authorizationError, *overloadedError:
 		return true
 	default:
 		return false
@@ -119,3 +273,19 @@ func IsClientError(err error) bool {
 func IsAuthorizationError(err error) bool {
 	return responseErrorType(err) == authorizationErr
 }
+
+// IsOverloadedError returns whether an error is an overloadedError,
+// meaning that the server rejected the request without running it
+// because it was too busy. See RetryAfter().
+func IsOverloadedError(err error) bool {
+	return responseErrorType(err) == overloadedErr
+}
+
+// RetryAfter returns the time after which the server suggests retrying
+// a request rejected with an overloadedError, or 0 for any other error.
+func RetryAfter(err error) time.Duration {
+	if oe, ok := err.(*overloadedError); ok {
+		return oe.retryAfter
+	}
+	return 0
+}
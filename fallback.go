@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+// Fallback handles the remote calls to services or methods which are not
+// registered in a Server (see WithFallback), i.e. to forward them to
+// another peer. It is given the names of the service and the method, and
+// a function decoding the arguments into the given pointer, which can be
+// called any number of times, and returns the reply to send back.
+type Fallback func(ctx context.Context, svcName, svcMethod string, decodeArgs func(v interface{}) error) (reply interface{}, err error)
+
+// WithFallback sets the Fallback handling the remote calls which do not
+// match any registered service or method. The calls go through the same
+// checks as any other (see WithAuthorizeFunc for instance) and are limited
+// and timed out in the same way. Local calls and subscriptions are not
+// handled by the Fallback.
+func WithFallback(f Fallback) ServerOption {
+	return func(s *Server) {
+		s.fallback = f
+	}
+}
+
+// getServiceOrFallback works like getService, but returns a service and
+// method running the Fallback, if set, when the requested ones do not
+// exist.
+func (server *Server) getServiceOrFallback(svcID ServiceID) (*service, *methodType, error) {
+	svc, mtype, err := server.getService(svcID)
+	if err == nil || server.fallback == nil {
+		return svc, mtype, err
+	}
+
+	f := server.fallback
+	svc, mtype = server.handlerMethod(svcID, func(_ funcService, ctx context.Context, args *encodedBody, reply *interface{}) error {
+		r, err := f(ctx, svcID.Name, svcID.Method, args.decode)
+		*reply = r
+		return err
+	})
+	return svc, mtype, nil
+}
+
+// handlerMethod returns a service and method running the given function
+// for a single request, which is called like a function registered with
+// RegisterFunc, with a funcService receiver.
+func (server *Server) handlerMethod(svcID ServiceID, fn interface{}) (*service, *methodType) {
+	fv := reflect.ValueOf(fn)
+	svc := &service{
+		name:     svcID.Name,
+		rcvr:     reflect.ValueOf(funcService{}),
+		typ:      typeOfFuncService,
+		logger:   server.logger,
+		executor: server.executor,
+	}
+	mtype := &methodType{
+		method:    reflect.Method{Name: svcID.Method, Type: fv.Type(), Func: fv},
+		ArgType:   fv.Type().In(2),
+		ReplyType: fv.Type().In(3),
+	}
+	return svc, mtype
+}
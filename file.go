@@ -0,0 +1,344 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Files are sent with Client.SendFile to a service registered with
+// Server.ReceiveFile, in chunks, each of them a call to the service:
+//
+//	Stat(FileName, *FileStatus)   returns the size received so far
+//	Write(FileChunk, *FileStatus) appends a chunk to the file
+//	Finish(FileEnd, *FileStatus)  checks and completes the file
+//
+// Chunks carry a CRC-32 checksum and the complete file its SHA-256 hash,
+// which are checked by the receiver. Partial files are kept by the
+// FileStore, so that transfers which fail can be resumed from where they
+// stopped by sending the same file again. Files with the same name
+// must not be sent by several clients at the same time.
+
+// DefaultFileChunkSize is the default size of the chunks of files sent
+// with SendFile.
+const DefaultFileChunkSize = 256 << 10
+
+// crcTable is the table of the checksums of file chunks.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileName is the argument of the Stat method of file receivers.
+type FileName struct {
+	Name string
+}
+
+// FileChunk is the argument of the Write method of file receivers.
+type FileChunk struct {
+	Name   string
+	Offset int64
+	Data   []byte
+	// CRC32 is the CRC-32 (Castagnoli) checksum of Data.
+	CRC32 uint32
+}
+
+// FileEnd is the argument of the Finish method of file receivers.
+type FileEnd struct {
+	Name   string
+	Size   int64
+	SHA256 []byte
+}
+
+// FileStatus is the reply of the methods of file receivers.
+type FileStatus struct {
+	// Size is the number of bytes of the file received so far.
+	Size int64
+}
+
+// PartialFile is a file being received, opened by a FileStore.
+type PartialFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Size returns the size of the file.
+	Size() (int64, error)
+}
+
+// FileStore holds the files received by a Server (see ReceiveFile).
+type FileStore interface {
+	// Open opens the partial file with the given name, creating it
+	// when it does not exist.
+	Open(ctx context.Context, name string) (PartialFile, error)
+	// Complete is called once the file with the given name has been
+	// entirely received and checked.
+	Complete(ctx context.Context, name string) error
+	// Remove removes the partial file with the given name, which
+	// failed to be checked.
+	Remove(ctx context.Context, name string) error
+}
+
+// DirStore returns a FileStore keeping the received files in the given
+// directory. Partial files are written with a ".part" suffix, which is
+// removed once they are complete, replacing any file with the same name.
+// Names must not contain paths.
+func DirStore(dir string) FileStore {
+	return dirStore(dir)
+}
+
+type dirStore string
+
+// path returns the path of the partial file with the given name.
+func (d dirStore) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return "", fmt.Errorf("rpc: invalid file name %q", name)
+	}
+	return filepath.Join(string(d), name+".part"), nil
+}
+
+func (d dirStore) Open(ctx context.Context, name string) (PartialFile, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (d dirStore) Complete(ctx context.Context, name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(string(d), name))
+}
+
+func (d dirStore) Remove(ctx context.Context, name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// osFile is a PartialFile of a dirStore.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// fileReceiver is the service receiving files (see ReceiveFile).
+type fileReceiver struct {
+	store FileStore
+}
+
+// ReceiveFile registers a service with the given name receiving the
+// files sent with SendFile, which are kept by the given store.
+func (server *Server) ReceiveFile(svcName string, store FileStore) error {
+	return server.RegisterName(svcName, &fileReceiver{store: store})
+}
+
+// Stat returns the size of the file received so far, where the transfer
+// resumes from.
+func (fr *fileReceiver) Stat(ctx context.Context, in FileName, out *FileStatus) error {
+	f, err := fr.store.Open(ctx, in.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out.Size, err = f.Size()
+	return err
+}
+
+// Write appends a chunk to the file.
+func (fr *fileReceiver) Write(ctx context.Context, in FileChunk, out *FileStatus) error {
+	if crc32.Checksum(in.Data, crcTable) != in.CRC32 {
+		return fmt.Errorf("rpc: checksum mismatch in chunk at offset %d of %s", in.Offset, in.Name)
+	}
+	f, err := fr.store.Open(ctx, in.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if in.Offset != size {
+		return fmt.Errorf("rpc: unexpected offset %d in %s, which has %d bytes", in.Offset, in.Name, size)
+	}
+	if _, err := f.WriteAt(in.Data, in.Offset); err != nil {
+		return err
+	}
+	out.Size = size + int64(len(in.Data))
+	return nil
+}
+
+// Finish checks the size and the hash of the received file and completes
+// it. Files which fail to be checked are removed, to be sent again from
+// the start.
+func (fr *fileReceiver) Finish(ctx context.Context, in FileEnd, out *FileStatus) error {
+	f, err := fr.store.Open(ctx, in.Name)
+	if err != nil {
+		return err
+	}
+	size, err := f.Size()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(f, 0, size))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if size != in.Size || !bytes.Equal(h.Sum(nil), in.SHA256) {
+		if err := fr.store.Remove(ctx, in.Name); err != nil {
+			return err
+		}
+		return fmt.Errorf("rpc: %s does not match the file sent", in.Name)
+	}
+	out.Size = size
+	return fr.store.Complete(ctx, in.Name)
+}
+
+// FileOption allows for functional setting of options on SendFile.
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	chunkSize int
+	progress  func(sent, total int64)
+	size      int64
+	callOpts  []CallOption
+}
+
+// WithChunkSize sets the size of the chunks the file is sent in,
+// DefaultFileChunkSize by default.
+func WithChunkSize(n int) FileOption {
+	return func(o *fileOptions) {
+		if n > 0 {
+			o.chunkSize = n
+		}
+	}
+}
+
+// WithFileSize sets the size of the file, when it cannot be obtained
+// from the reader, to be reported to the progress function.
+func WithFileSize(n int64) FileOption {
+	return func(o *fileOptions) {
+		o.size = n
+	}
+}
+
+// WithFileProgress sets a function called with the number of bytes of
+// the file sent so far, and its total size or -1 when it is unknown,
+// after every chunk. Resumed transfers start from the bytes sent before.
+func WithFileProgress(f func(sent, total int64)) FileOption {
+	return func(o *fileOptions) {
+		o.progress = f
+	}
+}
+
+// WithFileCallOptions sets the options of the calls sending the file,
+// i.e. WithTimeout to limit the time taken by every chunk.
+func WithFileCallOptions(opts ...CallOption) FileOption {
+	return func(o *fileOptions) {
+		o.callOpts = opts
+	}
+}
+
+// readerSize returns the size of the data left in a reader, or -1 when it
+// is unknown.
+func readerSize(r io.Reader) int64 {
+	switch t := r.(type) {
+	case interface{ Len() int }:
+		return int64(t.Len())
+	case *os.File:
+		fi, err := t.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := t.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+	}
+	return -1
+}
+
+// SendFile sends the data of the given reader to the file receiver
+// service svcName of dest (see ReceiveFile), as the file with the given
+// name. When part of the file has been received already, the transfer
+// resumes from there: that part is read from r, to compute the hash of
+// the file, but not sent.
+func (c *Client) SendFile(ctx context.Context, dest peer.ID, svcName, name string, r io.Reader, opts ...FileOption) error {
+	o := fileOptions{chunkSize: DefaultFileChunkSize, size: readerSize(r)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var st FileStatus
+	if err := c.CallContext(ctx, dest, svcName, "Stat", FileName{Name: name}, &st, o.callOpts...); err != nil {
+		return err
+	}
+	h := sha256.New()
+	sent, err := io.CopyN(h, r, st.Size)
+	if err == io.EOF {
+		return fmt.Errorf("rpc: %s has %d bytes already, more than sent", name, st.Size)
+	}
+	if err != nil {
+		return err
+	}
+	if o.progress != nil {
+		o.progress(sent, o.size)
+	}
+
+	buf := make([]byte, o.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		data := buf[:n]
+		h.Write(data)
+		chunk := FileChunk{
+			Name:   name,
+			Offset: sent,
+			Data:   data,
+			CRC32:  crc32.Checksum(data, crcTable),
+		}
+		if err := c.CallContext(ctx, dest, svcName, "Write", chunk, &st, o.callOpts...); err != nil {
+			return err
+		}
+		sent += int64(n)
+		if o.progress != nil {
+			o.progress(sent, o.size)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	end := FileEnd{Name: name, Size: sent, SHA256: h.Sum(nil)}
+	return c.CallContext(ctx, dest, svcName, "Finish", end, &st, o.callOpts...)
+}
@@ -0,0 +1,404 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Messages are delimited by their encoding: a header, whose length is
+// known once it has been decoded, followed by its body. Messages are not
+// prefixed with their length, as that would change the wire format
+// understood by the peers already speaking the protocol, and would need
+// a new protocol version for both encodings to coexist. Because the
+// header tells nothing about the size of the body, every message read
+// from a stream is bounded instead: headers may not exceed maxHeaderSize
+// and bodies the maximum message size of the reading side (see
+// WithServerMaxMessageSize and WithClientMaxMessageSize). Reading past a
+// limit fails, so that garbage or malicious data cannot make the decoder
+// read without bounds, which is what a length prefix checked against the
+// same limits would achieve.
+//
+// Binary encodings declare the lengths of strings and collections before
+// their contents, which decoders may allocate before reading them. Values
+// in those encodings are therefore read in full and checked first (see
+// scanMsgpack and scanCBOR): every declared length must fit in the rest of
+// the message, so that the memory used to decode a value is bounded by
+// its size.
+
+// maxHeaderSize is the maximum size of a request or response header.
+const maxHeaderSize = 1 << 20
+
+// DefaultMaxMessageSize is the default maximum size of the body of the
+// messages read by Clients and Servers. Values in binary encodings are
+// buffered in full before being decoded, so the limit also bounds the
+// memory used by every stream being read. Services exchanging larger
+// messages must raise it on both sides.
+const DefaultMaxMessageSize = 4 << 20
+
+// errMessageTooLarge is returned when reading past the size limit of a
+// message.
+var errMessageTooLarge = errors.New("message exceeds the maximum size")
+
+// WithServerMaxMessageSize sets the maximum size of the arguments read by
+// the Server, DefaultMaxMessageSize by default. Streams carrying larger
+// arguments are aborted. Zero or negative sizes disable the limit.
+func WithServerMaxMessageSize(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithClientMaxMessageSize sets the maximum size of the replies read by the
+// Client, DefaultMaxMessageSize by default. Calls receiving larger replies
+// fail. Zero or negative sizes disable the limit.
+func WithClientMaxMessageSize(n int64) ClientOption {
+	return func(c *Client) {
+		c.maxMessageSize = n
+	}
+}
+
+// frameReader reads the messages of a stream, failing when reading past
+// the limit of the current message.
+type frameReader struct {
+	r *bufio.Reader
+	// left is the number of bytes which can still be read, or -1
+	// when there is no limit.
+	left int64
+}
+
+// setLimit limits the number of bytes which can be read from now on. Zero
+// or negative limits disable it.
+func (fr *frameReader) setLimit(n int64) {
+	if n <= 0 {
+		n = -1
+	}
+	fr.left = n
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	if fr.left == 0 {
+		return 0, errMessageTooLarge
+	}
+	if fr.left > 0 && int64(len(p)) > fr.left {
+		p = p[:fr.left]
+	}
+	n, err := fr.r.Read(p)
+	if fr.left > 0 {
+		fr.left -= int64(n)
+	}
+	return n, err
+}
+
+func (fr *frameReader) ReadByte() (byte, error) {
+	if fr.left == 0 {
+		return 0, errMessageTooLarge
+	}
+	b, err := fr.r.ReadByte()
+	if err == nil && fr.left > 0 {
+		fr.left--
+	}
+	return b, err
+}
+
+func (fr *frameReader) UnreadByte() error {
+	err := fr.r.UnreadByte()
+	if err == nil && fr.left >= 0 {
+		fr.left++
+	}
+	return err
+}
+
+// remaining returns the number of bytes which can still be read, or -1
+// when there is no limit.
+func (fr *frameReader) remaining() int64 {
+	return fr.left
+}
+
+// withMaxSize sets the maximum size of the message bodies read from the
+// stream (see frameReader) and returns the streamWrap.
+func (sw *streamWrap) withMaxSize(n int64) *streamWrap {
+	sw.maxSize = n
+	return sw
+}
+
+// readHeader decodes the header of the next message from the stream, and
+// limits the reading of its body to the maximum size of the stream.
+func (sw *streamWrap) readHeader(v interface{}) error {
+	sw.fr.setLimit(maxHeaderSize)
+	var err error
+	if sw.codec.routing && isRoutedHeader(v) {
+		err = sw.readRoutedHeader(v)
+	} else {
+		err = sw.decode(v)
+	}
+	sw.fr.setLimit(sw.maxSize)
+	return err
+}
+
+// maxValueBuffer is the capacity of the buffer used to read values (see
+// decode) kept between values.
+const maxValueBuffer = 64 << 10
+
+// decode decodes the next value from the stream into v. Values in binary
+// encodings are read and checked before being decoded.
+func (sw *streamWrap) decode(v interface{}) error {
+	if sw.codec.scan == nil {
+		return sw.dec.Decode(v)
+	}
+	sw.vbuf.Reset()
+	if err := sw.codec.scan(&valueReader{r: sw.fr, out: &sw.vbuf}); err != nil {
+		return err
+	}
+	err := sw.codec.decodeChecked(sw.vbuf.Bytes(), v)
+	if sw.vbuf.Cap() > maxValueBuffer {
+		sw.vbuf = bytes.Buffer{}
+	}
+	return err
+}
+
+// messageReader is a source of encoded values.
+type messageReader interface {
+	io.Reader
+	io.ByteReader
+	// remaining returns the number of bytes left in the message,
+	// or -1 when unknown.
+	remaining() int64
+}
+
+// bytesReader reads values from a byte slice.
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (br bytesReader) remaining() int64 {
+	return int64(br.Len())
+}
+
+// errInvalidLength is returned when a value declares a length which
+// exceeds the rest of the message.
+var errInvalidLength = errors.New("declared length exceeds the size of the message")
+
+// valueReader reads an encoded value for a scanning function, copying it
+// to out when set.
+type valueReader struct {
+	r   messageReader
+	out *bytes.Buffer
+	// start is set before reading the first byte of a value.
+	start bool
+}
+
+// next reads the first byte of the next item. Reaching the end of the
+// stream is only unexpected after the start of the value.
+func (vr *valueReader) next() (byte, error) {
+	if !vr.start {
+		return vr.byte()
+	}
+	vr.start = false
+	b, err := vr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if vr.out != nil {
+		vr.out.WriteByte(b)
+	}
+	return b, nil
+}
+
+// byte reads a byte.
+func (vr *valueReader) byte() (byte, error) {
+	b, err := vr.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if vr.out != nil {
+		vr.out.WriteByte(b)
+	}
+	return b, nil
+}
+
+// uint reads an unsigned big-endian integer of n bytes.
+func (vr *valueReader) uint(n int) (uint64, error) {
+	var u uint64
+	for i := 0; i < n; i++ {
+		b, err := vr.byte()
+		if err != nil {
+			return 0, err
+		}
+		u = u<<8 | uint64(b)
+	}
+	return u, nil
+}
+
+// skip reads n bytes. The copy grows as they arrive, regardless of n.
+func (vr *valueReader) skip(n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	if err := vr.fits(n); err != nil {
+		return err
+	}
+	var w io.Writer = io.Discard
+	if vr.out != nil {
+		w = vr.out
+	}
+	_, err := io.CopyN(w, vr.r, int64(n))
+	return unexpectedEOF(err)
+}
+
+// fits checks that n bytes, or items of at least a byte, fit in the rest
+// of the message.
+func (vr *valueReader) fits(n uint64) error {
+	if n > math.MaxInt64 {
+		return errInvalidLength
+	}
+	if left := vr.r.remaining(); left >= 0 && int64(n) > left {
+		return errInvalidLength
+	}
+	return nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads in the
+// middle of a value.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// scanMsgpack reads a MessagePack value.
+func scanMsgpack(vr *valueReader) error {
+	// pending counts the values still to read, including the items
+	// of the collections being read, each taking at least a byte.
+	vr.start = true
+	for pending := uint64(1); pending > 0; pending-- {
+		b, err := vr.next()
+		if err != nil {
+			return err
+		}
+
+		var items, size uint64
+		switch {
+		case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+			// Fixed integers, nil and booleans.
+		case b <= 0x8f:
+			items = 2 * uint64(b&0x0f)
+		case b <= 0x9f:
+			items = uint64(b & 0x0f)
+		case b <= 0xbf:
+			size = uint64(b & 0x1f)
+		case b == 0xc4 || b == 0xd9:
+			size, err = vr.uint(1)
+		case b == 0xc5 || b == 0xda:
+			size, err = vr.uint(2)
+		case b == 0xc6 || b == 0xdb:
+			size, err = vr.uint(4)
+		case b == 0xc7, b == 0xc8, b == 0xc9:
+			// Extensions: length and type.
+			size, err = vr.uint(1 << (b - 0xc7))
+			size++
+		case b == 0xca:
+			size = 4
+		case b == 0xcb:
+			size = 8
+		case b >= 0xcc && b <= 0xd3:
+			size = 1 << (b & 0x03)
+		case b >= 0xd4 && b <= 0xd8:
+			size = 1 + 1<<(b-0xd4)
+		case b == 0xdc:
+			items, err = vr.uint(2)
+		case b == 0xdd:
+			items, err = vr.uint(4)
+		case b == 0xde:
+			items, err = vr.uint(2)
+			items *= 2
+		case b == 0xdf:
+			items, err = vr.uint(4)
+			items *= 2
+		default:
+			return fmt.Errorf("invalid msgpack descriptor: 0x%x", b)
+		}
+		if err != nil {
+			return err
+		}
+		if err := vr.skip(size); err != nil {
+			return err
+		}
+		if items > 0 {
+			if err := vr.fits(pending - 1 + items); err != nil {
+				return err
+			}
+			pending += items
+		}
+	}
+	return nil
+}
+
+// scanCBOR reads a CBOR value. Indefinite lengths, which CBORCodec never
+// uses, are not supported.
+func scanCBOR(vr *valueReader) error {
+	vr.start = true
+	for pending := uint64(1); pending > 0; pending-- {
+		b, err := vr.next()
+		if err != nil {
+			return err
+		}
+
+		major, info := b>>5, b&0x1f
+		var arg uint64
+		switch {
+		case info < 24:
+			arg = uint64(info)
+		case info <= 27:
+			arg, err = vr.uint(1 << (info - 24))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported CBOR item: 0x%x", b)
+		}
+
+		var items uint64
+		switch major {
+		case 2, 3: // byte and text strings
+			if err := vr.skip(arg); err != nil {
+				return err
+			}
+		case 4: // arrays
+			items = arg
+		case 5: // maps
+			if arg > math.MaxInt64/2 {
+				return errInvalidLength
+			}
+			items = 2 * arg
+		case 6: // tags
+			items = 1
+		}
+		if items > 0 {
+			if err := vr.fits(pending - 1 + items); err != nil {
+				return err
+			}
+			pending += items
+		}
+	}
+	return nil
+}
+
+// check checks the given number of values encoded one after another in
+// data, when the codec needs it (see decode).
+func (c *Codec) check(data []byte, n int) error {
+	if c.scan == nil {
+		return nil
+	}
+	vr := &valueReader{r: bytesReader{bytes.NewReader(data)}}
+	for i := 0; i < n; i++ {
+		if err := c.scan(vr); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// funcService is the receiver of the services made of functions (see
+// RegisterFunc).
+type funcService struct{}
+
+var typeOfFuncService = reflect.TypeOf(funcService{})
+
+// RegisterFunc registers a function as the method svcMethod of the service
+// svcName, so that handlers need not be methods of an exported type. The
+// function must have the signature of a method, without the receiver:
+//
+//	func(ctx context.Context, argType T1, replyType *T2) error
+//
+// or take a Respond function to be asynchronous (see Respond). Functions
+// can be added to the same service one by one, but not to services
+// registered with Register or RegisterName, and methods cannot be
+// replaced.
+func (server *Server) RegisterFunc(svcName, svcMethod string, fn interface{}) error {
+	if svcName == "" || svcMethod == "" {
+		return errors.New("rpc.RegisterFunc: the service and method names must be set")
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("rpc.RegisterFunc: %s.%s is not a function", svcName, svcMethod)
+	}
+	ft := fv.Type()
+	if ft.IsVariadic() {
+		return fmt.Errorf("rpc.RegisterFunc: %s.%s is variadic", svcName, svcMethod)
+	}
+
+	// The function is wrapped into a method of funcService.
+	ins := []reflect.Type{typeOfFuncService}
+	for i := 0; i < ft.NumIn(); i++ {
+		ins = append(ins, ft.In(i))
+	}
+	outs := make([]reflect.Type, ft.NumOut())
+	for i := range outs {
+		outs[i] = ft.Out(i)
+	}
+	wrapperType := reflect.FuncOf(ins, outs, false)
+	wrapper := reflect.MakeFunc(wrapperType, func(args []reflect.Value) []reflect.Value {
+		return fv.Call(args[1:])
+	})
+	mtype := suitableMethod(reflect.Method{Name: svcMethod, Type: wrapperType, Func: wrapper}, true)
+	if mtype == nil {
+		str := "rpc.RegisterFunc: " + svcName + "." + svcMethod + " has not a suitable type"
+		log.Print(str)
+		return errors.New(str)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	m := server.copyServices()
+	// Services are copied, as their methods are read without
+	// holding the lock.
+	s := &service{
+		name:     svcName,
+		rcvr:     reflect.ValueOf(funcService{}),
+		typ:      typeOfFuncService,
+		method:   map[string]*methodType{svcMethod: mtype},
+		logger:   server.logger,
+		executor: server.executor,
+	}
+	if old, present := m[svcName]; present {
+		if old.typ != typeOfFuncService {
+			return errors.New("rpc: service already defined: " + svcName)
+		}
+		if _, ok := old.method[svcMethod]; ok {
+			return errors.New("rpc: method already defined: " + svcName + "." + svcMethod)
+		}
+		for name, m := range old.method {
+			s.method[name] = m
+		}
+	}
+	m[svcName] = s
+	server.serviceMap.Store(m)
+	server.setServiceHandlers(svcName)
+	return nil
+}
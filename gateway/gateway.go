@@ -0,0 +1,188 @@
+// Package gateway exposes go-libp2p-gorpc services over HTTP, so that they
+// can be called with JSON bodies by tools like curl or from browsers,
+// without a libp2p stack on the caller side.
+//
+// A Gateway handles POST requests to /rpc/{service}/{method}. The request
+// body is the JSON-encoded argument for the method, which may not be
+// empty or null, nor larger than the limit of the Gateway (see
+// WithMaxBodySize), and the response body is the JSON-encoded reply.
+// Calls are performed against the destination peer configured in the
+// Gateway, which can be overridden with the "peer" query parameter.
+//
+// Since the Gateway does not know the Go types used by the services,
+// arguments and replies are handled as generic values: JSON objects are
+// sent as maps, which the server decodes into the fields of the same name,
+// and replies are converted back to JSON objects. Byte strings in replies
+// are rendered as JSON strings when they are valid UTF-8. Calls to the
+// local server of the client are converted the same way, by encoding the
+// arguments and decoding them into the types of the methods.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	logging "github.com/ipfs/go-log/v2"
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+	"github.com/libp2p/go-libp2p-gorpc/internal/jsonargs"
+)
+
+var logger = logging.Logger("p2p-gorpc-gateway")
+
+// Prefix is the path prefix handled by the Gateway.
+const Prefix = "/rpc/"
+
+// Option allows for functional setting of options on a Gateway.
+type Option func(*Gateway)
+
+// WithTimeout sets a timeout for the calls performed by the Gateway.
+func WithTimeout(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// DefaultMaxBodySize is the default maximum size of the request bodies
+// read by a Gateway.
+const DefaultMaxBodySize = 1 << 20
+
+// WithMaxBodySize sets the maximum size of the request bodies read by the
+// Gateway, DefaultMaxBodySize by default. Requests with larger bodies
+// fail with 413 (Request Entity Too Large).
+func WithMaxBodySize(n int64) Option {
+	return func(g *Gateway) {
+		g.maxBodySize = n
+	}
+}
+
+// Gateway is an http.Handler which translates HTTP requests into RPC
+// calls.
+type Gateway struct {
+	client      *rpc.Client
+	dest        peer.ID
+	timeout     time.Duration
+	maxBodySize int64
+}
+
+// New returns a Gateway which performs calls with the given client to
+// the given destination (an empty destination means calling the local
+// server of the client).
+func New(c *rpc.Client, dest peer.ID, opts ...Option) *Gateway {
+	g := &Gateway{
+		client:      c,
+		dest:        dest,
+		maxBodySize: DefaultMaxBodySize,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// errorResponse is the JSON body sent when a call fails.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP handles a request to call a method.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, Prefix), "/")
+	if !strings.HasPrefix(r.URL.Path, Prefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, http.StatusNotFound, "path must be "+Prefix+"{service}/{method}")
+		return
+	}
+	svcName, svcMethod := parts[0], parts[1]
+
+	dest := g.dest
+	if p := r.URL.Query().Get("peer"); p != "" {
+		pid, err := peer.Decode(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid peer: "+err.Error())
+			return
+		}
+		dest = pid
+	}
+
+	body := &bodyReader{r: http.MaxBytesReader(w, r.Body, g.maxBodySize)}
+	args, err := jsonargs.Decode(body)
+	switch {
+	case body.err != nil:
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", g.maxBodySize))
+		return
+	case err == io.EOF || (err == nil && args == nil):
+		writeError(w, http.StatusBadRequest, "missing arguments in the request body")
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	var opts []rpc.CallOption
+	if g.timeout > 0 {
+		opts = append(opts, rpc.WithTimeout(g.timeout))
+	}
+
+	var reply interface{}
+	err = g.client.CallContext(r.Context(), dest, svcName, svcMethod, args, &reply, opts...)
+	if err != nil {
+		logger.Debugf("%s.%s call failed: %s", svcName, svcMethod, err)
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jsonargs.ToJSON(reply)); err != nil {
+		logger.Error("error encoding reply:", err)
+	}
+}
+
+// bodyReader reads a request body, recording the errors other than
+// io.EOF, that is, bodies over the size limit, to tell them from
+// invalid JSON.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
+
+// errorStatus returns the HTTP status code for a call error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, rpc.ErrNoSuchService), errors.Is(err, rpc.ErrNoSuchMethod):
+		return http.StatusNotFound
+	case errors.Is(err, rpc.ErrInvalidArgs):
+		return http.StatusBadRequest
+	case rpc.IsAuthorizationError(err):
+		return http.StatusForbidden
+	case rpc.IsClientError(err):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{msg})
+}
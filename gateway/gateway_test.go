@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+	"github.com/libp2p/go-libp2p-gorpc/rpctest"
+)
+
+type Args struct {
+	A, B int
+	Name string
+}
+
+type Reply struct {
+	Result   int
+	Greeting string
+}
+
+type Arith struct{}
+
+func (a *Arith) Multiply(ctx context.Context, args Args, r *Reply) error {
+	r.Result = args.A * args.B
+	r.Greeting = "hello " + args.Name
+	return nil
+}
+
+func (a *Arith) Fail(ctx context.Context, args Args, r *Reply) error {
+	return errors.New("failed")
+}
+
+func TestGateway(t *testing.T) {
+	mc := rpctest.NewMockClient()
+	defer mc.Close()
+	mc.Register(&Arith{})
+
+	g := New(mc.Client, "")
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		g.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/rpc/Arith/Multiply", `{"A": 2, "B": 3, "Name": "gateway"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("unexpected status:", rec.Code, rec.Body.String())
+	}
+	var reply Reply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != 6 || reply.Greeting != "hello gateway" {
+		t.Error("unexpected reply:", rec.Body.String())
+	}
+
+	rec = post("/rpc/Arith/Fail", `{}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("unexpected status:", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "failed") {
+		t.Error("unexpected error body:", rec.Body.String())
+	}
+
+	rec = post("/rpc/Arith", `{}`)
+	if rec.Code != http.StatusNotFound {
+		t.Error("unexpected status:", rec.Code)
+	}
+
+	rec = post("/rpc/Arith/Multiply", `{"A": `)
+	if rec.Code != http.StatusBadRequest {
+		t.Error("unexpected status:", rec.Code)
+	}
+
+	for _, body := range []string{"", "null"} {
+		if rec = post("/rpc/Arith/Multiply", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status with body %q: %d", body, rec.Code)
+		}
+	}
+
+	for _, path := range []string{"/rpc/Arith/Divide", "/rpc/Algebra/Multiply"} {
+		if rec = post(path, `{}`); rec.Code != http.StatusNotFound {
+			t.Errorf("unexpected status calling %s: %d", path, rec.Code)
+		}
+	}
+
+	small := New(mc.Client, "", WithMaxBodySize(16))
+	rec = httptest.NewRecorder()
+	small.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rpc/Arith/Multiply", strings.NewReader(`{"A": 2, "B": 3, "Name": "gateway"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Error("unexpected status:", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rpc/Arith/Multiply", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Error("unexpected status:", rec.Code)
+	}
+}
+
+func TestGatewayLocal(t *testing.T) {
+	s := rpc.NewServer(nil, "")
+	if err := s.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	g := New(rpc.NewClientWithServer(nil, "", s), "")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/rpc/Arith/Multiply", strings.NewReader(`{"A": 2, "B": 3, "Name": "local"}`))
+	g.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal("unexpected status:", rec.Code, rec.Body.String())
+	}
+	var reply Reply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != 6 || reply.Greeting != "hello local" {
+		t.Error("unexpected reply:", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/rpc/Arith/Multiply", strings.NewReader(`{"A": "two"}`))
+	g.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Error("expected arguments of the wrong type to fail")
+	}
+
+	// Empty bodies are rejected before reaching the server.
+	for _, body := range []string{"", "null"} {
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, "/rpc/Arith/Multiply", strings.NewReader(body))
+		g.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status with body %q: %d", body, rec.Code)
+		}
+	}
+
+	// Local calls with nil arguments fail instead of panicking.
+	var reply2 Reply
+	err := rpc.NewClientWithServer(nil, "", s).Call("", "Arith", "Multiply", nil, &reply2)
+	if !rpc.IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+}
@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Peers supporting the handshake exchange the features they support over
+// a dedicated stream the first time they talk, so that clients only use
+// the features that servers understand (see WithHandshake). The client
+// writes its Features and the server answers with its own, after which
+// the stream is closed. Both sides cache the features of the other per
+// peer. Peers which do not handle the handshake protocol are considered
+// legacy peers, with the features of Version 0.
+
+// ProtocolVersion is the version of the protocol spoken by this package,
+// sent in the handshake.
+const ProtocolVersion = 1
+
+// Features describes what a peer supports.
+type Features struct {
+	// Version is the protocol version of the peer. It is zero for
+	// peers which do not support the handshake, whose features are
+	// unknown and assumed to be the most basic ones.
+	Version int
+	// Codecs lists the names of the codecs that can be requested for
+	// arguments and replies (see WithCodec).
+	Codecs []string `codec:",omitempty"`
+	// Compression lists the supported compression algorithms.
+	Compression []string `codec:",omitempty"`
+	// Streaming indicates support for subscriptions (see
+	// Client.Subscribe).
+	Streaming bool `codec:",omitempty"`
+	// Pipelining indicates support for pipelined streams (see
+	// WithPipelining).
+	Pipelining bool `codec:",omitempty"`
+	// MaxMessageSize is the maximum size of the message bodies read
+	// by the peer, or zero when it is not limited or unknown.
+	MaxMessageSize int64 `codec:",omitempty"`
+}
+
+// SupportsCodec returns true when the codec with the given name is
+// supported. MsgpackCodec, the default, is always supported.
+func (f *Features) SupportsCodec(name string) bool {
+	if name == "" || name == MsgpackCodec.name {
+		return true
+	}
+	for _, c := range f.Codecs {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCompression returns true when the compression with the given
+// name is supported.
+func (f *Features) SupportsCompression(name string) bool {
+	for _, c := range f.Compression {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// localFeatures returns the features supported by this package, with the
+// given maximum message size.
+func localFeatures(maxSize int64) *Features {
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	return &Features{
+		Version:        ProtocolVersion,
+		Codecs:         []string{MsgpackCodec.name, JSONCodec.name, CBORCodec.name},
+		Compression:    []string{gzipCompression},
+		Streaming:      true,
+		Pipelining:     true,
+		MaxMessageSize: maxSize,
+	}
+}
+
+// legacyFeatures are the features assumed for peers which do not support
+// the handshake.
+var legacyFeatures = &Features{}
+
+// HandshakeProtocol returns the protocol used by clients to open handshake
+// streams to servers using the given base protocol.
+func HandshakeProtocol(base protocol.ID) protocol.ID {
+	return protocol.ID(string(base) + "/handshake")
+}
+
+// WithHandshake makes the Client perform a handshake with every peer
+// before its first remote call to it, and adapt the calls to the features
+// of the peer: the codec requested with WithCodec falls back to the codec
+// of the stream when the peer does not support it, pipelining and
+// compression (see WithClientCompression) are only used with peers
+// supporting them, subscriptions fail right away with peers not
+// supporting them, and Raw arguments larger than the maximum message
+// size of the peer are not sent. When the handshake cannot be completed
+// because the peer cannot be reached, calls proceed as usual and the
+// handshake is attempted again with the next call.
+func WithHandshake() ClientOption {
+	return func(c *Client) {
+		c.features = newFeatureCache()
+	}
+}
+
+// featureCache holds the features of peers, making sure that a single
+// handshake is performed with every peer at a time.
+type featureCache struct {
+	mu       sync.Mutex
+	features map[peer.ID]*Features
+	pending  map[peer.ID]chan struct{}
+}
+
+func newFeatureCache() *featureCache {
+	return &featureCache{
+		features: make(map[peer.ID]*Features),
+		pending:  make(map[peer.ID]chan struct{}),
+	}
+}
+
+// get returns the features of the given peer, if known.
+func (fc *featureCache) get(p peer.ID) (*Features, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	f, ok := fc.features[p]
+	return f, ok
+}
+
+// set records the features of the given peer.
+func (fc *featureCache) set(p peer.ID, f *Features) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.features[p] = f
+}
+
+// load returns the features of the given peer, obtaining them with fetch
+// unless known. Concurrent loads for the same peer wait for the first
+// one. A nil result from fetch is not cached.
+func (fc *featureCache) load(p peer.ID, fetch func() *Features) *Features {
+	fc.mu.Lock()
+	if f, ok := fc.features[p]; ok {
+		fc.mu.Unlock()
+		return f
+	}
+	if wait, ok := fc.pending[p]; ok {
+		fc.mu.Unlock()
+		<-wait
+		f, _ := fc.get(p)
+		return f
+	}
+	done := make(chan struct{})
+	fc.pending[p] = done
+	fc.mu.Unlock()
+
+	f := fetch()
+
+	fc.mu.Lock()
+	if f != nil {
+		fc.features[p] = f
+	}
+	delete(fc.pending, p)
+	fc.mu.Unlock()
+	close(done)
+	return f
+}
+
+// PeerFeatures returns the features of the given peer, as learned in the
+// handshake (see WithHandshake).
+func (c *Client) PeerFeatures(p peer.ID) (*Features, bool) {
+	if c.features == nil {
+		return nil, false
+	}
+	return c.features.get(p)
+}
+
+// negotiate returns the features of the destination of the call,
+// performing the handshake unless they are known. It returns nil when
+// the handshake is disabled or could not be completed.
+func (c *Client) negotiate(call *Call) *Features {
+	if c.features == nil {
+		return nil
+	}
+	return c.features.load(call.Dest, func() *Features {
+		return c.handshake(call)
+	})
+}
+
+// handshake exchanges features with the destination of the call.
+func (c *Client) handshake(call *Call) *Features {
+	protos := append([]protocol.ID{c.protocol}, c.extraProtocols...)
+	hsProtos := make([]protocol.ID, len(protos))
+	for i, p := range protos {
+		hsProtos[i] = HandshakeProtocol(p)
+	}
+	s, err := c.openStreamWith(call, hsProtos)
+	if err != nil {
+		return c.handshakeFailed(call, err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	call.watchStream(s, stop)
+
+	sWrap := wrapStream(s, codecFor(c.codecs, s.Protocol())).withMaxSize(maxHeaderSize)
+	defer sWrap.release()
+	var f Features
+	err = sWrap.enc.Encode(localFeatures(c.maxMessageSize))
+	if err == nil {
+		err = sWrap.w.Flush()
+	}
+	if err == nil {
+		err = sWrap.readHeader(&f)
+	}
+	if err != nil {
+		s.Reset()
+		return c.handshakeFailed(call, err)
+	}
+	go helpers.FullClose(s)
+	c.streamLogger.Debugw("handshake completed", "peer", call.Dest, "version", f.Version)
+	return &f
+}
+
+// handshakeFailed returns the features of a peer with which the handshake
+// failed with the given error: legacy features when it is connected, as
+// it must have refused the protocol (which may only show when reading,
+// as the protocol is negotiated lazily for peers which announce it), or
+// nil otherwise.
+func (c *Client) handshakeFailed(call *Call, err error) *Features {
+	if call.ctx.Err() == nil && c.host.Network().Connectedness(call.Dest) == network.Connected {
+		c.streamLogger.Debugw("peer does not support the handshake", "peer", call.Dest, "error", err)
+		return legacyFeatures
+	}
+	c.streamLogger.Debugw("handshake failed", "peer", call.Dest, "error", err)
+	return nil
+}
+
+// adapt adjusts the call to the features of its destination, returning
+// an error when it cannot be performed.
+func (c *Client) adapt(call *Call, f *Features) error {
+	if f == nil {
+		return nil
+	}
+	if !f.SupportsCodec(call.SvcID.Codec) {
+		c.logger.Debugw("codec not supported by the peer, using the stream codec", "peer", call.Dest, "codec", call.SvcID.Codec)
+		call.SvcID.Codec = ""
+	}
+	if !f.SupportsCompression(gzipCompression) {
+		call.compressAbove = 0
+	}
+	if data, ok := rawBytes(call.Args); ok && f.MaxMessageSize > 0 && int64(len(data)) > f.MaxMessageSize {
+		return &clientError{"the arguments exceed the maximum message size of " + call.Dest.Pretty()}
+	}
+	return nil
+}
+
+// pipelinesSupported returns false when the given peer is known not to
+// support pipelined streams.
+func (c *Client) pipelinesSupported(p peer.ID) bool {
+	f, ok := c.PeerFeatures(p)
+	return !ok || f.Pipelining
+}
+
+// PeerFeatures returns the features of the given peer, as learned in the
+// handshake it initiated, if any.
+func (server *Server) PeerFeatures(p peer.ID) (*Features, bool) {
+	return server.features.get(p)
+}
+
+// handleHandshake is the libp2p stream handler for handshake streams.
+func (server *Server) handleHandshake(stream network.Stream) {
+	if !server.acceptStream(stream) {
+		return
+	}
+	sWrap := wrapStream(stream, codecFor(server.codecs, stream.Protocol())).withMaxSize(maxHeaderSize)
+	defer sWrap.release()
+	var f Features
+	if err := sWrap.readHeader(&f); err != nil {
+		server.streamLogger.Debugw("error reading handshake", "peer", sWrap.remotePeer(), "error", err)
+		stream.Reset()
+		return
+	}
+	server.features.set(sWrap.remotePeer(), &f)
+	err := sWrap.enc.Encode(localFeatures(server.maxMessageSize))
+	if err == nil {
+		err = sWrap.w.Flush()
+	}
+	if err != nil {
+		server.streamLogger.Debugw("error sending handshake", "peer", sWrap.remotePeer(), "error", err)
+		stream.Reset()
+		return
+	}
+	helpers.FullClose(stream)
+}
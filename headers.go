@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Request and response headers are encoded with the codec of the stream,
+// like the bodies. Codecs returned by WithRoutingHeaders write them in a
+// length-prefixed format instead, which starts with the service and the
+// method, so that routers and implementations in other languages can
+// route requests without decoding the header with the codec:
+//
+//	header: uvarint(len(name)) name uvarint(len(method)) method uvarint(len(rest)) rest
+//
+// where name and method are those of the request (ServiceID), or of the
+// request answered by the response (Response.Service), and rest is the
+// header encoded with the codec, with empty service and method names.
+// Bodies are written in the same way with both formats.
+
+// WithRoutingHeaders returns a codec working like c, but writing the
+// headers of requests and responses in the routing format described
+// above. It must be used by both the Clients and the Servers of a
+// protocol (see WithServerCodec and WithClientCodec). Only codecs with a
+// binary encoding, such as MsgpackCodec and CBORCodec, support it: c is
+// returned as it is otherwise, as the whitespace following JSON values
+// could not be told apart from the lengths of the fields.
+func (c *Codec) WithRoutingHeaders() *Codec {
+	if c.scan == nil {
+		return c
+	}
+	return &Codec{
+		name:    c.name,
+		handle:  c.handle,
+		scan:    c.scan,
+		generic: c.generic,
+		routing: true,
+	}
+}
+
+// writeHeader writes a request or response header to the stream.
+func (sw *streamWrap) writeHeader(v interface{}) error {
+	if !sw.codec.routing {
+		return sw.enc.Encode(v)
+	}
+	var name, method string
+	switch h := v.(type) {
+	case ServiceID:
+		name, method = h.Name, h.Method
+		h.Name, h.Method = "", ""
+		v = h
+	case *Response:
+		r := *h
+		name, method = r.Service.Name, r.Service.Method
+		r.Service.Name, r.Service.Method = "", ""
+		v = &r
+	default:
+		return sw.enc.Encode(v)
+	}
+	rest, err := sw.codec.marshal(v)
+	if err != nil {
+		return err
+	}
+	for _, field := range [][]byte{[]byte(name), []byte(method), rest} {
+		if err := sw.writeRaw(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRoutedHeader reads a request or response header written in the
+// routing format into v.
+func (sw *streamWrap) readRoutedHeader(v interface{}) error {
+	var fields [3][]byte
+	for i := range fields {
+		size, err := binary.ReadUvarint(sw.fr)
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if size > maxHeaderSize {
+			return fmt.Errorf("header too large: %d bytes", size)
+		}
+		fields[i] = make([]byte, size)
+		if _, err := io.ReadFull(sw.fr, fields[i]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	if err := sw.codec.unmarshal(fields[2], v); err != nil {
+		return err
+	}
+	name, method := string(fields[0]), string(fields[1])
+	switch h := v.(type) {
+	case *ServiceID:
+		h.Name, h.Method = name, method
+	case *Response:
+		h.Service.Name, h.Service.Method = name, method
+	}
+	return nil
+}
+
+// isRoutedHeader returns whether v is a header read in the routing
+// format by codecs using it.
+func isRoutedHeader(v interface{}) bool {
+	switch v.(type) {
+	case *ServiceID, *Response:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"errors"
+	"time"
+)
+
+// Heartbeats tell methods which take long to run apart from peers which
+// vanished: calls made with WithHeartbeat ask the server to send
+// heartbeats while the method runs, and fail when nothing arrives from
+// the server for a while, however long the method runs. Heartbeats are
+// Response headers with Heartbeat set, sent before the final response
+// like progress updates.
+
+// minHeartbeatInterval is the shortest interval between heartbeats sent
+// by servers.
+const minHeartbeatInterval = 50 * time.Millisecond
+
+// errNoHeartbeat is returned by calls made with WithHeartbeat when the
+// server stops sending heartbeats.
+var errNoHeartbeat = errors.New("rpc: no heartbeat received from the server in time")
+
+// WithHeartbeat asks the server to send a heartbeat every interval while
+// the method runs, and fails the call when nothing is received from the
+// server for timeout, which should be a few intervals. The call may
+// still last longer than timeout, unlike with WithTimeout. Servers of
+// versions without support for heartbeats do not send them, so calls to
+// them fail when they take longer than timeout. The timeout only applies
+// to calls made over streams which support read deadlines, and not to
+// pipelined calls (see WithPipelining).
+func WithHeartbeat(interval, timeout time.Duration) CallOption {
+	return func(o *callOptions) {
+		if interval <= 0 || timeout <= 0 {
+			o.heartbeat, o.heartbeatTimeout = 0, 0
+			return
+		}
+		o.heartbeat = interval
+		o.heartbeatTimeout = timeout
+	}
+}
+
+// heartbeats sends heartbeats at the given interval until the response
+// is sent or the stream fails.
+func (pr *progressReporter) heartbeats(interval time.Duration) {
+	if interval < minHeartbeatInterval {
+		interval = minHeartbeatInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-pr.stop:
+			return
+		case <-t.C:
+		}
+		if err := pr.heartbeat(); err != nil {
+			return
+		}
+	}
+}
+
+func (pr *progressReporter) heartbeat() error {
+	pr.s.wmu.Lock()
+	defer pr.s.wmu.Unlock()
+	if pr.stopped {
+		return errProgressAfterResponse
+	}
+	resp := &Response{
+		Service:   pr.svcID,
+		Heartbeat: true,
+	}
+	if err := pr.s.writeHeader(resp); err != nil {
+		return err
+	}
+	return pr.s.flushMessage()
+}
+
+// readDeadliner is implemented by the streams and connections which
+// support read deadlines.
+type readDeadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// heartbeatWait limits the time waited for the next message from the
+// server by a call made with WithHeartbeat.
+type heartbeatWait struct {
+	rd       readDeadliner
+	call     *Call
+	deadline time.Time
+}
+
+// awaitHeartbeat sets a read deadline on the stream for the next message
+// from the server, when the call requested heartbeats. It returns nil
+// otherwise, or when the stream does not support read deadlines.
+func (s *streamWrap) awaitHeartbeat(call *Call) *heartbeatWait {
+	timeout := call.opts.heartbeatTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	rd, ok := s.rwc.(readDeadliner)
+	if !ok {
+		return nil
+	}
+	hw := &heartbeatWait{rd: rd, call: call, deadline: time.Now().Add(timeout)}
+	deadline := hw.deadline
+	if ctxDeadline, ok := call.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	rd.SetReadDeadline(deadline)
+	return hw
+}
+
+// missed returns true when nothing was received from the server in time.
+func (hw *heartbeatWait) missed() bool {
+	return hw != nil && !time.Now().Before(hw.deadline)
+}
+
+// done restores the read deadline the stream had before waiting for
+// heartbeats, once the final response has arrived.
+func (hw *heartbeatWait) done() {
+	if hw == nil {
+		return
+	}
+	var deadline time.Time
+	if hw.call.streamDeadline {
+		deadline, _ = hw.call.ctx.Deadline()
+	}
+	hw.rd.SetReadDeadline(deadline)
+}
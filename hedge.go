@@ -0,0 +1,212 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Default hedging settings (see WithHedging).
+const (
+	defaultHedgePercentile = 0.95
+	defaultHedgeDelay      = 100 * time.Millisecond
+)
+
+// latencyWindow is the number of recent latencies kept for every method.
+const latencyWindow = 128
+
+// minLatencySamples is the number of latencies that must have been
+// observed for a method before its percentiles are used.
+const minLatencySamples = 10
+
+// WithHedging configures the delay after which HedgedCall sends a request
+// to the next destination when the previous ones have not responded. The
+// delay is the given percentile (between 0 and 1) of the latencies of the
+// last successful remote calls to the same method made by this client, or
+// the fallback delay when not enough calls have been observed. By default,
+// the 95th percentile is used, with a fallback of 100ms.
+func WithHedging(percentile float64, fallback time.Duration) ClientOption {
+	return func(c *Client) {
+		c.latencies.percentile = percentile
+		c.latencies.fallback = fallback
+	}
+}
+
+// latencyTracker keeps the latencies of the last successful calls to
+// every method, and to every method of every peer.
+type latencyTracker struct {
+	percentile float64
+	fallback   time.Duration
+
+	mu          sync.Mutex
+	samples     map[string]*latencyRing
+	peerSamples map[string]*latencyRing
+}
+
+// latencyRing holds the last latencyWindow latencies for a method.
+type latencyRing struct {
+	durations [latencyWindow]time.Duration
+	next      int
+	count     int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.durations[r.next] = d
+	r.next = (r.next + 1) % latencyWindow
+	if r.count < latencyWindow {
+		r.count++
+	}
+}
+
+// percentiles returns the given percentiles (between 0 and 1) of the
+// latencies in the ring, which must not be empty.
+func (r *latencyRing) percentiles(ps ...float64) []time.Duration {
+	durations := make([]time.Duration, r.count)
+	copy(durations, r.durations[:r.count])
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	res := make([]time.Duration, len(ps))
+	for k, p := range ps {
+		i := int(p * float64(len(durations)-1))
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(durations) {
+			i = len(durations) - 1
+		}
+		res[k] = durations[i]
+	}
+	return res
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		percentile:  defaultHedgePercentile,
+		fallback:    defaultHedgeDelay,
+		samples:     make(map[string]*latencyRing),
+		peerSamples: make(map[string]*latencyRing),
+	}
+}
+
+func (lt *latencyTracker) record(p peer.ID, svcID ServiceID, d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	addLatency(lt.samples, svcID.Name+"."+svcID.Method, d)
+	addLatency(lt.peerSamples, peerMethodKey(p, svcID.Name, svcID.Method), d)
+}
+
+// addLatency adds a latency to the ring with the given key.
+func addLatency(rings map[string]*latencyRing, key string, d time.Duration) {
+	r, ok := rings[key]
+	if !ok {
+		r = &latencyRing{}
+		rings[key] = r
+	}
+	r.add(d)
+}
+
+// hedgeDelay returns the configured percentile of the latencies observed
+// for the given method, or the fallback delay.
+func (lt *latencyTracker) hedgeDelay(svcName, svcMethod string) time.Duration {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	r, ok := lt.samples[svcName+"."+svcMethod]
+	if !ok || r.count < minLatencySamples {
+		return lt.fallback
+	}
+	return r.percentiles(lt.percentile)[0]
+}
+
+type hedgeResult struct {
+	reply reflect.Value
+	err   error
+}
+
+// HedgedCall performs a CallContext() to the first of the given
+// destinations. If it has not responded after a delay based on the latency
+// of previous calls to the same method (see WithHedging), the same request
+// is sent to the next destination, and so on, and the first successful
+// response is used. Requests are also sent to the next destination right
+// away when a call fails. Outstanding calls are cancelled once a response
+// is obtained. An error is returned only when all destinations have
+// failed, in which case it is the error from the last one to fail.
+// Destinations are ordered by latency first with WithLatencyRanking.
+//
+// The method may run in several destinations, so HedgedCall should only
+// be used with idempotent methods. The reply must be a pointer.
+func (c *Client) HedgedCall(
+	ctx context.Context,
+	dests []peer.ID,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) error {
+	if len(dests) == 0 {
+		return &clientError{"no destinations given"}
+	}
+	if c.latencyRanking {
+		dests = c.RankPeers(dests)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every call decodes its response on its own reply so that
+	// they do not race with each other.
+	replyType := reflect.TypeOf(reply).Elem()
+	results := make(chan hedgeResult, len(dests))
+	send := func(dest peer.ID) {
+		r := reflect.New(replyType)
+		go func() {
+			err := c.CallContext(ctx, dest, svcName, svcMethod, args, r.Interface(), opts...)
+			results <- hedgeResult{r, err}
+		}()
+	}
+
+	delay := c.latencies.hedgeDelay(svcName, svcMethod)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	send(dests[0])
+	sent := 1
+	pending := 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if sent < len(dests) {
+				c.logger.Debugw("hedging call", "peer", dests[sent], "service", svcName, "method", svcMethod, "delay", delay)
+				send(dests[sent])
+				sent++
+				pending++
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				reflect.ValueOf(reply).Elem().Set(res.reply.Elem())
+				return nil
+			}
+			err = res.err
+			if sent < len(dests) {
+				send(dests[sent])
+				sent++
+				pending++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// CallEvent describes a call for the Hooks.
+type CallEvent struct {
+	// Peer is the destination of the call on the Client and the
+	// caller on the Server. It is empty for local calls on the Server.
+	Peer     peer.ID
+	Service  string
+	Method   string
+	Metadata map[string]string
+	// Codec is the name of the codec of the arguments and the reply
+	// when it is named in the request (see WithCodec), or empty when
+	// they use the codec of the stream, so that Servers can tell the
+	// clients which still use an older codec.
+	Codec string
+	// Start is the time when the call was made or received.
+	Start time.Time
+
+	// The following are only set in OnCallEnd.
+
+	// QueueDelay is the time between the reception of a request and
+	// the start of the method on the Server.
+	QueueDelay time.Duration
+	// HandlerDuration is the time spent running the method on the Server.
+	HandlerDuration time.Duration
+	// Duration is the total duration of the call.
+	Duration time.Duration
+	// BytesSent and BytesReceived are the sizes of the request and the
+	// response as sent over the stream, from the point of view of the
+	// Client or the Server. They are only set for remote calls.
+	BytesSent     int64
+	BytesReceived int64
+	// Error is the error returned by the call, if any.
+	Error error
+
+	// args are the arguments of the call on the Server, once
+	// decoded, for auditing.
+	args interface{}
+}
+
+// Hooks are functions called during the lifecycle of the calls made by
+// a Client or handled by a Server. They can be used for audit logging,
+// quotas or custom metrics. Hooks are called synchronously and should
+// return quickly. Any of them may be nil.
+type Hooks struct {
+	// OnCallStart is called when a call is made or received.
+	OnCallStart func(CallEvent)
+	// OnCallEnd is called when a call finishes, successfully or not.
+	OnCallEnd func(CallEvent)
+	// OnReply is called by Clients with the reply of every successful
+	// call, once decoded, before the call returns. It can check or
+	// normalize the reply, which it may modify, and make the call fail
+	// by returning an error, which is returned by the call. Replies
+	// served from the cache (see WithCacheableMethod) are not passed to
+	// it again. It is not called by Servers.
+	OnReply func(ev CallEvent, reply interface{}) error
+}
+
+// WithClientHooks sets the Hooks called for the calls made by the Client.
+func WithClientHooks(h Hooks) ClientOption {
+	return func(c *Client) {
+		c.hooks = h
+	}
+}
+
+// WithServerHooks sets the Hooks called for the calls handled by the
+// Server.
+func WithServerHooks(h Hooks) ServerOption {
+	return func(s *Server) {
+		s.hooks = h
+	}
+}
+
+func (h *Hooks) callStart(ev *CallEvent) {
+	if h.OnCallStart != nil {
+		h.OnCallStart(*ev)
+	}
+}
+
+func (h *Hooks) callEnd(ev *CallEvent) {
+	if h.OnCallEnd != nil {
+		h.OnCallEnd(*ev)
+	}
+}
+
+func (h *Hooks) reply(ev *CallEvent, reply interface{}) error {
+	if h.OnReply == nil || reply == nil {
+		return nil
+	}
+	return h.OnReply(*ev, reply)
+}
+
+// logFields returns the fields identifying the call for logging,
+// followed by the given ones.
+func (ev *CallEvent) logFields(kv ...interface{}) []interface{} {
+	return append([]interface{}{
+		"peer", ev.Peer,
+		"service", ev.Service,
+		"method", ev.Method,
+	}, kv...)
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WithMaxInFlightPerPeer limits the number of remote calls that the Client
+// performs at the same time with the same peer to n, so that bursts of
+// calls (i.e. with MultiGo) do not open as many streams to a single peer.
+// Further calls wait for one of them to finish, in order of priority (see
+// WithPriority), and in order of arrival within the same priority, until
+// their context is done. The limit covers the retries of the calls. A
+// zero or negative n means no limit, which is the default.
+func WithMaxInFlightPerPeer(n int) ClientOption {
+	return func(c *Client) {
+		if n <= 0 {
+			c.inFlight = nil
+			return
+		}
+		c.inFlight = &peerQueues{max: n, queues: make(map[peer.ID]*peerQueue)}
+	}
+}
+
+// peerQueues holds a callQueue for every peer being called. Queues are
+// removed once no calls use them.
+type peerQueues struct {
+	max int
+
+	mu     sync.Mutex
+	queues map[peer.ID]*peerQueue
+}
+
+type peerQueue struct {
+	*callQueue
+	users int
+}
+
+// acquire waits until a call to the given peer with the given priority
+// can be sent, and returns the function to call once it finishes. The
+// error of the context is returned when it is done while waiting.
+func (pq *peerQueues) acquire(ctx context.Context, p peer.ID, prio Priority) (func(), error) {
+	pq.mu.Lock()
+	q, ok := pq.queues[p]
+	if !ok {
+		q = &peerQueue{callQueue: newCallQueue(pq.max)}
+		pq.queues[p] = q
+	}
+	q.users++
+	pq.mu.Unlock()
+
+	done := func() {
+		pq.mu.Lock()
+		q.users--
+		if q.users == 0 {
+			delete(pq.queues, p)
+		}
+		pq.mu.Unlock()
+	}
+	if err := q.acquire(ctx, prio); err != nil {
+		done()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	return func() {
+		q.release()
+		done()
+	}, nil
+}
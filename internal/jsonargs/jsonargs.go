@@ -0,0 +1,87 @@
+// Package jsonargs converts between JSON and the generic values used as
+// arguments and replies by the callers which do not know the Go types of
+// the services, such as the gateway and the gorpc-cli command.
+package jsonargs
+
+import (
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// Decode decodes the next JSON value from r into generic values (see
+// FromJSON). It returns io.EOF when r is empty.
+func Decode(r io.Reader) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return FromJSON(v), nil
+}
+
+// FromJSON converts JSON numbers in a decoded value into integers when
+// possible, or floats otherwise, so that they can be decoded into numeric
+// fields by the server.
+func FromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = FromJSON(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = FromJSON(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// ToJSON converts a generically decoded reply into a value which can be
+// encoded to JSON. Byte strings are converted to strings when they are
+// valid UTF-8, and map keys other than strings to their JSON encoding.
+func ToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			var key string
+			switch k := ToJSON(k).(type) {
+			case string:
+				key = k
+			default:
+				b, _ := json.Marshal(k)
+				key = string(b)
+			}
+			m[key] = ToJSON(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = ToJSON(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = ToJSON(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,37 @@
+package jsonargs
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	v, err := Decode(strings.NewReader(`{"A": 2, "B": [1.5, "x"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"A": int64(2), "B": []interface{}{1.5, "x"}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("expected %#v, got %#v", want, v)
+	}
+	if _, err := Decode(strings.NewReader("")); err != io.EOF {
+		t.Error("expected io.EOF:", err)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	v := map[interface{}]interface{}{
+		"name":   []byte("gorpc"),
+		int64(1): []interface{}{[]byte{0xff}},
+	}
+	out, err := json.Marshal(ToJSON(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"1":["/w=="],"name":"gorpc"}` {
+		t.Error("unexpected JSON:", string(out))
+	}
+}
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"errors"
+	"time"
+)
+
+// Sessions (see NewClientFromConn and Client.ServeReverse) may stay idle
+// for long periods, during which NAT mappings and idle connection
+// reapers can silently kill them. Keepalive pings are sent over idle
+// sessions to keep them in use and to detect dead peers early.
+
+// keepaliveConfig holds the keepalive settings for sessions.
+type keepaliveConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// WithClientKeepalive makes clients created with NewClientFromConn send a
+// keepalive ping over the connection when no calls have been made during
+// the given interval. The connection is closed, and further calls fail,
+// when the server does not answer a ping within the given timeout. A zero
+// or negative interval disables keepalives, which is the default.
+func WithClientKeepalive(interval, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.keepalive = keepaliveConfig{interval, timeout}
+	}
+}
+
+// WithServerKeepalive makes the Server send keepalive pings over reverse
+// sessions (see Server.CallReverse) when no calls have been made during
+// the given interval. Sessions are closed when the peer does not answer a
+// ping within the given timeout. A zero or negative interval disables
+// keepalives, which is the default.
+func WithServerKeepalive(interval, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.keepalive = keepaliveConfig{interval, timeout}
+	}
+}
+
+// errKeepaliveTimeout is returned when a keepalive ping is not answered
+// in time.
+var errKeepaliveTimeout = errors.New("keepalive timeout")
+
+// keepalive pings the other side of the session whenever it has been idle
+// for the configured interval, until the session is closed.
+func (sc *streamCaller) keepalive(cfg keepaliveConfig, logger Logger) {
+	if cfg.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := sc.ping(cfg); err != nil {
+			logger.Warnw("session keepalive failed", "peer", sc.s.remotePeer(), "error", err)
+			return
+		}
+	}
+}
+
+// ping sends a keepalive ping and waits for the answer, unless the
+// session has been used recently. The session is closed when the ping
+// fails.
+func (sc *streamCaller) ping(cfg keepaliveConfig) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return errSessionClosed
+	}
+	if time.Since(sc.lastUsed) < cfg.interval {
+		return nil
+	}
+
+	var timer *time.Timer
+	if cfg.timeout > 0 {
+		timer = time.AfterFunc(cfg.timeout, func() {
+			sc.s.reset()
+		})
+	}
+
+	err := sc.roundTripPing()
+	if timer != nil && !timer.Stop() {
+		err = errKeepaliveTimeout
+	}
+	if err != nil {
+		sc.markClosed()
+		sc.s.reset()
+		return err
+	}
+	sc.lastUsed = time.Now()
+	return nil
+}
+
+func (sc *streamCaller) roundTripPing() error {
+	if err := sc.s.writeHeader(ServiceID{Ping: true}); err != nil {
+		return err
+	}
+	if err := sc.s.w.Flush(); err != nil {
+		return err
+	}
+	// The answer is a Response and an empty body.
+	var resp Response
+	if err := sc.s.readHeader(&resp); err != nil {
+		return err
+	}
+	var body interface{}
+	return sc.s.decode(&body)
+}
+
+// servePing answers a keepalive ping received over a session.
+func servePing(s *streamWrap, svcID ServiceID) error {
+	return sendResponse(s, &Response{Service: svcID}, nil)
+}
@@ -0,0 +1,135 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Clients can order candidate destinations by their expected latency,
+// which is the moving average of the round-trip times kept by the
+// peerstore of the host. It is fed by the libp2p ping protocol, either by
+// the host itself or with Client.Ping and Client.ProbeLatencies.
+
+// pingProtocol is the protocol of the libp2p ping service, which answers
+// every pingSize bytes read with the same bytes.
+const pingProtocol = "/ipfs/ping/1.0.0"
+
+const pingSize = 32
+
+// WithLatencyRanking makes HedgedCall try its destinations in order of
+// expected latency (see RankPeers) instead of the given order.
+func WithLatencyRanking() ClientOption {
+	return func(c *Client) {
+		c.latencyRanking = true
+	}
+}
+
+// RankPeers returns the given peers ordered by expected latency, lowest
+// first. The local peer comes first, and peers with no latency measured
+// come last, in the given order.
+func (c *Client) RankPeers(peers []peer.ID) []peer.ID {
+	ranked := make([]peer.ID, len(peers))
+	copy(ranked, peers)
+	if c.host == nil {
+		return ranked
+	}
+	ps := c.host.Peerstore()
+	local := c.host.ID()
+	latencies := make(map[peer.ID]time.Duration, len(peers))
+	for _, p := range peers {
+		if p == local {
+			latencies[p] = 0
+		} else if l := ps.LatencyEWMA(p); l > 0 {
+			latencies[p] = l
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		li, iok := latencies[ranked[i]]
+		lj, jok := latencies[ranked[j]]
+		if iok != jok {
+			return iok
+		}
+		return li < lj
+	})
+	return ranked
+}
+
+// Ping measures the round-trip time to the given peer with the libp2p
+// ping protocol, and records it in the peerstore of the host. It honors
+// the dialing options of the Client.
+func (c *Client) Ping(ctx context.Context, p peer.ID) (time.Duration, error) {
+	if c.noDial {
+		if c.host.Network().Connectedness(p) != network.Connected {
+			return 0, ErrNotConnected
+		}
+		ctx = network.WithNoDial(ctx, "rpc: dialing disabled")
+	}
+	s, err := c.host.NewStream(ctx, p, pingProtocol)
+	if err != nil {
+		return 0, newClientError(err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	out := make([]byte, pingSize)
+	if _, err := rand.Read(out); err != nil {
+		s.Reset()
+		return 0, err
+	}
+	in := make([]byte, pingSize)
+	start := time.Now()
+	if _, err := s.Write(out); err != nil {
+		s.Reset()
+		return 0, newClientError(err)
+	}
+	if _, err := io.ReadFull(s, in); err != nil {
+		s.Reset()
+		return 0, newClientError(err)
+	}
+	rtt := time.Since(start)
+	if !bytes.Equal(in, out) {
+		s.Reset()
+		return 0, &clientError{"wrong ping reply from " + p.Pretty()}
+	}
+	c.host.Peerstore().RecordLatency(p, rtt)
+	return rtt, nil
+}
+
+// ProbeLatencies pings the given peers every interval, in the background,
+// until the context is cancelled, so that their expected latencies stay
+// up to date. The first round of pings is sent right away.
+func (c *Client) ProbeLatencies(ctx context.Context, interval time.Duration, peers ...peer.ID) {
+	probe := func() {
+		for _, p := range peers {
+			if p == c.host.ID() {
+				continue
+			}
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			if _, err := c.Ping(pingCtx, p); err != nil {
+				c.logger.Debugw("error probing latency", "peer", p, "error", err)
+			}
+			cancel()
+		}
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			probe()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import "reflect"
+
+// LocalCallMode decides how the arguments and the reply of local calls
+// (see NewClientWithServer) are passed to the methods of the Server.
+// Local calls are only encoded with LocalDeepCopy.
+type LocalCallMode int
+
+const (
+	// LocalCopy passes a copy of the arguments to the method, and a
+	// new reply value which is copied to the reply of the caller once
+	// the method succeeds. This is the default. The copies are
+	// shallow: the values the arguments and the reply point to, such
+	// as slices, maps and pointer fields, are shared with the caller.
+	LocalCopy LocalCallMode = iota
+	// LocalDirect passes the arguments and the reply of the caller as
+	// they are when their types match those of the method, saving the
+	// copies. The method then works on the values of the caller: the
+	// changes it makes to arguments given as pointers are seen by the
+	// caller, and the reply is written while the method runs, even
+	// when it fails or runs past the deadline of the call.
+	LocalDirect
+	// LocalDeepCopy encodes and decodes the arguments before passing
+	// them to the method, and its reply before setting the reply of
+	// the caller, with the codec of the call (see WithCodec), or
+	// MsgpackCodec. Like with remote calls, methods cannot change the
+	// values of the caller, nor keep references to them, and only the
+	// values which can be encoded are passed, at the cost of encoding
+	// them.
+	LocalDeepCopy
+)
+
+// WithLocalCallMode sets how the Client passes the arguments and the
+// reply of local calls to the methods, LocalCopy by default.
+func WithLocalCallMode(m LocalCallMode) ClientOption {
+	return func(c *Client) {
+		c.localMode = m
+	}
+}
+
+// localCodec returns the codec used to copy the values of a local call
+// with LocalDeepCopy.
+func (call *Call) localCodec() *Codec {
+	if call.opts.codec != nil {
+		return call.opts.codec
+	}
+	return MsgpackCodec
+}
+
+// deepCopy copies src into dst, which must be a pointer, by encoding and
+// decoding it with the given codec.
+func deepCopy(c *Codec, dst, src interface{}) error {
+	data, err := c.marshal(src)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(data, dst)
+}
+
+// deepCopyValue returns a copy of v made with deepCopy.
+func deepCopyValue(c *Codec, v reflect.Value) (reflect.Value, error) {
+	cp := reflect.New(v.Type())
+	if err := deepCopy(c, cp.Interface(), v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return cp.Elem(), nil
+}
+
+// convertArgs returns the arguments of a local call as a value of the
+// given argument type of the method, converting them by encoding and
+// decoding them with the given codec when their type does not match,
+// like for a remote call. This is the case of the generic values (i.e.
+// maps) used by callers which do not know the types of the services,
+// such as the gateway. Arguments of a matching type, or of a pointer to
+// it, are returned as they are.
+func convertArgs(c *Codec, args interface{}, argType reflect.Type) (interface{}, error) {
+	t := reflect.TypeOf(args)
+	if t == nil {
+		return args, nil
+	}
+	want := argType
+	if want.Kind() == reflect.Ptr {
+		want = want.Elem()
+	}
+	if t.AssignableTo(want) || (t.Kind() == reflect.Ptr && t.Elem().AssignableTo(want)) {
+		return args, nil
+	}
+	v := reflect.New(want)
+	if err := deepCopy(c, v.Interface(), args); err != nil {
+		return nil, err
+	}
+	if argType.Kind() == reflect.Ptr {
+		return v.Interface(), nil
+	}
+	return v.Elem().Interface(), nil
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"fmt"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Logger is used by Clients and Servers to log messages along with
+// structured fields, given as alternating keys and values. Loggers from
+// go-log and zap's SugaredLogger satisfy this interface.
+type Logger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// Unless a Logger is provided with WithClientLogger() or
+// WithServerLogger(), messages are logged with go-log, split into
+// subsystems whose levels can be changed independently while running
+// (see SetLogLevel): the calls made by Clients, the requests handled by
+// Servers, and the streams, which are opened, accepted, kept alive and
+// closed by both of them. This allows debugging the handling of streams
+// without logging every call.
+
+// The subsystems of the logs of Clients and Servers.
+const (
+	ClientLogSubsystem = "p2p-gorpc-client"
+	ServerLogSubsystem = "p2p-gorpc-server"
+	StreamLogSubsystem = "p2p-gorpc-stream"
+)
+
+var (
+	clientLogger Logger = logging.Logger(ClientLogSubsystem)
+	serverLogger Logger = logging.Logger(ServerLogSubsystem)
+	streamLogger Logger = logging.Logger(StreamLogSubsystem)
+)
+
+// SetLogLevel sets the level of the logs of the given subsystem (i.e.
+// StreamLogSubsystem) to "debug", "info", "warn" or "error". It has no
+// effect on the Loggers provided with WithClientLogger() and
+// WithServerLogger().
+func SetLogLevel(subsystem, level string) error {
+	switch subsystem {
+	case ClientLogSubsystem, ServerLogSubsystem, StreamLogSubsystem:
+		return logging.SetLogLevel(subsystem, level)
+	}
+	return fmt.Errorf("rpc: unknown log subsystem %q", subsystem)
+}
+
+// WithClientLogger sets the Logger used by the Client, for all the
+// subsystems.
+func WithClientLogger(l Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = l
+		c.streamLogger = l
+	}
+}
+
+// WithServerLogger sets the Logger used by the Server, for all the
+// subsystems.
+func WithServerLogger(l Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = l
+		s.streamLogger = l
+	}
+}
+
+// WithClientSlowCallThreshold makes the Client log the calls taking
+// longer than d, at warning level, with their peer, method, duration and
+// sizes. This helps spotting pathological peers without tracing every
+// call.
+func WithClientSlowCallThreshold(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.slowCall = d
+	}
+}
+
+// WithServerSlowCallThreshold makes the Server log the calls taking
+// longer than d, at warning level, with their peer, method, duration and
+// sizes, along with the time they were queued and spent in the method.
+func WithServerSlowCallThreshold(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.slowCall = d
+	}
+}
+
+// logSlowCall logs a finished call when it took longer than the given
+// threshold, if set.
+func logSlowCall(l Logger, threshold time.Duration, ev *CallEvent, kv ...interface{}) {
+	if threshold <= 0 || ev.Duration <= threshold {
+		return
+	}
+	l.Warnw("slow call", ev.logFields(append([]interface{}{
+		"duration", ev.Duration,
+		"bytesSent", ev.BytesSent,
+		"bytesReceived", ev.BytesReceived,
+		"error", ev.Error,
+	}, kv...)...)...)
+}
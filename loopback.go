@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// WithLocalDialer makes the Client send the calls to its own peer over a
+// connection obtained from dial when it has no local Server (see
+// NewClientWithServer), instead of failing. This supports setups where
+// the Client and the Server run in different processes sharing the same
+// peer identity, which libp2p cannot connect to each other: the process
+// of the Server serves the connections with ServeConn, i.e. over a Unix
+// socket. The connection is kept for the following local calls, which
+// are sent one at a time, and dialed again once it fails.
+func WithLocalDialer(dial func(ctx context.Context) (io.ReadWriteCloser, error)) ClientOption {
+	return func(c *Client) {
+		c.loopback = &loopback{dial: dial}
+	}
+}
+
+// loopback holds the connection of a Client to the Server of its own
+// peer (see WithLocalDialer).
+type loopback struct {
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+
+	mu sync.Mutex
+	sc *streamCaller
+}
+
+// caller returns the session over the connection, dialing it when there
+// is none or it failed.
+func (lb *loopback) caller(ctx context.Context, c *Client) (*streamCaller, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.sc != nil && !lb.sc.isClosed() {
+		return lb.sc, nil
+	}
+	rwc, err := lb.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lb.sc = newStreamCaller(c.wrap(rwc, MsgpackCodec))
+	return lb.sc, nil
+}
+
+// callLoopback performs a local call over the connection to the Server
+// of the peer.
+func (c *Client) callLoopback(call *Call) error {
+	sc, err := c.loopback.caller(call.ctx, c)
+	if err != nil {
+		return newClientError(err)
+	}
+	call.markReached()
+	return sc.call(call)
+}
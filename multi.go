@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// MultiSummary is the outcome of MultiCallDeadline(). Every destination
+// is listed in exactly one of Succeeded, TimedOut, Unreachable and
+// Failed.
+type MultiSummary struct {
+	// Results holds the result of every call, in the order of the
+	// destinations.
+	Results []*MultiResult
+	// Succeeded lists the destinations whose call returned no error.
+	Succeeded []peer.ID
+	// TimedOut lists the destinations whose call did not finish
+	// within its budget.
+	TimedOut []peer.ID
+	// Unreachable lists the destinations to which no stream could be
+	// opened.
+	Unreachable []peer.ID
+	// Failed lists the destinations which were reached but whose call
+	// failed otherwise (i.e. with an error returned by the method).
+	Failed []peer.ID
+}
+
+// MultiCallDeadline works like MultiCall() but makes all the calls with
+// the given context, splitting the time left until its deadline into a
+// budget for every destination, and returns a summary classifying the
+// results. The destinations and replies must match in length, or every
+// call fails with a client error.
+//
+// Calls run in parallel, in which case every call may take the whole
+// time left, unless limited with WithConcurrency, in which case the time
+// left when a call starts is split evenly between the rounds of calls
+// still to run. Calls whose budget runs out, including while opening the
+// stream, are reported as timed out. Destinations which cannot be dialed
+// before that are reported as unreachable (see WithStreamOpenTimeout to
+// detect them early). When the context has no deadline, calls are only
+// limited by the given CallOptions (i.e. WithTimeout).
+func (c *Client) MultiCallDeadline(
+	ctx context.Context,
+	dests []peer.ID,
+	svcName, svcMethod string,
+	args interface{},
+	replies []interface{},
+	opts ...CallOption,
+) *MultiSummary {
+
+	summary := &MultiSummary{
+		Results: make([]*MultiResult, len(dests)),
+	}
+	if !checkMatchingLengths(len(dests), len(replies)) {
+		for i, dest := range dests {
+			summary.Results[i] = &MultiResult{
+				Index: i,
+				Peer:  dest,
+				Error: newClientError(errMismatchedLengths),
+			}
+			summary.Failed = append(summary.Failed, dest)
+		}
+		return summary
+	}
+
+	concurrency := newCallOptions(opts).concurrency
+	deadline, hasDeadline := ctx.Deadline()
+	timedOut := make([]bool, len(dests))
+	reached := make([]bool, len(dests))
+
+	runBounded(len(dests), concurrency, func(i int) {
+		res := &MultiResult{
+			Index: i,
+			Peer:  dests[i],
+			Reply: replies[i],
+		}
+		summary.Results[i] = res
+
+		callCtx := ctx
+		if hasDeadline {
+			var cancel context.CancelFunc
+			budget := callBudget(time.Until(deadline), len(dests)-i, concurrency)
+			callCtx, cancel = context.WithTimeout(ctx, budget)
+			defer cancel()
+		}
+
+		start := time.Now()
+		done := make(chan *Call, 1)
+		call := newCall(callCtx, dests[i], svcName, svcMethod, args, replies[i], done, opts...)
+		call.logger = c.logger
+		go c.makeCall(call)
+		<-done
+		res.Error = call.getError()
+		res.Latency = time.Since(start)
+		timedOut[i] = callCtx.Err() == context.DeadlineExceeded
+		reached[i] = call.wasReached()
+	})
+
+	for i, res := range summary.Results {
+		switch {
+		case res.Error == nil:
+			summary.Succeeded = append(summary.Succeeded, res.Peer)
+		case timedOut[i]:
+			summary.TimedOut = append(summary.TimedOut, res.Peer)
+		case !reached[i]:
+			summary.Unreachable = append(summary.Unreachable, res.Peer)
+		default:
+			summary.Failed = append(summary.Failed, res.Peer)
+		}
+	}
+	return summary
+}
+
+// callBudget returns the time that a call may take when the given time is
+// left for the given number of calls still to run, with at most n
+// simultaneous calls (no limit if n <= 0).
+func callBudget(left time.Duration, calls, n int) time.Duration {
+	if n <= 0 || n >= calls {
+		return left
+	}
+	rounds := (calls + n - 1) / n
+	return left / time.Duration(rounds)
+}
+
+// MultiCallResults works like MultiCall() but bundles the destination,
+// reply, error and latency of every call in a MultiResult. The results
+// are returned in the order of the destinations.
+func (c *Client) MultiCallResults(
+	ctxs []context.Context,
+	dests []peer.ID,
+	svcName, svcMethod string,
+	args interface{},
+	replies []interface{},
+	opts ...CallOption,
+) []*MultiResult {
+	results := make([]*MultiResult, len(dests))
+	for res := range c.MultiStream(ctxs, dests, svcName, svcMethod, args, replies, opts...) {
+		results[res.Index] = res
+	}
+	return results
+}
+
+// FirstNonError returns the index of the first nil error in the given
+// errors (i.e. as returned by MultiCall()), that is, the first call that
+// succeeded, or -1 if all of them failed.
+func FirstNonError(errs []error) int {
+	for i, err := range errs {
+		if err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// QuorumReached returns true when at least n of the given errors are nil,
+// that is, when at least n calls succeeded.
+func QuorumReached(errs []error, n int) bool {
+	ok := 0
+	for _, err := range errs {
+		if err == nil {
+			ok++
+		}
+	}
+	return ok >= n
+}
+
+// ResultErrors returns the errors of the given results, in order, for use
+// with FirstNonError() and QuorumReached().
+func ResultErrors(results []*MultiResult) []error {
+	errs := make([]error, len(results))
+	for i, res := range results {
+		errs[i] = res.Error
+	}
+	return errs
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// RegisterOption allows for functional setting of options when
+// registering a service (see Server.Register).
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	names   func(string) string
+	exclude map[string]bool
+	version string
+}
+
+func newRegisterOptions(opts []RegisterOption) registerOptions {
+	var rOpts registerOptions
+	for _, opt := range opts {
+		opt(&rOpts)
+	}
+	return rOpts
+}
+
+// WithMethodNames sets the names under which the methods of the service
+// are called, given by a function taking the name of every Go method
+// (see SnakeCase for instance). Methods for which it returns an empty
+// string are not published.
+func WithMethodNames(f func(method string) string) RegisterOption {
+	return func(o *registerOptions) {
+		o.names = f
+	}
+}
+
+// WithoutMethods prevents the given methods of the service from being
+// called, even if they are exported. The methods are given by their Go
+// names.
+func WithoutMethods(methods ...string) RegisterOption {
+	return func(o *registerOptions) {
+		if o.exclude == nil {
+			o.exclude = make(map[string]bool)
+		}
+		for _, m := range methods {
+			o.exclude[m] = true
+		}
+	}
+}
+
+// rename returns the given methods under their published names, without
+// the excluded ones.
+func (o registerOptions) rename(methods map[string]*methodType) (map[string]*methodType, error) {
+	if o.names == nil && len(o.exclude) == 0 {
+		return methods, nil
+	}
+	renamed := make(map[string]*methodType, len(methods))
+	for name, mtype := range methods {
+		if o.exclude[name] {
+			continue
+		}
+		if o.names != nil {
+			name = o.names(name)
+			if name == "" {
+				continue
+			}
+		}
+		if _, ok := renamed[name]; ok {
+			return nil, errors.New("rpc.Register: several methods are named " + name)
+		}
+		renamed[name] = mtype
+	}
+	return renamed, nil
+}
+
+// SnakeCase returns the given method name in snake case, for use with
+// WithMethodNames: "GetHTTPStatus" becomes "get_http_status".
+func SnakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Words start with an upper case letter following a
+			// lower case one, or followed by one in acronyms.
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,170 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ugorji/go/codec"
+)
+
+// One-way requests are requests which are not sent over a stream and for
+// which no reply is sent back, so that they can be delivered by other
+// means, like pubsub (see the broadcast package).
+
+// Publisher publishes messages in pubsub topics. The broadcast package
+// provides one for go-libp2p-pubsub.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte) error
+}
+
+// WithPublisher sets the Publisher used by the Client to broadcast
+// requests with Broadcast().
+func WithPublisher(p Publisher) ClientOption {
+	return func(c *Client) {
+		c.publisher = p
+	}
+}
+
+// Broadcast publishes a one-way request to the given service method in a
+// pubsub topic with the Publisher of the Client (see WithPublisher), so
+// that every Server serving the topic runs it (see the broadcast
+// package). Like with EncodeRequest(), only the WithMetadata,
+// WithPriority and WithToken call options are honored, and the token of
+// the Client (see WithClientToken) is attached by default.
+func (c *Client) Broadcast(topic, svcName, svcMethod string, args interface{}, opts ...CallOption) error {
+	return c.BroadcastContext(context.Background(), topic, svcName, svcMethod, args, opts...)
+}
+
+// BroadcastContext performs a Broadcast() with a user provided context.
+func (c *Client) BroadcastContext(ctx context.Context, topic, svcName, svcMethod string, args interface{}, opts ...CallOption) error {
+	if c.publisher == nil {
+		return &clientError{"cannot broadcast: publisher not set"}
+	}
+	if c.token != nil {
+		opts = append([]CallOption{WithToken(c.token)}, opts...)
+	}
+	data, err := EncodeRequest(svcName, svcMethod, args, opts...)
+	if err != nil {
+		return newClientError(err)
+	}
+	return c.publisher.Publish(ctx, topic, data)
+}
+
+// EncodeRequest serializes a one-way request to the given service method
+// with the given arguments, to be run with Server.HandleRequest(). Only
+// the WithMetadata, WithPriority and WithToken call options are honored.
+func EncodeRequest(svcName, svcMethod string, args interface{}, opts ...CallOption) ([]byte, error) {
+	cOpts := newCallOptions(opts)
+	svcID := ServiceID{
+		Name:     svcName,
+		Method:   svcMethod,
+		Metadata: cOpts.metadata,
+		Priority: cOpts.priority,
+		Token:    cOpts.token,
+	}
+
+	return MsgpackCodec.marshal(svcID, args)
+}
+
+// HandleRequest runs a one-way request serialized with EncodeRequest() on
+// behalf of the given peer, which is subject to the same checks as the
+// peers calling over streams: the peer filter, the authorization
+// function, the capability tokens and the validation of the arguments of
+// the Server. The method runs like for any remote call, with the
+// executor (see WithExecutor) and the timeout (see WithMethodTimeout) of
+// the Server. Since one-way requests can neither be signed nor
+// authenticated, they are rejected by Servers requiring signatures (see
+// WithRequiredSignatures) or authentication (see WithAuthenticator). The
+// reply is discarded and the error returned by the method, if any, is
+// returned.
+func (server *Server) HandleRequest(ctx context.Context, from peer.ID, data []byte) (err error) {
+	if err := MsgpackCodec.check(data, 2); err != nil {
+		return newServerError(err)
+	}
+	dec := codec.NewDecoderBytes(data, MsgpackCodec.handle)
+	var svcID ServiceID
+	if err := dec.Decode(&svcID); err != nil {
+		return newServerError(err)
+	}
+
+	ev := &CallEvent{
+		Peer:     from,
+		Service:  svcID.Name,
+		Method:   svcID.Method,
+		Metadata: svcID.Metadata,
+		Start:    time.Now(),
+	}
+	server.callStart(ev)
+	defer func() {
+		ev.Duration = time.Since(ev.Start)
+		ev.Error = err
+		server.logger.Debugw("one-way request handled", ev.logFields("duration", ev.Duration, "error", err)...)
+		server.callEnd(ev)
+	}()
+
+	if server.peerFilter != nil && !server.peerFilter(from) {
+		return newAuthorizationError(fmt.Errorf("requests from %s are not allowed", from.Pretty()))
+	}
+	if server.authenticator != nil {
+		return newUnauthenticatedError(errNoCredentials)
+	}
+	if err := server.checkAccess(from, svcID); err != nil {
+		return err
+	}
+	service, mtype, err := server.getService(svcID)
+	if err != nil {
+		return err
+	}
+	argv, err := decodeArgs(dec.Decode, mtype)
+	if err != nil {
+		return newServerError(err)
+	}
+	if err := server.validateArgs(ctx, argv); err != nil {
+		return err
+	}
+
+	if server.queue != nil {
+		if err := server.queue.acquire(ctx, svcID.Priority); err != nil {
+			return err
+		}
+		defer server.queue.release()
+	}
+
+	ctx = withMetadata(ctx, svcID.Metadata)
+	var key crypto.PubKey
+	if server.host != nil {
+		key = server.host.Peerstore().PubKey(from)
+	}
+	ctx = withRemotePeer(ctx, from, key)
+	timeout := server.methodTimeout(svcID)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctxv := reflect.ValueOf(ctx)
+
+	handlerStart := time.Now()
+	defer func() {
+		ev.HandlerDuration = time.Since(handlerStart)
+	}()
+
+	if mtype.async {
+		var discard interface{}
+		return service.localAsyncCall(mtype, ctx, ctxv, argv, &discard)
+	}
+	replyv := reflect.New(mtype.ReplyType.Elem())
+	returnValues, ok := service.callWithTimeout(mtype, svcID, []reflect.Value{service.rcvr, ctxv, argv, replyv}, timeout)
+	if !ok {
+		return errServerDeadline
+	}
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
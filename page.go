@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Methods returning long lists can return them in pages, which callers
+// obtain one after another with a Pages iterator. The arguments of such
+// methods have a string field named PageToken, set to the token of the
+// page to return, and their replies a string field named NextPageToken,
+// set to the token of the following page, along with the items of the
+// page. The first page is requested with the PageToken given in the
+// arguments, usually empty, and the last page has an empty
+// NextPageToken. Tokens are opaque to the callers: methods can use
+// offsets, keys or anything else.
+
+// Pages iterates over the pages of the reply of a paginated method, as
+// returned by NewPages:
+//
+//	pages := rpc.NewPages[ListArgs, ListReply](ctx, client, dest, "Store", "List", ListArgs{Prefix: "a"})
+//	for pages.Next() {
+//		for _, item := range pages.Page().Items {
+//			...
+//		}
+//	}
+//	if err := pages.Err(); err != nil {
+//		...
+//	}
+type Pages[A, R any] struct {
+	ctx                context.Context
+	client             *Client
+	dest               peer.ID
+	svcName, svcMethod string
+	args               A
+	opts               []CallOption
+
+	token string
+	page  R
+	err   error
+	done  bool
+}
+
+// NewPages returns a Pages iterator calling svcName.svcMethod of dest
+// with the given Client and arguments, once for every page. A is the
+// type of the arguments, a struct or a pointer to a struct with a
+// PageToken field, and R the type of the replies, a struct with a
+// NextPageToken field. The arguments are not modified.
+func NewPages[A, R any](ctx context.Context, c *Client, dest peer.ID, svcName, svcMethod string, args A, opts ...CallOption) *Pages[A, R] {
+	p := &Pages[A, R]{
+		ctx:       ctx,
+		client:    c,
+		dest:      dest,
+		svcName:   svcName,
+		svcMethod: svcMethod,
+		args:      args,
+		opts:      opts,
+	}
+	token, err := pageToken(reflect.ValueOf(args), "PageToken")
+	if err != nil {
+		p.err = err
+	}
+	p.token = token
+	return p
+}
+
+// pageToken returns the value of the token field with the given name
+// of a struct, or of the struct it points to.
+func pageToken(v reflect.Value, name string) (string, error) {
+	f, err := pageTokenField(v, name)
+	if err != nil {
+		return "", err
+	}
+	return f.String(), nil
+}
+
+// pageTokenField returns the token field with the given name of a
+// struct, or of the struct it points to.
+func pageTokenField(v reflect.Value, name string) (reflect.Value, error) {
+	v = reflect.Indirect(v)
+	if !v.IsValid() {
+		return reflect.Value{}, errors.New("rpc: no arguments for pagination")
+	}
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.String {
+			return f, nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("rpc: %s has no string field %s for pagination", v.Type(), name)
+}
+
+// withPageToken returns a copy of the arguments, or of the struct they
+// point to, with the given page token.
+func withPageToken(args interface{}, token string) (interface{}, error) {
+	v := reflect.ValueOf(args)
+	ptr := v.Kind() == reflect.Ptr
+	c := reflect.New(reflect.Indirect(v).Type())
+	c.Elem().Set(reflect.Indirect(v))
+	f, err := pageTokenField(c, "PageToken")
+	if err != nil {
+		return nil, err
+	}
+	f.SetString(token)
+	if ptr {
+		return c.Interface(), nil
+	}
+	return c.Elem().Interface(), nil
+}
+
+// Next requests the next page, returning false after the last page or
+// when the call fails (see Err).
+func (p *Pages[A, R]) Next() bool {
+	if p.done || p.err != nil {
+		return false
+	}
+	args, err := withPageToken(p.args, p.token)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	var reply R
+	if err := p.client.CallContext(p.ctx, p.dest, p.svcName, p.svcMethod, args, &reply, p.opts...); err != nil {
+		p.err = err
+		return false
+	}
+	next, err := pageToken(reflect.ValueOf(&reply), "NextPageToken")
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if next != "" && next == p.token {
+		p.err = fmt.Errorf("rpc: %s.%s returned the token of the same page", p.svcName, p.svcMethod)
+		return false
+	}
+	p.page = reply
+	p.token = next
+	p.done = next == ""
+	return true
+}
+
+// Page returns the page obtained by the last call to Next.
+func (p *Pages[A, R]) Page() R {
+	return p.page
+}
+
+// Token returns the token of the page following the last one obtained,
+// which is empty after the last page. Iterating can be resumed later by
+// requesting the pages from that token.
+func (p *Pages[A, R]) Token() string {
+	return p.token
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (p *Pages[A, R]) Err() error {
+	return p.err
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PeerFilter decides whether a peer may be called (by a Client) or may
+// make calls (to a Server). It may consult the peerstore of the host,
+// i.e. to only allow peers supporting some protocol or with some
+// metadata. See AllowPeers and DenyPeers for static lists.
+type PeerFilter func(p peer.ID) bool
+
+// AllowPeers returns a PeerFilter accepting only the given peers.
+func AllowPeers(peers ...peer.ID) PeerFilter {
+	set := peerSet(peers)
+	return func(p peer.ID) bool {
+		_, ok := set[p]
+		return ok
+	}
+}
+
+// DenyPeers returns a PeerFilter rejecting the given peers.
+func DenyPeers(peers ...peer.ID) PeerFilter {
+	set := peerSet(peers)
+	return func(p peer.ID) bool {
+		_, ok := set[p]
+		return !ok
+	}
+}
+
+func peerSet(peers []peer.ID) map[peer.ID]struct{} {
+	set := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		set[p] = struct{}{}
+	}
+	return set
+}
+
+// WithClientPeerFilter makes the Client refuse to perform remote calls
+// (including batches, subscriptions and reverse sessions) to the peers
+// rejected by the given filter, which fail with a client error before
+// any stream is opened. Local calls are not filtered.
+func WithClientPeerFilter(f PeerFilter) ClientOption {
+	return func(c *Client) {
+		c.peerFilter = f
+	}
+}
+
+// WithServerPeerFilter makes the Server reset right away the streams
+// opened by the peers rejected by the given filter, without reading
+// their requests. Unlike WithAuthorizeFunc, it applies to every service
+// as well as to reverse sessions and pipelined streams. Calls made by
+// the local Client are not filtered.
+func WithServerPeerFilter(f PeerFilter) ServerOption {
+	return func(s *Server) {
+		s.peerFilter = f
+	}
+}
+
+// checkPeer returns an error when the Client may not call the given peer.
+func (c *Client) checkPeer(p peer.ID) error {
+	if c.peerFilter != nil && !c.peerFilter(p) {
+		return &clientError{"calls to " + p.Pretty() + " are not allowed"}
+	}
+	return nil
+}
+
+// acceptStream returns whether the Server accepts the given stream,
+// resetting it otherwise.
+func (server *Server) acceptStream(stream network.Stream) bool {
+	p := stream.Conn().RemotePeer()
+	if server.peerFilter == nil || server.peerFilter(p) {
+		return true
+	}
+	server.streamLogger.Debugw("rejecting stream from filtered peer", "peer", p, "protocol", stream.Protocol())
+	stream.Reset()
+	return false
+}
@@ -0,0 +1,158 @@
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PendingCall describes a call in progress made by a Client (see
+// PendingCalls).
+type PendingCall struct {
+	Dest    peer.ID
+	Service string
+	Method  string
+	// Start is the time when the call was made.
+	Start time.Time
+	// Deadline is the deadline of the context of the call, if any.
+	Deadline time.Time
+
+	call *Call
+}
+
+// Elapsed returns the time elapsed since the call was made.
+func (pc PendingCall) Elapsed() time.Duration {
+	return time.Since(pc.Start)
+}
+
+// Cancel cancels the call (see Call.Cancel). It does nothing when the
+// call has finished in the meantime.
+func (pc PendingCall) Cancel() {
+	pc.call.Cancel()
+}
+
+// pendingCalls tracks the calls in progress of a Client.
+type pendingCalls struct {
+	mu    sync.Mutex
+	calls map[*Call]time.Time
+	// drained is set when the Client is closed, and closed once
+	// there are no calls in progress anymore.
+	drained chan struct{}
+}
+
+// add adds a call in progress. It returns false when the Client is
+// closed.
+func (pcs *pendingCalls) add(call *Call, start time.Time) bool {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	if pcs.drained != nil {
+		return false
+	}
+	if pcs.calls == nil {
+		pcs.calls = make(map[*Call]time.Time)
+	}
+	pcs.calls[call] = start
+	return true
+}
+
+// addAll adds several calls in progress, all or none of them. It returns
+// false when the Client is closed.
+func (pcs *pendingCalls) addAll(calls []*Call, start time.Time) bool {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	if pcs.drained != nil {
+		return false
+	}
+	if pcs.calls == nil {
+		pcs.calls = make(map[*Call]time.Time)
+	}
+	for _, call := range calls {
+		pcs.calls[call] = start
+	}
+	return true
+}
+
+func (pcs *pendingCalls) remove(call *Call) {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	delete(pcs.calls, call)
+	pcs.checkDrained()
+}
+
+// close prevents calls from being added, cancels the subscriptions,
+// which never finish by themselves, and returns a channel closed once
+// there are no calls or subscriptions in progress.
+func (pcs *pendingCalls) close() <-chan struct{} {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	if pcs.drained == nil {
+		pcs.drained = make(chan struct{})
+		for call := range pcs.calls {
+			if call.SvcID.Subscribe {
+				call.Cancel()
+			}
+		}
+		pcs.checkDrained()
+	}
+	return pcs.drained
+}
+
+// isClosed returns true once the Client is closed.
+func (pcs *pendingCalls) isClosed() bool {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	return pcs.drained != nil
+}
+
+// checkDrained closes drained when the Client is closed and there are
+// no calls in progress. It must be called with the lock held.
+func (pcs *pendingCalls) checkDrained() {
+	if pcs.drained == nil || len(pcs.calls) > 0 {
+		return
+	}
+	select {
+	case <-pcs.drained:
+	default:
+		close(pcs.drained)
+	}
+}
+
+// cancel cancels all the calls in progress.
+func (pcs *pendingCalls) cancel() {
+	pcs.mu.Lock()
+	defer pcs.mu.Unlock()
+	for call := range pcs.calls {
+		call.Cancel()
+	}
+}
+
+// PendingCalls returns the calls in progress made by the Client, the
+// oldest first, i.e. to find calls which are stuck or to build
+// administration endpoints. The returned calls can be cancelled.
+// Subscriptions are not included.
+func (c *Client) PendingCalls() []PendingCall {
+	c.pending.mu.Lock()
+	calls := make([]PendingCall, 0, len(c.pending.calls))
+	for call, start := range c.pending.calls {
+		// Calls cancelled while being sent are done already.
+		if call.isFinished() || call.SvcID.Subscribe {
+			continue
+		}
+		deadline, _ := call.ctx.Deadline()
+		calls = append(calls, PendingCall{
+			Dest:     call.Dest,
+			Service:  call.SvcID.Name,
+			Method:   call.SvcID.Method,
+			Start:    start,
+			Deadline: deadline,
+			call:     call,
+		})
+	}
+	c.pending.mu.Unlock()
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].Start.Before(calls[j].Start)
+	})
+	return calls
+}
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// maxPeriodicBackoff is the maximum factor by which the interval between
+// periodic calls grows while they fail.
+const maxPeriodicBackoff = 16
+
+// Periodic is a call made repeatedly, as returned by Client.Every().
+type Periodic struct {
+	mu       sync.Mutex
+	latest   Result
+	at       time.Time
+	calls    int
+	failures int
+	done     chan struct{}
+}
+
+// Every performs the given request repeatedly with the given destination
+// and CallOptions, once right away and then every interval, until the
+// context is cancelled, i.e. to send heartbeats or push metrics. A random
+// delay up to jitter is added to every interval, so that peers started
+// together do not call at the same times. While calls fail, the interval
+// doubles after every failure, up to 16 times the given interval, and it
+// is restored after a successful call.
+//
+// The Reply of the request only gives the type of the replies: every
+// call obtains a new reply, which is returned by Periodic.Latest() and
+// may be kept by the caller.
+func (c *Client) Every(ctx context.Context, interval, jitter time.Duration, dest peer.ID, req Request, opts ...CallOption) *Periodic {
+	p := &Periodic{done: make(chan struct{})}
+	go p.run(ctx, c, interval, jitter, dest, req, opts)
+	return p
+}
+
+func (p *Periodic) run(ctx context.Context, c *Client, interval, jitter time.Duration, dest peer.ID, req Request, opts []CallOption) {
+	defer close(p.done)
+	replyType := reflect.TypeOf(req.Reply)
+	backoff := 1
+	for {
+		var reply interface{}
+		if replyType != nil && replyType.Kind() == reflect.Ptr {
+			reply = reflect.New(replyType.Elem()).Interface()
+		}
+		err := c.CallContext(ctx, dest, req.Service, req.Method, req.Args, reply, opts...)
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.latest = Result{Reply: reply, Error: err}
+		p.at = time.Now()
+		p.calls++
+		if err != nil {
+			p.failures++
+			if backoff < maxPeriodicBackoff {
+				backoff *= 2
+			}
+		} else {
+			p.failures = 0
+			backoff = 1
+		}
+		p.mu.Unlock()
+
+		wait := interval * time.Duration(backoff)
+		if jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Latest returns the result of the last call and the time at which it
+// finished, or a zero Result and time before the first call finishes.
+func (p *Periodic) Latest() (Result, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latest, p.at
+}
+
+// Calls returns the number of calls made so far.
+func (p *Periodic) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// Failures returns the number of consecutive calls which failed, up to
+// the last one.
+func (p *Periodic) Failures() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failures
+}
+
+// Done returns a channel which is closed once the calls stopped, after
+// the context was cancelled.
+func (p *Periodic) Done() <-chan struct{} {
+	return p.done
+}
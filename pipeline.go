@@ -0,0 +1,440 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Pipelined streams are persistent streams over which a client sends
+// many requests without waiting for the previous ones to be answered.
+// Every request carries an ID (ServiceID.RequestID), the server handles
+// them concurrently and sends every response, tagged with the ID of its
+// request, as soon as it is ready, so responses may arrive out of order.
+// Clients abandoning a call send a cancellation frame with its ID
+// (ServiceID.Cancel) instead of resetting the stream, which is shared
+// with other calls.
+
+// PipelineProtocol returns the protocol used by clients to open pipelined
+// streams to servers using the given base protocol.
+func PipelineProtocol(base protocol.ID) protocol.ID {
+	return protocol.ID(string(base) + "/pipeline")
+}
+
+// WithPipelining makes the Client perform its remote calls over a single
+// pipelined stream per destination, which is opened with the first call
+// and kept open afterwards. Calls made simultaneously share the stream,
+// which saves opening a stream for every call and helps when streams are
+// expensive to open, i.e. over relays. A call which fails to obtain a
+// response because the stream broke makes the next call open a new one.
+//
+// Cancelling the context of a call makes it return right away, and the
+// context of the method is cancelled on the server.
+func WithPipelining() ClientOption {
+	return func(c *Client) {
+		c.pipelines = make(map[peer.ID]*pipeline)
+	}
+}
+
+// handlePipelineStream is the libp2p stream handler for pipelined streams.
+func (server *Server) handlePipelineStream(stream network.Stream) {
+	if !server.acceptStream(stream) {
+		return
+	}
+	server.streamLogger.Debugw("new pipelined stream", "peer", stream.Conn().RemotePeer())
+	sWrap := server.wrap(stream, codecFor(server.codecs, stream.Protocol())).withFlushDelay(server.flushDelay)
+	sWrap.signKey = server.key
+	err := server.servePipeline(context.Background(), sWrap)
+	if err != nil {
+		server.streamLogger.Debugw("pipelined stream failed", "peer", sWrap.remotePeer(), "error", err)
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// servePipeline reads the requests arriving on a pipelined stream and
+// handles each of them in its own goroutine, until the stream is closed.
+// The context of the requests is cancelled when the stream fails.
+func (server *Server) servePipeline(ctx context.Context, s *streamWrap) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+
+	for first := true; ; first = false {
+		s.reqStart = s.consumed()
+		var svcID ServiceID
+		var err error
+		if first {
+			err = server.readFirstHeader(s, &svcID)
+		} else {
+			err = s.readHeader(&svcID)
+		}
+		if IsAuthorizationError(err) {
+			// The stream is closed once the error is sent.
+			return sendResponse(s, newErrorResponse(svcID, err), nil)
+		}
+		if err == io.EOF {
+			// Finish responding before closing.
+			wg.Wait()
+			s.inflight.Wait()
+			s.wmu.Lock()
+			defer s.wmu.Unlock()
+			return s.flushNow()
+		}
+		if err != nil {
+			cancel()
+			wg.Wait()
+			return err
+		}
+		if svcID.Ping {
+			if err := servePing(s, svcID); err != nil {
+				return err
+			}
+			continue
+		}
+		if svcID.Cancel {
+			server.streamLogger.Debugw("request cancelled", "peer", s.remotePeer(), "id", svcID.RequestID)
+			s.cancelRequest(svcID.RequestID)
+			continue
+		}
+
+		argsRead := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := server.serveRequest(ctx, s, svcID, "", true, func() {
+				close(argsRead)
+			})
+			if err != nil {
+				server.logger.Errorw("error handling RPC", "peer", s.remotePeer(), "service", svcID.Name, "method", svcID.Method, "error", err)
+				resp := newErrorResponse(svcID, err)
+				if err := sendResponse(s, resp, nil); err != nil {
+					server.streamLogger.Debugw("error sending response", "peer", s.remotePeer(), "error", err)
+				}
+			}
+		}()
+		<-argsRead
+	}
+}
+
+// trackRequest registers the cancel function of a pipelined request, so
+// that it can be cancelled with cancelRequest(). It returns a function
+// which cancels the request and unregisters it, to be used instead.
+func (s *streamWrap) trackRequest(id uint64, cancel context.CancelFunc) context.CancelFunc {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	if s.cancels == nil {
+		s.cancels = make(map[uint64]context.CancelFunc)
+	}
+	s.cancels[id] = cancel
+	return func() {
+		s.cmu.Lock()
+		delete(s.cancels, id)
+		s.cmu.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequest cancels the pipelined request with the given ID, if it
+// is being handled.
+func (s *streamWrap) cancelRequest(id uint64) {
+	s.cmu.Lock()
+	cancel, ok := s.cancels[id]
+	s.cmu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// pipelineRequest is a call waiting for its response on a pipeline.
+type pipelineRequest struct {
+	call *Call
+	done chan error
+}
+
+// pipeline sends calls over a pipelined stream and dispatches the
+// responses to them.
+type pipeline struct {
+	s *streamWrap
+	// ready is closed once the stream has been opened, or
+	// opening it has failed.
+	ready chan struct{}
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pipelineRequest
+	// err is set when the pipeline fails, after which it
+	// cannot be used anymore.
+	err error
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{
+		ready:   make(chan struct{}),
+		pending: make(map[uint64]*pipelineRequest),
+	}
+}
+
+// getError returns the error which made the pipeline fail, if any.
+func (p *pipeline) getError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// fail resets the stream and makes all the pending calls fail with
+// the given error.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	pending := p.pending
+	p.pending = make(map[uint64]*pipelineRequest)
+	p.mu.Unlock()
+
+	p.s.reset()
+	for _, req := range pending {
+		req.done <- err
+	}
+}
+
+// remove removes the request with the given ID from the pending ones
+// and returns it, or nil when it is not pending.
+func (p *pipeline) remove(id uint64) *pipelineRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	req, ok := p.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(p.pending, id)
+	return req
+}
+
+// call sends the call request and waits for the response, which is read
+// into the call. Errors sent by the server are set in the call, while the
+// returned error indicates that the response could not be obtained. The
+// returned boolean is true when the request was not sent.
+func (p *pipeline) call(call *Call) (bool, error) {
+	req := &pipelineRequest{call: call, done: make(chan error, 1)}
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return true, p.err
+	}
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = req
+	p.mu.Unlock()
+
+	svcID := call.SvcID
+	svcID.RequestID = id
+	if err := p.write(call, svcID); err != nil {
+		p.remove(id)
+		p.fail(err)
+		return true, err
+	}
+
+	select {
+	case err := <-req.done:
+		return false, err
+	case <-call.ctx.Done():
+		if p.remove(id) != nil {
+			go p.cancel(id)
+			return false, call.ctx.Err()
+		}
+		// The response is being read.
+		return false, <-req.done
+	}
+}
+
+// write sends a request over the stream.
+func (p *pipeline) write(call *Call, svcID ServiceID) error {
+	p.s.wmu.Lock()
+	defer p.s.wmu.Unlock()
+	sent := p.s.cw.count()
+	defer func() {
+		call.setInfo(func(info *CallInfo) {
+			info.BytesSent = p.s.cw.count() - sent
+		})
+	}()
+
+	if err := p.s.writeRequest(svcID, call.Args, call.signKey, call.compressAbove); err != nil {
+		return newClientError(err)
+	}
+	if err := p.s.flushMessage(); err != nil {
+		return newClientError(err)
+	}
+	return nil
+}
+
+// cancel sends a cancellation frame for the request with the given ID.
+func (p *pipeline) cancel(id uint64) {
+	p.s.wmu.Lock()
+	err := p.s.writeHeader(ServiceID{Cancel: true, RequestID: id})
+	if err == nil {
+		err = p.s.w.Flush()
+	}
+	p.s.wmu.Unlock()
+	if err != nil {
+		p.fail(newClientError(err))
+	}
+}
+
+// readResponses reads the responses arriving over the stream and
+// dispatches them to the pending calls, until the stream fails.
+func (p *pipeline) readResponses() {
+	for {
+		start := p.s.consumed()
+		var resp Response
+		if err := p.s.readHeader(&resp); err != nil {
+			p.fail(newClientError(err))
+			return
+		}
+		id := resp.Service.RequestID
+
+		if resp.Heartbeat {
+			continue
+		}
+		if resp.Progress != nil {
+			p.mu.Lock()
+			req := p.pending[id]
+			p.mu.Unlock()
+			if req != nil && req.call.opts.progress != nil {
+				req.call.opts.progress(*resp.Progress)
+			}
+			continue
+		}
+
+		req := p.remove(id)
+		if req == nil {
+			// The call was cancelled, or this answers a ping.
+			var discard interface{}
+			if _, err := p.s.decodeResponseBody(&resp, &discard); err != nil && err != io.EOF {
+				p.fail(newClientError(err))
+				return
+			}
+			continue
+		}
+
+		err := readReply(p.s, req.call, &resp)
+		req.call.setInfo(func(info *CallInfo) {
+			info.BytesReceived = p.s.consumed() - start
+		})
+		req.done <- err
+		if err != nil {
+			// The stream cannot be read anymore.
+			p.fail(err)
+			return
+		}
+	}
+}
+
+// pipelineTo returns the pipeline to the destination of the call, opening
+// a new one when there is none. The returned duration is the time taken
+// to open the stream, when it was opened for this call.
+func (c *Client) pipelineTo(call *Call) (*pipeline, time.Duration, error) {
+	c.pipelinesMu.Lock()
+	p := c.pipelines[call.Dest]
+	if p != nil && p.getError() == nil {
+		c.pipelinesMu.Unlock()
+		select {
+		case <-p.ready:
+		case <-call.ctx.Done():
+			return nil, 0, call.ctx.Err()
+		}
+		if err := p.getError(); err != nil {
+			return nil, 0, err
+		}
+		return p, 0, nil
+	}
+	p = newPipeline()
+	c.pipelines[call.Dest] = p
+	c.pipelinesMu.Unlock()
+
+	start := time.Now()
+	err := c.openPipeline(call, p)
+	close(p.ready)
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, time.Since(start), nil
+}
+
+// openPipeline opens the stream of a pipeline to the destination of the
+// call. The pipeline is marked as failed when it cannot be opened.
+func (c *Client) openPipeline(call *Call, p *pipeline) error {
+	base := c.protocols("")
+	protos := make([]protocol.ID, len(base))
+	for i, proto := range base {
+		protos[i] = PipelineProtocol(proto)
+	}
+	s, err := c.openStreamWith(call, protos)
+	if err != nil {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		return err
+	}
+	c.setPeerProtocol(call.Dest, s.Protocol())
+	c.streamLogger.Debugw("opened pipelined stream", "peer", call.Dest, "protocol", s.Protocol())
+	sWrap := c.wrap(s, codecFor(c.codecs, s.Protocol()))
+	if err := c.authenticate(call, sWrap); err != nil {
+		s.Reset()
+		sWrap.release()
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		return err
+	}
+	p.s = sWrap.withFlushDelay(c.flushDelay)
+	go p.readResponses()
+	return nil
+}
+
+// sendPipelined performs a remote call over the pipeline to its
+// destination. It works like send().
+func (c *Client) sendPipelined(call *Call) (bool, error) {
+	start := time.Now()
+	p, setup, err := c.pipelineTo(call)
+	if IsAuthorizationError(err) {
+		// The credentials were rejected.
+		return false, err
+	}
+	if err != nil {
+		return true, newClientError(err)
+	}
+	if err := checkTransport(call, p.s.stream.Conn()); err != nil {
+		return false, err
+	}
+	call.markReached()
+	call.setInfo(func(info *CallInfo) {
+		info.StreamSetup = setup
+	})
+	call.setConnInfo(p.s.stream.Conn())
+
+	c.logger.Debugw(
+		"sending pipelined call",
+		"peer", call.Dest,
+		"service", call.SvcID.Name,
+		"method", call.SvcID.Method,
+	)
+	retriable, err := p.call(call)
+	if err != nil {
+		if ctxErr := call.ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		return retriable, err
+	}
+	if call.getError() == nil {
+		c.latencies.record(call.Dest, call.SvcID, time.Since(start))
+	}
+	return false, nil
+}
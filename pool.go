@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Executor runs the methods called by remote peers on a Server (see
+// WithExecutor). Execute must run f eventually, possibly on another
+// goroutine, and may block the caller until it can be accepted. Methods
+// are run on the goroutine handling their stream otherwise.
+type Executor interface {
+	Execute(f func())
+}
+
+// WithExecutor makes the Server run the methods called by remote peers on
+// the given Executor, such as a WorkerPool, so that their scheduling and
+// the number of goroutines running them are predictable. The goroutine
+// handling the request waits for the method to finish. Local calls are
+// still run by the calling goroutine.
+func WithExecutor(e Executor) ServerOption {
+	return func(s *Server) {
+		s.executor = e
+	}
+}
+
+// PoolStats provides statistics about a WorkerPool.
+type PoolStats struct {
+	// Workers is the number of goroutines of the pool.
+	Workers int
+	// Busy is the number of workers running a task.
+	Busy int
+	// Queued is the number of tasks waiting for a worker.
+	Queued int
+	// Executed is the number of tasks finished.
+	Executed int64
+	// AvgQueueDelay is the average time that the tasks started so far
+	// waited for a worker.
+	AvgQueueDelay time.Duration
+}
+
+// WorkerPool is an Executor running tasks on a fixed number of
+// goroutines. Tasks wait in a bounded queue for a free worker, and
+// Execute blocks when the queue is full, so that bursts do not
+// accumulate unbounded work.
+type WorkerPool struct {
+	workers int
+	tasks   chan poolTask
+
+	mu       sync.Mutex
+	busy     int
+	executed int64
+	started  int64
+	waited   time.Duration
+
+	closeOnce sync.Once
+	done      sync.WaitGroup
+}
+
+type poolTask struct {
+	f        func()
+	enqueued time.Time
+}
+
+// NewWorkerPool starts a WorkerPool with the given number of workers,
+// GOMAXPROCS when zero or negative, and the given queue length.
+func NewWorkerPool(workers, queueLen int) *WorkerPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	p := &WorkerPool{
+		workers: workers,
+		tasks:   make(chan poolTask, queueLen),
+	}
+	p.done.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Execute queues f to be run by a worker, waiting for room in the queue
+// if needed. It must not be called after Close.
+func (p *WorkerPool) Execute(f func()) {
+	p.tasks <- poolTask{f: f, enqueued: time.Now()}
+}
+
+// work runs the queued tasks until the pool is closed.
+func (p *WorkerPool) work() {
+	defer p.done.Done()
+	for t := range p.tasks {
+		p.mu.Lock()
+		p.busy++
+		p.started++
+		p.waited += time.Since(t.enqueued)
+		p.mu.Unlock()
+
+		t.f()
+
+		p.mu.Lock()
+		p.busy--
+		p.executed++
+		p.mu.Unlock()
+	}
+}
+
+// Stats returns the current statistics of the pool.
+func (p *WorkerPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := PoolStats{
+		Workers:  p.workers,
+		Busy:     p.busy,
+		Queued:   len(p.tasks),
+		Executed: p.executed,
+	}
+	if p.started > 0 {
+		st.AvgQueueDelay = p.waited / time.Duration(p.started)
+	}
+	return st
+}
+
+// Close stops the workers once the queued tasks have run, and waits for
+// them.
+func (p *WorkerPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.tasks)
+	})
+	p.done.Wait()
+}
+
+// call calls the method with the given arguments, on the executor of the
+// server if any.
+func (s *service) call(mtype *methodType, args []reflect.Value) []reflect.Value {
+	if s.executor == nil {
+		return mtype.method.Func.Call(args)
+	}
+	done := make(chan []reflect.Value, 1)
+	s.executor.Execute(func() {
+		done <- mtype.method.Func.Call(args)
+	})
+	return <-done
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// WithPreconnectValidation makes Preconnect open a stream to every peer,
+// after connecting to it, to check that it speaks one of the client's
+// protocols. This also saves the protocol negotiation from the first
+// calls to each peer.
+func WithPreconnectValidation() ClientOption {
+	return func(c *Client) {
+		c.preconnectValidation = true
+	}
+}
+
+// Preconnect connects to the given peers ahead of time, in parallel, so
+// that the first calls to them do not need to wait for the connection to
+// be established. Peer addresses must be known by the host. Peers which
+// are already connected are left untouched, unless
+// WithPreconnectValidation is used.
+//
+// The returned slice contains the error obtained for each peer, in the
+// same order. The local peer is skipped.
+func (c *Client) Preconnect(ctx context.Context, peers ...peer.ID) []error {
+	errs := make([]error, len(peers))
+	if c.host == nil {
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		if p == "" || p == c.host.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			errs[i] = c.preconnect(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (c *Client) preconnect(ctx context.Context, p peer.ID) error {
+	err := c.host.Connect(ctx, c.host.Peerstore().PeerInfo(p))
+	if err != nil {
+		return newClientError(err)
+	}
+	if !c.preconnectValidation {
+		return nil
+	}
+
+	protos := append([]protocol.ID{c.protocol}, c.extraProtocols...)
+	s, err := c.host.NewStream(ctx, p, protos...)
+	if err != nil {
+		return newClientError(err)
+	}
+	c.setPeerProtocol(p, s.Protocol())
+	c.streamLogger.Debugw("preconnected", "peer", p, "protocol", s.Protocol())
+	// Servers ignore streams closed without any request.
+	go helpers.FullClose(s)
+	return nil
+}
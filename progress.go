@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+)
+
+// Progress is an update on the progress of a long-running call, sent by
+// the server method with ReportProgress().
+type Progress struct {
+	Percent float64
+	Message string
+}
+
+// ProgressFunc is a function receiving progress updates for a call.
+type ProgressFunc func(Progress)
+
+// WithProgress requests progress updates for the call, which are passed
+// to the given function as they arrive, before the call completes. The
+// function is called from the goroutine performing the call and should
+// not block.
+func WithProgress(f ProgressFunc) CallOption {
+	return func(o *callOptions) {
+		o.progress = f
+	}
+}
+
+// errProgressAfterResponse is returned when reporting progress
+// after the method has returned.
+var errProgressAfterResponse = errors.New("rpc: cannot report progress after the response has been sent")
+
+// progressReporter sends progress updates over a stream until the final
+// response is sent.
+type progressReporter struct {
+	s       *streamWrap
+	svcID   ServiceID
+	stopped bool
+	// stop is closed once stopped is set.
+	stop chan struct{}
+}
+
+// startProgress sets up a new progress reporter for the stream, which
+// sends progress updates and heartbeats for the given request.
+func (s *streamWrap) startProgress(svcID ServiceID) *progressReporter {
+	pr := &progressReporter{s: s, svcID: svcID, stop: make(chan struct{})}
+	s.wmu.Lock()
+	if s.progress == nil {
+		s.progress = make(map[uint64]*progressReporter)
+	}
+	s.progress[svcID.RequestID] = pr
+	s.wmu.Unlock()
+	return pr
+}
+
+// stopProgress stops the progress reporter of the request with the given
+// ID, which is 0 unless requests are pipelined. It must be called with
+// wmu locked.
+func (s *streamWrap) stopProgress(reqID uint64) {
+	if pr, ok := s.progress[reqID]; ok {
+		pr.stopped = true
+		close(pr.stop)
+		delete(s.progress, reqID)
+	}
+}
+
+func (pr *progressReporter) report(p Progress) error {
+	pr.s.wmu.Lock()
+	defer pr.s.wmu.Unlock()
+	if pr.stopped {
+		return errProgressAfterResponse
+	}
+
+	resp := &Response{
+		Service:  pr.svcID,
+		Progress: &p,
+	}
+	if err := pr.s.writeHeader(resp); err != nil {
+		return err
+	}
+	return pr.s.flushMessage()
+}
+
+// withProgress returns a context carrying a function to report progress.
+func withProgress(ctx context.Context, f func(Progress) error) context.Context {
+	return context.WithValue(ctx, progressKey, f)
+}
+
+// ReportProgress sends a progress update to the caller of a method. It is
+// meant to be used by server methods on the context they receive. Updates
+// are only sent when the caller requested them (see WithProgress),
+// otherwise this does nothing.
+func ReportProgress(ctx context.Context, percent float64, msg string) error {
+	f, ok := ctx.Value(progressKey).(func(Progress) error)
+	if !ok {
+		return nil
+	}
+	return f(Progress{Percent: percent, Message: msg})
+}
@@ -0,0 +1,151 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Peers which cannot be reached directly (i.e. behind a NAT) can be
+// called through a gateway running a Proxy. Calls made with ThroughProxy
+// are sent to the gateway, carrying their actual destination in the
+// request (ServiceID.Destination), and the Server of the gateway forwards
+// them with the Client of its Proxy, sending back the response of the
+// destination. Arguments and replies are forwarded as they were encoded,
+// and only decoded and encoded again when the codecs of both streams
+// differ.
+//
+// The destination sees the gateway as the caller: requests are not
+// forwarded with their signature or token, but with those of the Client
+// of the Proxy, if any. Their idempotency keys are prefixed with the
+// peer ID of the caller, so that the keys of different callers do not
+// collide at the destination (see WithDeduplication).
+
+// Proxy forwards the calls received by a Server for other peers (see
+// WithProxy).
+type Proxy struct {
+	client *Client
+	allow  func(src, dest peer.ID) bool
+}
+
+// ProxyOption allows for functional setting of options on a Proxy.
+type ProxyOption func(*Proxy)
+
+// WithForwardFilter sets a function deciding whether the calls from src
+// are forwarded to dest. Without it, no call is forwarded.
+func WithForwardFilter(f func(src, dest peer.ID) bool) ProxyOption {
+	return func(p *Proxy) {
+		p.allow = f
+	}
+}
+
+// NewProxy returns a Proxy forwarding calls with the given Client. The
+// Proxy only forwards the calls allowed by its forward filter (see
+// WithForwardFilter), which must be set: forwarding the calls of any
+// peer to any destination would make the gateway an open relay.
+func NewProxy(c *Client, opts ...ProxyOption) *Proxy {
+	p := &Proxy{client: c}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithProxy makes the Server forward the calls for other peers with the
+// given Proxy. Servers without a Proxy reject them. The forwarded calls
+// go through the same checks as any other (see WithAuthorizeFunc for
+// instance) and are limited and timed out in the same way.
+func WithProxy(p *Proxy) ServerOption {
+	return func(s *Server) {
+		s.proxy = p
+	}
+}
+
+// ThroughProxy sends the call to the given gateway, which forwards it to
+// the destination (see Proxy). Note that servers of versions without
+// support for proxies handle the call themselves.
+func ThroughProxy(gateway peer.ID) CallOption {
+	return func(o *callOptions) {
+		o.proxy = gateway
+	}
+}
+
+// errNotProxy is returned by Servers without a Proxy for calls to
+// other peers.
+var errNotProxy = errors.New("rpc: calls to other peers are not forwarded")
+
+// proxiedError is the error of a forwarded call, which keeps its type in
+// the response sent back (see invoke).
+type proxiedError struct {
+	err error
+}
+
+func (e *proxiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *proxiedError) Unwrap() error {
+	return e.err
+}
+
+// methodErrorType returns the type of the error returned by a method, as
+// reported in the response.
+func methodErrorType(err error) responseErr {
+	pe, ok := err.(*proxiedError)
+	if !ok {
+		return nonRPCErr
+	}
+	err = pe.err
+	if ce, ok := err.(*codedError); ok {
+		err = ce.err
+	}
+	return responseErrorType(err)
+}
+
+// lookupService returns the service and method handling the given
+// request from src: one forwarding it when it is for another peer, or
+// the one given by getServiceOrFallback.
+func (server *Server) lookupService(src peer.ID, svcID ServiceID) (*service, *methodType, error) {
+	dest := svcID.Destination
+	if dest == "" || (server.host != nil && dest == server.host.ID()) {
+		return server.getServiceOrFallback(svcID)
+	}
+	p := server.proxy
+	if p == nil {
+		return nil, nil, newServerError(errNotProxy)
+	}
+	if p.allow == nil || !p.allow(src, dest) {
+		return nil, nil, newServerError(fmt.Errorf("rpc: calls to %s are not forwarded", dest.Pretty()))
+	}
+	svc, mtype := server.handlerMethod(svcID, func(_ funcService, ctx context.Context, args *encodedBody, reply *encodedBody) error {
+		return p.forward(ctx, src, svcID, args, reply)
+	})
+	return svc, mtype, nil
+}
+
+// forward performs the given request from src with the Client of the
+// Proxy.
+func (p *Proxy) forward(ctx context.Context, src peer.ID, svcID ServiceID, args, reply *encodedBody) error {
+	c := p.client
+	call := newCall(ctx, svcID.Destination, svcID.Name, svcID.Method, args, reply, make(chan *Call, 1))
+	call.logger = c.logger
+	call.SvcID.Metadata = svcID.Metadata
+	if svcID.IdempotencyKey != "" {
+		call.SvcID.IdempotencyKey = src.String() + "/" + svcID.IdempotencyKey
+	}
+	call.SvcID.Priority = svcID.Priority
+	call.SvcID.Codec = svcID.Codec
+	call.SvcID.Version = svcID.Version
+	c.makeCall(call)
+
+	err := call.getError()
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*clientError); ok {
+		err = newServerError(fmt.Errorf("rpc: cannot forward the call to %s: %w", svcID.Destination.Pretty(), err))
+	}
+	return &proxiedError{err}
+}
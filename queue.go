@@ -0,0 +1,212 @@
+package rpc
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Priority indicates the relative importance of a call. Servers limiting
+// the number of concurrent calls (see WithMaxConcurrentCalls) run waiting
+// requests with higher priority first.
+type Priority int
+
+// Priority levels.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// WithPriority sets the priority of the call. Calls have PriorityNormal
+// by default.
+func WithPriority(p Priority) CallOption {
+	return func(o *callOptions) {
+		o.priority = p
+	}
+}
+
+// WithMaxConcurrentCalls limits the number of methods that the Server runs
+// at the same time to n. Further requests wait until one of the running
+// methods finishes, and are run in order of priority (see WithPriority),
+// and in order of arrival within the same priority. A zero or negative n
+// means no limit.
+func WithMaxConcurrentCalls(n int) ServerOption {
+	return func(s *Server) {
+		s.callQueue().max = n
+	}
+}
+
+// WithAdmissionQueue bounds the queue of requests waiting to run when the
+// limit set with WithMaxConcurrentCalls is reached. At most maxLen
+// requests wait: further ones are rejected immediately with an error for
+// which IsOverloadedError() is true, so that the server does not
+// accumulate more work than it can handle. Requests waiting longer
+// than maxWait are rejected in the same way. Rejected requests are not run
+// and carry a hint of when to retry them (see RetryAfter()). A negative
+// maxLen means no limit on the queue length, and a zero or negative
+// maxWait means no limit on the waiting time. It has no effect unless
+// the number of concurrent calls is limited.
+func WithAdmissionQueue(maxLen int, maxWait time.Duration) ServerOption {
+	return func(s *Server) {
+		q := s.callQueue()
+		q.maxWaiting = maxLen
+		q.maxWait = maxWait
+	}
+}
+
+// defaultRetryAfter is the retry hint given for rejected requests when
+// no maximum waiting time is set.
+const defaultRetryAfter = time.Second
+
+// callQueue returns the server's call queue, creating it if needed.
+func (s *Server) callQueue() *callQueue {
+	if s.queue == nil {
+		s.queue = newCallQueue(0)
+	}
+	return s.queue
+}
+
+// waiter is a request waiting in a callQueue. ready is closed when the
+// request can run.
+type waiter struct {
+	priority Priority
+	seq      uint64
+	ready    chan struct{}
+	index    int // in the heap, -1 when removed
+}
+
+// waiterHeap sorts waiters by priority and then by arrival.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
+}
+
+// callQueue limits the number of running calls, making the rest wait
+// in order of priority. Requests are rejected when too many are waiting
+// or they have waited for too long.
+type callQueue struct {
+	max        int
+	maxWaiting int
+	maxWait    time.Duration
+
+	mu      sync.Mutex
+	running int
+	waiting waiterHeap
+	seq     uint64
+}
+
+func newCallQueue(max int) *callQueue {
+	return &callQueue{
+		max:        max,
+		maxWaiting: -1,
+	}
+}
+
+// overloaded returns the error for requests rejected by the queue.
+func (q *callQueue) overloaded(reason string) error {
+	retryAfter := q.maxWait
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	return &overloadedError{
+		msg:        fmt.Sprintf("server overloaded: %s", reason),
+		retryAfter: retryAfter,
+	}
+}
+
+// acquire waits until a call with the given priority can run. It returns
+// an overloadedError if the request is rejected, or a serverError if the
+// context is cancelled while waiting. release() must be called when the
+// call finishes if no error is returned.
+func (q *callQueue) acquire(ctx context.Context, p Priority) error {
+	q.mu.Lock()
+	if q.running < q.max && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+	if q.maxWaiting >= 0 && len(q.waiting) >= q.maxWaiting {
+		q.mu.Unlock()
+		return q.overloaded("too many queued requests")
+	}
+	w := &waiter{
+		priority: p,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+	}
+	q.seq++
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	var expired <-chan time.Time
+	if q.maxWait > 0 {
+		timer := time.NewTimer(q.maxWait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-expired:
+		err = q.overloaded("queued for too long")
+	case <-ctx.Done():
+		err = newServerError(ctx.Err())
+	}
+
+	q.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&q.waiting, w.index)
+		q.mu.Unlock()
+		return err
+	}
+	q.mu.Unlock()
+	// The call was let through in the meantime.
+	q.release()
+	return err
+}
+
+// release finishes a running call, handing its slot to the
+// next waiting one if any.
+func (q *callQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		w := heap.Pop(&q.waiting).(*waiter)
+		close(w.ready)
+		return
+	}
+	q.running--
+}
@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Raw is a byte slice which is sent as is, without being encoded by the
+// codec of the stream. It can be used as the arguments or the reply of
+// methods whose values are serialized already (i.e. protocol buffers),
+// taking Raw arguments and a *Raw reply:
+//
+//	func (t *T) MethodName(ctx context.Context, in rpc.Raw, out *rpc.Raw) error
+//
+// On the wire, raw values are written right after the header, prefixed
+// by their length as an unsigned varint, and marked in the header
+// (ServiceID.Raw and Response.Raw). Raw values can also be decoded as
+// byte slices when sent by clients or servers not using them.
+type Raw []byte
+
+// rawBytes returns the bytes of a Raw or *Raw value.
+func rawBytes(v interface{}) ([]byte, bool) {
+	switch r := v.(type) {
+	case Raw:
+		return r, true
+	case *Raw:
+		if r != nil {
+			return *r, true
+		}
+	}
+	return nil, false
+}
+
+// writeRaw writes a raw value to the stream.
+func (sw *streamWrap) writeRaw(data []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(data)))
+	if _, err := sw.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(data)
+	return err
+}
+
+// readRaw reads a raw value from the stream into v, which must be a *Raw,
+// a *[]byte or a pointer to an empty interface.
+func (sw *streamWrap) readRaw(v interface{}) error {
+	// The JSON codec follows values with whitespace.
+	if _, ok := sw.codec.handle.(*codec.JsonHandle); ok {
+		if err := skipWhitespace(sw.fr); err != nil {
+			return err
+		}
+	}
+	size, err := binary.ReadUvarint(sw.fr)
+	if err != nil {
+		return err
+	}
+	if size > math.MaxInt64 || (sw.fr.left >= 0 && size > uint64(sw.fr.left)) {
+		return fmt.Errorf("raw value too large: %d bytes", size)
+	}
+	// The buffer grows as the data arrives, rather than trusting
+	// the size.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, sw.fr, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	data := buf.Bytes()
+
+	switch r := v.(type) {
+	case *Raw:
+		*r = data
+	case *[]byte:
+		*r = data
+	case *interface{}:
+		*r = data
+	default:
+		return fmt.Errorf("raw value cannot be decoded as %T", v)
+	}
+	return nil
+}
+
+// skipWhitespace discards the whitespace at the current position of
+// the reader.
+func skipWhitespace(r io.ByteScanner) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return r.UnreadByte()
+		}
+	}
+}
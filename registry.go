@@ -0,0 +1,64 @@
+package rpc
+
+import (
+	"errors"
+)
+
+// The registered services are kept in a map which is never modified once
+// stored: registering or unregistering a service stores a modified copy
+// of it, so that calls look their service up without locking, even while
+// services are being registered or unregistered. Changes are serialized
+// by server.mu. Calls which looked up a service before it was
+// unregistered complete normally.
+
+// services returns the registered services, by key (see serviceKey). The
+// returned map must not be modified.
+func (server *Server) services() map[string]*service {
+	m, _ := server.serviceMap.Load().(map[string]*service)
+	return m
+}
+
+// copyServices returns a copy of the registered services, to be modified
+// and stored with server.serviceMap.Store. It must be called with
+// server.mu held.
+func (server *Server) copyServices() map[string]*service {
+	old := server.services()
+	m := make(map[string]*service, len(old)+1)
+	for key, s := range old {
+		m[key] = s
+	}
+	return m
+}
+
+// Unregister removes a registered service, or the given version of it
+// (see WithVersion), so that new calls to it fail with ErrNoSuchService.
+// Calls to it already being handled complete normally. Other options are
+// ignored.
+func (server *Server) Unregister(svcName string, opts ...RegisterOption) error {
+	key := serviceKey(svcName, newRegisterOptions(opts).version)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	m := server.copyServices()
+	if _, ok := m[key]; !ok {
+		return errors.New("rpc: can't find service " + key)
+	}
+	delete(m, key)
+	server.serviceMap.Store(m)
+	delete(server.docs, key)
+	if !server.hasService(svcName) {
+		server.removeServiceHandlers(svcName)
+	}
+	return nil
+}
+
+// removeServiceHandlers removes the stream handlers of the protocols of
+// the given service, when per-service protocols are enabled.
+func (server *Server) removeServiceHandlers(sname string) {
+	if !server.serviceProtocols || server.host == nil {
+		return
+	}
+	for _, p := range server.protocols() {
+		server.host.RemoveStreamHandler(ServiceProtocol(p, sname))
+	}
+}
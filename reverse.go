@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Reverse calls allow a Server to call services provided by a peer
+// which cannot be dialed (i.e. because it is behind a NAT). The peer
+// opens a stream to the server using Client.ServeReverse() and serves
+// the requests that the server sends over it with Server.CallReverse().
+
+// ReverseProtocol returns the protocol used by clients to open reverse
+// sessions to servers using the given base protocol.
+func ReverseProtocol(base protocol.ID) protocol.ID {
+	return protocol.ID(string(base) + "/reverse")
+}
+
+// handleReverseStream registers a reverse session opened by a client.
+// Any previous session from the same peer is closed.
+func (server *Server) handleReverseStream(stream network.Stream) {
+	if !server.acceptStream(stream) {
+		return
+	}
+	p := stream.Conn().RemotePeer()
+	server.streamLogger.Debugw("new reverse session", "peer", p)
+
+	sc := newStreamCaller(server.wrap(stream, codecFor(server.codecs, stream.Protocol())))
+	server.reverseMu.Lock()
+	old := server.reverseSessions[p]
+	server.reverseSessions[p] = sc
+	server.reverseMu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	go sc.keepalive(server.keepalive, server.streamLogger)
+}
+
+// ReversePeers returns the peers which have opened a reverse session
+// with this server and can be called with CallReverse().
+func (server *Server) ReversePeers() []peer.ID {
+	server.reverseMu.Lock()
+	defer server.reverseMu.Unlock()
+	peers := make([]peer.ID, 0, len(server.reverseSessions))
+	for p, sc := range server.reverseSessions {
+		if !sc.isClosed() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// CallReverse performs a call to a service provided by the given peer,
+// using the reverse session opened by it (see Client.ServeReverse()).
+// Calls to the same peer are performed one at a time. Cancelling the
+// context of a call closes the reverse session.
+func (server *Server) CallReverse(
+	ctx context.Context,
+	dest peer.ID,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) error {
+	server.reverseMu.Lock()
+	sc := server.reverseSessions[dest]
+	server.reverseMu.Unlock()
+	if sc == nil {
+		return &clientError{"no reverse session with " + dest.Pretty()}
+	}
+
+	done := make(chan *Call, 1)
+	call := newCall(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+	call.logger = server.logger
+	err := sc.call(call)
+	if sc.isClosed() {
+		server.reverseMu.Lock()
+		if server.reverseSessions[dest] == sc {
+			delete(server.reverseSessions, dest)
+		}
+		server.reverseMu.Unlock()
+	}
+	call.doneWithError(err)
+	return call.getError()
+}
+
+// ServeReverse opens a reverse session with the given destination and
+// serves the calls it makes (see Server.CallReverse()) using the Server
+// configured in this Client (see NewClientWithServer()). It blocks until
+// the context is cancelled or the session is closed.
+func (c *Client) ServeReverse(ctx context.Context, dest peer.ID) error {
+	if c.server == nil {
+		return &clientError{"cannot serve reverse calls: server not set"}
+	}
+	if c.host == nil {
+		return &clientError{"cannot serve reverse calls: host not set"}
+	}
+	if err := c.checkPeer(dest); err != nil {
+		return err
+	}
+
+	protos := make([]protocol.ID, 0, 1+len(c.extraProtocols))
+	protos = append(protos, ReverseProtocol(c.protocol))
+	for _, p := range c.extraProtocols {
+		protos = append(protos, ReverseProtocol(p))
+	}
+
+	s, err := c.host.NewStream(ctx, dest, protos...)
+	if err != nil {
+		return newClientError(err)
+	}
+	defer s.Close()
+
+	err = c.server.serveSession(ctx, c.server.wrap(s, codecFor(c.codecs, s.Protocol())))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,315 @@
+package rpctest
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+)
+
+// The conformance vectors are golden byte sequences exchanged over a
+// stream by a client and a server, which alternative implementations of
+// the protocol, in Go or in other languages, can check themselves
+// against: a server must answer the request of every vector with its
+// response, and a client must send the request of the vectors when
+// making the same calls. The vectors call the ConformanceService, which
+// the server under test must provide under the name "Conformance".
+//
+// Requests are compared byte by byte, but responses value by value: the
+// Duration field of response headers varies from call to call, and
+// implementations may encode the fields of maps in a different order.
+
+// ConformanceServiceName is the name of the service called by the
+// conformance vectors.
+const ConformanceServiceName = "Conformance"
+
+// Operands is the argument of ConformanceService.Add.
+type Operands struct {
+	A, B int
+}
+
+// ConformanceService is the service called by the conformance vectors.
+type ConformanceService struct{}
+
+// Add sets r to the sum of the operands.
+func (cs *ConformanceService) Add(ctx context.Context, in Operands, r *int) error {
+	*r = in.A + in.B
+	return nil
+}
+
+// Metadata sets r to the metadata value with the given key attached to
+// the request (see rpc.WithMetadata).
+func (cs *ConformanceService) Metadata(ctx context.Context, key string, r *string) error {
+	*r = rpc.GetMetadata(ctx)[key]
+	return nil
+}
+
+// Fail fails with the given message and the error code 42.
+func (cs *ConformanceService) Fail(ctx context.Context, msg string, r *string) error {
+	return rpc.WithErrorCode(errors.New(msg), 42)
+}
+
+// Vector is a request sent by a client over a new stream, and the
+// response of the server to it.
+type Vector struct {
+	// Name identifies the vector, i.e. "msgpack/call".
+	Name string
+	// Description explains what the vector exercises.
+	Description string
+	// Codec is the name of the codec of the stream (see rpc.Codec).
+	Codec string
+	// Request holds the bytes written by the client on a new stream.
+	Request []byte
+	// Response holds the bytes written by the server.
+	Response []byte
+}
+
+// unhex decodes the hexadecimal bytes of a vector.
+func unhex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+// vectors holds the conformance vectors, as hexadecimal strings.
+var vectors = []struct {
+	name, description, request, response string
+}{
+	{
+		"msgpack/call",
+		"A successful call.",
+		"82a44e616d65ab436f6e666f726d616e6365a64d6574686f64a341646482a14102a14203",
+		"84a75365727669636582a44e616d65ab436f6e666f726d616e6365a64d6574686f64a3416464a54572726f72a0a74572725479706500a84475726174696f6ed20000975005",
+	},
+	{
+		"msgpack/metadata",
+		"A call with metadata.",
+		"83a44e616d65ab436f6e666f726d616e6365a64d6574686f64a84d65746164617461a84d6574616461746181a36b6579a576616c7565a36b6579",
+		"84a75365727669636583a44e616d65ab436f6e666f726d616e6365a64d6574686f64a84d65746164617461a84d6574616461746181a36b6579a576616c7565a54572726f72a0a74572725479706500a84475726174696f6ed13e19a576616c7565",
+	},
+	{
+		"msgpack/error",
+		"A method failing with an error code.",
+		"82a44e616d65ab436f6e666f726d616e6365a64d6574686f64a44661696ca4626f6f6d",
+		"85a75365727669636582a44e616d65ab436f6e666f726d616e6365a64d6574686f64a44661696ca54572726f72a4626f6f6da74572725479706500a84475726174696f6ed1448ba4436f64652aa0",
+	},
+	{
+		"msgpack/unknown-service",
+		"A call to a service which does not exist.",
+		"82a44e616d65a7556e6b6e6f776ea64d6574686f64a341646482a14102a14203",
+		"83a75365727669636582a44e616d65a0a64d6574686f64a0a54572726f72bf7270633a2063616e27742066696e64207365727669636520556e6b6e6f776ea74572725479706501c0",
+	},
+	{
+		"json/call",
+		"A successful call.",
+		"7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a22416464227d207b2241223a322c2242223a337d20",
+		"7b2253657276696365223a7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a22416464227d2c224572726f72223a22222c2245727254797065223a302c224475726174696f6e223a323935347d203520",
+	},
+	{
+		"json/metadata",
+		"A call with metadata.",
+		"7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a224d65746164617461222c224d65746164617461223a7b226b6579223a2276616c7565227d7d20226b65792220",
+		"7b2253657276696365223a7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a224d65746164617461222c224d65746164617461223a7b226b6579223a2276616c7565227d7d2c224572726f72223a22222c2245727254797065223a302c224475726174696f6e223a323233327d202276616c75652220",
+	},
+	{
+		"json/error",
+		"A method failing with an error code.",
+		"7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a224661696c227d2022626f6f6d2220",
+		"7b2253657276696365223a7b224e616d65223a22436f6e666f726d616e6365222c224d6574686f64223a224661696c227d2c224572726f72223a22626f6f6d222c2245727254797065223a302c224475726174696f6e223a333030362c22436f6465223a34327d20222220",
+	},
+	{
+		"json/unknown-service",
+		"A call to a service which does not exist.",
+		"7b224e616d65223a22556e6b6e6f776e222c224d6574686f64223a22416464227d207b2241223a322c2242223a337d20",
+		"7b2253657276696365223a7b224e616d65223a22222c224d6574686f64223a22227d2c224572726f72223a227270633a2063616e27742066696e64207365727669636520556e6b6e6f776e222c2245727254797065223a317d206e756c6c20",
+	},
+	{
+		"cbor/call",
+		"A successful call.",
+		"a2664d6574686f6463416464644e616d656b436f6e666f726d616e6365a2614102614203",
+		"a4684475726174696f6e19051b674572725479706500654572726f72606753657276696365a2664d6574686f6463416464644e616d656b436f6e666f726d616e636505",
+	},
+	{
+		"cbor/metadata",
+		"A call with metadata.",
+		"a3684d65746164617461a1636b65796576616c7565664d6574686f64684d65746164617461644e616d656b436f6e666f726d616e6365636b6579",
+		"a4684475726174696f6e19046e674572725479706500654572726f72606753657276696365a3684d65746164617461a1636b65796576616c7565664d6574686f64684d65746164617461644e616d656b436f6e666f726d616e63656576616c7565",
+	},
+	{
+		"cbor/error",
+		"A method failing with an error code.",
+		"a2664d6574686f64644661696c644e616d656b436f6e666f726d616e636564626f6f6d",
+		"a564436f6465182a684475726174696f6e190737674572725479706500654572726f7264626f6f6d6753657276696365a2664d6574686f64644661696c644e616d656b436f6e666f726d616e636560",
+	},
+	{
+		"cbor/unknown-service",
+		"A call to a service which does not exist.",
+		"a2664d6574686f6463416464644e616d6567556e6b6e6f776ea2614102614203",
+		"a3674572725479706501654572726f72781f7270633a2063616e27742066696e64207365727669636520556e6b6e6f776e6753657276696365a2664d6574686f6460644e616d6560f6",
+	},
+}
+
+// Vectors returns the conformance vectors.
+func Vectors() []Vector {
+	vs := make([]Vector, 0, len(vectors))
+	for _, v := range vectors {
+		vs = append(vs, Vector{
+			Name:        v.name,
+			Description: v.description,
+			Codec:       v.name[:strings.Index(v.name, "/")],
+			Request:     unhex(v.request),
+			Response:    unhex(v.response),
+		})
+	}
+	return vs
+}
+
+// vectorHandles holds the handles decoding the messages of the vectors,
+// by codec name, which are decoded as generic values to be compared.
+var vectorHandles = map[string]codec.Handle{
+	"msgpack": &codec.MsgpackHandle{BasicHandle: codec.BasicHandle{DecodeOptions: codec.DecodeOptions{RawToString: true}}},
+	"json":    &codec.JsonHandle{},
+	"cbor":    &codec.CborHandle{},
+}
+
+// decodeMessages decodes the values written to a stream with the given
+// codec, leaving out the Duration field of response headers.
+func decodeMessages(codecName string, data []byte) ([]interface{}, error) {
+	h, ok := vectorHandles[codecName]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", codecName)
+	}
+	dec := codec.NewDecoder(bytes.NewReader(data), h)
+	var vs []interface{}
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return vs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch m := v.(type) {
+		case map[interface{}]interface{}:
+			delete(m, "Duration")
+		case map[string]interface{}:
+			delete(m, "Duration")
+		}
+		vs = append(vs, v)
+	}
+}
+
+// CheckResponse returns an error when the response written by a server
+// to the request of the vector does not match the vector.
+func (v Vector) CheckResponse(resp []byte) error {
+	want, err := decodeMessages(v.Codec, v.Response)
+	if err != nil {
+		return fmt.Errorf("%s: decoding the vector: %w", v.Name, err)
+	}
+	got, err := decodeMessages(v.Codec, resp)
+	if err != nil {
+		return fmt.Errorf("%s: decoding the response: %w", v.Name, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("%s: got response %v, want %v", v.Name, got, want)
+	}
+	return nil
+}
+
+// TestServerConformance sends the request of every conformance vector to
+// a server and checks its response. The server must provide the
+// ConformanceService under the name "Conformance" (see
+// ConformanceServiceName). Dial opens a new stream to the server using
+// the codec with the given name, i.e. a libp2p stream with the protocol
+// the server associates to the codec, or a connection to a process
+// implementing the protocol in another language.
+func TestServerConformance(t *testing.T, dial func(codec string) (io.ReadWriteCloser, error)) {
+	for _, v := range Vectors() {
+		v := v
+		t.Run(v.Name, func(t *testing.T) {
+			rwc, err := dial(v.Codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rwc.Close()
+			if _, err := rwc.Write(v.Request); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := io.ReadAll(rwc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := v.CheckResponse(resp); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// specIntro is the description of the protocol written by WriteSpec.
+const specIntro = `# go-libp2p-gorpc wire protocol
+
+Every call is made over a new stream, opened with the protocol of the
+server. The protocol determines the codec of the stream: MessagePack by
+default, or JSON or CBOR when the server associates them to the
+protocol. The client writes a request, made of a header and of the
+arguments of the method, and the server answers with a response, made of
+a header and of the reply of the method, after which it closes the
+stream. Headers and bodies are encoded one after another with the codec
+of the stream, JSON values being followed by a space.
+
+Structures are encoded as maps from field names to values. Fields marked
+as optional below are left out when they hold their zero value.
+Durations are encoded as integers, in nanoseconds.
+
+The ErrType field of responses tells the kind of error in the Error
+field: 0 for errors returned by the method, 1 for errors of the server
+(i.e. unknown services), 2 for errors of the client, 3 for unauthorized
+requests and 4 for requests rejected by overloaded servers. The reply is
+nil when the call failed.
+`
+
+// writeFields writes the table of the fields of the given header type.
+func writeFields(b *strings.Builder, title string, t reflect.Type) {
+	fmt.Fprintf(b, "\n## %s\n\n", title)
+	b.WriteString("| Field | Type | Optional |\n|---|---|---|\n")
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		optional := ""
+		if strings.Contains(f.Tag.Get("codec"), "omitempty") {
+			optional = "yes"
+		}
+		fmt.Fprintf(b, "| %s | %s | %s |\n", f.Name, f.Type, optional)
+	}
+}
+
+// WriteSpec writes the specification of the wire protocol to w, in
+// Markdown, followed by the conformance vectors. The fields of request
+// and response headers are listed from the definitions of rpc.ServiceID
+// and rpc.Response, so that the specification follows the
+// implementation.
+func WriteSpec(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(specIntro)
+	writeFields(&b, "Request header", reflect.TypeOf(rpc.ServiceID{}))
+	writeFields(&b, "Response header", reflect.TypeOf(rpc.Response{}))
+	fmt.Fprintf(&b, "\n## Conformance vectors\n\nThe vectors call the %s service (see ConformanceService).\n", ConformanceServiceName)
+	for _, v := range Vectors() {
+		fmt.Fprintf(&b, "\n### %s\n\n%s\n\nRequest:\n\n```\n%s```\n\nResponse:\n\n```\n%s```\n",
+			v.Name, v.Description, hex.Dump(v.Request), hex.Dump(v.Response))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,78 @@
+// Package rpctest provides utilities to test services and clients using
+// go-libp2p-gorpc without setting up libp2p hosts and networking.
+package rpctest
+
+import (
+	"context"
+	"net"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+)
+
+// Connect returns a Client which performs all its calls against the given
+// Server through an in-memory connection. Arguments and replies go
+// through the same serialization as with libp2p streams, regardless of
+// the destination of the calls. The returned function closes the
+// connection and waits for the server to finish.
+//
+// Cancelling the context of a call while it is in progress closes the
+// connection, after which all calls fail.
+func Connect(s *rpc.Server, opts ...rpc.ClientOption) (*rpc.Client, func()) {
+	cliConn, srvConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(ctx, srvConn)
+	}()
+
+	c := rpc.NewClientFromConn(cliConn, opts...)
+	closeFunc := func() {
+		cliConn.Close()
+		cancel()
+		<-done
+	}
+	return c, closeFunc
+}
+
+// MockClient is an rpc.Client whose calls are all routed to the services
+// registered in it, which are served by an in-memory Server. It allows
+// testing code which uses a Client by registering fake implementations
+// of the remote services.
+type MockClient struct {
+	*rpc.Client
+
+	// Server is the server where services are registered.
+	Server *rpc.Server
+
+	closeFunc func()
+}
+
+// NewMockClient returns a new MockClient with the given options. Services
+// can be registered with Register() and RegisterName() before performing
+// calls.
+func NewMockClient(opts ...rpc.ClientOption) *MockClient {
+	s := rpc.NewServer(nil, "")
+	c, closeFunc := Connect(s, opts...)
+	return &MockClient{
+		Client:    c,
+		Server:    s,
+		closeFunc: closeFunc,
+	}
+}
+
+// Register registers a service in the mock server. See Server.Register().
+func (mc *MockClient) Register(rcvr interface{}) error {
+	return mc.Server.Register(rcvr)
+}
+
+// RegisterName registers a service in the mock server with the given
+// name. See Server.RegisterName().
+func (mc *MockClient) RegisterName(name string, rcvr interface{}) error {
+	return mc.Server.RegisterName(name, rcvr)
+}
+
+// Close closes the in-memory connection to the mock server.
+func (mc *MockClient) Close() {
+	mc.closeFunc()
+}
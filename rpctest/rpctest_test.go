@@ -0,0 +1,199 @@
+package rpctest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	rpc "github.com/libp2p/go-libp2p-gorpc"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Arith struct{}
+
+func (a *Arith) Multiply(ctx context.Context, args Args, r *int) error {
+	*r = args.A * args.B
+	return nil
+}
+
+func (a *Arith) Fail(ctx context.Context, args Args, r *int) error {
+	return errors.New("failed")
+}
+
+func TestConnect(t *testing.T) {
+	s := rpc.NewServer(nil, "")
+	s.Register(&Arith{})
+	c, closeFunc := Connect(s)
+	defer closeFunc()
+
+	var r int
+	err := c.Call(peer.ID("anyone"), "Arith", "Multiply", Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestMockClient(t *testing.T) {
+	mc := NewMockClient()
+	defer mc.Close()
+
+	if err := mc.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var r int
+	err := mc.Call("", "Arith", "Multiply", Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+
+	err = mc.Call("", "Arith", "Fail", Args{2, 3}, &r)
+	if err == nil || err.Error() != "failed" {
+		t.Error("expected different error:", err)
+	}
+
+	err = mc.Call("", "Unknown", "Method", Args{2, 3}, &r)
+	if !rpc.IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+}
+
+func makeConformanceNodes(t *testing.T) (h1, h2 host.Host) {
+	var err error
+	if h1, err = libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	if h2, err = libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	h2.Peerstore().AddAddrs(h1.ID(), h1.Addrs(), peerstore.PermanentAddrTTL)
+	return h1, h2
+}
+
+var conformanceCodecs = []*rpc.Codec{rpc.MsgpackCodec, rpc.JSONCodec, rpc.CBORCodec}
+
+func TestConformance(t *testing.T) {
+	h1, h2 := makeConformanceNodes(t)
+	defer h1.Close()
+	defer h2.Close()
+
+	var protos []protocol.ID
+	var opts []rpc.ServerOption
+	for _, c := range conformanceCodecs {
+		p := protocol.ID("/conformance/" + c.Name())
+		protos = append(protos, p)
+		opts = append(opts, rpc.WithServerCodec(p, c))
+	}
+	s := rpc.NewServer(h1, "", append(opts, rpc.WithServerProtocols(protos...))...)
+	if err := s.RegisterName(ConformanceServiceName, &ConformanceService{}); err != nil {
+		t.Fatal(err)
+	}
+
+	TestServerConformance(t, func(codec string) (io.ReadWriteCloser, error) {
+		return h2.NewStream(context.Background(), h1.ID(), protocol.ID("/conformance/"+codec))
+	})
+
+	vs := Vectors()
+	if err := vs[0].CheckResponse(vs[1].Response); err == nil {
+		t.Error("expected a mismatch")
+	}
+}
+
+func TestClientConformance(t *testing.T) {
+	h1, h2 := makeConformanceNodes(t)
+	defer h1.Close()
+	defer h2.Close()
+
+	calls := map[string]struct {
+		svcName, method string
+		args            interface{}
+		opts            []rpc.CallOption
+		want            interface{}
+	}{
+		"call":            {ConformanceServiceName, "Add", Operands{2, 3}, nil, 5},
+		"metadata":        {ConformanceServiceName, "Metadata", "key", []rpc.CallOption{rpc.WithMetadata("key", "value")}, "value"},
+		"error":           {ConformanceServiceName, "Fail", "boom", nil, nil},
+		"unknown-service": {"Unknown", "Add", Operands{2, 3}, nil, nil},
+	}
+	for _, v := range Vectors() {
+		v := v
+		p := protocol.ID("/conformance/" + v.Name)
+		h1.SetStreamHandler(p, func(s network.Stream) {
+			defer s.Close()
+			req := make([]byte, len(v.Request))
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(s, req); err != nil || !bytes.Equal(req, v.Request) {
+				t.Errorf("%s: unexpected request %x: %v", v.Name, req, err)
+				s.Reset()
+				return
+			}
+			s.Write(v.Response)
+		})
+
+		kind := v.Name[strings.Index(v.Name, "/")+1:]
+		call := calls[kind]
+		c := rpc.NewClient(h2, p, rpc.WithClientCodec(p, codecByName(v.Codec)))
+		var reply interface{} = new(int)
+		if _, ok := call.want.(string); ok {
+			reply = new(string)
+		}
+		err := c.Call(h1.ID(), call.svcName, call.method, call.args, reply, call.opts...)
+		switch kind {
+		case "error":
+			if err == nil || err.Error() != "boom" || rpc.ErrorCode(err) != 42 {
+				t.Errorf("%s: unexpected error: %v", v.Name, err)
+			}
+		case "unknown-service":
+			if !rpc.IsServerError(err) {
+				t.Errorf("%s: expected a server error: %v", v.Name, err)
+			}
+		default:
+			if err != nil || reflect.ValueOf(reply).Elem().Interface() != call.want {
+				t.Errorf("%s: unexpected reply %v: %v", v.Name, reply, err)
+			}
+		}
+	}
+}
+
+func codecByName(name string) *rpc.Codec {
+	for _, c := range conformanceCodecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestWriteSpec(t *testing.T) {
+	var b strings.Builder
+	if err := WriteSpec(&b); err != nil {
+		t.Fatal(err)
+	}
+	spec := b.String()
+	for _, s := range []string{"| IdempotencyKey | string | yes |", "| ErrType |", "### cbor/error"} {
+		if !strings.Contains(spec, s) {
+			t.Errorf("expected %q in the specification", s)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ScheduledCall is a call made at a later time, as returned by
+// Client.Schedule() and Client.After(). The call is delivered to its done
+// channel once finished, like with GoContext(), including when it is
+// cancelled before being made.
+type ScheduledCall struct {
+	// At is the time at which the call is made.
+	At time.Time
+
+	mu        sync.Mutex
+	call      *Call
+	cancelled bool
+	cancelCh  chan struct{}
+}
+
+// Schedule performs a GoContext() call at the given time, or right away
+// when it is in the past. The call, including the timeout set with
+// WithTimeout, starts when it is due. It finishes with the error of the
+// context, without being made, when the context is done before, and
+// with a context.Canceled error when cancelled before with
+// ScheduledCall.Cancel().
+//
+// The provided done channel must be nil, or have capacity for 1 element
+// at least, or an error is returned.
+func (c *Client) Schedule(
+	ctx context.Context,
+	at time.Time,
+	dest peer.ID,
+	svcName, svcMethod string,
+	args, reply interface{},
+	done chan *Call,
+	opts ...CallOption,
+) (*ScheduledCall, error) {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		return nil, newClientError(errNoCapacity)
+	}
+	sc := &ScheduledCall{
+		At:       at,
+		cancelCh: make(chan struct{}),
+	}
+	go func() {
+		t := time.NewTimer(time.Until(at))
+		defer t.Stop()
+		var err error
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-sc.cancelCh:
+		}
+
+		call := newCall(ctx, dest, svcName, svcMethod, args, reply, done, opts...)
+		call.logger = c.logger
+		sc.mu.Lock()
+		if sc.cancelled {
+			err = context.Canceled
+		}
+		sc.call = call
+		sc.mu.Unlock()
+		if err != nil {
+			call.doneWithError(err)
+			return
+		}
+		c.makeCall(call)
+	}()
+	return sc, nil
+}
+
+// After works like Schedule() but makes the call once the given duration
+// has elapsed.
+func (c *Client) After(
+	ctx context.Context,
+	d time.Duration,
+	dest peer.ID,
+	svcName, svcMethod string,
+	args, reply interface{},
+	done chan *Call,
+	opts ...CallOption,
+) (*ScheduledCall, error) {
+	return c.Schedule(ctx, time.Now().Add(d), dest, svcName, svcMethod, args, reply, done, opts...)
+}
+
+// Cancel cancels the call. When it has not been made yet, it is not made
+// and finishes with a context.Canceled error. Otherwise, it works like
+// Call.Cancel().
+func (sc *ScheduledCall) Cancel() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.cancelled {
+		return
+	}
+	sc.cancelled = true
+	close(sc.cancelCh)
+	if sc.call != nil {
+		sc.call.Cancel()
+	}
+}
+
+// Call returns the call once it is due, or nil before.
+func (sc *ScheduledCall) Call() *Call {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.call
+}
@@ -30,6 +30,10 @@
 // that the client sees as if created by errors.New.  If an error is returned,
 // the reply parameter may not be sent back to the client.
 //
+// Methods may also be asynchronous, taking a Respond function instead
+// of the reply parameter, in order to complete the call later from
+// another goroutine. See Respond.
+//
 // In order to use this package, a ready-to-go LibP2P Host must be provided
 // to clients and servers, along with a protocol.ID. rpc will add a stream
 // handler for the given protocol. Hosts must be ready to speak to clients,
@@ -52,22 +56,22 @@ import (
 	"log"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 
-	logging "github.com/ipfs/go-log/v2"
 	stats "github.com/libp2p/go-libp2p-gorpc/stats"
 )
 
-var logger = logging.Logger("p2p-gorpc")
-
 // Precompute the reflect type for error. Can't use error directly
 // because Typeof takes an empty interface value. This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
@@ -75,16 +79,21 @@ var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 type methodType struct {
 	method    reflect.Method
 	ArgType   reflect.Type
-	ReplyType reflect.Type
+	ReplyType reflect.Type // nil for asynchronous methods
+	async     bool
 }
 
 // service stores information about a service (which is a pointer to a
 // Go struct normally)
 type service struct {
-	name   string                 // name of service
-	rcvr   reflect.Value          // receiver of methods for the service
-	typ    reflect.Type           // type of the receiver
-	method map[string]*methodType // registered methods
+	name    string                 // name of service
+	version string                 // version of service (see WithVersion)
+	rcvr    reflect.Value          // receiver of methods for the service
+	typ     reflect.Type           // type of the receiver
+	method  map[string]*methodType // registered methods
+	logger  Logger                 // logger of the server
+	// executor runs the methods called by remote peers, if set.
+	executor Executor
 }
 
 // ServiceID is a header sent when performing an RPC request
@@ -92,6 +101,69 @@ type service struct {
 type ServiceID struct {
 	Name   string
 	Method string
+	// Metadata carries the values attached with WithMetadata.
+	Metadata map[string]string `codec:",omitempty"`
+	// IdempotencyKey, when set, allows the server to recognize
+	// retried requests. See WithIdempotencyKey.
+	IdempotencyKey string `codec:",omitempty"`
+	// Priority of the request. See WithPriority.
+	Priority Priority `codec:",omitempty"`
+	// Progress indicates that the client wants to receive progress
+	// updates. See WithProgress.
+	Progress bool `codec:",omitempty"`
+	// Heartbeat is the interval at which the client wants to receive
+	// heartbeats while the method runs. See WithHeartbeat.
+	Heartbeat time.Duration `codec:",omitempty"`
+	// Ping marks keepalive pings sent over sessions, which are
+	// answered with an empty response.
+	Ping bool `codec:",omitempty"`
+	// Batch is set in the first request sent over a stream to the
+	// number of requests that follow it, itself included, when they
+	// are sent as a batch. See Client.Batch.
+	Batch int `codec:",omitempty"`
+	// RequestID identifies the requests sent over pipelined streams,
+	// whose responses carry the same ID. See WithPipelining.
+	RequestID uint64 `codec:",omitempty"`
+	// Cancel marks cancellation frames sent over pipelined streams,
+	// which have no arguments and cancel the request with the same
+	// RequestID.
+	Cancel bool `codec:",omitempty"`
+	// Subscribe marks subscription requests. See Client.Subscribe.
+	Subscribe bool `codec:",omitempty"`
+	// Cursor is the cursor of the last event received by a client
+	// resuming a subscription. See WithResubscribe.
+	Cursor uint64 `codec:",omitempty"`
+	// Codec names the codec of the arguments and the reply, when it
+	// is not the one used for the stream. See WithCodec.
+	Codec string `codec:",omitempty"`
+	// Raw indicates that the arguments are a Raw value.
+	Raw bool `codec:",omitempty"`
+	// Version is the version of the service requested by the client.
+	// See WithServiceVersion.
+	Version string `codec:",omitempty"`
+	// Destination is the peer a call sent through a proxy is for.
+	// See ThroughProxy.
+	Destination peer.ID `codec:",omitempty"`
+	// Compression names the compression of the arguments, if any,
+	// and AcceptCompression the compressions accepted for the
+	// reply. See WithClientCompression.
+	Compression       string   `codec:",omitempty"`
+	AcceptCompression []string `codec:",omitempty"`
+	// Values carries the context values propagated by the client.
+	// See WithClientContextValue.
+	Values map[string]string `codec:",omitempty"`
+	// Token is the capability token attached to the request. See
+	// WithToken.
+	Token *Token `codec:",omitempty"`
+	// Signature is the signature of the request by the client. See
+	// WithRequestSigning.
+	Signature []byte `codec:",omitempty"`
+	// ChunkSize is set by clients accepting replies in chunks to the
+	// maximum size of the chunks. See WithReplyChunking.
+	ChunkSize int64 `codec:",omitempty"`
+	// Authenticate marks the header starting the authentication of
+	// the client, which has no arguments. See WithCredentials.
+	Authenticate bool `codec:",omitempty"`
 }
 
 // Response is a header sent when responding to an RPC
@@ -100,6 +172,42 @@ type Response struct {
 	Service ServiceID
 	Error   string // error, if any.
 	ErrType responseErr
+	// Progress is set in the progress updates sent before the final
+	// response, when requested by the client.
+	Progress *Progress `codec:",omitempty"`
+	// Heartbeat is set in the heartbeats sent before the final
+	// response, when requested by the client.
+	Heartbeat bool `codec:",omitempty"`
+	// RetryAfter is the time after which the request can be retried
+	// when it was rejected because the server is overloaded.
+	RetryAfter time.Duration `codec:",omitempty"`
+	// Duration is the time the server spent running the method.
+	Duration time.Duration `codec:",omitempty"`
+	// Code is the application-defined code of the error, if any
+	// (see WithErrorCode).
+	Code int `codec:",omitempty"`
+	// Detail is the detail of the error, if any, encoded with the
+	// codec of the body (see WithErrorDetail).
+	Detail []byte `codec:",omitempty"`
+	// Raw indicates that the body is a Raw value.
+	Raw bool `codec:",omitempty"`
+	// Compression names the compression of the body, if any. See
+	// WithServerCompression.
+	Compression string `codec:",omitempty"`
+	// Signature is the signature of the response by the server,
+	// which signs the responses to signed requests.
+	Signature []byte `codec:",omitempty"`
+	// Chunk is set in the frames carrying the chunks of a reply sent
+	// before the final response. See WithReplyChunking.
+	Chunk bool `codec:",omitempty"`
+	// Cursor is the cursor of the event carried by the response, for
+	// subscriptions. See Subscription.Cursor.
+	Cursor uint64 `codec:",omitempty"`
+
+	// detail is the detail of the error to be encoded, and
+	// detailCodec the codec to decode Detail with.
+	detail      interface{}
+	detailCodec *Codec
 }
 
 // AuthorizeWithMap returns an authrorization function that follows the
@@ -127,6 +235,60 @@ func WithAuthorizeFunc(a func(pid peer.ID, name string, method string) bool) Ser
 // ServerOption allows for functional setting of options on a Server.
 type ServerOption func(*Server)
 
+// WithServerProtocols makes the Server handle requests on the given
+// protocols in addition to the one provided to NewServer. This allows
+// serving several versions of a protocol at the same time (i.e. during
+// upgrades).
+func WithServerProtocols(ps ...protocol.ID) ServerOption {
+	return func(s *Server) {
+		s.extraProtocols = append(s.extraProtocols, ps...)
+	}
+}
+
+// WithServerServiceProtocols makes the Server handle every registered service on
+// its own protocol as well, obtained with ServiceProtocol() from each of the
+// server protocols. Streams on these protocols can only be used to call the
+// associated service. This allows libp2p facilities working at the protocol
+// level (connection gating, metrics, stream prioritization...) to tell
+// services apart.
+func WithServerServiceProtocols() ServerOption {
+	return func(s *Server) {
+		s.serviceProtocols = true
+	}
+}
+
+// ServiceProtocol returns the protocol used for the given service when
+// per-service protocols are enabled, which is the base protocol suffixed
+// with the service name (i.e. "/myapp/rpc/1.0.0/Arith").
+func ServiceProtocol(base protocol.ID, svcName string) protocol.ID {
+	return protocol.ID(string(base) + "/" + svcName)
+}
+
+// WithDeduplication enables the detection of duplicated requests sent
+// with an idempotency key (see WithIdempotencyKey). When a peer repeats
+// a request with the same key within the given window, the server does not
+// run the method again and returns the original response instead. Requests
+// arriving while the original one is still running wait for it to finish.
+func WithDeduplication(window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.dedup = newDedupCache(window)
+	}
+}
+
+// WithMethodTimeout sets the maximum execution time for the given
+// service method, or for all the methods of the service when method is
+// empty. Methods running for longer have their context cancelled and the
+// client receives an error immediately, regardless of whether the method
+// returns, including local calls (see Server.Call).
+func WithMethodTimeout(svcName, method string, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		if s.methodTimeouts == nil {
+			s.methodTimeouts = make(map[string]time.Duration)
+		}
+		s.methodTimeouts[svcName+"."+method] = timeout
+	}
+}
+
 // WithServerStatsHandler providers a implementation of stats.Handler to be
 // used by the Server.
 func WithServerStatsHandler(h stats.Handler) ServerOption {
@@ -143,45 +305,203 @@ func WithServerStatsHandler(h stats.Handler) ServerOption {
 // by the client. The LibP2P host must be already correctly configured to
 // be able to handle connections from clients.
 type Server struct {
-	host         host.Host
-	protocol     protocol.ID
-	statsHandler stats.Handler
+	host           host.Host
+	protocol       protocol.ID
+	extraProtocols []protocol.ID
+	statsHandler   stats.Handler
+	logger         Logger
+	streamLogger   Logger // logs the handling of streams
+	hooks          Hooks
+	stats          *callStats
 
-	mu         sync.RWMutex // protects the serviceMap
-	serviceMap map[string]*service
+	mu         sync.Mutex   // serializes the changes of the services
+	serviceMap atomic.Value // map[string]*service, copied on write (see services)
 
 	// authorize defines authorization strategy of the server
 	// If Authorization function is not provided, all methods would be allowed.
 	authorize func(peer.ID, string, string) bool
+
+	// dedup keeps track of requests with idempotency keys.
+	dedup *dedupCache
+
+	// serviceProtocols enables a protocol for each registered service.
+	serviceProtocols bool
+
+	// codecs holds the codecs used for some protocols.
+	codecs map[protocol.ID]*Codec
+
+	// queue limits the number of concurrent calls.
+	queue *callQueue
+
+	// methodTimeouts holds the maximum execution time of methods,
+	// keyed by "service.method" or "service." for whole services.
+	methodTimeouts map[string]time.Duration
+
+	// methodCodecs holds the codecs required by some methods,
+	// keyed by "service.method".
+	methodCodecs map[string]*Codec
+
+	reverseMu       sync.Mutex
+	reverseSessions map[peer.ID]*streamCaller
+	keepalive       keepaliveConfig
+
+	// subs holds the subscribers of every method, keyed by
+	// "service.method", and eventLogs the cursors and the history of
+	// the events of every method (see WithSubscriptionHistory).
+	subsMu      sync.Mutex
+	subs        map[string]map[*subscriber]struct{}
+	eventLogs   map[string]*eventLog
+	historySize int
+
+	// contextValues holds the context keys of the values propagated
+	// by clients, keyed by name (see WithServerContextValue).
+	contextValues map[string]interface{}
+
+	// peerFilter rejects streams from some peers (see
+	// WithServerPeerFilter).
+	peerFilter PeerFilter
+
+	// tokenAuthority is the key of the authority issuing the
+	// capability tokens required by the server, if any (see
+	// WithTokenAuthority).
+	tokenAuthority crypto.PubKey
+
+	// key signs the responses to signed requests.
+	key crypto.PrivKey
+	// requireSignatures makes the server reject unsigned requests
+	// (see WithRequiredSignatures).
+	requireSignatures bool
+
+	// audit writes audit records (see WithAuditSink).
+	audit *auditor
+
+	// docs holds the documentation of the services, by name.
+	docs map[string]ServiceDoc
+	// reflection registers the ReflectionService (see
+	// WithReflection).
+	reflection bool
+
+	// maxMessageSize limits the size of the arguments (see
+	// WithServerMaxMessageSize).
+	maxMessageSize int64
+
+	// features holds the features of the peers which performed
+	// the handshake.
+	features *featureCache
+
+	// executor runs the methods called by remote peers (see
+	// WithExecutor).
+	executor Executor
+
+	// compressAbove is the size from which replies are compressed
+	// (see WithServerCompression).
+	compressAbove int
+
+	// readBuffer and writeBuffer are the sizes of the buffers of
+	// the streams (see WithServerBufferSizes), and flushDelay the
+	// delay of the flushes of responses on pipelined streams (see
+	// WithServerFlushDelay).
+	readBuffer  int
+	writeBuffer int
+	flushDelay  time.Duration
+
+	// fallback handles the calls to unknown services and methods
+	// (see WithFallback).
+	fallback Fallback
+
+	// proxy forwards the calls for other peers (see WithProxy).
+	proxy *Proxy
+
+	// slowCall is the duration from which calls are logged as slow
+	// (see WithServerSlowCallThreshold).
+	slowCall time.Duration
+
+	// argsValidator validates the arguments of all the calls (see
+	// WithArgsValidator).
+	argsValidator func(ctx context.Context, args interface{}) error
+
+	// bwReporter is reported the bytes of the calls (see
+	// WithServerBandwidthReporter).
+	bwReporter metrics.Reporter
+
+	// authenticator authenticates the clients at the start of
+	// every stream (see WithAuthenticator).
+	authenticator Authenticator
 }
 
 // NewServer creates a Server object with the given LibP2P host
 // and protocol.
 func NewServer(h host.Host, p protocol.ID, opts ...ServerOption) *Server {
 	s := &Server{
-		host:     h,
-		protocol: p,
+		host:            h,
+		protocol:        p,
+		logger:          serverLogger,
+		streamLogger:    streamLogger,
+		reverseSessions: make(map[peer.ID]*streamCaller),
+		maxMessageSize:  DefaultMaxMessageSize,
+		features:        newFeatureCache(),
 	}
+	s.stats = newServerStats(s)
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	// An admission queue alone does not limit anything.
+	if s.queue != nil && s.queue.max <= 0 {
+		s.queue = nil
+	}
+	if s.audit != nil {
+		go s.audit.run(s.logger)
+	}
+	if s.reflection {
+		s.registerReflection()
+	}
 
 	if h != nil {
-		h.SetStreamHandler(p, func(stream network.Stream) {
-			sWrap := wrapStream(stream)
-			defer helpers.FullClose(stream)
-			err := s.handle(sWrap)
-			if err != nil {
-				logger.Error("error handling RPC:", err)
-				resp := &Response{ServiceID{}, err.Error(), responseErrorType(err)}
-				sendResponse(sWrap, resp, nil)
-			}
-		})
+		s.key = h.Peerstore().PrivKey(h.ID())
+		for _, proto := range s.protocols() {
+			h.SetStreamHandler(proto, s.handleStream)
+			h.SetStreamHandler(ReverseProtocol(proto), s.handleReverseStream)
+			h.SetStreamHandler(PipelineProtocol(proto), s.handlePipelineStream)
+			h.SetStreamHandler(HandshakeProtocol(proto), s.handleHandshake)
+		}
 	}
 	return s
 }
 
+// handleStream is the libp2p stream handler for the server protocols.
+func (server *Server) handleStream(stream network.Stream) {
+	server.handleServiceStream(stream, "")
+}
+
+// handleServiceStream handles a stream which may only carry requests
+// for the given service. An empty svcName allows any service.
+func (server *Server) handleServiceStream(stream network.Stream, svcName string) {
+	if !server.acceptStream(stream) {
+		return
+	}
+	sWrap := server.wrap(stream, codecFor(server.codecs, stream.Protocol()))
+	sWrap.signKey = server.key
+	pending, err := server.handle(sWrap, svcName)
+	if err != nil {
+		server.logger.Errorw("error handling RPC", "peer", sWrap.remotePeer(), "error", err)
+		resp := newErrorResponse(ServiceID{}, err)
+		if err := sendResponse(sWrap, resp, nil); err != nil {
+			server.streamLogger.Debugw("error sending response", "peer", sWrap.remotePeer(), "error", err)
+		}
+	}
+	// Asynchronous methods close the stream once they respond.
+	if !pending {
+		helpers.FullClose(stream)
+		sWrap.release()
+	}
+}
+
+// protocols returns all the protocols handled by the server.
+func (server *Server) protocols() []protocol.ID {
+	return append([]protocol.ID{server.protocol}, server.extraProtocols...)
+}
+
 // ID returns the peer.ID of the host associated with this server.
 func (server *Server) ID() peer.ID {
 	if server.host == nil {
@@ -190,18 +510,74 @@ func (server *Server) ID() peer.ID {
 	return server.host.ID()
 }
 
-func (server *Server) handle(s *streamWrap) error {
-	logger.Debugf("%s: handling remote RPC from %s", server.host.ID().Pretty(), s.stream.Conn().RemotePeer())
-	var err error
+func (server *Server) handle(s *streamWrap, svcName string) (bool, error) {
+	server.streamLogger.Debugw("handling remote RPC", "peer", s.remotePeer())
 	var svcID ServiceID
+	err := server.readFirstHeader(s, &svcID)
+	if err == io.EOF {
+		// The client closed the stream without sending
+		// anything (i.e. when preconnecting).
+		server.streamLogger.Debugw("stream closed without requests", "peer", s.remotePeer())
+		return false, nil
+	}
+	if IsAuthorizationError(err) {
+		return false, err
+	}
+	if err != nil {
+		return false, newServerError(err)
+	}
+	if svcID.Batch > 1 {
+		return false, server.serveBatch(s, svcID, svcName)
+	}
+	if svcID.Subscribe {
+		return false, server.serveSubscription(s, svcID, svcName)
+	}
+	return server.serveRequest(context.Background(), s, svcID, svcName, false, nil)
+}
+
+// serveRequest handles a request once its ServiceID header has been read
+// from the stream. When the request is part of a session (several requests
+// sent sequentially over the same stream) the stream is not watched for
+// closure and the arguments are always consumed, even on errors, so that
+// the next request can be read.
+//
+// The returned boolean is true when the request is handled by an
+// asynchronous method which has not responded yet. In that case, the
+// stream is closed after responding, unless it is a session.
+//
+// When given, argsRead is called as soon as the arguments have been read
+// from the stream, or when the request fails before reading them, so that
+// the next request can be read while this one runs.
+func (server *Server) serveRequest(ctx context.Context, s *streamWrap, svcID ServiceID, svcName string, session bool, argsRead func()) (pending bool, err error) {
 	var argv, replyv reflect.Value
-	ctx := context.Background()
 
-	err = s.dec.Decode(&svcID)
-	if err != nil {
-		return newServerError(err)
+	if argsRead != nil {
+		defer func() {
+			if argsRead != nil {
+				argsRead()
+			}
+		}()
 	}
 
+	drainArgs := func() {
+		if session {
+			var discard interface{}
+			if svcID.Signature != nil {
+				s.decode(&discard)
+			} else if svcID.Compression != "" {
+				s.readRaw(&discard)
+			} else {
+				s.decodeBody(svcID.Codec, svcID.Raw, &discard)
+			}
+		}
+	}
+
+	if svcName != "" && svcID.Name != svcName {
+		drainArgs()
+		return false, newServerError(fmt.Errorf("rpc: service %s cannot be called using the %s protocol", svcID.Name, s.protocol()))
+	}
+
+	var endStats func(err error)
 	sh := server.statsHandler
 	if sh != nil {
 		ctx = sh.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/" + svcID.Name + "/" + svcID.Method})
@@ -211,7 +587,8 @@ func (server *Server) handle(s *streamWrap) error {
 		}
 		sh.HandleRPC(ctx, begin)
 
-		defer func() {
+		statsCtx := ctx
+		endStats = func(err error) {
 			end := &stats.End{
 				BeginTime: beginTime,
 				EndTime:   time.Now(),
@@ -219,44 +596,98 @@ func (server *Server) handle(s *streamWrap) error {
 			if err != nil && err != io.EOF {
 				end.Error = newServerError(err)
 			}
-			sh.HandleRPC(ctx, end)
+			sh.HandleRPC(statsCtx, end)
+		}
+		defer func() {
+			if !pending {
+				endStats(err)
+			}
 		}()
 	}
 
-	logger.Debugf("RPC ServiceID is %s.%s", svcID.Name, svcID.Method)
-
-	service, mtype, err := server.getService(svcID)
-	if err != nil {
-		return newServerError(err)
+	ev := &CallEvent{
+		Peer:     s.remotePeer(),
+		Service:  svcID.Name,
+		Method:   svcID.Method,
+		Metadata: svcID.Metadata,
+		Codec:    svcID.Codec,
+		Start:    time.Now(),
 	}
+	server.callStart(ev)
+	sent := s.cw.count()
+	endCall := func(err error) {
+		ev.Duration = time.Since(ev.Start)
+		ev.BytesSent = s.cw.count() - sent
+		if ev.Error == nil {
+			ev.Error = err
+		}
+		server.logger.Debugw("RPC handled", ev.logFields("duration", ev.Duration, "error", ev.Error)...)
+		server.callEnd(ev)
+	}
+	defer func() {
+		if !pending {
+			endCall(err)
+		}
+	}()
 
-	if server.authorize != nil && !server.authorize(s.stream.Conn().RemotePeer(), svcID.Name, svcID.Method) {
-		errMsg := fmt.Sprintf("client does not have permissions to this method, service name: %s, method name: %s", svcID.Name, svcID.Method)
-		return newAuthorizationError(errors.New(errMsg))
+	ctx = withMetadata(ctx, svcID.Metadata)
+	ctx = server.withContextValues(ctx, svcID.Values)
+	ctx = withTransport(ctx, s)
+	ctx = withIdentity(ctx, s)
+	if svcID.Progress || svcID.Heartbeat > 0 {
+		pr := s.startProgress(svcID)
+		if svcID.Progress {
+			ctx = withProgress(ctx, pr.report)
+		}
+		if svcID.Heartbeat > 0 {
+			go pr.heartbeats(svcID.Heartbeat)
+		}
 	}
 
-	// Decode the argument value.
-	argIsValue := false // if true, need to indirect before calling.
-	if mtype.ArgType.Kind() == reflect.Ptr {
-		argv = reflect.New(mtype.ArgType.Elem())
-	} else {
-		argv = reflect.New(mtype.ArgType)
-		argIsValue = true
+	// Access is checked first, so that the peers which are denied
+	// cannot learn the registered names from the suggestions of
+	// the errors for unknown services and methods.
+	if err := server.checkAccess(s.remotePeer(), svcID); err != nil {
+		drainArgs()
+		return false, err
 	}
-	// argv guaranteed to be a pointer now.
-	if err = s.dec.Decode(argv.Interface()); err != nil {
-		return newServerError(err)
+
+	service, mtype, err := server.lookupService(s.remotePeer(), svcID)
+	if err != nil {
+		drainArgs()
+		return false, newServerError(err)
 	}
-	if argIsValue {
-		argv = argv.Elem()
+	if err := server.checkCodec(svcID); err != nil {
+		drainArgs()
+		return false, err
 	}
 
-	replyv = reflect.New(mtype.ReplyType.Elem())
+	ctx, argv, err = decodeRequestArgs(ctx, s, svcID, mtype)
+	if err != nil {
+		return false, err
+	}
+	if err := server.validateArgs(ctx, argv); err != nil {
+		return false, err
+	}
+	ev.args = argv.Interface()
+	ev.BytesReceived = s.consumed() - s.reqStart
 
 	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	ctxv := reflect.ValueOf(ctx)
+	// Pipelined requests can be cancelled by the client. They
+	// are registered before reading the next request, which may
+	// be the cancellation.
+	if svcID.RequestID != 0 {
+		cancel = s.trackRequest(svcID.RequestID, cancel)
+	}
+	if argsRead != nil {
+		argsRead()
+		argsRead = nil
+	}
+	defer func() {
+		if !pending {
+			cancel()
+		}
+	}()
 
 	// TODO(lanzafame): once I figure out a
 	// good to get the size of the payload.
@@ -272,51 +703,313 @@ func (server *Server) handle(s *streamWrap) error {
 	// (or reset). In that case, we need to cancel our
 	// context. Note this will also happen at the end
 	// of a successful operation when we close the stream
-	// on our side.
-	go func() {
-		p := make([]byte, 1)
-		_, err := s.stream.Read(p)
-		if err != nil {
-			cancel()
+	// on our side. Sessions cannot be watched this way as
+	// further requests are read from the stream.
+	if !session {
+		rwc := s.rwc
+		go func() {
+			p := make([]byte, 1)
+			_, err := rwc.Read(p)
+			if err != nil {
+				cancel()
+			}
+		}()
+	}
+
+	// Wait for our turn when the number of concurrent
+	// calls is limited.
+	if server.queue != nil {
+		if err = server.queue.acquire(ctx, svcID.Priority); err != nil {
+			return false, err
+		}
+		defer func() {
+			if !pending {
+				server.queue.release()
+			}
+		}()
+	}
+
+	cancelTimeout := func() {}
+	timeout := server.methodTimeout(svcID)
+	if timeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+	}
+	defer func() {
+		if !pending {
+			cancelTimeout()
 		}
 	}()
+	ctxv := reflect.ValueOf(ctx)
 
 	// Call service and respond
-	return service.svcCall(s, mtype, svcID, ctxv, argv, replyv)
+	ev.QueueDelay = time.Since(ev.Start)
+	if mtype.async {
+		pending = true
+		s.inflight.Add(1)
+		service.asyncCall(s, mtype, svcID, ctxv, argv, timeout, ev, func(err error) {
+			defer s.inflight.Done()
+			endCall(err)
+			if server.queue != nil {
+				server.queue.release()
+			}
+			cancelTimeout()
+			cancel()
+			if endStats != nil {
+				endStats(err)
+			}
+			if !session {
+				s.fullClose()
+				s.release()
+			}
+		})
+		return true, nil
+	}
+
+	replyv = reflect.New(mtype.ReplyType.Elem())
+	if server.dedup != nil && svcID.IdempotencyKey != "" {
+		return false, server.dedupCall(s, service, mtype, svcID, ctx, ctxv, argv, replyv, timeout, ev)
+	}
+	return false, service.svcCall(s, mtype, svcID, ctxv, argv, replyv, timeout, ev)
 }
 
+// decodeArgs decodes the argument value for the given method.
+func decodeArgs(decode func(interface{}) error, mtype *methodType) (reflect.Value, error) {
+	argIsValue := false // if true, need to indirect before calling.
+	var argv reflect.Value
+	if mtype.ArgType.Kind() == reflect.Ptr {
+		argv = reflect.New(mtype.ArgType.Elem())
+	} else {
+		argv = reflect.New(mtype.ArgType)
+		argIsValue = true
+	}
+	// argv guaranteed to be a pointer now.
+	if err := decode(argv.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("rpc: cannot decode arguments as %s: %w", mtype.ArgType, err)
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+	return argv, nil
+}
+
+// checkAccess verifies that the given peer may call the method of the
+// request: that it is authorized (see WithAuthorizeFunc), that it has a
+// valid token when tokens are required (see WithTokenAuthority) and that
+// the request is signed when signatures are required (see
+// WithRequiredSignatures).
+func (server *Server) checkAccess(p peer.ID, svcID ServiceID) error {
+	if server.authorize != nil && !server.authorize(p, svcID.Name, svcID.Method) {
+		errMsg := fmt.Sprintf("client does not have permissions to this method, service name: %s, method name: %s", svcID.Name, svcID.Method)
+		return newAuthorizationError(errors.New(errMsg))
+	}
+	if err := server.checkToken(p, svcID); err != nil {
+		return err
+	}
+	if server.requireSignatures && svcID.Signature == nil {
+		return newAuthorizationError(errUnsignedRequest)
+	}
+	return nil
+}
+
+// methodTimeout returns the maximum execution time for the method
+// in the given ServiceID, or 0 if there is none.
+func (server *Server) methodTimeout(svcID ServiceID) time.Duration {
+	if t, ok := server.methodTimeouts[svcID.Name+"."+svcID.Method]; ok {
+		return t
+	}
+	return server.methodTimeouts[svcID.Name+"."]
+}
+
+// errServerDeadline is returned to clients when a method does
+// not finish within its configured timeout.
+var errServerDeadline = newServerError(errors.New("deadline exceeded on server"))
+
 // svcCall calls the actual method associated
-func (s *service) svcCall(sWrap *streamWrap, mtype *methodType, svcID ServiceID, ctxv, argv, replyv reflect.Value) error {
-	function := mtype.method.Func
+func (s *service) svcCall(sWrap *streamWrap, mtype *methodType, svcID ServiceID, ctxv, argv, replyv reflect.Value, timeout time.Duration, ev *CallEvent) error {
+	resp, ok := s.invokeWithTimeout(mtype, svcID, ctxv, argv, replyv, timeout, ev)
+	if !ok {
+		return sendResponse(sWrap, resp, nil)
+	}
+	return sendResponse(sWrap, resp, replyv.Interface())
+}
 
+// invokeWithTimeout works like invoke, but stops waiting for the method
+// once the timeout has passed, in which case it returns a deadline error
+// response and false. The reply must not be used then, as the method
+// may still be running. The handler duration and the returned error are
+// recorded in the given CallEvent.
+func (s *service) invokeWithTimeout(mtype *methodType, svcID ServiceID, ctxv, argv, replyv reflect.Value, timeout time.Duration, ev *CallEvent) (resp *Response, ok bool) {
+	start := time.Now()
+	defer func() {
+		ev.HandlerDuration = time.Since(start)
+		resp.Duration = ev.HandlerDuration
+		if err := responseToError(resp); err != nil {
+			ev.Error = err
+		}
+	}()
+
+	returnValues, ok := s.callWithTimeout(mtype, svcID, []reflect.Value{s.rcvr, ctxv, argv, replyv}, timeout)
+	if !ok {
+		return &Response{
+			Service: svcID,
+			Error:   errServerDeadline.Error(),
+			ErrType: serverErr,
+		}, false
+	}
+	return methodResponse(svcID, returnValues), true
+}
+
+// callWithTimeout calls the method like call, but stops waiting for it
+// once the timeout has passed, in which case it returns false. The
+// arguments must not be used then, as the method may still be running.
+func (s *service) callWithTimeout(mtype *methodType, svcID ServiceID, args []reflect.Value, timeout time.Duration) ([]reflect.Value, bool) {
+	return s.runWithTimeout(svcID, timeout, func() []reflect.Value {
+		return s.call(mtype, args)
+	})
+}
+
+// runWithTimeout runs the given call of a method of the service, but
+// stops waiting for it once the timeout has passed, in which case it
+// returns false.
+func (s *service) runWithTimeout(svcID ServiceID, timeout time.Duration, call func() []reflect.Value) ([]reflect.Value, bool) {
+	if timeout <= 0 {
+		return call(), true
+	}
+
+	done := make(chan []reflect.Value, 1)
+	go func() {
+		done <- call()
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case returnValues := <-done:
+		return returnValues, true
+	case <-t.C:
+		s.logger.Warnw("method did not finish in time", "service", svcID.Name, "method", svcID.Method, "timeout", timeout)
+		return nil, false
+	}
+}
+
+// invoke calls the method and returns the Response header
+// to be sent back.
+func (s *service) invoke(mtype *methodType, svcID ServiceID, ctxv, argv, replyv reflect.Value) *Response {
 	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call([]reflect.Value{s.rcvr, ctxv, argv, replyv})
+	returnValues := s.call(mtype, []reflect.Value{s.rcvr, ctxv, argv, replyv})
+	return methodResponse(svcID, returnValues)
+}
+
+// methodResponse returns the Response header for the values returned by
+// a method.
+func methodResponse(svcID ServiceID, returnValues []reflect.Value) *Response {
 	// The return value for the method is an error.
 	errInter := returnValues[0].Interface()
 	errmsg := ""
+	errType := nonRPCErr
+	code := 0
+	var detail interface{}
 	if errInter != nil {
 		errmsg = errInter.(error).Error()
+		errType = methodErrorType(errInter.(error))
+		code = ErrorCode(errInter.(error))
+		detail = errorDetail(errInter.(error))
+	}
+	return &Response{
+		Service: svcID,
+		Error:   errmsg,
+		ErrType: errType,
+		Code:    code,
+		detail:  detail,
 	}
-	resp := &Response{svcID, errmsg, nonRPCErr}
-
-	return sendResponse(sWrap, resp, replyv.Interface())
 }
 
 func sendResponse(s *streamWrap, resp *Response, body interface{}) error {
-	if err := s.enc.Encode(resp); err != nil {
-		logger.Error("error encoding response:", err)
-		s.stream.Reset()
-		return err
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.stopProgress(resp.Service.RequestID)
+	// Unknown codecs are answered with the codec of the stream.
+	if s.bodyCodec(resp.Service.Codec) == s.codec {
+		resp.Service.Codec = ""
 	}
-	if err := s.enc.Encode(body); err != nil {
-		logger.Error("error encoding body:", err)
-		s.stream.Reset()
-		return err
+	s.encodeDetail(resp)
+	resp.Raw = isRawBody(body)
+
+	// Bodies which may be compressed are encoded first, to know
+	// their size.
+	if s.signsResponse(resp) || (s.compressAbove > 0 && body != nil && accepts(resp.Service, gzipCompression)) || s.chunksReply(resp, body) {
+		data, err := s.marshalBody(resp.Service.Codec, body)
+		if err != nil {
+			s.reset()
+			return fmt.Errorf("error encoding body: %w", err)
+		}
+		return writeEncodedResponse(s, resp, data)
 	}
-	if err := s.w.Flush(); err != nil {
-		logger.Debug("error flushing response:", err)
-		s.stream.Reset()
-		return err
+
+	if err := s.writeHeader(resp); err != nil {
+		s.reset()
+		return fmt.Errorf("error encoding response: %w", err)
+	}
+	if err := s.encodeBody(resp.Service.Codec, body); err != nil {
+		s.reset()
+		return fmt.Errorf("error encoding body: %w", err)
+	}
+	if err := s.flushMessage(); err != nil {
+		s.reset()
+		return fmt.Errorf("error flushing response: %w", err)
+	}
+	return nil
+}
+
+// sendEncodedResponse works like sendResponse but takes an
+// already encoded body.
+func sendEncodedResponse(s *streamWrap, resp *Response, body []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.stopProgress(resp.Service.RequestID)
+	s.encodeDetail(resp)
+	return writeEncodedResponse(s, resp, body)
+}
+
+// writeEncodedResponse writes a response with an already encoded body,
+// signing it when needed, and flushes the stream.
+func writeEncodedResponse(s *streamWrap, resp *Response, body []byte) error {
+	if s.chunksReply(resp, body) && len(body) > chunkSize(resp.Service) {
+		return writeChunkedResponse(s, resp, body)
+	}
+	if s.signsResponse(resp) {
+		if err := s.writeSignedResponse(resp, body, s.signKey); err != nil {
+			s.reset()
+			return fmt.Errorf("error encoding response: %w", err)
+		}
+		if err := s.flushMessage(); err != nil {
+			s.reset()
+			return fmt.Errorf("error flushing response: %w", err)
+		}
+		return nil
+	}
+
+	compress := compresses(s.compressAbove, len(body)) && accepts(resp.Service, gzipCompression)
+	if compress {
+		resp.Compression = gzipCompression
+	}
+	if err := s.writeHeader(resp); err != nil {
+		s.reset()
+		return fmt.Errorf("error encoding response: %w", err)
+	}
+	var err error
+	if compress {
+		err = s.writeCompressed(body)
+	} else {
+		_, err = s.w.Write(body)
+	}
+	if err != nil {
+		s.reset()
+		return fmt.Errorf("error writing body: %w", err)
+	}
+	if err := s.flushMessage(); err != nil {
+		s.reset()
+		return fmt.Errorf("error flushing response: %w", err)
 	}
 	return nil
 }
@@ -324,10 +1017,10 @@ func sendResponse(s *streamWrap, resp *Response, body interface{}) error {
 // Call allows a server to process a Call directly and act like a client
 // to itself. This is mostly useful because LibP2P does not allow to
 // create streams between a server and a client which share the same
-// host. See NewClientWithServer() for more info.
-func (server *Server) Call(call *Call) error {
-	var err error
-
+// host. See NewClientWithServer() for more info. Calls to methods with a
+// timeout (see WithMethodTimeout) return once it passes, even if the
+// method is still running.
+func (server *Server) Call(call *Call) (err error) {
 	sh := server.statsHandler
 	if sh != nil {
 		call.ctx = sh.TagRPC(call.ctx, &stats.RPCTagInfo{FullMethodName: "/" + call.SvcID.Name + "/" + call.SvcID.Method})
@@ -355,19 +1048,100 @@ func (server *Server) Call(call *Call) error {
 		}()
 	}
 
+	ev := &CallEvent{
+		Service:  call.SvcID.Name,
+		Method:   call.SvcID.Method,
+		Metadata: call.SvcID.Metadata,
+		Start:    time.Now(),
+	}
+	server.callStart(ev)
+	defer func() {
+		ev.Duration = time.Since(ev.Start)
+		ev.Error = err
+		server.callEnd(ev)
+	}()
+
+	ev.args = call.Args
+
 	var argv, replyv reflect.Value
 	service, mtype, err := server.getService(call.SvcID)
 	if err != nil {
 		return newServerError(err)
 	}
 
+	if server.queue != nil {
+		if err := server.queue.acquire(call.ctx, call.SvcID.Priority); err != nil {
+			return err
+		}
+		defer server.queue.release()
+	}
+
 	// Use the context value from the call directly
-	ctxv := reflect.ValueOf(call.ctx)
+	ctx := withMetadata(call.ctx, call.SvcID.Metadata)
+	if server.host != nil {
+		ctx = withRemotePeer(ctx, server.host.ID(), server.host.Peerstore().PubKey(server.host.ID()))
+	}
+	timeout := server.methodTimeout(call.SvcID)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if f := call.opts.progress; f != nil {
+		ctx = withProgress(ctx, func(p Progress) error {
+			f(p)
+			return nil
+		})
+	}
+	ctxv := reflect.ValueOf(ctx)
+	ev.QueueDelay = time.Since(ev.Start)
+	handlerStart := time.Now()
+	if argv := reflect.ValueOf(call.Args); !argv.IsValid() || (argv.Kind() == reflect.Ptr && argv.IsNil()) {
+		return &clientError{fmt.Sprintf("%s.%s is being called with nil args", call.SvcID.Name, call.SvcID.Method)}
+	}
+	args, err := convertArgs(call.localCodec(), call.Args, mtype.ArgType)
+	if err != nil {
+		return newClientError(err)
+	}
+	if mtype.async {
+		if !reflect.TypeOf(args).AssignableTo(mtype.ArgType) {
+			return fmt.Errorf(
+				"%s.%s is being called with the wrong arg type",
+				call.SvcID.Name,
+				call.SvcID.Method,
+			)
+		}
+		argv = reflect.ValueOf(args)
+		reply := call.Reply
+		if call.localMode == LocalDeepCopy {
+			if argv, err = deepCopyValue(call.localCodec(), argv); err != nil {
+				return newClientError(err)
+			}
+			reply = reflect.New(reflect.TypeOf(call.Reply).Elem()).Interface()
+		}
+		if err := server.validateArgs(ctx, argv); err != nil {
+			return err
+		}
+		err = service.localAsyncCall(mtype, ctx, ctxv, argv, reply)
+		if err == nil && call.localMode == LocalDeepCopy {
+			if err := deepCopy(call.localCodec(), call.Reply, reply); err != nil {
+				return newServerError(err)
+			}
+		}
+		ev.HandlerDuration = time.Since(handlerStart)
+		if timeout > 0 && ctx.Err() == context.DeadlineExceeded && call.ctx.Err() == nil {
+			return errServerDeadline
+		}
+		return err
+	}
 
 	// Decode the argument value.
 	argIsValue := false // if true, need to indirect before calling.
-	if mtype.ArgType.Kind() == reflect.Ptr {
-		if reflect.TypeOf(call.Args).Kind() != reflect.Ptr {
+	direct := call.localMode == LocalDirect
+	if direct && reflect.TypeOf(args) == mtype.ArgType {
+		argv = reflect.ValueOf(args)
+	} else if mtype.ArgType.Kind() == reflect.Ptr {
+		if reflect.TypeOf(args).Kind() != reflect.Ptr {
 			return fmt.Errorf(
 				"%s.%s is being called with the wrong arg type",
 				call.SvcID.Name,
@@ -375,9 +1149,9 @@ func (server *Server) Call(call *Call) error {
 			)
 		}
 		argv = reflect.New(mtype.ArgType.Elem())
-		argv.Elem().Set(reflect.ValueOf(call.Args).Elem())
+		argv.Elem().Set(reflect.ValueOf(args).Elem())
 	} else {
-		if reflect.TypeOf(call.Args).Kind() == reflect.Ptr {
+		if reflect.TypeOf(args).Kind() == reflect.Ptr {
 			return fmt.Errorf(
 				"%s.%s is being called with the wrong arg type",
 				call.SvcID.Name,
@@ -385,7 +1159,7 @@ func (server *Server) Call(call *Call) error {
 			)
 		}
 		argv = reflect.New(mtype.ArgType)
-		argv.Elem().Set(reflect.ValueOf(call.Args))
+		argv.Elem().Set(reflect.ValueOf(args))
 		argIsValue = true
 	}
 	// argv guaranteed to be a pointer here.
@@ -393,24 +1167,60 @@ func (server *Server) Call(call *Call) error {
 	if argIsValue {
 		argv = argv.Elem()
 	}
+	if call.localMode == LocalDeepCopy {
+		if argv, err = deepCopyValue(call.localCodec(), argv); err != nil {
+			return newClientError(err)
+		}
+	}
+	if err := server.validateArgs(ctx, argv); err != nil {
+		return err
+	}
 
-	replyv = reflect.New(mtype.ReplyType.Elem())
-
-	// Call service and respond
-	function := mtype.method.Func
+	// Methods which may time out keep their own reply, as they may
+	// still be running when the call returns.
+	creplyv := reflect.ValueOf(call.Reply)
+	direct = direct && timeout <= 0 && creplyv.IsValid() && creplyv.Type() == mtype.ReplyType && !creplyv.IsNil()
+	if direct {
+		replyv = creplyv
+	} else {
+		replyv = reflect.New(mtype.ReplyType.Elem())
+	}
 
 	// Invoke the method, providing a new value for the reply.
-	returnValues := function.Call(
-		[]reflect.Value{
+	// Local calls are not run on the executor of the Server.
+	returnValues, ok := service.runWithTimeout(call.SvcID, timeout, func() []reflect.Value {
+		return mtype.method.Func.Call([]reflect.Value{
 			service.rcvr,
 			ctxv, // context
 			argv, // argument
 			replyv,
-		},
-	) // reply
+		})
+	})
+	ev.HandlerDuration = time.Since(handlerStart)
 
-	creplyv := reflect.ValueOf(call.Reply)
-	creplyv.Elem().Set(replyv.Elem())
+	if !ok || (timeout > 0 && ctx.Err() == context.DeadlineExceeded && call.ctx.Err() == nil) {
+		return errServerDeadline
+	}
+
+	switch {
+	case direct:
+	case call.localMode == LocalDeepCopy:
+		if returnValues[0].IsNil() {
+			if err := deepCopy(call.localCodec(), call.Reply, replyv.Interface()); err != nil {
+				return newServerError(err)
+			}
+		}
+	case replyv.Elem().Type().AssignableTo(creplyv.Elem().Type()):
+		creplyv.Elem().Set(replyv.Elem())
+	default:
+		// The reply has another type than the method's, such as the
+		// generic values used by the gateway: convert it like args.
+		if returnValues[0].IsNil() {
+			if err := deepCopy(call.localCodec(), call.Reply, replyv.Interface()); err != nil {
+				return newServerError(err)
+			}
+		}
+	}
 
 	// The return value for the method is an error.
 	errInter := returnValues[0].Interface()
@@ -422,17 +1232,16 @@ func (server *Server) Call(call *Call) error {
 
 func (server *Server) getService(id ServiceID) (*service, *methodType, error) {
 	// Look up the request.
-	server.mu.RLock()
-	service := server.serviceMap[id.Name]
-	server.mu.RUnlock()
+	service := server.services()[serviceKey(id.Name, id.Version)]
 	if service == nil {
-		err := errors.New("rpc: can't find service " + id.Name)
-		return nil, nil, newServerError(err)
+		if id.Version != "" && server.hasService(id.Name) {
+			return nil, nil, ErrUnsupportedVersion
+		}
+		return nil, nil, newNoSuchError(ErrNoSuchService, id.Name, server.serviceNames())
 	}
 	mtype := service.method[id.Method]
 	if mtype == nil {
-		err := errors.New("rpc: can't find method " + id.Method)
-		return nil, nil, newServerError(err)
+		return nil, nil, newNoSuchError(ErrNoSuchMethod, id.Method, service.methodNames())
 	}
 	return service, mtype, nil
 }
@@ -466,26 +1275,27 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 // It returns an error if the receiver is not an exported type or has
 // no suitable methods. It also logs the error using package log.
 // The client accesses each method using a string of the form "Type.Method",
-// where Type is the receiver's concrete type.
-func (server *Server) Register(rcvr interface{}) error {
-	return server.register(rcvr, "", false)
+// where Type is the receiver's concrete type. The names of the methods
+// and which ones are published can be changed with RegisterOptions.
+func (server *Server) Register(rcvr interface{}, opts ...RegisterOption) error {
+	return server.register(rcvr, "", false, opts)
 }
 
 // RegisterName is like Register but uses the provided name for the type
 // instead of the receiver's concrete type.
-func (server *Server) RegisterName(name string, rcvr interface{}) error {
-	return server.register(rcvr, name, true)
+func (server *Server) RegisterName(name string, rcvr interface{}, opts ...RegisterOption) error {
+	return server.register(rcvr, name, true, opts)
 }
 
-func (server *Server) register(rcvr interface{}, name string, useName bool) error {
+func (server *Server) register(rcvr interface{}, name string, useName bool, opts []RegisterOption) error {
 	server.mu.Lock()
 	defer server.mu.Unlock()
-	if server.serviceMap == nil {
-		server.serviceMap = make(map[string]*service)
-	}
+	m := server.copyServices()
 	s := new(service)
 	s.typ = reflect.TypeOf(rcvr)
 	s.rcvr = reflect.ValueOf(rcvr)
+	s.logger = server.logger
+	s.executor = server.executor
 	sname := reflect.Indirect(s.rcvr).Type().Name()
 	if useName {
 		sname = name
@@ -500,13 +1310,22 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 		log.Print(s)
 		return errors.New(s)
 	}
-	if _, present := server.serviceMap[sname]; present {
-		return errors.New("rpc: service already defined: " + sname)
+	rOpts := newRegisterOptions(opts)
+	key := serviceKey(sname, rOpts.version)
+	if _, present := m[key]; present {
+		return errors.New("rpc: service already defined: " + key)
 	}
 	s.name = sname
+	s.version = rOpts.version
 
 	// Install the methods
 	s.method = suitableMethods(s.typ, true)
+	methods, err := rOpts.rename(s.method)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	s.method = methods
 
 	if len(s.method) == 0 {
 		str := ""
@@ -521,78 +1340,114 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 		log.Print(str)
 		return errors.New(str)
 	}
-	server.serviceMap[s.name] = s
+	m[key] = s
+	server.serviceMap.Store(m)
+	server.setServiceHandlers(sname)
 	return nil
 }
 
+// setServiceHandlers sets the stream handlers of the protocols of the
+// given service, when per-service protocols are enabled.
+func (server *Server) setServiceHandlers(sname string) {
+	if !server.serviceProtocols || server.host == nil {
+		return
+	}
+	for _, p := range server.protocols() {
+		svcProto := ServiceProtocol(p, sname)
+		server.host.SetStreamHandler(svcProto, func(stream network.Stream) {
+			server.handleServiceStream(stream, sname)
+		})
+	}
+}
+
 // suitableMethods returns suitable Rpc methods of typ, it will report
 // error using log if reportErr is true.
 func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 	methods := make(map[string]*methodType)
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
-		mtype := method.Type
-		mname := method.Name
 		// Method must be exported.
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs four ins: receiver, context.Context, *args, *reply.
-		if mtype.NumIn() != 4 {
-			if reportErr {
-				log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
-			}
-			continue
+		if mtype := suitableMethod(method, reportErr); mtype != nil {
+			methods[method.Name] = mtype
 		}
+	}
+	return methods
+}
 
-		// First argument needs to be a context
-		ctxType := mtype.In(1)
-		ctxIntType := reflect.TypeOf((*context.Context)(nil)).Elem()
-		if !ctxType.Implements(ctxIntType) {
-			if reportErr {
-				log.Println(mname, "first argument is not a context.Context:", ctxType)
-			}
-			continue
+// suitableMethod returns the methodType of the given method, or nil if
+// it is not a suitable Rpc method, which is reported using log if
+// reportErr is true.
+func suitableMethod(method reflect.Method, reportErr bool) *methodType {
+	mtype := method.Type
+	mname := method.Name
+	// Method needs four ins: receiver, context.Context, *args, *reply.
+	if mtype.NumIn() != 4 {
+		if reportErr {
+			log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
 		}
+		return nil
+	}
 
-		// Second arg need not be a pointer so that's not checked.
-		argType := mtype.In(2)
-		if !isExportedOrBuiltinType(argType) {
-			if reportErr {
-				log.Println(mname, "argument type not exported:", argType)
-			}
-			continue
+	// First argument needs to be a context
+	ctxType := mtype.In(1)
+	ctxIntType := reflect.TypeOf((*context.Context)(nil)).Elem()
+	if !ctxType.Implements(ctxIntType) {
+		if reportErr {
+			log.Println(mname, "first argument is not a context.Context:", ctxType)
 		}
-		// Third arg must be a pointer.
-		replyType := mtype.In(3)
-		if replyType.Kind() != reflect.Ptr {
-			if reportErr {
-				log.Println("method", mname, "reply type not a pointer:", replyType)
-			}
-			continue
+		return nil
+	}
+
+	// Second arg need not be a pointer so that's not checked.
+	argType := mtype.In(2)
+	if !isExportedOrBuiltinType(argType) {
+		if reportErr {
+			log.Println(mname, "argument type not exported:", argType)
 		}
-		// Reply type must be exported.
-		if !isExportedOrBuiltinType(replyType) {
+		return nil
+	}
+	// Asynchronous methods take a Respond function instead
+	// of the reply and return nothing.
+	if mtype.In(3) == typeOfRespond {
+		if mtype.NumOut() != 0 {
 			if reportErr {
-				log.Println("method", mname, "reply type not exported:", replyType)
+				log.Println("method", mname, "is asynchronous but has outs:", mtype.NumOut())
 			}
-			continue
+			return nil
 		}
-		// Method needs one out.
-		if mtype.NumOut() != 1 {
-			if reportErr {
-				log.Println("method", mname, "has wrong number of outs:", mtype.NumOut())
-			}
-			continue
+		return &methodType{method: method, ArgType: argType, async: true}
+	}
+	// Third arg must be a pointer.
+	replyType := mtype.In(3)
+	if replyType.Kind() != reflect.Ptr {
+		if reportErr {
+			log.Println("method", mname, "reply type not a pointer:", replyType)
 		}
-		// The return type of the method must be error.
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			if reportErr {
-				log.Println("method", mname, "returns", returnType.String(), "not error")
-			}
-			continue
+		return nil
+	}
+	// Reply type must be exported.
+	if !isExportedOrBuiltinType(replyType) {
+		if reportErr {
+			log.Println("method", mname, "reply type not exported:", replyType)
 		}
-		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+		return nil
 	}
-	return methods
+	// Method needs one out.
+	if mtype.NumOut() != 1 {
+		if reportErr {
+			log.Println("method", mname, "has wrong number of outs:", mtype.NumOut())
+		}
+		return nil
+	}
+	// The return type of the method must be error.
+	if returnType := mtype.Out(0); returnType != typeOfError {
+		if reportErr {
+			log.Println("method", mname, "returns", returnType.String(), "not error")
+		}
+		return nil
+	}
+	return &methodType{method: method, ArgType: argType, ReplyType: replyType}
 }
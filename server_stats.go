@@ -0,0 +1,281 @@
+package rpc
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// MethodStats provides statistics about the calls to a method handled by a
+// Server, or made by a Client. Latencies are measured on the last calls.
+type MethodStats struct {
+	// Calls is the number of calls finished.
+	Calls int64
+	// Active is the number of calls in progress.
+	Active int64
+	// Errors is the number of calls which finished with an error.
+	Errors int64
+	// BytesReceived and BytesSent are the total sizes of the messages
+	// received and sent for remote calls: the requests and the
+	// responses for a Server, the responses and the requests for a
+	// Client.
+	BytesReceived int64
+	BytesSent     int64
+	// RequestSizes and ResponseSizes are the distributions of the
+	// sizes of the requests and the responses of remote calls, as
+	// sent over the streams, which tell the methods that would
+	// benefit from streaming or compression.
+	RequestSizes  SizeHistogram
+	ResponseSizes SizeHistogram
+
+	AvgLatency time.Duration
+	P50Latency time.Duration
+	P90Latency time.Duration
+	P99Latency time.Duration
+
+	// Peers breaks down the calls by caller for a Server, and by
+	// destination for a Client. Local calls are attributed to the
+	// empty peer.ID.
+	Peers map[peer.ID]PeerStats
+}
+
+// sizeBounds are the upper bounds of the buckets of SizeHistograms.
+var sizeBounds = []int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// SizeHistogram is the distribution of the sizes of messages, in buckets
+// bounded by powers of 4 from 64 bytes to 16 MiB.
+type SizeHistogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in
+	// bytes, and Counts the number of messages in every bucket,
+	// the last one counting the messages larger than the last
+	// bound. They are nil when there are no messages.
+	Bounds []int64
+	Counts []int64
+	// Max is the size of the largest message.
+	Max int64
+}
+
+// add records the size of a message.
+func (h *SizeHistogram) add(size int64) {
+	if h.Counts == nil {
+		h.Bounds = sizeBounds
+		h.Counts = make([]int64, len(sizeBounds)+1)
+	}
+	i := sort.Search(len(sizeBounds), func(i int) bool { return sizeBounds[i] >= size })
+	h.Counts[i]++
+	if size > h.Max {
+		h.Max = size
+	}
+}
+
+// copy returns a copy of the histogram which does not share its counts.
+func (h SizeHistogram) copy() SizeHistogram {
+	if h.Counts != nil {
+		h.Counts = append([]int64(nil), h.Counts...)
+	}
+	return h
+}
+
+// Count returns the number of messages.
+func (h SizeHistogram) Count() int64 {
+	var n int64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Percentile returns an upper bound of the given percentile of the sizes
+// (i.e. 0.9 for the 90th percentile): the upper bound of the bucket
+// holding it, or Max when it is lower or in the last bucket. It returns
+// zero when there are no messages.
+func (h SizeHistogram) Percentile(p float64) int64 {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank {
+			if i < len(h.Bounds) && h.Bounds[i] < h.Max {
+				return h.Bounds[i]
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+// PeerStats provides statistics about the calls to a method made by a
+// peer.
+type PeerStats struct {
+	Calls         int64
+	Errors        int64
+	BytesReceived int64
+	BytesSent     int64
+}
+
+// Stats returns the statistics for every method of the registered
+// services which has been called, indexed by "Service.Method".
+func (server *Server) Stats() map[string]MethodStats {
+	return server.stats.snapshot()
+}
+
+// Stats returns the statistics for every method called by the Client,
+// indexed by "Service.Method".
+func (c *Client) Stats() map[string]MethodStats {
+	return c.stats.snapshot()
+}
+
+// methodCounters accumulates the statistics for a method.
+type methodCounters struct {
+	stats     MethodStats
+	total     time.Duration
+	latencies latencyRing
+	peers     map[peer.ID]*PeerStats
+}
+
+// callStats keeps the statistics of a Server or a Client. For Servers,
+// only calls to registered methods are accounted, so that unknown
+// requests cannot make it grow.
+type callStats struct {
+	server *Server // nil for Clients
+
+	mu      sync.Mutex
+	methods map[string]*methodCounters
+}
+
+func newServerStats(server *Server) *callStats {
+	return &callStats{
+		server:  server,
+		methods: make(map[string]*methodCounters),
+	}
+}
+
+func newClientStats() *callStats {
+	return &callStats{
+		methods: make(map[string]*methodCounters),
+	}
+}
+
+// counters returns the counters for the method of the call, or nil if
+// it is not registered. It must be called with the lock held.
+func (ss *callStats) counters(ev *CallEvent) *methodCounters {
+	key := ev.Service + "." + ev.Method
+	mc, ok := ss.methods[key]
+	if ok {
+		return mc
+	}
+	if ss.server != nil {
+		if _, _, err := ss.server.getService(ServiceID{Name: ev.Service, Method: ev.Method}); err != nil {
+			return nil
+		}
+	}
+	mc = &methodCounters{peers: make(map[peer.ID]*PeerStats)}
+	ss.methods[key] = mc
+	return mc
+}
+
+// callStart records the start of a call in the statistics and
+// runs the hooks.
+func (server *Server) callStart(ev *CallEvent) {
+	server.stats.callStart(ev)
+	server.hooks.callStart(ev)
+}
+
+// callEnd records the end of a call in the statistics and runs
+// the hooks.
+func (server *Server) callEnd(ev *CallEvent) {
+	server.stats.callEnd(ev)
+	server.hooks.callEnd(ev)
+	logSlowCall(server.logger, server.slowCall, ev, "queueDelay", ev.QueueDelay, "handlerDuration", ev.HandlerDuration)
+	reportBandwidth(server.bwReporter, server.protocol, ev)
+	if server.audit != nil {
+		server.audit.record(ev, server.logger)
+	}
+}
+
+func (ss *callStats) callStart(ev *CallEvent) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if mc := ss.counters(ev); mc != nil {
+		mc.stats.Active++
+	}
+}
+
+func (ss *callStats) callEnd(ev *CallEvent) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	mc := ss.counters(ev)
+	if mc == nil {
+		return
+	}
+	// The method may have been registered while the call was running.
+	if mc.stats.Active > 0 {
+		mc.stats.Active--
+	}
+	mc.stats.Calls++
+	mc.stats.BytesReceived += ev.BytesReceived
+	mc.stats.BytesSent += ev.BytesSent
+	if ss.server != nil {
+		ss.recordSizes(mc, ev.BytesReceived, ev.BytesSent)
+	} else {
+		ss.recordSizes(mc, ev.BytesSent, ev.BytesReceived)
+	}
+	mc.total += ev.Duration
+	mc.latencies.add(ev.Duration)
+
+	ps, ok := mc.peers[ev.Peer]
+	if !ok {
+		ps = &PeerStats{}
+		mc.peers[ev.Peer] = ps
+	}
+	ps.Calls++
+	ps.BytesReceived += ev.BytesReceived
+	ps.BytesSent += ev.BytesSent
+	if ev.Error != nil {
+		mc.stats.Errors++
+		ps.Errors++
+	}
+}
+
+// recordSizes records the sizes of the request and the response of a
+// remote call.
+func (ss *callStats) recordSizes(mc *methodCounters, request, response int64) {
+	if request > 0 {
+		mc.stats.RequestSizes.add(request)
+	}
+	if response > 0 {
+		mc.stats.ResponseSizes.add(response)
+	}
+}
+
+func (ss *callStats) snapshot() map[string]MethodStats {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	res := make(map[string]MethodStats, len(ss.methods))
+	for key, mc := range ss.methods {
+		st := mc.stats
+		st.RequestSizes = st.RequestSizes.copy()
+		st.ResponseSizes = st.ResponseSizes.copy()
+		if st.Calls > 0 {
+			st.AvgLatency = mc.total / time.Duration(st.Calls)
+			ps := mc.latencies.percentiles(0.5, 0.9, 0.99)
+			st.P50Latency, st.P90Latency, st.P99Latency = ps[0], ps[1], ps[2]
+		}
+		st.Peers = make(map[peer.ID]PeerStats, len(mc.peers))
+		for p, pst := range mc.peers {
+			st.Peers[p] = *pst
+		}
+		res[key] = st
+	}
+	return res
+}
@@ -1,23 +1,36 @@
 package rpc
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
 
 	logging "github.com/ipfs/go-log/v2"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 func init() {
-	logging.SetLogLevel("p2p-gorpc", "DEBUG")
+	for _, subsystem := range []string{ClientLogSubsystem, ServerLogSubsystem, StreamLogSubsystem} {
+		logging.SetLogLevel(subsystem, "DEBUG")
+	}
 	//logging.SetDebugLogging()
 }
 
@@ -75,6 +88,32 @@ func (t *Arith) GimmeError(ctx context.Context, args *Args, r *int) error {
 	return errors.New("an error")
 }
 
+func (t *Arith) Metadata(ctx context.Context, key string, r *string) error {
+	*r = GetMetadata(ctx)[key]
+	return nil
+}
+
+func (t *Arith) Steps(ctx context.Context, steps int, r *int) error {
+	for i := 1; i <= steps; i++ {
+		err := ReportProgress(ctx, float64(i*100/steps), fmt.Sprintf("step %d", i))
+		if err != nil {
+			return err
+		}
+		*r = i
+	}
+	return nil
+}
+
+func (t *Arith) AsyncAdd(ctx context.Context, args Args, respond Respond) {
+	go func() {
+		if args.A < 0 || args.B < 0 {
+			respond(nil, errors.New("negative operand"))
+			return
+		}
+		respond(args.A+args.B, nil)
+	}()
+}
+
 func (t *Arith) Sleep(ctx context.Context, secs int, res *struct{}) error {
 	t.ctxTracker.setCtx(ctx)
 	tim := time.NewTimer(time.Duration(secs) * time.Second)
@@ -327,46 +366,2970 @@ func TestCallContext(t *testing.T) {
 	})
 }
 
-func TestMultiCall(t *testing.T) {
+func testCallTimeout(t *testing.T, servHost, clientHost host.Host, dest peer.ID) {
+	s := NewServer(servHost, "rpc")
+	c := NewClientWithServer(clientHost, "rpc", s)
+
+	var arith Arith
+	arith.ctxTracker = &ctxTracker{}
+	s.Register(&arith)
+
+	err := c.Call(dest, "Arith", "Sleep", 5, &struct{}{}, WithTimeout(time.Second/2))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !strings.Contains(err.Error(), "context") {
+		t.Error("expected a context error:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if !arith.ctxTracker.cancelled() {
+		t.Error("expected ctx cancellation in the function")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
 	h1, h2 := makeRandomNodes()
 	defer h1.Close()
 	defer h2.Close()
 
-	s := NewServer(h1, "rpc")
-	c := NewClientWithServer(h2, "rpc", s)
+	t.Run("local", func(t *testing.T) {
+		testCallTimeout(t, h1, h2, h2.ID())
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		testCallTimeout(t, h1, h2, h1.ID())
+	})
+}
+
+func testMetadata(t *testing.T, servHost, clientHost host.Host, dest peer.ID) {
+	s := NewServer(servHost, "rpc")
+	c := NewClientWithServer(clientHost, "rpc", s)
+
 	var arith Arith
 	s.Register(&arith)
 
-	replies := make([]int, 2, 2)
-	ctxs := make([]context.Context, 2, 2)
-	repliesInt := make([]interface{}, 2, 2)
-	for i := range repliesInt {
-		repliesInt[i] = &replies[i]
-		ctxs[i] = context.Background()
+	var r string
+	err := c.Call(dest, "Arith", "Metadata", "request-id", &r, WithMetadata("request-id", "abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != "abc" {
+		t.Error("unexpected metadata value:", r)
 	}
 
-	errs := c.MultiCall(
-		ctxs,
-		[]peer.ID{h1.ID(), h2.ID()},
-		"Arith",
-		"Multiply",
-		&Args{2, 3},
-		repliesInt,
+	err = c.Call(dest, "Arith", "Metadata", "request-id", &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != "" {
+		t.Error("expected no metadata:", r)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	t.Run("local", func(t *testing.T) {
+		testMetadata(t, h1, h2, h2.ID())
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		testMetadata(t, h1, h2, h1.ID())
+	})
+}
+
+func testProgress(t *testing.T, servHost, clientHost host.Host, dest peer.ID) {
+	s := NewServer(servHost, "rpc")
+	c := NewClientWithServer(clientHost, "rpc", s)
+
+	var arith Arith
+	s.Register(&arith)
+
+	var updates []Progress
+	var r int
+	err := c.Call(dest, "Arith", "Steps", 4, &r, WithProgress(func(p Progress) {
+		updates = append(updates, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 4 {
+		t.Error("result is:", r)
+	}
+	if len(updates) != 4 {
+		t.Fatal("expected 4 progress updates:", updates)
+	}
+	if updates[3].Percent != 100 || updates[3].Message != "step 4" {
+		t.Error("unexpected last update:", updates[3])
+	}
+
+	// Without WithProgress, reporting is a no-op.
+	err = c.Call(dest, "Arith", "Steps", 4, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 4 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	t.Run("local", func(t *testing.T) {
+		testProgress(t, h1, h2, h2.ID())
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		testProgress(t, h1, h2, h1.ID())
+	})
+}
+
+func testAsync(t *testing.T, servHost, clientHost host.Host, dest peer.ID) {
+	s := NewServer(servHost, "rpc")
+	c := NewClientWithServer(clientHost, "rpc", s)
+
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(dest, "Arith", "AsyncAdd", Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 5 {
+		t.Error("result is:", r)
+	}
+
+	err = c.Call(dest, "Arith", "AsyncAdd", Args{-2, 3}, &r)
+	if err == nil || err.Error() != "negative operand" {
+		t.Error("expected an error:", err)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	t.Run("local", func(t *testing.T) {
+		testAsync(t, h1, h2, h2.ID())
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		testAsync(t, h1, h2, h1.ID())
+	})
+}
+
+// Stubborn has a method which ignores its context.
+type Stubborn struct {
+	release chan struct{}
+}
+
+func (s *Stubborn) Wait(ctx context.Context, in int, out *int) error {
+	<-s.release
+	*out = in
+	return nil
+}
+
+func testMethodTimeout(t *testing.T, servHost, clientHost host.Host, dest peer.ID) {
+	s := NewServer(servHost, "rpc",
+		WithMethodTimeout("Arith", "Sleep", 100*time.Millisecond),
+		WithMethodTimeout("Stubborn", "", 100*time.Millisecond),
 	)
+	c := NewClientWithServer(clientHost, "rpc", s)
 
-	if len(errs) != 2 {
-		t.Fatal("expected two errs")
+	arith := &Arith{}
+	arith.ctxTracker = &ctxTracker{}
+	s.Register(arith)
+	stubborn := &Stubborn{release: make(chan struct{})}
+	defer close(stubborn.release)
+	s.Register(stubborn)
+
+	start := time.Now()
+	err := c.Call(dest, "Arith", "Sleep", 5, &struct{}{})
+	if !IsServerError(err) || err.Error() != "deadline exceeded on server" {
+		t.Error("expected a server deadline error:", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("the call took too long")
+	}
+	if !arith.ctxTracker.cancelled() {
+		t.Error("expected the method context to be cancelled")
 	}
 
-	for _, err := range errs {
-		if err != nil {
-			t.Error(err)
+	// The call does not wait for methods ignoring their context.
+	var r int
+	start = time.Now()
+	err = c.Call(dest, "Stubborn", "Wait", 1, &r)
+	if !IsServerError(err) || err.Error() != "deadline exceeded on server" {
+		t.Error("expected a server deadline error:", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("the call took too long")
+	}
+
+	err = c.Call(dest, "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+func TestMethodTimeout(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	t.Run("local", func(t *testing.T) {
+		testMethodTimeout(t, h1, h2, h2.ID())
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		testMethodTimeout(t, h1, h2, h1.ID())
+	})
+}
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+type testLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *testLogger) log(level, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[kv[i].(string)] = kv[i+1]
+	}
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+func (l *testLogger) Debugw(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *testLogger) Infow(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *testLogger) Warnw(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *testLogger) Errorw(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func (l *testLogger) find(msg string) (logEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e, true
 		}
 	}
+	return logEntry{}, false
+}
 
-	for _, reply := range replies {
-		if reply != 6 {
-			t.Error("expected 2*3=6")
+func TestLogger(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var slog, clog testLogger
+	s := NewServer(h1, "rpc", WithServerLogger(&slog))
+	c := NewClient(h2, "rpc", WithClientLogger(&clog))
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := clog.find("call finished")
+	if !ok {
+		t.Fatal("the client did not log the call")
+	}
+	if e.fields["peer"] != h1.ID() || e.fields["service"] != "Arith" || e.fields["method"] != "Multiply" {
+		t.Error("unexpected fields:", e.fields)
+	}
+	if _, ok := e.fields["duration"].(time.Duration); !ok {
+		t.Error("expected a duration:", e.fields)
+	}
+
+	// The server logs once the response is sent.
+	time.Sleep(100 * time.Millisecond)
+	e, ok = slog.find("RPC handled")
+	if !ok {
+		t.Fatal("the server did not log the call")
+	}
+	if e.fields["peer"] != h2.ID() || e.fields["method"] != "Multiply" || e.fields["error"] != nil {
+		t.Error("unexpected fields:", e.fields)
+	}
+
+	err = c.Call(h1.ID(), "Arith", "Nope", &Args{2, 3}, &r)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	e, ok = clog.find("call failed")
+	if !ok || e.level != "error" || e.fields["error"] == nil {
+		t.Error("the client did not log the failure:", e)
+	}
+}
+
+func TestSlowCallLogger(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	var slog, clog testLogger
+	s := NewServer(h1, "rpc", WithServerLogger(&slog), WithServerSlowCallThreshold(50*time.Millisecond))
+	c := NewClient(h2, "rpc", WithClientLogger(&clog), WithClientSlowCallThreshold(50*time.Millisecond))
+	var arith Arith
+	s.Register(&arith)
+	s.RegisterFunc("Timer", "Sleep", func(ctx context.Context, d time.Duration, r *struct{}) error {
+		time.Sleep(d)
+		return nil
+	})
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(h1.ID(), "Timer", "Sleep", 100*time.Millisecond, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, l := range []*testLogger{&clog, &slog} {
+		e, ok := l.find("slow call")
+		if !ok {
+			t.Fatal("the slow call was not logged")
+		}
+		if e.level != "warn" || e.fields["method"] != "Sleep" || e.fields["duration"].(time.Duration) < 100*time.Millisecond {
+			t.Error("unexpected entry:", e)
+		}
+		if e.fields["bytesSent"].(int64) == 0 || e.fields["bytesReceived"].(int64) == 0 {
+			t.Error("expected the sizes of the call:", e.fields)
+		}
+		n := 0
+		for _, e := range l.entries {
+			if e.msg == "slow call" {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Error("expected only the slow call to be logged:", n)
+		}
+	}
+	if e, _ := slog.find("slow call"); e.fields["handlerDuration"].(time.Duration) < 100*time.Millisecond {
+		t.Error("expected the duration of the method:", e.fields)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	serverStarts := make(chan CallEvent, 10)
+	serverEnds := make(chan CallEvent, 10)
+	s := NewServer(h1, "rpc", WithServerHooks(Hooks{
+		OnCallStart: func(ev CallEvent) { serverStarts <- ev },
+		OnCallEnd:   func(ev CallEvent) { serverEnds <- ev },
+	}))
+
+	var clientStarts, clientEnds []CallEvent
+	c := NewClient(h2, "rpc", WithClientHooks(Hooks{
+		OnCallStart: func(ev CallEvent) { clientStarts = append(clientStarts, ev) },
+		OnCallEnd:   func(ev CallEvent) { clientEnds = append(clientEnds, ev) },
+	}))
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	err := c.Call(h1.ID(), "Arith", "GimmeError", &Args{1, 2}, &r, WithMetadata("user", "alice"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(clientStarts) != 1 || len(clientEnds) != 1 {
+		t.Fatal("expected one start and one end event on the client")
+	}
+	ev := clientEnds[0]
+	if ev.Peer != h1.ID() || ev.Service != "Arith" || ev.Method != "GimmeError" {
+		t.Error("unexpected event:", ev)
+	}
+	if ev.Error == nil || ev.Error.Error() != "an error" {
+		t.Error("expected the call error:", ev.Error)
+	}
+	if ev.Duration <= 0 {
+		t.Error("expected a duration")
+	}
+
+	select {
+	case ev = <-serverStarts:
+	case <-time.After(time.Second):
+		t.Fatal("no start event on the server")
+	}
+	if ev.Peer != h2.ID() || ev.Metadata["user"] != "alice" {
+		t.Error("unexpected event:", ev)
+	}
+
+	select {
+	case ev = <-serverEnds:
+	case <-time.After(time.Second):
+		t.Fatal("no end event on the server")
+	}
+	if ev.Error == nil || ev.Error.Error() != "an error" {
+		t.Error("expected the method error:", ev.Error)
+	}
+	if ev.HandlerDuration <= 0 || ev.Duration < ev.QueueDelay+ev.HandlerDuration {
+		t.Error("unexpected durations:", ev)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	var arith Arith
+	s.Register(&arith)
+
+	unknown, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r int
+	err = c.Call(unknown, "Arith", "Multiply", &Args{2, 3}, &r, WithRetries(2, 10*time.Millisecond))
+	if !IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithRetries(2, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("result is:", r)
+	}
+}
+
+// Gauge keeps track of the number of simultaneous calls to Hold.
+type Gauge struct {
+	mu          sync.Mutex
+	active, max int
+}
+
+func (g *Gauge) Hold(ctx context.Context, d time.Duration, r *int) error {
+	g.mu.Lock()
+	g.active++
+	if g.active > g.max {
+		g.max = g.active
+	}
+	g.mu.Unlock()
+
+	time.Sleep(d)
+
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	return nil
+}
+
+func TestMultiCallConcurrency(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s)
+	var gauge Gauge
+	s.Register(&gauge)
+
+	n := 10
+	ctxs := make([]context.Context, n)
+	dests := make([]peer.ID, n)
+	replies := make([]interface{}, n)
+	for i := range ctxs {
+		ctxs[i] = context.Background()
+		dests[i] = h1.ID()
+		replies[i] = new(int)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctxs[n-1] = cancelled
+
+	errs := c.MultiCall(ctxs, dests, "Gauge", "Hold", 20*time.Millisecond, replies, WithConcurrency(3))
+	for i, err := range errs[:n-1] {
+		if err != nil {
+			t.Error(i, err)
+		}
+	}
+	if errs[n-1] != context.Canceled {
+		t.Error("expected a cancelled call:", errs[n-1])
+	}
+	if gauge.max > 3 {
+		t.Error("too many simultaneous calls:", gauge.max)
+	}
+}
+
+func TestMultiStream(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s)
+	var arith Arith
+	s.Register(&arith)
+
+	dests := []peer.ID{h1.ID(), h2.ID(), h1.ID()}
+	ctxs := make([]context.Context, len(dests))
+	replies := make([]interface{}, len(dests))
+	for i := range dests {
+		ctxs[i] = context.Background()
+		replies[i] = new(int)
+	}
+
+	seen := make(map[int]bool)
+	for res := range c.MultiStream(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies, WithConcurrency(2)) {
+		if res.Error != nil {
+			t.Error(res.Index, res.Error)
+		}
+		if res.Peer != dests[res.Index] {
+			t.Error("unexpected peer:", res.Peer)
+		}
+		if *res.Reply.(*int) != 6 {
+			t.Error("expected 2*3=6")
+		}
+		if res.Latency <= 0 {
+			t.Error("expected a latency")
+		}
+		seen[res.Index] = true
+	}
+	if len(seen) != len(dests) {
+		t.Error("missing results:", seen)
+	}
+}
+
+func TestMultiCallResults(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s)
+	var arith Arith
+	s.Register(&arith)
+
+	dests := []peer.ID{h1.ID(), h2.ID(), h1.ID()}
+	ctxs := make([]context.Context, len(dests))
+	replies := make([]interface{}, len(dests))
+	for i := range dests {
+		ctxs[i] = context.Background()
+		replies[i] = new(Quotient)
+	}
+
+	results := c.MultiCallResults(ctxs, dests, "Arith", "Divide", &Args{7, 2}, replies)
+	for i, res := range results {
+		if res.Index != i || res.Peer != dests[i] || res.Reply != replies[i] {
+			t.Error("unexpected result:", res)
+		}
+		if res.Error != nil || res.Reply.(*Quotient).Quo != 3 {
+			t.Error("unexpected result:", res.Error, res.Reply)
+		}
+	}
+	errs := ResultErrors(results)
+	if FirstNonError(errs) != 0 || !QuorumReached(errs, 3) {
+		t.Error("expected all calls to succeed:", errs)
+	}
+
+	errs = ResultErrors(c.MultiCallResults(ctxs, dests, "Arith", "Divide", &Args{7, 0}, replies))
+	if FirstNonError(errs) != -1 || QuorumReached(errs, 1) {
+		t.Error("expected all calls to fail:", errs)
+	}
+	errs = []error{errors.New("a"), nil, errors.New("b"), nil}
+	if FirstNonError(errs) != 1 || !QuorumReached(errs, 2) || QuorumReached(errs, 3) {
+		t.Error("unexpected aggregation:", errs)
+	}
+}
+
+// Gate records the order in which calls run. Wait blocks until
+// the gate is opened.
+type Gate struct {
+	open chan struct{}
+
+	mu    sync.Mutex
+	order []string
+}
+
+func (g *Gate) Wait(ctx context.Context, name string, r *struct{}) error {
+	<-g.open
+	return nil
+}
+
+func (g *Gate) Record(ctx context.Context, name string, r *struct{}) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.order = append(g.order, name)
+	return nil
+}
+
+func (q *callQueue) waitingLen() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func TestPriority(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithMaxConcurrentCalls(1))
+	c := NewClient(h2, "rpc")
+	gate := &Gate{open: make(chan struct{})}
+	s.Register(gate)
+
+	waitQueued := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for s.queue.waitingLen() != n {
+			if time.Now().After(deadline) {
+				t.Fatal("requests were not queued")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	done := make(chan *Call, 4)
+	c.Go(h1.ID(), "Gate", "Wait", "", &struct{}{}, done)
+	time.Sleep(100 * time.Millisecond)
+	c.Go(h1.ID(), "Gate", "Record", "low", &struct{}{}, done, WithPriority(PriorityLow))
+	waitQueued(1)
+	c.Go(h1.ID(), "Gate", "Record", "normal", &struct{}{}, done)
+	waitQueued(2)
+	c.Go(h1.ID(), "Gate", "Record", "high", &struct{}{}, done, WithPriority(PriorityHigh))
+	waitQueued(3)
+
+	close(gate.open)
+	for i := 0; i < 4; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Error(call.Error)
+		}
+	}
+
+	expected := []string{"high", "normal", "low"}
+	for i, name := range expected {
+		if gate.order[i] != name {
+			t.Fatalf("unexpected order: %v", gate.order)
+		}
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc",
+		WithMaxConcurrentCalls(1),
+		WithAdmissionQueue(1, 300*time.Millisecond),
+	)
+	c := NewClient(h2, "rpc")
+	gate := &Gate{open: make(chan struct{})}
+	s.Register(gate)
+
+	done := make(chan *Call, 2)
+	c.Go(h1.ID(), "Gate", "Wait", "", &struct{}{}, done)
+	time.Sleep(100 * time.Millisecond)
+	c.Go(h1.ID(), "Gate", "Record", "queued", &struct{}{}, done)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.queue.waitingLen() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("request was not queued")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The queue is full.
+	err := c.Call(h1.ID(), "Gate", "Record", "rejected", &struct{}{})
+	if !IsOverloadedError(err) {
+		t.Fatal("expected an overloaded error:", err)
+	}
+	if RetryAfter(err) != 300*time.Millisecond {
+		t.Error("unexpected retry hint:", RetryAfter(err))
+	}
+
+	// The queued request waits for too long.
+	call := <-done
+	if call.SvcID.Method != "Record" || !IsOverloadedError(call.Error) {
+		t.Fatal("expected the queued request to be rejected:", call.Error)
+	}
+
+	close(gate.open)
+	call = <-done
+	if call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if len(gate.order) != 0 {
+		t.Error("rejected requests should not run:", gate.order)
+	}
+}
+
+// Lag echoes its arguments after a delay.
+type Lag struct {
+	delay time.Duration
+}
+
+func (l *Lag) Echo(ctx context.Context, in string, out *string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(l.delay):
+	}
+	*out = in
+	return nil
+}
+
+func TestHedgedCall(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s1 := NewServer(h1, "rpc")
+	s1.Register(&Lag{delay: 5 * time.Second})
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Lag{})
+	c := NewClientWithServer(h2, "rpc", s2, WithHedging(0.9, 50*time.Millisecond))
+
+	start := time.Now()
+	var out string
+	err := c.HedgedCall(context.Background(), []peer.ID{h1.ID(), h2.ID()}, "Lag", "Echo", "hi", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hi" {
+		t.Error("unexpected reply:", out)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("call was not hedged")
+	}
+
+	// Every destination fails.
+	err = c.HedgedCall(context.Background(), []peer.ID{h1.ID(), h2.ID()}, "Lag", "Missing", "hi", &out)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for i := 0; i < minLatencySamples; i++ {
+		c.latencies.record(h1.ID(), ServiceID{Name: "Lag", Method: "Echo"}, time.Duration(i)*time.Millisecond)
+	}
+	if d := c.latencies.hedgeDelay("Lag", "Echo"); d != 8*time.Millisecond {
+		t.Error("unexpected hedge delay:", d)
+	}
+}
+
+func TestCallInfo(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Lag{delay: 50 * time.Millisecond})
+	c := NewClient(h2, "rpc")
+
+	var info CallInfo
+	var out string
+	err := c.Call(h1.ID(), "Lag", "Echo", "hello", &out, WithCallInfo(&info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BytesSent == 0 || info.BytesReceived == 0 {
+		t.Error("unexpected sizes:", info.BytesSent, info.BytesReceived)
+	}
+	if info.StreamSetup <= 0 {
+		t.Error("stream setup time not set")
+	}
+	if info.ServerDuration < 50*time.Millisecond {
+		t.Error("unexpected server duration:", info.ServerDuration)
+	}
+	if info.Latency < info.ServerDuration+info.StreamSetup {
+		t.Error("unexpected latency:", info.Latency)
+	}
+
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Lag", "Echo", "hello", &out, done)
+	call := <-done
+	if call.Info.BytesReceived != info.BytesReceived {
+		t.Error("unexpected size:", call.Info.BytesReceived)
+	}
+}
+
+func TestPayloadSizes(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(Echo{})
+	c := NewClient(h2, "rpc")
+
+	var out []byte
+	for _, size := range []int{10, 10, 10, 100 << 10} {
+		if err := c.Call(h1.ID(), "Echo", "Echo", make([]byte, size), &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss, cs := s.Stats()["Echo.Echo"], c.Stats()["Echo.Echo"]
+	if cs.Calls != 4 || cs.BytesSent != ss.BytesReceived || cs.BytesReceived != ss.BytesSent {
+		t.Errorf("unexpected client stats: %+v", cs)
+	}
+	for _, h := range []SizeHistogram{ss.RequestSizes, ss.ResponseSizes, cs.RequestSizes, cs.ResponseSizes} {
+		if h.Count() != 4 || len(h.Counts) != len(h.Bounds)+1 {
+			t.Fatalf("unexpected histogram: %+v", h)
+		}
+		if p := h.Percentile(0.5); p == 0 || p > 1<<10 {
+			t.Error("unexpected median size:", p)
+		}
+		if p := h.Percentile(0.99); p != h.Max || p < 100<<10 || p > 101<<10 {
+			t.Error("unexpected 99th percentile:", p, h.Max)
+		}
+	}
+	for i, n := range ss.RequestSizes.Counts {
+		if cs.RequestSizes.Counts[i] != n || cs.ResponseSizes.Counts[i] != ss.ResponseSizes.Counts[i] {
+			t.Error("the sizes measured by the client and the server differ:", cs.RequestSizes, ss.RequestSizes)
+		}
+	}
+
+	// Snapshots do not change afterwards.
+	if ss.RequestSizes.Bounds[6] != 256<<10 || ss.RequestSizes.Counts[6] != 1 {
+		t.Fatal("expected the large request in the 256 KiB bucket:", ss.RequestSizes)
+	}
+	c.Call(h1.ID(), "Echo", "Echo", make([]byte, 100<<10), &out)
+	if ss.RequestSizes.Counts[6] != 1 || s.Stats()["Echo.Echo"].RequestSizes.Counts[6] != 2 {
+		t.Error("the statistics were modified")
+	}
+	if (SizeHistogram{}).Percentile(0.5) != 0 {
+		t.Error("expected no size without messages")
+	}
+}
+
+func TestCallInfoTransport(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+
+	for _, opts := range [][]ClientOption{nil, {WithPipelining()}} {
+		c := NewClient(h2, "rpc", opts...)
+		var info CallInfo
+		var r int
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithCallInfo(&info), WithTransports("quic", "tcp")); err != nil {
+			t.Fatal(err)
+		}
+		if info.Transport != "tcp" || info.Relayed || info.Direction != network.DirOutbound {
+			t.Errorf("unexpected connection information: %+v", info)
+		}
+		if info.Security != "" || info.Encrypted {
+			t.Errorf("the security of TCP connections is not known: %+v", info)
+		}
+
+		err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithTransports("quic"))
+		if !IsClientError(err) || !strings.Contains(err.Error(), "tcp transport") {
+			t.Error("expected the call to be refused over TCP:", err)
+		}
+	}
+
+	for addr, name := range map[string]string{
+		"/ip4/1.2.3.4/tcp/4001":                         "tcp",
+		"/ip4/1.2.3.4/udp/4001/quic":                    "quic",
+		"/dns4/example.com/tcp/443/wss":                 "wss",
+		"/ip6/::1/tcp/4001/ws/p2p-circuit":              "ws",
+		"/ip4/1.2.3.4/tcp/4001/p2p/" + h1.ID().Pretty(): "tcp",
+	} {
+		if n := TransportName(ma.StringCast(addr)); n != name {
+			t.Errorf("%s: expected %s, got %s", addr, name, n)
+		}
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+	local := NewClientWithServer(h1, "rpc", s)
+
+	var r int
+	for i := 0; i < 3; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, i}, &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := local.Call("", "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	var q Quotient
+	c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &q)
+	c.Call(h1.ID(), "Unknown", "Method", &Args{1, 0}, &q)
+
+	st := s.Stats()
+	if len(st) != 2 {
+		t.Fatal("unexpected methods:", st)
+	}
+	mul := st["Arith.Multiply"]
+	if mul.Calls != 4 || mul.Errors != 0 || mul.Active != 0 {
+		t.Errorf("unexpected counters: %+v", mul)
+	}
+	if mul.BytesReceived == 0 || mul.BytesSent == 0 {
+		t.Errorf("unexpected sizes: %+v", mul)
+	}
+	if mul.AvgLatency <= 0 || mul.P99Latency < mul.P50Latency {
+		t.Errorf("unexpected latencies: %+v", mul)
+	}
+	if mul.Peers[h2.ID()].Calls != 3 || mul.Peers[""].Calls != 1 {
+		t.Errorf("unexpected peers: %+v", mul.Peers)
+	}
+	div := st["Arith.Divide"]
+	if div.Calls != 1 || div.Errors != 1 || div.Peers[h2.ID()].Errors != 1 {
+		t.Errorf("unexpected counters: %+v", div)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	c := NewClient(h2, "rpc")
+
+	var r1, r3, r5 int
+	var quo Quotient
+	reqs := []Request{
+		{"Arith", "Multiply", &Args{2, 3}, &r1},
+		{"Arith", "Divide", &Args{1, 0}, &quo},
+		{"Arith", "AsyncAdd", Args{4, 5}, &r3},
+		{"Missing", "Method", &Args{}, &struct{}{}},
+		{"Arith", "Multiply", &Args{6, 7}, &r5},
+	}
+	res := c.Batch(context.Background(), h1.ID(), reqs)
+	if len(res) != len(reqs) {
+		t.Fatal("unexpected number of results:", len(res))
+	}
+	if res[0].Error != nil || r1 != 6 {
+		t.Error("unexpected result:", res[0].Error, r1)
+	}
+	if res[1].Error == nil || res[1].Error.Error() != "divide by zero" {
+		t.Error("expected divide by zero error:", res[1].Error)
+	}
+	if res[2].Error != nil || r3 != 9 {
+		t.Error("unexpected result:", res[2].Error, r3)
+	}
+	if !IsServerError(res[3].Error) {
+		t.Error("expected a server error:", res[3].Error)
+	}
+	if res[4].Error != nil || r5 != 42 || res[4].Reply != &r5 {
+		t.Error("unexpected result:", res[4].Error, r5)
+	}
+
+	// A batch of many small calls.
+	reqs = make([]Request, 200)
+	replies := make([]int, len(reqs))
+	for i := range reqs {
+		reqs[i] = Request{"Arith", "Add", Args{i, 1}, &replies[i]}
+	}
+	for i, r := range c.Batch(context.Background(), h1.ID(), reqs) {
+		if r.Error != nil || replies[i] != i+1 {
+			t.Fatal("unexpected result:", i, r.Error, replies[i])
+		}
+	}
+
+	// Batches are retried when their stream cannot be opened.
+	h3, _ := libp2p.New(
+		context.Background(),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	defer h3.Close()
+	h2.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+	reqs = []Request{{"Arith", "Multiply", &Args{2, 3}, &r1}}
+	if res := c.Batch(context.Background(), h3.ID(), reqs); !IsClientError(res[0].Error) {
+		t.Fatal("expected a client error without server:", res[0].Error)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		NewServer(h3, "rpc").Register(&arith)
+	}()
+	res = c.Batch(context.Background(), h3.ID(), reqs, WithRetries(10, 20*time.Millisecond))
+	if res[0].Error != nil || r1 != 6 {
+		t.Error("unexpected result:", res[0].Error, r1)
+	}
+
+	// Batches are reported to the hooks and stats, and adapted to the
+	// features of the destination, here a peer which predates the
+	// handshake and does not support the codec of the calls.
+	h1.RemoveStreamHandler(HandshakeProtocol("rpc"))
+	var ends []CallEvent
+	hc := NewClient(h2, "rpc", WithHandshake(), WithClientHooks(Hooks{
+		OnCallEnd: func(ev CallEvent) { ends = append(ends, ev) },
+	}))
+	reqs = []Request{
+		{"Arith", "Multiply", &Args{2, 3}, &r1},
+		{"Arith", "Add", Args{1, 2}, &r3},
+	}
+	res = hc.Batch(context.Background(), h1.ID(), reqs, WithCodec(CBORCodec))
+	if res[0].Error != nil || res[1].Error != nil || r1 != 6 || r3 != 3 {
+		t.Fatal("unexpected results:", res, r1, r3)
+	}
+	if len(ends) != 2 || ends[0].Method != "Multiply" || ends[1].Method != "Add" {
+		t.Fatal("unexpected events:", ends)
+	}
+	for _, ev := range ends {
+		if ev.Codec != "" {
+			t.Error("the codec was not adapted to the peer:", ev.Codec)
+		}
+	}
+	if st := hc.Stats()["Arith.Add"]; st.Calls != 1 || st.Active != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	s.Register(&arith)
+	s.Register(&Lag{delay: 500 * time.Millisecond})
+	c := NewClient(h2, "rpc", WithPipelining())
+
+	// A slow call does not hold the faster ones.
+	var slow string
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Lag", "Echo", "hi", &slow, done)
+	start := time.Now()
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != 6 {
+		t.Error("unexpected reply:", r)
+	}
+	if time.Since(start) > 250*time.Millisecond {
+		t.Error("call waited for the previous one")
+	}
+	if call := <-done; call.Error != nil || slow != "hi" {
+		t.Error("unexpected result:", call.Error, slow)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var r int
+			if err := c.Call(h1.ID(), "Arith", "AsyncAdd", Args{i, 1}, &r); err != nil {
+				t.Error(err)
+			}
+			if r != i+1 {
+				t.Error("unexpected reply:", r)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var quo Quotient
+	err := c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &quo)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Error("expected divide by zero error:", err)
+	}
+
+	var updates int
+	err = c.Call(h1.ID(), "Arith", "Steps", 3, &r, WithProgress(func(p Progress) {
+		updates++
+	}))
+	if err != nil || r != 3 || updates != 3 {
+		t.Error("unexpected progress:", err, r, updates)
+	}
+
+	// Cancelled calls do not break the stream.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.CallContext(ctx, h1.ID(), "Lag", "Echo", "hi", &slow); err != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", err)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r); err != nil || r != 8 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	streams := 0
+	for _, conn := range h2.Network().ConnsToPeer(h1.ID()) {
+		for _, st := range conn.GetStreams() {
+			if st.Protocol() == PipelineProtocol("rpc") {
+				streams++
+			}
+		}
+	}
+	if streams != 1 {
+		t.Error("expected a single pipelined stream:", streams)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	var arith Arith
+	arith.ctxTracker = &ctxTracker{}
+	s.Register(&arith)
+	c := NewClient(h2, "rpc", WithPipelining())
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	p := c.pipelines[h1.ID()]
+
+	// Keep another call in flight on the same stream.
+	done := make(chan *Call, 1)
+	c.Go(h1.ID(), "Arith", "AsyncAdd", Args{1, 2}, &r, done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := c.CallContext(ctx, h1.ID(), "Arith", "Sleep", 5, &struct{}{})
+	if err != context.DeadlineExceeded {
+		t.Error("expected a deadline error:", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !arith.ctxTracker.cancelled() {
+		t.Error("expected ctx cancellation in the function")
+	}
+
+	if call := <-done; call.Error != nil || r != 3 {
+		t.Error("unexpected result:", call.Error, r)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 4}, &r); err != nil || r != 8 {
+		t.Error("unexpected result:", err, r)
+	}
+	if c.pipelines[h1.ID()] != p || p.getError() != nil {
+		t.Error("the pipelined stream was closed")
+	}
+}
+
+type Feed struct{}
+
+func (f *Feed) Events(ctx context.Context, topic string, r *struct{}) error {
+	if topic == "" {
+		return errors.New("no topic")
+	}
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Feed{})
+	local := NewClientWithServer(h1, "rpc", s)
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	eventsA := make(chan string)
+	subA, err := c.Subscribe(ctx, h1.ID(), "Feed", "Events", "a", eventsA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventsB := make(chan string)
+	subB, err := local.Subscribe(ctx, h1.ID(), "Feed", "Events", "b", eventsB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribe(ctx, h1.ID(), "Feed", "Events", "", make(chan string)); err == nil || err.Error() != "no topic" {
+		t.Error("expected the subscription to be rejected:", err)
+	}
+
+	sender := s.EventSender("Feed", "Events")
+	if n := sender.Subscribers(); n != 2 {
+		t.Fatal("unexpected number of subscribers:", n)
+	}
+	n := sender.SendMatching("for a", func(filter interface{}) bool {
+		return filter.(string) == "a"
+	})
+	if n != 1 {
+		t.Error("event sent to unexpected subscribers:", n)
+	}
+	if n := sender.Send("for all"); n != 2 {
+		t.Error("event sent to unexpected subscribers:", n)
+	}
+	for _, want := range []string{"for a", "for all"} {
+		if ev := <-eventsA; ev != want {
+			t.Errorf("expected %q, got %q", want, ev)
+		}
+	}
+	if ev := <-eventsB; ev != "for all" {
+		t.Error("unexpected event:", ev)
+	}
+
+	subA.Unsubscribe()
+	if _, ok := <-eventsA; ok {
+		t.Error("events channel not closed")
+	}
+	if err := subA.Err(); err != context.Canceled {
+		t.Error("unexpected error:", err)
+	}
+	if subB.Err() != nil {
+		t.Error("subscription should be active")
+	}
+	subB.Unsubscribe()
+
+	for i := 0; sender.Subscribers() > 0; i++ {
+		if i == 100 {
+			t.Fatal("subscribers were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type ResumableFeed struct {
+	cursors chan uint64
+}
+
+func (f *ResumableFeed) Events(ctx context.Context, topic string, r *struct{}) error {
+	cursor, _ := GetResumeCursor(ctx)
+	f.cursors <- cursor
+	return nil
+}
+
+func TestResubscribe(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithSubscriptionHistory(10))
+	feed := &ResumableFeed{cursors: make(chan uint64, 10)}
+	s.Register(feed)
+	sender := s.EventSender("ResumableFeed", "Events")
+	c := NewClient(h2, "rpc")
+	ctx := context.Background()
+
+	events := make(chan string, 10)
+	sub, err := c.Subscribe(ctx, h1.ID(), "ResumableFeed", "Events", "a", events, WithResubscribe(5, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	if cursor := <-feed.cursors; cursor != 0 {
+		t.Error("unexpected resume cursor:", cursor)
+	}
+	sender.Send("1")
+	if ev := <-events; ev != "1" {
+		t.Fatal("unexpected event:", ev)
+	}
+	cursor := sub.Cursor()
+	if cursor == 0 {
+		t.Fatal("cursor not set")
+	}
+
+	// The events sent while the connection is down are delivered once
+	// the subscription is resumed.
+	h2.Network().ClosePeer(h1.ID())
+	sender.Send("2")
+	sender.Send("3")
+	if resumed := <-feed.cursors; resumed != cursor {
+		t.Errorf("expected to resume from %d, got %d", cursor, resumed)
+	}
+	for _, want := range []string{"2", "3"} {
+		if ev := <-events; ev != want {
+			t.Errorf("expected %q, got %q", want, ev)
+		}
+	}
+	if sub.Cursor() != cursor+2 {
+		t.Error("unexpected cursor:", sub.Cursor())
+	}
+	if sub.Err() != nil {
+		t.Error("subscription should be active:", sub.Err())
+	}
+
+	// Resuming by hand from the last cursor only gets the new events.
+	local := NewClientWithServer(h1, "rpc", s)
+	localEvents := make(chan string, 10)
+	localSub, err := local.Subscribe(ctx, h1.ID(), "ResumableFeed", "Events", "a", localEvents, WithCursor(cursor+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localSub.Unsubscribe()
+	<-feed.cursors
+	if ev := <-localEvents; ev != "3" {
+		t.Error("unexpected event:", ev)
+	}
+	if localSub.Cursor() != cursor+2 {
+		t.Error("unexpected cursor:", localSub.Cursor())
+	}
+
+	// Without history, the events sent after the cursor are lost.
+	s2 := NewServer(h1, "rpc2")
+	s2.Register(feed)
+	c2 := NewClient(h2, "rpc2")
+	sub2, err := c2.Subscribe(ctx, h1.ID(), "ResumableFeed", "Events", "a", make(chan string, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Unsubscribe()
+	<-feed.cursors
+	s2.EventSender("ResumableFeed", "Events").Send("1")
+	s2.EventSender("ResumableFeed", "Events").Send("2")
+	for i := 0; sub2.Cursor() == 0; i++ {
+		if i == 100 {
+			t.Fatal("event not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = c2.Subscribe(ctx, h1.ID(), "ResumableFeed", "Events", "a", make(chan string), WithCursor(sub2.Cursor()-1))
+	if err != ErrEventsLost {
+		t.Error("expected ErrEventsLost:", err)
+	}
+	<-feed.cursors
+}
+
+func TestMultiCallDeadline(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+	h3, err := libp2p.New(
+		context.Background(),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h3.Close()
+	h2.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+
+	s1 := NewServer(h1, "rpc")
+	s1.Register(&Lag{delay: 5 * time.Second})
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Lag{})
+	s3 := NewServer(h3, "rpc")
+	s3.RegisterName("Lag", &Arith{})
+	unknown, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientWithServer(h2, "rpc", s2)
+
+	dests := []peer.ID{h1.ID(), h2.ID(), h3.ID(), unknown}
+	replies := make([]interface{}, len(dests))
+	for i := range replies {
+		replies[i] = new(string)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	sum := c.MultiCallDeadline(ctx, dests, "Lag", "Echo", "hi", replies)
+	if time.Since(start) > 2*time.Second {
+		t.Error("deadline not respected")
+	}
+
+	check := func(name string, got []peer.ID, want peer.ID) {
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("unexpected %s destinations: %v", name, got)
+		}
+	}
+	check("succeeded", sum.Succeeded, h2.ID())
+	check("timed out", sum.TimedOut, h1.ID())
+	check("failed", sum.Failed, h3.ID())
+	check("unreachable", sum.Unreachable, unknown)
+	if len(sum.Results) != len(dests) || sum.Results[1].Error != nil || *replies[1].(*string) != "hi" {
+		t.Error("unexpected results:", sum.Results)
+	}
+	for i, res := range sum.Results {
+		if res.Index != i || res.Peer != dests[i] {
+			t.Error("unexpected result:", res)
+		}
+	}
+
+	if b := callBudget(time.Second, 5, 2); b != time.Second/3 {
+		t.Error("unexpected budget:", b)
+	}
+	if b := callBudget(time.Second, 5, 0); b != time.Second {
+		t.Error("unexpected budget:", b)
+	}
+}
+
+func TestMultiMismatch(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	c := NewClient(h2, "rpc")
+	dests := []peer.ID{h1.ID(), h1.ID()}
+	ctxs := []context.Context{context.Background()}
+	replies := []interface{}{new(int), new(int)}
+
+	errs := c.MultiCall(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies)
+	if len(errs) != len(dests) || !IsClientError(errs[0]) || !IsClientError(errs[1]) {
+		t.Error("expected client errors:", errs)
+	}
+	for res := range c.MultiStream(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies) {
+		if !IsClientError(res.Error) {
+			t.Error("expected a client error:", res.Error)
+		}
+	}
+	sum := c.MultiCallDeadline(context.Background(), dests, "Arith", "Multiply", &Args{2, 3}, replies[:1])
+	if len(sum.Failed) != len(dests) {
+		t.Error("expected failed calls:", sum.Failed)
+	}
+	err := c.MultiGo(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies, make([]chan *Call, 2))
+	if !IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+
+	ctxs = append(ctxs, context.Background())
+	err = c.MultiGo(ctxs, dests, "Arith", "Multiply", &Args{2, 3}, replies, []chan *Call{nil, make(chan *Call)})
+	if !IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+	err = c.Go(h1.ID(), "Arith", "Multiply", &Args{2, 3}, new(int), make(chan *Call))
+	if !IsClientError(err) {
+		t.Error("expected a client error:", err)
+	}
+}
+
+func TestPeerFilters(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerPeerFilter(DenyPeers(h2.ID())))
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	c := NewClient(h2, "rpc")
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err == nil {
+		t.Error("expected the stream to be rejected")
+	}
+	c = NewClient(h2, "rpc", WithPipelining())
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err == nil {
+		t.Error("expected the stream to be rejected")
+	}
+
+	s2 := NewServer(h2, "rpc", WithServerPeerFilter(AllowPeers(h1.ID())))
+	s2.Register(&arith)
+	c = NewClientWithServer(h1, "rpc", s, WithClientPeerFilter(AllowPeers(h1.ID())))
+	err = c.Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if !IsClientError(err) || !strings.Contains(err.Error(), "not allowed") {
+		t.Error("expected a client error:", err)
+	}
+	// Local calls are not filtered.
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	c = NewClient(h1, "rpc", WithClientPeerFilter(DenyPeers(h1.ID())))
+	err = c.Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+}
+
+func TestCapabilityTokens(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	authority, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(h1, "rpc", WithTokenAuthority(pub))
+	var arith Arith
+	s.Register(&arith)
+
+	issue := func(key crypto.PrivKey, claims TokenClaims) *Token {
+		tok, err := IssueToken(key, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	tok := issue(authority, TokenClaims{Subject: h2.ID(), Scopes: []string{"Arith.Multiply"}})
+
+	var r int
+	c := NewClient(h2, "rpc", WithClientToken(tok))
+	err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if err != nil || r != 6 {
+		t.Error("unexpected result:", err, r)
+	}
+	err = c.Call(h1.ID(), "Arith", "Add", Args{2, 3}, &r)
+	if !IsAuthorizationError(err) {
+		t.Error("expected an authorization error:", err)
+	}
+	err = c.Call(h1.ID(), "Arith", "Add", Args{2, 3}, &r,
+		WithToken(issue(authority, TokenClaims{Subject: h2.ID(), Scopes: []string{"Arith.*"}})))
+	if err != nil || r != 5 {
+		t.Error("unexpected result:", err, r)
+	}
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range []*Token{
+		nil,
+		issue(other, TokenClaims{Subject: h2.ID(), Scopes: []string{"*"}}),
+		issue(authority, TokenClaims{Subject: h1.ID(), Scopes: []string{"*"}}),
+		issue(authority, TokenClaims{Subject: h2.ID(), Scopes: []string{"*"}, Expires: time.Now().Add(-time.Minute)}),
+	} {
+		err = NewClient(h2, "rpc").Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithToken(tok))
+		if !IsAuthorizationError(err) {
+			t.Error("expected an authorization error:", err)
+		}
+	}
+
+	tok = issue(authority, TokenClaims{Subject: h2.ID(), Scopes: []string{"*"}, Expires: time.Now().Add(time.Minute)})
+	err = NewClient(h2, "rpc").Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithToken(tok))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleRequestChecks(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	encode := func(args interface{}, opts ...CallOption) []byte {
+		data, err := EncodeRequest("Arith", "Multiply", args, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	ctx := context.Background()
+
+	s := NewServer(h1, "rpc", WithServerPeerFilter(DenyPeers(h2.ID())))
+	s.Register(&Arith{})
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3})); !IsAuthorizationError(err) {
+		t.Error("expected a filtered peer to be rejected:", err)
+	}
+	if err := s.HandleRequest(ctx, h1.ID(), encode(&Args{2, 3})); err != nil {
+		t.Error(err)
+	}
+
+	authority, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewServer(h1, "rpc", WithTokenAuthority(pub))
+	s.Register(&Arith{})
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3})); !IsAuthorizationError(err) {
+		t.Error("expected a request without token to be rejected:", err)
+	}
+	tok, err := IssueToken(authority, TokenClaims{Subject: h2.ID(), Scopes: []string{"Arith.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3}, WithToken(tok))); err != nil {
+		t.Error(err)
+	}
+	if err := s.HandleRequest(ctx, h1.ID(), encode(&Args{2, 3}, WithToken(tok))); !IsAuthorizationError(err) {
+		t.Error("expected a token of another peer to be rejected:", err)
+	}
+
+	s = NewServer(h1, "rpc", WithRequiredSignatures())
+	s.Register(&Arith{})
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3})); !IsAuthorizationError(err) {
+		t.Error("expected an unsigned request to be rejected:", err)
+	}
+
+	s = NewServer(h1, "rpc", WithAuthenticator(&secretAuthenticator{"s3cr3t"}))
+	s.Register(&Arith{})
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3})); !errors.Is(err, ErrUnauthenticated) {
+		t.Error("expected an unauthenticated request to be rejected:", err)
+	}
+
+	s = NewServer(h1, "rpc", WithArgsValidator(func(ctx context.Context, args interface{}) error {
+		if a, ok := args.(*Args); ok && a.B == 0 {
+			return FieldError{Field: "B", Message: "required"}
+		}
+		return nil
+	}))
+	s.Register(&Arith{})
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 0})); !errors.Is(err, ErrInvalidArgs) {
+		t.Error("expected invalid arguments to be rejected:", err)
+	}
+
+	// Methods run on the executor and within the timeout of the Server.
+	pool := NewWorkerPool(1, 1)
+	s = NewServer(h1, "rpc", WithExecutor(pool), WithMethodTimeout("Stubborn", "", 100*time.Millisecond))
+	s.Register(&Arith{})
+	stubborn := &Stubborn{release: make(chan struct{})}
+	s.Register(stubborn)
+	if err := s.HandleRequest(ctx, h2.ID(), encode(&Args{2, 3})); err != nil {
+		t.Error(err)
+	}
+	if st := pool.Stats(); st.Executed != 1 {
+		t.Error("the method did not run on the executor:", st.Executed)
+	}
+	data, err := EncodeRequest("Stubborn", "Wait", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.HandleRequest(ctx, h2.ID(), data); err != errServerDeadline {
+		t.Error("expected a server deadline error:", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("the request took too long")
+	}
+
+	// The pool is closed once the method is done.
+	close(stubborn.release)
+	for i := 0; pool.Stats().Executed < 2; i++ {
+		if i == 100 {
+			t.Fatal("the method did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pool.Close()
+}
+
+type auditLog struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	fail    bool
+}
+
+func (l *auditLog) WriteAudit(rec AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail {
+		return errors.New("disk full")
+	}
+	l.records = append(l.records, rec)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	log := &auditLog{}
+	s := NewServer(h1, "rpc", WithAuditSink(log, AuditConfig{HashArgs: true}))
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	c := NewClient(h2, "rpc")
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	c.Call(h1.ID(), "Arith", "Divide", &Args{2, 0}, &Quotient{})
+	local := NewClientWithServer(h1, "rpc", s)
+	if err := local.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushAudit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	log.mu.Lock()
+	records := log.records
+	log.mu.Unlock()
+	if len(records) != 3 {
+		t.Fatal("unexpected records:", records)
+	}
+	rec := records[0]
+	if rec.Peer != h2.ID() || rec.Service != "Arith" || rec.Method != "Multiply" || rec.Error != "" {
+		t.Error("unexpected record:", rec)
+	}
+	if rec.BytesReceived == 0 || rec.BytesSent == 0 || rec.Duration <= 0 || rec.Time.IsZero() {
+		t.Error("missing sizes or times:", rec)
+	}
+	if records[1].Error != "divide by zero" {
+		t.Error("unexpected error:", records[1].Error)
+	}
+	if len(rec.ArgsHash) != 32 || !bytes.Equal(rec.ArgsHash, records[2].ArgsHash) || bytes.Equal(rec.ArgsHash, records[1].ArgsHash) {
+		t.Error("unexpected argument hashes")
+	}
+	if records[2].Peer != "" {
+		t.Error("unexpected peer for local call:", records[2].Peer)
+	}
+
+	log.fail = true
+	c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	s.FlushAudit(context.Background())
+	if n := s.AuditDropped(); n != 1 {
+		t.Error("unexpected dropped records:", n)
+	}
+
+	sampled := &auditLog{}
+	s2 := NewServer(h2, "rpc", WithAuditSink(sampled, AuditConfig{SampleRate: 1e-9}))
+	s2.Register(&arith)
+	for i := 0; i < 10; i++ {
+		NewClient(h1, "rpc").Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	}
+	s2.FlushAudit(context.Background())
+	if len(sampled.records) != 0 {
+		t.Error("expected calls not to be sampled:", sampled.records)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithReflection())
+	var arith Arith
+	s.Register(&arith)
+	err := s.Document("Arith", ServiceDoc{
+		Description: "Arithmetic operations.",
+		Methods: map[string]MethodDoc{
+			"Divide": {Description: "Divides A by B.", ArgsSchema: `{"type": "object"}`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Document("Missing", ServiceDoc{}); err == nil {
+		t.Error("expected an error documenting a missing service")
+	}
+
+	var descs []ServiceDescription
+	c := NewClient(h2, "rpc")
+	err = c.Call(h1.ID(), ReflectionService, "Describe", struct{}{}, &descs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 2 || descs[0].Name != "Arith" || descs[1].Name != ReflectionService {
+		t.Fatal("unexpected services:", descs)
+	}
+	if descs[0].Description != "Arithmetic operations." {
+		t.Error("unexpected description:", descs[0].Description)
+	}
+	var divide, async *MethodDescription
+	for i, m := range descs[0].Methods {
+		switch m.Name {
+		case "Divide":
+			divide = &descs[0].Methods[i]
+		case "AsyncAdd":
+			async = &descs[0].Methods[i]
+		}
+	}
+	if divide == nil || divide.Description != "Divides A by B." || divide.ArgsSchema != `{"type": "object"}` ||
+		divide.ArgType != "*rpc.Args" || divide.ReplyType != "rpc.Quotient" {
+		t.Error("unexpected method description:", divide)
+	}
+	if async == nil || async.ReplyType != "" {
+		t.Error("unexpected method description:", async)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithServerMaxMessageSize(1024))
+	s.Register(&Lag{})
+	c := NewClient(h2, "rpc")
+
+	var out string
+	if err := c.Call(h1.ID(), "Lag", "Echo", strings.Repeat("a", 100), &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(h1.ID(), "Lag", "Echo", strings.Repeat("a", 2000), &out); err == nil {
+		t.Error("expected an error sending arguments over the limit")
+	}
+	raw := Raw(bytes.Repeat([]byte("a"), 2000))
+	if err := c.Call(h1.ID(), "Lag", "Echo", raw, &out); err == nil {
+		t.Error("expected an error sending raw arguments over the limit")
+	}
+
+	// Replies are limited by the client.
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Lag{})
+	c2 := NewClient(h1, "rpc", WithClientMaxMessageSize(1024))
+	if err := c2.Call(h2.ID(), "Lag", "Echo", strings.Repeat("a", 2000), &out); err == nil {
+		t.Error("expected an error receiving a reply over the limit")
+	}
+	if err := c2.Call(h2.ID(), "Lag", "Echo", "a", &out); err != nil || out != "a" {
+		t.Error("unexpected reply:", out, err)
+	}
+
+	// Servers are limited to DefaultMaxMessageSize by default, unless
+	// raised.
+	big := strings.Repeat("a", DefaultMaxMessageSize+1)
+	if err := c2.Call(h2.ID(), "Lag", "Echo", big, &out); err == nil {
+		t.Error("expected an error sending arguments over the default limit")
+	}
+	s3 := NewServer(h2, "rpc3", WithServerMaxMessageSize(2*DefaultMaxMessageSize))
+	s3.Register(&Lag{})
+	c3 := NewClient(h1, "rpc3", WithClientMaxMessageSize(2*DefaultMaxMessageSize))
+	if err := c3.Call(h2.ID(), "Lag", "Echo", big, &out); err != nil || len(out) != len(big) {
+		t.Error("unexpected reply:", len(out), err)
+	}
+}
+
+// fuzzConn is a connection reading the given data and discarding
+// anything written to it.
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (fuzzConn) Close() error { return nil }
+
+func FuzzServeConn(f *testing.F) {
+	req, err := EncodeRequest("Lag", "Echo", "hello")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(req)
+	f.Add(append(append([]byte{}, req...), req...))
+	f.Add(req[:len(req)-3])
+	header, err := MsgpackCodec.Marshal(ServiceID{Name: "Lag", Method: "Echo", Raw: true})
+	if err != nil {
+		f.Fatal(err)
+	}
+	// A raw value claiming to be huge.
+	f.Add(append(header, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01))
+	// A byte string claiming to be huge.
+	f.Add(append(header[:len(header):len(header)], 0xc6, 0xff, 0xff, 0xff, 0xff))
+	f.Add([]byte{0xdf, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{})
+
+	s := NewServer(nil, "", WithServerMaxMessageSize(1<<20))
+	s.Register(&Lag{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.ServeConn(ctx, fuzzConn{bytes.NewReader(data)})
+	})
+}
+
+type Locality struct{}
+
+type Where struct {
+	Peer       peer.ID
+	RemoteAddr string
+	Relayed    bool
+	Protocol   protocol.ID
+	Direction  network.Direction
+}
+
+func (Locality) Where(ctx context.Context, in struct{}, out *Where) error {
+	t := GetTransport(ctx)
+	if t == nil {
+		return errors.New("no transport")
+	}
+	*out = Where{t.Peer, t.RemoteAddr.String(), t.Relayed, t.Protocol, t.Stream.Direction}
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(Locality{})
+	c := NewClient(h2, "rpc")
+
+	var tr Where
+	if err := c.Call(h1.ID(), "Locality", "Where", struct{}{}, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Peer != h2.ID() {
+		t.Error("unexpected peer:", tr.Peer)
+	}
+	if tr.Protocol != "rpc" || tr.Relayed {
+		t.Error("unexpected transport:", tr.Protocol, tr.Relayed)
+	}
+	if tr.RemoteAddr == "" || tr.Direction != network.DirInbound {
+		t.Error("unexpected connection:", tr.RemoteAddr, tr.Direction)
+	}
+
+	// Local calls have no transport.
+	lc := NewClientWithServer(h1, "rpc", s)
+	if err := lc.Call(h1.ID(), "Locality", "Where", struct{}{}, &tr); err == nil {
+		t.Error("expected no transport for a local call")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	pool := NewWorkerPool(1, 4)
+	defer pool.Close()
+	s := NewServer(h1, "rpc", WithExecutor(pool))
+	s.Register(&Lag{delay: 200 * time.Millisecond})
+	c := NewClient(h2, "rpc")
+
+	// A single worker runs the calls one after another.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out string
+			if err := c.Call(h1.ID(), "Lag", "Echo", "a", &out); err != nil || out != "a" {
+				t.Error("unexpected reply:", out, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if st := pool.Stats(); st.Busy != 1 || st.Queued != 2 {
+		t.Errorf("unexpected pool stats while running: %+v", st)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 600*time.Millisecond {
+		t.Error("calls ran concurrently:", d)
+	}
+	st := pool.Stats()
+	if st.Workers != 1 || st.Executed != 3 || st.Busy != 0 || st.AvgQueueDelay == 0 {
+		t.Errorf("unexpected pool stats: %+v", st)
+	}
+
+	pool = NewWorkerPool(0, 0)
+	defer pool.Close()
+	if pool.Stats().Workers != runtime.GOMAXPROCS(0) {
+		t.Error("pools should default to GOMAXPROCS workers")
+	}
+}
+
+type Conflict struct{}
+
+func (Conflict) Put(ctx context.Context, key string, out *struct{}) error {
+	return WithErrorCode(fmt.Errorf("%s already exists", key), 409)
+}
+
+func (Conflict) PutAsync(ctx context.Context, key string, respond Respond) {
+	respond(nil, WithErrorCode(fmt.Errorf("%s already exists", key), 409))
+}
+
+func TestErrorCode(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(Conflict{})
+	c := NewClient(h2, "rpc")
+	lc := NewClientWithServer(h1, "rpc", s)
+
+	for _, method := range []string{"Put", "PutAsync"} {
+		for _, cl := range []*Client{c, lc} {
+			err := cl.Call(h1.ID(), "Conflict", method, "a", &struct{}{})
+			if ErrorCode(err) != 409 || err.Error() != "a already exists" {
+				t.Errorf("unexpected error from %s: %v (code %d)", method, err, ErrorCode(err))
+			}
+		}
+	}
+	if ErrorCode(errors.New("no code")) != 0 || WithErrorCode(nil, 1) != nil {
+		t.Error("errors without codes should have code 0")
+	}
+}
+
+type ConflictDetail struct {
+	Key     string
+	Version int
+}
+
+func TestErrorDetail(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Store", "Put", func(ctx context.Context, key string, r *struct{}) error {
+		err := WithErrorDetail(errors.New("conflict"), ConflictDetail{Key: key, Version: 3})
+		return WithErrorCode(err, 409)
+	})
+	c := NewClient(h2, "rpc")
+	lc := NewClientWithServer(h1, "rpc", s)
+
+	for _, cl := range []*Client{c, lc} {
+		for _, opts := range [][]CallOption{nil, {WithCodec(JSONCodec)}} {
+			err := cl.CallContext(context.Background(), h1.ID(), "Store", "Put", "a", &struct{}{}, opts...)
+			var detail ConflictDetail
+			if !ErrorDetail(err, &detail) || detail.Key != "a" || detail.Version != 3 {
+				t.Error("unexpected detail:", detail, err)
+			}
+			var ptr *ConflictDetail
+			if !ErrorDetail(err, &ptr) || ptr == nil || ptr.Key != "a" {
+				t.Error("unexpected detail:", ptr, err)
+			}
+			if err.Error() != "conflict" || ErrorCode(err) != 409 {
+				t.Error("unexpected error:", err)
+			}
+		}
+	}
+
+	var detail ConflictDetail
+	if ErrorDetail(errors.New("no detail"), &detail) || ErrorDetail(nil, &detail) || WithErrorDetail(nil, detail) != nil {
+		t.Error("errors without details should have none")
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	err := s.RegisterFunc("Math", "Add", func(ctx context.Context, args Args, r *int) error {
+		*r = args.A + args.B
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterFunc("Math", "Sub", func(ctx context.Context, args Args, respond Respond) {
+		respond(args.A-args.B, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register(&Arith{})
+
+	for _, fn := range []interface{}{
+		nil,
+		"Add",
+		func(args Args, r *int) error { return nil },
+		func(ctx context.Context, args Args, r int) error { return nil },
+		func(ctx context.Context, args Args, r *int) {},
+	} {
+		if err := s.RegisterFunc("Math", "Bad", fn); err == nil {
+			t.Errorf("expected an error registering %T", fn)
+		}
+	}
+	if err := s.RegisterFunc("Math", "Add", func(ctx context.Context, args Args, r *int) error { return nil }); err == nil {
+		t.Error("expected an error replacing a method")
+	}
+	if err := s.RegisterFunc("Arith", "Add", func(ctx context.Context, args Args, r *int) error { return nil }); err == nil {
+		t.Error("expected an error adding a function to a type")
+	}
+
+	c := NewClient(h2, "rpc")
+	lc := NewClientWithServer(h1, "rpc", s)
+	for _, cl := range []*Client{c, lc} {
+		var r int
+		if err := cl.Call(h1.ID(), "Math", "Add", Args{2, 3}, &r); err != nil || r != 5 {
+			t.Error("unexpected result:", r, err)
+		}
+		if err := cl.Call(h1.ID(), "Math", "Sub", Args{2, 3}, &r); err != nil || r != -1 {
+			t.Error("unexpected result:", r, err)
+		}
+	}
+}
+
+func TestMethodNames(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	err := s.RegisterName("arith", &Arith{}, WithMethodNames(SnakeCase), WithoutMethods("GimmeError"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(h2, "rpc")
+
+	var r int
+	if err := c.Call(h1.ID(), "arith", "async_add", Args{2, 3}, &r); err != nil || r != 5 {
+		t.Error("unexpected result:", r, err)
+	}
+	if err := c.Call(h1.ID(), "arith", "AsyncAdd", Args{2, 3}, &r); err == nil {
+		t.Error("expected an error calling the Go name of the method")
+	}
+	if err := c.Call(h1.ID(), "arith", "gimme_error", Args{2, 3}, &r); err == nil || err.Error() != "rpc: can't find method gimme_error" {
+		t.Error("expected excluded methods not to be found:", err)
+	}
+
+	err = s.Register(&Arith{}, WithMethodNames(func(string) string { return "Same" }))
+	if err == nil {
+		t.Error("expected an error for methods with the same name")
+	}
+
+	for name, expected := range map[string]string{
+		"Add":           "add",
+		"GetHTTPStatus": "get_http_status",
+		"ID":            "id",
+		"Sha256Sum":     "sha256_sum",
+	} {
+		if sc := SnakeCase(name); sc != expected {
+			t.Errorf("SnakeCase(%q) = %q, expected %q", name, sc, expected)
+		}
+	}
+}
+
+type LagV2 struct{}
+
+func (LagV2) Echo(ctx context.Context, in []string, out *[]string) error {
+	*out = in
+	return nil
+}
+
+func TestServiceVersions(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	if err := s.Register(&Lag{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Lag", LagV2{}, WithVersion("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Lag", LagV2{}, WithVersion("v2")); err == nil {
+		t.Error("expected an error registering a version twice")
+	}
+	c := NewClient(h2, "rpc")
+	lc := NewClientWithServer(h1, "rpc", s)
+
+	for _, cl := range []*Client{c, lc} {
+		var out string
+		if err := cl.Call(h1.ID(), "Lag", "Echo", "a", &out); err != nil || out != "a" {
+			t.Error("unexpected reply:", out, err)
+		}
+		var outs []string
+		if err := cl.Call(h1.ID(), "Lag", "Echo", []string{"a", "b"}, &outs, WithServiceVersion("v2")); err != nil || len(outs) != 2 {
+			t.Error("unexpected reply:", outs, err)
+		}
+		err := cl.Call(h1.ID(), "Lag", "Echo", "a", &out, WithServiceVersion("v3"))
+		if !errors.Is(err, ErrUnsupportedVersion) || !IsServerError(err) {
+			t.Error("expected ErrUnsupportedVersion:", err)
+		}
+		err = cl.Call(h1.ID(), "Missing", "Echo", "a", &out, WithServiceVersion("v3"))
+		if err == nil || errors.Is(err, ErrUnsupportedVersion) {
+			t.Error("expected an error for a missing service:", err)
+		}
+	}
+
+	descs := s.Describe()
+	if len(descs) != 2 || descs[0].Name != "Lag" || descs[0].Version != "" || descs[1].Version != "v2" {
+		t.Errorf("unexpected descriptions: %+v", descs)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	fallback := func(ctx context.Context, svcName, svcMethod string, decodeArgs func(interface{}) error) (interface{}, error) {
+		if svcMethod == "Fail" {
+			return nil, errors.New("fallback failed")
+		}
+		var args Args
+		if err := decodeArgs(&args); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%s.%s(%d, %d)", svcName, svcMethod, args.A, args.B), nil
+	}
+	s := NewServer(h1, "rpc", WithFallback(fallback))
+	s.Register(&Arith{})
+	c := NewClient(h2, "rpc")
+
+	for _, opts := range [][]CallOption{nil, {WithCodec(CBORCodec)}} {
+		var r string
+		err := c.CallContext(context.Background(), h1.ID(), "Remote", "Add", Args{2, 3}, &r, opts...)
+		if err != nil || r != "Remote.Add(2, 3)" {
+			t.Error("unexpected result:", r, err)
+		}
+		err = c.CallContext(context.Background(), h1.ID(), "Arith", "Sub", Args{2, 3}, &r, opts...)
+		if err != nil || r != "Arith.Sub(2, 3)" {
+			t.Error("unexpected result:", r, err)
+		}
+	}
+
+	var r string
+	err := c.Call(h1.ID(), "Remote", "Fail", Args{}, &r)
+	if err == nil || err.Error() != "fallback failed" {
+		t.Error("expected the error of the fallback:", err)
+	}
+
+	// Registered methods are preferred.
+	var n int
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{2, 3}, &n); err != nil || n != 5 {
+		t.Error("unexpected result:", n, err)
+	}
+
+	// Local calls are not handled by the fallback.
+	lc := NewClientWithServer(h1, "rpc", s)
+	if err := lc.Call(h1.ID(), "Remote", "Add", Args{2, 3}, &r); err == nil {
+		t.Error("expected an error calling an unknown service locally")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+	h3, _ := libp2p.New(
+		context.Background(),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/19997"),
+	)
+	defer h3.Close()
+	// Only the gateway (h1) knows how to reach h3.
+	h1.Peerstore().AddAddrs(h3.ID(), h3.Addrs(), peerstore.PermanentAddrTTL)
+
+	// The destination uses another codec, so that arguments and
+	// replies are decoded and encoded again by the gateway.
+	s3 := NewServer(h3, "rpc", WithServerCodec("rpc", JSONCodec), WithDeduplication(time.Minute))
+	s3.Register(&Arith{})
+	s3.RegisterFunc("Conflict", "Put", func(ctx context.Context, key string, r *int) error {
+		return WithErrorCode(WithErrorDetail(errors.New("conflict"), ConflictDetail{Key: key}), 409)
+	})
+
+	proxy := NewProxy(NewClient(h1, "rpc", WithClientCodec("rpc", JSONCodec)), WithForwardFilter(func(src, dest peer.ID) bool {
+		return dest != h2.ID()
+	}))
+	s1 := NewServer(h1, "rpc", WithProxy(proxy))
+	s1.Register(&Arith{})
+
+	c := NewClient(h2, "rpc")
+	via := ThroughProxy(h1.ID())
+	var r int
+	if err := c.Call(h3.ID(), "Arith", "Multiply", &Args{2, 3}, &r, via); err != nil || r != 6 {
+		t.Error("unexpected result:", r, err)
+	}
+	if err := c.Call(h3.ID(), "Arith", "Add", Args{2, 3}, &r, via, WithCodec(CBORCodec)); err != nil || r != 5 {
+		t.Error("unexpected result:", r, err)
+	}
+	// Calls for the gateway are handled by it.
+	if err := c.Call(h1.ID(), "Arith", "Add", Args{1, 1}, &r, via); err != nil || r != 2 {
+		t.Error("unexpected result:", r, err)
+	}
+
+	err := c.Call(h3.ID(), "Arith", "GimmeError", &Args{}, &r, via)
+	if err == nil || err.Error() != "an error" || IsServerError(err) {
+		t.Error("expected the error of the method:", err)
+	}
+	err = c.Call(h3.ID(), "Conflict", "Put", "key", &r, via)
+	var detail ConflictDetail
+	if ErrorCode(err) != 409 || !ErrorDetail(err, &detail) || detail.Key != "key" {
+		t.Error("expected the error code and detail of the method:", err, detail)
+	}
+	err = c.Call(h3.ID(), "Unknown", "Method", &Args{}, &r, via)
+	if !IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+
+	// Calls to filtered destinations are not forwarded.
+	err = c.Call(h2.ID(), "Arith", "Add", Args{1, 1}, &r, ThroughProxy(h1.ID()))
+	if !IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+	// Servers without a Proxy do not forward calls.
+	c1 := NewClient(h1, "rpc", WithClientCodec("rpc", JSONCodec))
+	err = c1.Call(h2.ID(), "Arith", "Add", Args{1, 1}, &r, ThroughProxy(h3.ID()))
+	if !IsServerError(err) {
+		t.Error("expected a server error:", err)
+	}
+	// Proxies without a forward filter do not forward calls either.
+	s2 := NewServer(h2, "rpc", WithProxy(NewProxy(NewClient(h2, "rpc"))))
+	s2.Register(&Arith{})
+	err = NewClient(h1, "rpc").Call(h3.ID(), "Arith", "Add", Args{1, 1}, &r, ThroughProxy(h2.ID()))
+	if !IsServerError(err) || !strings.Contains(err.Error(), "not forwarded") {
+		t.Error("expected a server error:", err)
+	}
+
+	// The idempotency keys of different callers do not collide at
+	// the destination.
+	h4, _ := libp2p.New(
+		context.Background(),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	defer h4.Close()
+	h4.Peerstore().AddAddrs(h1.ID(), h1.Addrs(), peerstore.PermanentAddrTTL)
+	key := WithIdempotencyKey("same")
+	if err := c.Call(h3.ID(), "Arith", "Add", Args{1, 2}, &r, via, key); err != nil || r != 3 {
+		t.Error("unexpected result:", r, err)
+	}
+	if err := NewClient(h4, "rpc").Call(h3.ID(), "Arith", "Add", Args{2, 2}, &r, via, key); err != nil || r != 4 {
+		t.Error("expected the reply of another caller not to be replayed:", r, err)
+	}
+	if err := c.Call(h3.ID(), "Arith", "Add", Args{2, 2}, &r, via, key); err != nil || r != 3 {
+		t.Error("expected the reply of the first call to be replayed:", r, err)
+	}
+}
+
+func TestRemotePeer(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Peers", "Caller", func(ctx context.Context, in struct{}, out *peer.ID) error {
+		p, ok := GetRemotePeer(ctx)
+		if !ok {
+			return errors.New("no remote peer")
+		}
+		key := GetRemotePublicKey(ctx)
+		if key == nil {
+			return errors.New("no public key")
+		}
+		if id, err := peer.IDFromPublicKey(key); err != nil || id != p {
+			return errors.New("the public key does not match the peer")
+		}
+		*out = p
+		return nil
+	})
+
+	var p peer.ID
+	c := NewClient(h2, "rpc")
+	if err := c.Call(h1.ID(), "Peers", "Caller", struct{}{}, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != h2.ID() {
+		t.Error("unexpected remote peer:", p)
+	}
+
+	// Local calls are made by the peer of the server.
+	c = NewClientWithServer(h1, "rpc", s)
+	if err := c.Call(h1.ID(), "Peers", "Caller", struct{}{}, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != h1.ID() {
+		t.Error("unexpected remote peer:", p)
+	}
+
+	if _, ok := GetRemotePeer(context.Background()); ok {
+		t.Error("expected no remote peer")
+	}
+}
+
+func TestLocalCallMode(t *testing.T) {
+	s := NewServer(nil, "")
+	var replies []*Args
+	s.RegisterFunc("Local", "Swap", func(ctx context.Context, in *Args, out *Args) error {
+		replies = append(replies, out)
+		out.A, out.B = in.B, in.A
+		in.A = 0
+		return nil
+	})
+
+	args := &Args{1, 2}
+	var r Args
+	c := NewClientWithServer(nil, "", s)
+	if err := c.Call("", "Local", "Swap", args, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != (Args{2, 1}) || args.A != 1 || replies[0] == &r {
+		t.Error("expected copies to be passed to the method:", r, args)
+	}
+
+	r = Args{}
+	c = NewClientWithServer(nil, "", s, WithLocalCallMode(LocalDirect))
+	if err := c.Call("", "Local", "Swap", args, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != (Args{2, 1}) || args.A != 0 || replies[1] != &r {
+		t.Error("expected the values of the caller to be passed to the method:", r, args)
+	}
+
+	// Deep copies do not share the values pointed to with the caller.
+	s.RegisterFunc("Local", "Append", func(ctx context.Context, in []int, out *[]int) error {
+		in[0] = 0
+		*out = append(in, 4)
+		return nil
+	})
+	s.RegisterFunc("Local", "AppendAsync", func(ctx context.Context, in []int, respond Respond) {
+		in[0] = 0
+		respond(append(in, 4), nil)
+	})
+	for _, method := range []string{"Append", "AppendAsync"} {
+		in := []int{1, 2, 3}
+		var out []int
+		c = NewClientWithServer(nil, "", s, WithLocalCallMode(LocalDeepCopy))
+		if err := c.Call("", "Local", method, in, &out); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(in) != "[1 2 3]" || fmt.Sprint(out) != "[0 2 3 4]" {
+			t.Error("unexpected values:", in, out)
+		}
+		c = NewClientWithServer(nil, "", s)
+		if err := c.Call("", "Local", method, in, &out); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(in) != "[0 2 3]" {
+			t.Error("expected the arguments to be shared:", in)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.RegisterFunc("Timer", "Sleep", func(ctx context.Context, d time.Duration, r *struct{}) error {
+		time.Sleep(d)
+		return nil
+	})
+	// The peer reads requests but never answers.
+	h1.SetStreamHandler("stall", func(s network.Stream) {
+		io.Copy(io.Discard, s)
+	})
+
+	// Calls last as long as heartbeats arrive.
+	c := NewClient(h2, "rpc")
+	opt := WithHeartbeat(50*time.Millisecond, 200*time.Millisecond)
+	if err := c.Call(h1.ID(), "Timer", "Sleep", 500*time.Millisecond, &struct{}{}, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewClient(h2, "stall")
+	start := time.Now()
+	err := c.Call(h1.ID(), "Timer", "Sleep", time.Millisecond, &struct{}{}, opt)
+	if err == nil || !strings.Contains(err.Error(), "no heartbeat") {
+		t.Fatal("expected a heartbeat error:", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("the missing heartbeat was detected late:", d)
+	}
+}
+
+func TestLogSubsystems(t *testing.T) {
+	s := NewServer(nil, "")
+	c := NewClient(nil, "")
+	if s.logger != serverLogger || s.streamLogger != streamLogger || c.logger != clientLogger || c.streamLogger != streamLogger {
+		t.Error("expected the loggers of the subsystems")
+	}
+	var l testLogger
+	c = NewClient(nil, "", WithClientLogger(&l))
+	if c.logger != &l || c.streamLogger != &l {
+		t.Error("expected the given logger for all the subsystems")
+	}
+
+	if err := SetLogLevel(StreamLogSubsystem, "debug"); err != nil {
+		t.Error(err)
+	}
+	if err := SetLogLevel(ClientLogSubsystem, "loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if err := SetLogLevel("p2p-gorpc-other", "debug"); err == nil {
+		t.Error("expected an error for an unknown subsystem")
+	}
+}
+
+func TestNoSuchServiceSuggestions(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+	s.Register(&Feed{})
+	remote := NewClient(h2, "rpc")
+	local := NewClientWithServer(h1, "rpc", s)
+
+	for _, c := range []*Client{remote, local} {
+		var r int
+		err := c.Call(h1.ID(), "Arth", "Multiply", &Args{2, 3}, &r)
+		if !errors.Is(err, ErrNoSuchService) || errors.Is(err, ErrNoSuchMethod) || !IsServerError(err) {
+			t.Error("expected ErrNoSuchService:", err)
+		}
+		if sg := Suggestions(err); len(sg) != 1 || sg[0] != "Arith" {
+			t.Error("unexpected suggestions:", sg)
+		}
+		if err.Error() != "rpc: can't find service Arth (did you mean Arith?)" {
+			t.Error("unexpected message:", err)
+		}
+
+		err = c.Call(h1.ID(), "Arith", "multiply", &Args{2, 3}, &r)
+		if !errors.Is(err, ErrNoSuchMethod) {
+			t.Error("expected ErrNoSuchMethod:", err)
+		}
+		if sg := Suggestions(err); len(sg) != 1 || sg[0] != "Multiply" {
+			t.Error("unexpected suggestions:", sg)
+		}
+
+		err = c.Call(h1.ID(), "Nothing", "Multiply", &Args{2, 3}, &r)
+		if !errors.Is(err, ErrNoSuchService) || Suggestions(err) != nil || err.Error() != "rpc: can't find service Nothing" {
+			t.Error("expected no suggestions:", err)
+		}
+	}
+
+	// Denied peers get no suggestions.
+	s2 := NewServer(h1, "rpc2", WithAuthorizeFunc(func(pid peer.ID, svc, method string) bool {
+		return pid != h2.ID()
+	}))
+	s2.Register(&Arith{})
+	var r int
+	err := NewClient(h2, "rpc2").Call(h1.ID(), "Arth", "Multiply", &Args{2, 3}, &r)
+	if !IsAuthorizationError(err) || Suggestions(err) != nil || strings.Contains(err.Error(), "Arith") {
+		t.Error("expected an authorization error without suggestions:", err)
+	}
+	if _, err := NewClient(h2, "rpc2").Subscribe(context.Background(), h1.ID(), "Fed", "Events", "a", make(chan string)); !IsAuthorizationError(err) {
+		t.Error("expected an authorization error:", err)
+	}
+
+	if d := editDistance("kitten", "sitting"); d != 3 {
+		t.Error("unexpected distance:", d)
+	}
+}
+
+type Range struct {
+	Min, Max int
+}
+
+func (r *Range) Validate() error {
+	if r.Min > r.Max {
+		return FieldErrors{{"Min", "greater than Max"}}
+	}
+	return nil
+}
+
+func TestArgsValidation(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithArgsValidator(func(ctx context.Context, args interface{}) error {
+		if a, ok := args.(*Args); ok && a.B == 0 {
+			return FieldError{Field: "B", Message: "required"}
+		}
+		if a, ok := args.(Args); ok && a.A < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}))
+	s.Register(&Arith{})
+	ran := false
+	s.RegisterFunc("Ranges", "Size", func(ctx context.Context, r Range, size *int) error {
+		ran = true
+		*size = r.Max - r.Min
+		return nil
+	})
+
+	for _, c := range []*Client{NewClient(h2, "rpc"), NewClientWithServer(h1, "rpc", s)} {
+		var r int
+		err := c.Call(h1.ID(), "Ranges", "Size", Range{3, 1}, &r)
+		if !errors.Is(err, ErrInvalidArgs) || !IsClientError(err) || ran {
+			t.Fatal("expected ErrInvalidArgs:", err)
+		}
+		if f := InvalidFields(err); len(f) != 1 || f[0] != (FieldError{"Min", "greater than Max"}) {
+			t.Error("unexpected fields:", f)
+		}
+		if err.Error() != "rpc: invalid arguments: Min: greater than Max" {
+			t.Error("unexpected message:", err)
+		}
+		if err := c.Call(h1.ID(), "Ranges", "Size", Range{1, 3}, &r); err != nil || r != 2 {
+			t.Error("unexpected result:", r, err)
+		}
+
+		err = c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 0}, &r)
+		if f := InvalidFields(err); !errors.Is(err, ErrInvalidArgs) || len(f) != 1 || f[0].Field != "B" {
+			t.Error("expected an invalid field:", err, f)
+		}
+		err = c.Call(h1.ID(), "Arith", "Add", Args{-1, 2}, &r)
+		if !errors.Is(err, ErrInvalidArgs) || InvalidFields(err) != nil || err.Error() != "rpc: invalid arguments: negative" {
+			t.Error("expected an invalid argument:", err)
+		}
+		ran = false
+	}
+}
+
+func TestReplyHook(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	s.Register(&Arith{})
+	hooks := WithClientHooks(Hooks{
+		OnReply: func(ev CallEvent, reply interface{}) error {
+			r, ok := reply.(*int)
+			if !ok || ev.Service != "Arith" {
+				return nil
+			}
+			if *r > 100 {
+				return fmt.Errorf("%s.%s: %d is out of range", ev.Service, ev.Method, *r)
+			}
+			*r = -*r
+			return nil
+		},
+	})
+
+	for _, c := range []*Client{NewClient(h2, "rpc", hooks), NewClientWithServer(h1, "rpc", s, hooks)} {
+		var r int
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != -6 {
+			t.Error("expected a normalized reply:", r, err)
+		}
+		err := c.Call(h1.ID(), "Arith", "Multiply", &Args{20, 30}, &r)
+		if err == nil || err.Error() != "Arith.Multiply: 600 is out of range" {
+			t.Error("expected the error of the hook:", err)
+		}
+		if err := c.Call(h1.ID(), "Arith", "Divide", &Args{1, 0}, &Quotient{}); err == nil || err.Error() != "divide by zero" {
+			t.Error("expected the error of the method:", err)
+		}
+	}
+}
+
+// testReporter records the bytes reported per stream. The methods of the
+// embedded nil Reporter panic, as they should not be called.
+type testReporter struct {
+	metrics.Reporter
+	mu   sync.Mutex
+	sent map[protocol.ID]map[peer.ID]int64
+	recv map[protocol.ID]map[peer.ID]int64
+}
+
+func newTestReporter() *testReporter {
+	return &testReporter{
+		sent: make(map[protocol.ID]map[peer.ID]int64),
+		recv: make(map[protocol.ID]map[peer.ID]int64),
+	}
+}
+
+func (r *testReporter) log(m map[protocol.ID]map[peer.ID]int64, size int64, proto protocol.ID, p peer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m[proto] == nil {
+		m[proto] = make(map[peer.ID]int64)
+	}
+	m[proto][p] += size
+}
+
+func (r *testReporter) LogSentMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	r.log(r.sent, size, proto, p)
+}
+
+func (r *testReporter) LogRecvMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	r.log(r.recv, size, proto, p)
+}
+
+func (r *testReporter) bytes(m map[protocol.ID]map[peer.ID]int64, proto protocol.ID, p peer.ID) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return m[proto][p]
+}
+
+func TestBandwidthReporter(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	sr, cr := newTestReporter(), newTestReporter()
+	s := NewServer(h1, "rpc", WithServerBandwidthReporter(sr))
+	c := NewClient(h2, "rpc", WithClientBandwidthReporter(cr))
+	var arith Arith
+	s.Register(&arith)
+
+	var r int
+	for i := 0; i < 2; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var q Quotient
+	if err := c.Call(h1.ID(), "Arith", "Divide", &Args{7, 2}, &q); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mul := BandwidthProtocol("rpc", "Arith", "Multiply")
+	div := BandwidthProtocol("rpc", "Arith", "Divide")
+	if mul != "rpc/Arith.Multiply" {
+		t.Error("unexpected protocol:", mul)
+	}
+	for _, proto := range []protocol.ID{mul, div} {
+		sent, recv := cr.bytes(cr.sent, proto, h1.ID()), cr.bytes(cr.recv, proto, h1.ID())
+		if sent == 0 || recv == 0 {
+			t.Errorf("%s: expected the client to report the bytes of the calls: %d %d", proto, sent, recv)
+		}
+		if n := sr.bytes(sr.recv, proto, h2.ID()); n != sent {
+			t.Errorf("%s: the server received %d bytes, the client sent %d", proto, n, sent)
+		}
+		if n := sr.bytes(sr.sent, proto, h2.ID()); n != recv {
+			t.Errorf("%s: the server sent %d bytes, the client received %d", proto, n, recv)
+		}
+	}
+	if cr.bytes(cr.sent, mul, h1.ID()) <= cr.bytes(cr.sent, div, h1.ID()) {
+		t.Error("expected the bytes of both calls to Multiply to be reported")
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	if err := s.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Arith", &Arith{}, WithVersion("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	var r int
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unregister("Arith"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unregister("Arith"); err == nil {
+		t.Error("expected an error unregistering a service twice")
+	}
+	err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r)
+	if !errors.Is(err, ErrNoSuchService) {
+		t.Error("expected ErrNoSuchService:", err)
+	}
+	if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r, WithServiceVersion("2")); err != nil {
+		t.Error("expected the other version to remain registered:", err)
+	}
+	if err := s.Register(&Arith{}); err != nil {
+		t.Error("expected the service to be registered again:", err)
+	}
+
+	// Services are registered and unregistered while being called.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.RegisterName("Churn", &Arith{})
+			s.Unregister("Churn")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := c.Call(h1.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil {
+			t.Error(err)
+		}
+		err := c.Call(h1.ID(), "Churn", "Multiply", &Args{2, 3}, &r)
+		if err != nil && !errors.Is(err, ErrNoSuchService) {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// secretAuthenticator accepts the clients answering its challenges with
+// the challenge prefixed by the secret.
+type secretAuthenticator struct {
+	secret string
+}
+
+func (sa *secretAuthenticator) Challenge(p peer.ID) ([]byte, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func (sa *secretAuthenticator) Authenticate(ctx context.Context, p peer.ID, challenge, credentials []byte) (interface{}, error) {
+	if !bytes.Equal(credentials, append([]byte(sa.secret), challenge...)) {
+		return nil, errors.New("wrong secret")
+	}
+	return "user-" + sa.secret, nil
+}
+
+type secretCredentials string
+
+func (sc secretCredentials) Credentials(ctx context.Context, p peer.ID, challenge []byte) ([]byte, error) {
+	return append([]byte(sc), challenge...), nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc", WithAuthenticator(&secretAuthenticator{"s3cr3t"}))
+	s.RegisterFunc("Auth", "Whoami", func(ctx context.Context, in struct{}, out *string) error {
+		id, ok := GetIdentity(ctx)
+		if !ok {
+			return errors.New("no identity")
+		}
+		*out = id.(string)
+		return nil
+	})
+
+	for _, opts := range [][]ClientOption{
+		{WithCredentials(secretCredentials("s3cr3t"))},
+		{WithCredentials(secretCredentials("s3cr3t")), WithPipelining()},
+	} {
+		c := NewClient(h2, "rpc", opts...)
+		for i := 0; i < 2; i++ {
+			var id string
+			if err := c.Call(h1.ID(), "Auth", "Whoami", struct{}{}, &id); err != nil {
+				t.Fatal(err)
+			}
+			if id != "user-s3cr3t" {
+				t.Error("unexpected identity:", id)
+			}
+		}
+	}
+
+	for _, opts := range [][]ClientOption{
+		nil,
+		{WithCredentials(secretCredentials("wrong"))},
+		{WithCredentials(StaticCredentials("s3cr3t"))},
+		{WithCredentials(secretCredentials("wrong")), WithPipelining()},
+	} {
+		c := NewClient(h2, "rpc", opts...)
+		var id string
+		err := c.Call(h1.ID(), "Auth", "Whoami", struct{}{}, &id)
+		if !errors.Is(err, ErrUnauthenticated) || !IsAuthorizationError(err) {
+			t.Errorf("expected ErrUnauthenticated: %T %v", err, err)
+		}
+	}
+
+	// Servers without an Authenticator accept any credentials.
+	s2 := NewServer(h2, "rpc")
+	s2.Register(&Arith{})
+	c := NewClient(h1, "rpc", WithCredentials(StaticCredentials("token")))
+	var r int
+	if err := c.Call(h2.ID(), "Arith", "Multiply", &Args{2, 3}, &r); err != nil || r != 6 {
+		t.Error("expected the call to succeed:", r, err)
+	}
+}
+
+func TestMultiCall(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClientWithServer(h2, "rpc", s)
+	var arith Arith
+	s.Register(&arith)
+
+	replies := make([]int, 2, 2)
+	ctxs := make([]context.Context, 2, 2)
+	repliesInt := make([]interface{}, 2, 2)
+	for i := range repliesInt {
+		repliesInt[i] = &replies[i]
+		ctxs[i] = context.Background()
+	}
+
+	errs := c.MultiCall(
+		ctxs,
+		[]peer.ID{h1.ID(), h2.ID()},
+		"Arith",
+		"Multiply",
+		&Args{2, 3},
+		repliesInt,
+	)
+
+	if len(errs) != 2 {
+		t.Fatal("expected two errs")
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, reply := range replies {
+		if reply != 6 {
+			t.Error("expected 2*3=6")
+		}
+	}
+}
+
+func TestMultiCallContext(t *testing.T) {
+	h1, h2 := makeRandomNodes()
+	defer h1.Close()
+	defer h2.Close()
+
+	s := NewServer(h1, "rpc")
+	c := NewClient(h2, "rpc")
+	s.RegisterFunc("Timer", "Sleep", func(ctx context.Context, d time.Duration, r *struct{}) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	dests := []peer.ID{h1.ID(), h1.ID(), h1.ID(), h1.ID()}
+	replies := make([]interface{}, len(dests))
+	for i := range replies {
+		replies[i] = &struct{}{}
+	}
+
+	// The timeout applies to every call, not to all of them.
+	errs := c.MultiCallContext(context.Background(), dests, "Timer", "Sleep", 80*time.Millisecond, replies,
+		WithTimeout(time.Second/4), WithConcurrency(1))
+	for i, err := range errs {
+		if err != nil {
+			t.Error(i, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	errs = c.MultiCallContext(ctx, dests, "Timer", "Sleep", 5*time.Second, replies)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error("the calls were not cancelled with the context:", d)
+	}
+	for i, err := range errs {
+		if err == nil {
+			t.Error(i, "expected the cancelled call to fail")
+		}
+	}
+
+	errs = c.MultiCallContext(context.Background(), dests, "Timer", "Sleep", time.Millisecond, replies[:1])
+	for _, err := range errs {
+		if !IsClientError(err) {
+			t.Error("expected a client error:", err)
 		}
 	}
 }
@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// A session is a stream over which several requests are sent one after
+// another, each of them followed by its response, as opposed to the
+// regular mode of operation where a new stream is opened for every
+// request.
+
+// serveSession handles the requests arriving on a session stream until
+// it is closed or the context is cancelled.
+func (server *Server) serveSession(ctx context.Context, s *streamWrap) error {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.reset()
+		case <-finished:
+		}
+	}()
+
+	for {
+		s.reqStart = s.consumed()
+		var svcID ServiceID
+		err := s.readHeader(&svcID)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if svcID.Ping {
+			if err := servePing(s, svcID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = server.serveRequest(ctx, s, svcID, "", true, nil)
+		if err != nil {
+			server.logger.Errorw("error handling RPC", "peer", s.remotePeer(), "service", svcID.Name, "method", svcID.Method, "error", err)
+			resp := newErrorResponse(svcID, err)
+			if err := sendResponse(s, resp, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errSessionClosed is returned when trying to use a session which
+// has failed before.
+var errSessionClosed = errors.New("rpc: session is closed")
+
+// streamCaller performs calls over a session stream. Calls are sent one
+// at a time. Because requests cannot be cancelled individually, the
+// cancellation of a call context closes the session.
+type streamCaller struct {
+	mu       sync.Mutex
+	s        *streamWrap
+	closed   bool
+	lastUsed time.Time
+
+	// stop is closed when the session is closed.
+	stop chan struct{}
+}
+
+func newStreamCaller(s *streamWrap) *streamCaller {
+	return &streamCaller{
+		s:        s,
+		lastUsed: time.Now(),
+		stop:     make(chan struct{}),
+	}
+}
+
+// call sends the call request and reads the response into it. Errors
+// sent by the server are set in the call, while the returned error
+// indicates a failure of the session, which is closed.
+func (sc *streamCaller) call(call *Call) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closed {
+		return newClientError(errSessionClosed)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-call.ctx.Done():
+			// The context is also cancelled when the call
+			// finishes, in which case stop is closed already.
+			select {
+			case <-stop:
+			default:
+				sc.s.reset()
+			}
+		case <-stop:
+		}
+	}()
+
+	err := sc.roundTrip(call)
+	sc.lastUsed = time.Now()
+	if err != nil {
+		sc.markClosed()
+		sc.s.reset()
+		if ctxErr := call.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+	}
+	return err
+}
+
+func (sc *streamCaller) roundTrip(call *Call) error {
+	sent, received := sc.s.cw.count(), sc.s.cr.count()
+	defer func() {
+		call.setInfo(func(info *CallInfo) {
+			info.BytesSent = sc.s.cw.count() - sent
+			info.BytesReceived = sc.s.cr.count() - received
+		})
+	}()
+	if err := sc.s.writeRequest(call.SvcID, call.Args, call.signKey, call.compressAbove); err != nil {
+		return newClientError(err)
+	}
+	if err := sc.s.w.Flush(); err != nil {
+		return newClientError(err)
+	}
+	return receiveResponse(sc.s, call)
+}
+
+// close closes the session stream.
+func (sc *streamCaller) close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.markClosed()
+	return sc.s.rwc.Close()
+}
+
+// markClosed marks the session as closed. It must be called
+// with the lock held.
+func (sc *streamCaller) markClosed() {
+	if !sc.closed {
+		sc.closed = true
+		close(sc.stop)
+	}
+}
+
+// isClosed returns true when the session cannot be used anymore.
+func (sc *streamCaller) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
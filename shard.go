@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultShardReplicas is the default number of points of every peer on
+// the hash ring of a ShardedClient.
+const DefaultShardReplicas = 64
+
+// ShardedClient routes calls to the peer owning their key (i.e. a CID)
+// among a set of peers, with consistent hashing: every peer is placed at
+// several points on a ring of hashes, and keys belong to the peer at the
+// first point after their hash. When peers join or leave, only the keys
+// of the points involved change owners.
+type ShardedClient struct {
+	client   *Client
+	replicas int
+
+	mu    sync.RWMutex
+	peers map[peer.ID]struct{}
+	ring  []ringPoint
+}
+
+// ringPoint is a point of a peer on the hash ring.
+type ringPoint struct {
+	hash uint64
+	peer peer.ID
+}
+
+// ShardOption allows for functional setting of options on a
+// ShardedClient.
+type ShardOption func(*ShardedClient)
+
+// WithShardReplicas sets the number of points of every peer on the hash
+// ring, DefaultShardReplicas by default. More points spread the keys more
+// evenly across peers, at the cost of memory.
+func WithShardReplicas(n int) ShardOption {
+	return func(sc *ShardedClient) {
+		if n > 0 {
+			sc.replicas = n
+		}
+	}
+}
+
+// NewShardedClient returns a ShardedClient making calls with the given
+// Client to the given peers.
+func NewShardedClient(c *Client, peers []peer.ID, opts ...ShardOption) *ShardedClient {
+	sc := &ShardedClient{
+		client:   c,
+		replicas: DefaultShardReplicas,
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	sc.SetPeers(peers)
+	return sc
+}
+
+// ringHash hashes keys and peer points onto the ring.
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// rebuild recomputes the ring for the current peers. It must be called
+// with the lock held.
+func (sc *ShardedClient) rebuild() {
+	ring := make([]ringPoint, 0, len(sc.peers)*sc.replicas)
+	for p := range sc.peers {
+		for i := 0; i < sc.replicas; i++ {
+			ring = append(ring, ringPoint{
+				hash: ringHash(strconv.Itoa(i) + "/" + string(p)),
+				peer: p,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].peer < ring[j].peer
+	})
+	sc.ring = ring
+}
+
+// SetPeers replaces the set of peers keys are routed to.
+func (sc *ShardedClient) SetPeers(peers []peer.ID) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.peers = make(map[peer.ID]struct{}, len(peers))
+	for _, p := range peers {
+		sc.peers[p] = struct{}{}
+	}
+	sc.rebuild()
+}
+
+// AddPeer adds a peer to the set of peers keys are routed to.
+func (sc *ShardedClient) AddPeer(p peer.ID) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.peers[p]; ok {
+		return
+	}
+	sc.peers[p] = struct{}{}
+	sc.rebuild()
+}
+
+// RemovePeer removes a peer from the set of peers keys are routed to.
+// Its keys are routed to the remaining peers from then on.
+func (sc *ShardedClient) RemovePeer(p peer.ID) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.peers[p]; !ok {
+		return
+	}
+	delete(sc.peers, p)
+	sc.rebuild()
+}
+
+// Peers returns the set of peers keys are routed to.
+func (sc *ShardedClient) Peers() []peer.ID {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	peers := make([]peer.ID, 0, len(sc.peers))
+	for p := range sc.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// PeersFor returns the first n different peers following the given key
+// on the ring, the owner of the key first, i.e. to store replicas of the
+// value of the key on them. Fewer peers are returned when there are not
+// enough of them.
+func (sc *ShardedClient) PeersFor(key string, n int) []peer.ID {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if n > len(sc.peers) {
+		n = len(sc.peers)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(sc.ring), func(i int) bool {
+		return sc.ring[i].hash >= h
+	})
+	peers := make([]peer.ID, 0, n)
+	seen := make(map[peer.ID]struct{}, n)
+	for i := 0; i < len(sc.ring) && len(peers) < n; i++ {
+		p := sc.ring[(start+i)%len(sc.ring)].peer
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// PeerFor returns the peer owning the given key, or false when there are
+// no peers.
+func (sc *ShardedClient) PeerFor(key string) (peer.ID, bool) {
+	peers := sc.PeersFor(key, 1)
+	if len(peers) == 0 {
+		return "", false
+	}
+	return peers[0], true
+}
+
+// Call performs a Call() to the peer owning the given key.
+func (sc *ShardedClient) Call(
+	key string,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) error {
+	return sc.CallContext(context.Background(), key, svcName, svcMethod, args, reply, opts...)
+}
+
+// CallContext performs a CallContext() to the peer owning the given key.
+// The owner is looked up for every call, so calls follow the changes of
+// the set of peers.
+func (sc *ShardedClient) CallContext(
+	ctx context.Context,
+	key string,
+	svcName, svcMethod string,
+	args, reply interface{},
+	opts ...CallOption,
+) error {
+	dest, ok := sc.PeerFor(key)
+	if !ok {
+		return &clientError{"no peers to route the call to"}
+	}
+	return sc.client.CallContext(ctx, dest, svcName, svcMethod, args, reply, opts...)
+}
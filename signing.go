@@ -0,0 +1,279 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Requests and responses can be signed with the key of the peer sending
+// them, regardless of the security of the transport (see
+// WithRequestSigning). The signature is carried in the header and covers
+// the header itself, without the signature, and the body, encoded as it
+// would be sent unsigned. Signed bodies are sent as a byte string so that
+// the receiver can verify them before decoding them. Servers answer signed
+// requests with signed responses, which echo the signature of the request
+// in their Service field, binding them to it.
+
+// SignedMessage is a signed request or response, which can be verified
+// at any time, i.e. to keep verifiable records of who asked for what.
+type SignedMessage struct {
+	// Signer is the peer which signed the message.
+	Signer peer.ID
+	// Key is the public key of the signer.
+	Key crypto.PubKey
+	// Data holds the signed contents: the header of the message
+	// without its signature and the encoded body, encoded with
+	// CBORCodec.
+	Data      []byte
+	Signature []byte
+}
+
+// Verify checks that the message was signed by the key of the signer.
+func (m *SignedMessage) Verify() error {
+	if !m.Signer.MatchesPublicKey(m.Key) {
+		return errors.New("the key does not belong to the signer")
+	}
+	ok, err := m.Key.Verify(m.Data, m.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// WithRequestSigning makes the Client sign the requests of its remote
+// calls with the key of its host, and require signed responses, whose
+// signature is verified before decoding them.
+func WithRequestSigning() ClientOption {
+	return func(c *Client) {
+		c.signing = true
+	}
+}
+
+// WithSignedResponse makes the call fill in the given SignedMessage with
+// its signed response, when the Client signs its requests (see
+// WithRequestSigning).
+func WithSignedResponse(m *SignedMessage) CallOption {
+	return func(o *callOptions) {
+		o.signedResponse = m
+	}
+}
+
+// WithRequiredSignatures makes the Server reject remote requests which
+// are not signed (see WithRequestSigning) with an authorization error.
+// Signed requests are verified, and answered with signed responses,
+// regardless of this option.
+func WithRequiredSignatures() ServerOption {
+	return func(s *Server) {
+		s.requireSignatures = true
+	}
+}
+
+type contextSignedRequestKey struct{}
+
+// GetSignedRequest returns the signed request of the call, when the
+// client signed it (see WithRequestSigning). It is meant to be used by
+// server methods on the context they receive.
+func GetSignedRequest(ctx context.Context) *SignedMessage {
+	m, _ := ctx.Value(contextSignedRequestKey{}).(*SignedMessage)
+	return m
+}
+
+// signedData returns the data covered by the signature of a message
+// with the given header and body.
+func signedData(header interface{}, body []byte) ([]byte, error) {
+	return CBORCodec.marshal(header, body)
+}
+
+// writeRequest writes a request header and its arguments to the stream,
+// signing them when a key is given, or compressing them when they take at
+// least compressAbove bytes otherwise (see WithClientCompression). The
+// stream is not flushed.
+func (sw *streamWrap) writeRequest(svcID ServiceID, args interface{}, key crypto.PrivKey, compressAbove int) error {
+	if key == nil && compressAbove > 0 {
+		body, err := sw.marshalBody(svcID.Codec, args)
+		if err != nil {
+			return err
+		}
+		if !compresses(compressAbove, len(body)) {
+			if err := sw.writeHeader(svcID); err != nil {
+				return err
+			}
+			_, err = sw.w.Write(body)
+			return err
+		}
+		svcID.Compression = gzipCompression
+		if err := sw.writeHeader(svcID); err != nil {
+			return err
+		}
+		return sw.writeCompressed(body)
+	}
+	if key == nil {
+		if err := sw.writeHeader(svcID); err != nil {
+			return err
+		}
+		return sw.encodeBody(svcID.Codec, args)
+	}
+
+	body, err := sw.marshalBody(svcID.Codec, args)
+	if err != nil {
+		return err
+	}
+	svcID.Signature = nil
+	data, err := signedData(svcID, body)
+	if err != nil {
+		return err
+	}
+	if svcID.Signature, err = key.Sign(data); err != nil {
+		return err
+	}
+	if err := sw.writeHeader(svcID); err != nil {
+		return err
+	}
+	return sw.enc.Encode(body)
+}
+
+// writeSignedResponse writes a response header and its encoded body (see
+// marshalBody), signed with the given key. The stream is not flushed.
+func (sw *streamWrap) writeSignedResponse(resp *Response, body []byte, key crypto.PrivKey) error {
+	resp.Signature = nil
+	data, err := signedData(resp, body)
+	if err != nil {
+		return err
+	}
+	if resp.Signature, err = key.Sign(data); err != nil {
+		return err
+	}
+	if err := sw.writeHeader(resp); err != nil {
+		return err
+	}
+	return sw.enc.Encode(body)
+}
+
+// signsResponse returns whether the given response must be signed, that
+// is, when it answers a signed request and the key of the server is
+// known.
+func (sw *streamWrap) signsResponse(resp *Response) bool {
+	return sw.signKey != nil && resp.Service.Signature != nil
+}
+
+// readSigned reads the body of a message with the given header, without
+// its signature, and verifies the signature of the message. It returns
+// the signed message and a streamWrap to decode the body from, which
+// must be released.
+func (sw *streamWrap) readSigned(header interface{}, sig []byte) (*SignedMessage, *streamWrap, error) {
+	var body []byte
+	if err := sw.decode(&body); err != nil {
+		return nil, nil, err
+	}
+	if sw.stream == nil {
+		return nil, nil, errors.New("signatures cannot be verified without the identity of the peer")
+	}
+	data, err := signedData(header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &SignedMessage{
+		Signer:    sw.remotePeer(),
+		Key:       sw.stream.Conn().RemotePublicKey(),
+		Data:      data,
+		Signature: sig,
+	}
+	if err := m.Verify(); err != nil {
+		return nil, nil, err
+	}
+	return m, wrapConn(bodyConn{bytes.NewReader(body)}, sw.codec), nil
+}
+
+// readSignedRequest reads and verifies the arguments of a signed request,
+// returning a streamWrap to decode them from, which must be released.
+func (sw *streamWrap) readSignedRequest(svcID ServiceID) (*SignedMessage, *streamWrap, error) {
+	sig := svcID.Signature
+	svcID.Signature = nil
+	m, body, err := sw.readSigned(svcID, sig)
+	if err != nil {
+		return nil, nil, newAuthorizationError(fmt.Errorf("cannot verify the request: %w", err))
+	}
+	return m, body, nil
+}
+
+// decodeResponseBody decodes the body of the given response into v,
+// verifying its signature when it is signed. The signed message is
+// returned for signed responses.
+func (sw *streamWrap) decodeResponseBody(resp *Response, v interface{}) (*SignedMessage, error) {
+	if resp.Compression != "" {
+		body, err := sw.readCompressed(resp.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer body.release()
+		return nil, body.decodeBody(resp.Service.Codec, resp.Raw, v)
+	}
+	if resp.Signature == nil {
+		return nil, sw.decodeBody(resp.Service.Codec, resp.Raw, v)
+	}
+	header := *resp
+	header.Signature = nil
+	m, body, err := sw.readSigned(&header, resp.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("cannot verify the response: %w", err)
+	}
+	defer body.release()
+	return m, body.decodeBody(resp.Service.Codec, resp.Raw, v)
+}
+
+// bodyConn is a read-only connection reading a signed body.
+type bodyConn struct {
+	*bytes.Reader
+}
+
+func (bodyConn) Write(p []byte) (int, error) {
+	return 0, errors.New("read-only connection")
+}
+
+func (bodyConn) Close() error {
+	return nil
+}
+
+// errUnsignedRequest is returned by servers requiring signed requests.
+var errUnsignedRequest = errors.New("the request must be signed")
+
+// decodeRequestArgs decodes the arguments of a request, verifying them
+// first when the request is signed, in which case the signed request is
+// added to the returned context.
+func decodeRequestArgs(ctx context.Context, s *streamWrap, svcID ServiceID, mtype *methodType) (context.Context, reflect.Value, error) {
+	if svcID.Compression != "" {
+		body, err := s.readCompressed(svcID.Compression)
+		if err != nil {
+			return ctx, reflect.Value{}, newServerError(err)
+		}
+		defer body.release()
+		s = body
+	}
+	if svcID.Signature == nil {
+		argv, err := decodeArgs(s.bodyDecoder(svcID.Codec, svcID.Raw), mtype)
+		if err != nil {
+			return ctx, argv, newServerError(err)
+		}
+		return ctx, argv, nil
+	}
+
+	m, body, err := s.readSignedRequest(svcID)
+	if err != nil {
+		return ctx, reflect.Value{}, err
+	}
+	defer body.release()
+	argv, err := decodeArgs(body.bodyDecoder(svcID.Codec, svcID.Raw), mtype)
+	if err != nil {
+		return ctx, argv, newServerError(err)
+	}
+	return context.WithValue(ctx, contextSignedRequestKey{}, m), argv, nil
+}
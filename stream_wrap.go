@@ -2,8 +2,17 @@ package rpc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 
 	"github.com/ugorji/go/codec"
 )
@@ -12,11 +21,58 @@ import (
 // write/read from a stream, so we can just carry the encoders
 // and bufios with us
 type streamWrap struct {
-	stream network.Stream
+	stream network.Stream // nil when wrapping other connections
+	rwc    io.ReadWriteCloser
 	enc    *codec.Encoder
 	dec    *codec.Decoder
 	w      *bufio.Writer
 	r      *bufio.Reader
+	fr     *frameReader
+	cw     *countingWriter
+	cr     *countingReader
+	codec  *Codec
+
+	// reqStart is the position in the stream where the current
+	// request starts, for sessions.
+	reqStart int64
+
+	// wmu serializes the writing of responses and progress
+	// updates, which may be sent from different goroutines.
+	wmu sync.Mutex
+	// progress holds the progress reporters of the requests
+	// being handled, by request ID.
+	progress map[uint64]*progressReporter
+
+	// inflight tracks the asynchronous methods which have
+	// not responded yet.
+	inflight sync.WaitGroup
+
+	// cancels holds the functions to cancel the requests being
+	// handled on pipelined streams, by request ID.
+	cmu     sync.Mutex
+	cancels map[uint64]context.CancelFunc
+
+	// signKey signs the responses to signed requests.
+	signKey crypto.PrivKey
+	// identity is the identity of the client authenticated on the
+	// stream, if any (see WithAuthenticator).
+	identity interface{}
+
+	// maxSize is the maximum size of the message bodies read
+	// from the stream (see readHeader).
+	maxSize int64
+	// vbuf holds the values being decoded (see decode).
+	vbuf bytes.Buffer
+	// compressAbove is the size from which the responses written
+	// to the stream are compressed (see WithServerCompression).
+	compressAbove int
+
+	// flushDelay delays the flushes of the messages written to the
+	// stream (see flushMessage). flushPending is set while a
+	// delayed flush is scheduled with flushTimer.
+	flushDelay   time.Duration
+	flushPending bool
+	flushTimer   *time.Timer
 }
 
 // wrapStream takes a stream and complements it with r/w bufios and
@@ -24,18 +80,215 @@ type streamWrap struct {
 // wrap.w.Write(). To encode something into it we can wrap.enc.Encode().
 // Finally, we should wrap.w.Flush() to actually send the data. Similar
 // for receiving.
-func wrapStream(s network.Stream) *streamWrap {
-	reader := bufio.NewReader(s)
-	writer := bufio.NewWriter(s)
-	h := &codec.MsgpackHandle{}
-	dec := codec.NewDecoder(reader, h)
-	enc := codec.NewEncoder(writer, h)
+func wrapStream(s network.Stream, c *Codec) *streamWrap {
+	return wrapConn(s, c)
+}
+
+// wrapConn works like wrapStream but takes any connection. Streams
+// provided as a connection are detected.
+//
+// The buffers and codec state of released streamWraps (see release())
+// are reused.
+func wrapConn(rwc io.ReadWriteCloser, c *Codec) *streamWrap {
+	stream, _ := rwc.(network.Stream)
+	if sw, ok := c.wraps.Get().(*streamWrap); ok {
+		sw.stream = stream
+		sw.rwc = rwc
+		sw.cr.r, sw.cr.n = rwc, 0
+		sw.cw.w, sw.cw.n = rwc, 0
+		sw.r.Reset(sw.cr)
+		sw.w.Reset(sw.cw)
+		sw.fr.left = -1
+		sw.maxSize = DefaultMaxMessageSize
+		sw.compressAbove = 0
+		sw.flushDelay = 0
+		sw.dec.Reset(sw.fr)
+		sw.enc.Reset(sw.w)
+		return sw
+	}
+
+	cr := &countingReader{r: rwc}
+	cw := &countingWriter{w: rwc}
+	reader := bufio.NewReader(cr)
+	writer := bufio.NewWriter(cw)
+	fr := &frameReader{r: reader, left: -1}
+	dec := codec.NewDecoder(fr, c.handle)
+	enc := codec.NewEncoder(writer, c.handle)
 	return &streamWrap{
-		stream: s,
-		r:      reader,
-		w:      writer,
-		enc:    enc,
-		dec:    dec,
+		stream:  stream,
+		rwc:     rwc,
+		r:       reader,
+		fr:      fr,
+		w:       writer,
+		cr:      cr,
+		cw:      cw,
+		codec:   c,
+		enc:     enc,
+		dec:     dec,
+		maxSize: DefaultMaxMessageSize,
+	}
+}
+
+// release puts the streamWrap back in the pool of its codec, once the
+// stream is not going to be used anymore. The streamWrap must not be
+// used after calling it.
+func (sw *streamWrap) release() {
+	sw.stream = nil
+	sw.rwc = nil
+	sw.cr.r = nil
+	sw.cw.w = nil
+	sw.r.Reset(nil)
+	sw.w.Reset(nil)
+	sw.reqStart = 0
+	sw.signKey = nil
+	sw.identity = nil
+	sw.wmu.Lock()
+	sw.progress = nil
+	if sw.flushPending {
+		sw.flushTimer.Stop()
+		sw.flushPending = false
 	}
+	sw.wmu.Unlock()
+	sw.codec.wraps.Put(sw)
+}
 
+// bodyCodec returns the codec with the given name, or the codec of the
+// stream when the name is empty or unknown.
+func (sw *streamWrap) bodyCodec(name string) *Codec {
+	if name == "" || name == sw.codec.name {
+		return sw.codec
+	}
+	if c := codecByName(name); c != nil {
+		return c
+	}
+	return sw.codec
+}
+
+// encodeBody encodes arguments or replies using the codec with the given
+// name (see bodyCodec). Values using a codec other than the one of the
+// stream are encoded separately and sent as a byte string, and Raw
+// values are sent as they are, like captured bodies using the same
+// codecs.
+func (sw *streamWrap) encodeBody(name string, v interface{}) error {
+	if data, ok := rawBytes(v); ok {
+		return sw.writeRaw(data)
+	}
+	if eb, ok := v.(*encodedBody); ok {
+		if data, ok := eb.encodedFor(sw, name); ok {
+			_, err := sw.w.Write(data)
+			return err
+		}
+		ev, err := eb.value()
+		if err != nil {
+			return err
+		}
+		return sw.encodeBody(name, ev)
+	}
+	c := sw.bodyCodec(name)
+	if c == sw.codec {
+		return sw.enc.Encode(v)
+	}
+	data, err := c.marshal(v)
+	if err != nil {
+		return err
+	}
+	return sw.enc.Encode(data)
+}
+
+// decodeBody decodes arguments or replies encoded with encodeBody(). Raw
+// indicates that a Raw value was sent.
+func (sw *streamWrap) decodeBody(name string, raw bool, v interface{}) error {
+	if eb, ok := v.(*encodedBody); ok {
+		return sw.captureBody(name, raw, eb)
+	}
+	if raw {
+		return sw.readRaw(v)
+	}
+	c := sw.bodyCodec(name)
+	if c == sw.codec {
+		return sw.decode(v)
+	}
+	var data []byte
+	if err := sw.decode(&data); err != nil {
+		return err
+	}
+	return c.unmarshal(data, v)
+}
+
+// marshalBody encodes a value as encodeBody() writes it to the stream.
+func (sw *streamWrap) marshalBody(name string, v interface{}) ([]byte, error) {
+	if data, ok := rawBytes(v); ok {
+		var buf bytes.Buffer
+		w := &streamWrap{w: bufio.NewWriter(&buf)}
+		if err := w.writeRaw(data); err != nil {
+			return nil, err
+		}
+		err := w.w.Flush()
+		return buf.Bytes(), err
+	}
+	if eb, ok := v.(*encodedBody); ok {
+		if data, ok := eb.encodedFor(sw, name); ok {
+			return data, nil
+		}
+		ev, err := eb.value()
+		if err != nil {
+			return nil, err
+		}
+		return sw.marshalBody(name, ev)
+	}
+	c := sw.bodyCodec(name)
+	data, err := c.marshal(v)
+	if err != nil || c == sw.codec {
+		return data, err
+	}
+	return sw.codec.marshal(data)
+}
+
+// bodyDecoder returns a function decoding values with decodeBody().
+func (sw *streamWrap) bodyDecoder(name string, raw bool) func(interface{}) error {
+	return func(v interface{}) error {
+		return sw.decodeBody(name, raw, v)
+	}
+}
+
+// consumed returns the number of bytes read from the stream which
+// have been decoded.
+func (sw *streamWrap) consumed() int64 {
+	return sw.cr.count() - int64(sw.r.Buffered())
+}
+
+// reset resets the stream, or closes the connection when it
+// is not a libp2p stream.
+func (sw *streamWrap) reset() error {
+	if sw.stream != nil {
+		return sw.stream.Reset()
+	}
+	return sw.rwc.Close()
+}
+
+// fullClose closes the stream after waiting for the other side to
+// close it, or closes the connection when it is not a libp2p stream.
+func (sw *streamWrap) fullClose() error {
+	if sw.stream != nil {
+		return helpers.FullClose(sw.stream)
+	}
+	return sw.rwc.Close()
+}
+
+// remotePeer returns the peer on the other side of the stream, or
+// an empty peer.ID when the connection is not a libp2p stream.
+func (sw *streamWrap) remotePeer() peer.ID {
+	if sw.stream != nil {
+		return sw.stream.Conn().RemotePeer()
+	}
+	return ""
+}
+
+// protocol returns the protocol of the stream, or an empty
+// protocol.ID when the connection is not a libp2p stream.
+func (sw *streamWrap) protocol() protocol.ID {
+	if sw.stream != nil {
+		return sw.stream.Protocol()
+	}
+	return ""
 }
@@ -0,0 +1,685 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Subscriptions let clients receive events pushed by a server instead of
+// polling it. A client subscribes to a method of a registered service
+// (see Client.Subscribe), which is called with the filter arguments given
+// by the client and may reject the subscription by returning an error.
+// Its reply is discarded, and the context it is given is cancelled when
+// the subscription ends. The stream used to subscribe stays open and
+// carries the events sent afterwards to the subscribers of the method
+// with an EventSender (see Server.EventSender).
+//
+// The Server gives every event of a method a cursor, sent along with it,
+// which increases with every event. Clients can resume a subscription
+// whose stream failed (i.e. on a network blip) by subscribing again from
+// the cursor of the last event they received (see WithResubscribe and
+// WithCursor): the method is called again, and can obtain the cursor
+// with GetResumeCursor, then the events sent to the method in the
+// meantime are delivered from the history kept by the Server (see
+// WithSubscriptionHistory) before the new ones. When some of them are
+// no longer in the history, the subscription fails with ErrEventsLost.
+
+// subscriptionBuffer is the number of events that can be queued for a
+// subscriber before it is considered too slow and dropped.
+const subscriptionBuffer = 64
+
+// errSlowSubscriber is sent to subscribers which do not keep up with
+// the events.
+var errSlowSubscriber = errors.New("rpc: subscriber dropped because it is too slow")
+
+// ErrEventsLost is the server error ending the subscriptions resumed
+// from a cursor after which some events are no longer in the history of
+// the Server (see WithSubscriptionHistory).
+var ErrEventsLost error = &serverError{msg: "rpc: the events after the cursor are no longer available"}
+
+// WithSubscriptionHistory makes the Server keep the last n events sent
+// to the subscribers of every method, so that subscriptions resumed
+// from the cursor of an event (see WithResubscribe) receive the events
+// sent after it. Without history, resumed subscriptions fail with
+// ErrEventsLost when events were sent in the meantime.
+func WithSubscriptionHistory(n int) ServerOption {
+	return func(s *Server) {
+		s.historySize = n
+	}
+}
+
+// GetResumeCursor returns the cursor from which a subscription is being
+// resumed, that is, the cursor of the last event received by the client
+// (see WithResubscribe). It is meant to be used by subscription methods
+// on the context they receive, i.e. to reject resumptions.
+func GetResumeCursor(ctx context.Context) (uint64, bool) {
+	cursor, ok := ctx.Value(resumeCursorKey).(uint64)
+	return cursor, ok
+}
+
+// subEvent is an event sent to subscribers, with its cursor.
+type subEvent struct {
+	cursor uint64
+	event  interface{}
+}
+
+// pastEvent is an event kept in the history of a method, with the
+// function selecting its subscribers, if any.
+type pastEvent struct {
+	subEvent
+	match func(filter interface{}) bool
+}
+
+// eventLog gives cursors to the events of a method and keeps the last
+// ones.
+type eventLog struct {
+	last    uint64
+	history []pastEvent
+}
+
+// logEvent gives the next cursor of the given method to an event, and
+// adds it to the history of the method. It must be called with subsMu
+// held.
+func (server *Server) logEvent(key string, event interface{}, match func(filter interface{}) bool) subEvent {
+	if server.eventLogs == nil {
+		server.eventLogs = make(map[string]*eventLog)
+	}
+	l := server.eventLogs[key]
+	if l == nil {
+		// Cursors start from the current time, so that the cursors
+		// given before the Server restarted are older than the new
+		// ones.
+		l = &eventLog{last: uint64(time.Now().UnixNano())}
+		server.eventLogs[key] = l
+	}
+	l.last++
+	ev := subEvent{cursor: l.last, event: event}
+	if server.historySize > 0 {
+		l.history = append(l.history, pastEvent{ev, match})
+		if len(l.history) > server.historySize {
+			l.history = l.history[1:]
+		}
+	}
+	return ev
+}
+
+// missedEvents returns the events of the given method sent after the
+// given cursor to the subscribers with the given filter, or
+// ErrEventsLost when some of them are no longer in the history. It must
+// be called with subsMu held.
+func (server *Server) missedEvents(key string, cursor uint64, filter interface{}) ([]subEvent, error) {
+	l := server.eventLogs[key]
+	if l == nil || l.last <= cursor {
+		return nil, nil
+	}
+	if len(l.history) == 0 || l.history[0].cursor > cursor+1 {
+		return nil, ErrEventsLost
+	}
+	var missed []subEvent
+	for _, ev := range l.history {
+		if ev.cursor > cursor && (ev.match == nil || ev.match(filter)) {
+			missed = append(missed, ev.subEvent)
+		}
+	}
+	return missed, nil
+}
+
+// subscriber is a subscription to a method in a Server.
+type subscriber struct {
+	peer   peer.ID
+	filter interface{}
+	events chan subEvent
+
+	closeOnce sync.Once
+	// closed is closed when the server drops the subscriber.
+	closed chan struct{}
+}
+
+// drop closes the subscription from the server side.
+func (sub *subscriber) drop() {
+	sub.closeOnce.Do(func() {
+		close(sub.closed)
+	})
+}
+
+// EventSender pushes events to the subscribers of a method. It is
+// obtained with Server.EventSender().
+type EventSender struct {
+	server *Server
+	key    string
+}
+
+// EventSender returns an EventSender for the subscribers of the given
+// method.
+func (server *Server) EventSender(svcName, svcMethod string) *EventSender {
+	return &EventSender{
+		server: server,
+		key:    svcName + "." + svcMethod,
+	}
+}
+
+// Send pushes the given event to all the subscribers of the method and
+// returns the number of subscribers it was queued for. Subscribers which
+// do not keep up with the events are dropped.
+func (es *EventSender) Send(event interface{}) int {
+	return es.SendMatching(event, nil)
+}
+
+// SendMatching works like Send, but only pushes the event to the
+// subscribers whose filter arguments (as taken by the method) make the
+// given function return true. The function is kept along with the event
+// in the history of the method, if any (see WithSubscriptionHistory).
+func (es *EventSender) SendMatching(event interface{}, match func(filter interface{}) bool) int {
+	es.server.subsMu.Lock()
+	ev := es.server.logEvent(es.key, event, match)
+	subs := make([]*subscriber, 0, len(es.server.subs[es.key]))
+	for sub := range es.server.subs[es.key] {
+		subs = append(subs, sub)
+	}
+	es.server.subsMu.Unlock()
+
+	n := 0
+	for _, sub := range subs {
+		if match != nil && !match(sub.filter) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+			n++
+		default:
+			es.server.logger.Warnw("dropping slow subscriber", "peer", sub.peer, "method", es.key)
+			sub.drop()
+		}
+	}
+	return n
+}
+
+// Subscribers returns the number of subscribers of the method.
+func (es *EventSender) Subscribers() int {
+	es.server.subsMu.Lock()
+	defer es.server.subsMu.Unlock()
+	return len(es.server.subs[es.key])
+}
+
+// subscribe calls the method of the subscription and, when it succeeds,
+// registers a subscriber with the given filter arguments. The subscriber
+// of a resumed subscription is given the events it missed first.
+func (server *Server) subscribe(ctx context.Context, p peer.ID, svcID ServiceID, argv reflect.Value) (*subscriber, error) {
+	service, mtype, err := server.getService(svcID)
+	if err != nil {
+		return nil, err
+	}
+	if mtype.async {
+		return nil, newServerError(fmt.Errorf("rpc: cannot subscribe to asynchronous method %s.%s", svcID.Name, svcID.Method))
+	}
+
+	ctx = withMetadata(ctx, svcID.Metadata)
+	ctx = server.withContextValues(ctx, svcID.Values)
+	if svcID.Cursor > 0 {
+		ctx = context.WithValue(ctx, resumeCursorKey, svcID.Cursor)
+	}
+	replyv := reflect.New(mtype.ReplyType.Elem())
+	resp := service.invoke(mtype, svcID, reflect.ValueOf(ctx), argv, replyv)
+	if err := responseToError(resp); err != nil {
+		return nil, err
+	}
+
+	key := svcID.Name + "." + svcID.Method
+	filter := argv.Interface()
+	server.subsMu.Lock()
+	defer server.subsMu.Unlock()
+	var missed []subEvent
+	if svcID.Cursor > 0 {
+		if missed, err = server.missedEvents(key, svcID.Cursor, filter); err != nil {
+			return nil, err
+		}
+	}
+	sub := &subscriber{
+		peer:   p,
+		filter: filter,
+		events: make(chan subEvent, subscriptionBuffer+len(missed)),
+		closed: make(chan struct{}),
+	}
+	for _, ev := range missed {
+		sub.events <- ev
+	}
+	if server.subs == nil {
+		server.subs = make(map[string]map[*subscriber]struct{})
+	}
+	if server.subs[key] == nil {
+		server.subs[key] = make(map[*subscriber]struct{})
+	}
+	server.subs[key][sub] = struct{}{}
+	return sub, nil
+}
+
+// unsubscribe removes a subscriber.
+func (server *Server) unsubscribe(svcID ServiceID, sub *subscriber) {
+	key := svcID.Name + "." + svcID.Method
+	server.subsMu.Lock()
+	defer server.subsMu.Unlock()
+	delete(server.subs[key], sub)
+	if len(server.subs[key]) == 0 {
+		delete(server.subs, key)
+	}
+}
+
+// serveSubscription handles a subscription request once its ServiceID
+// header has been read, and sends the events to the subscriber until the
+// stream is closed by the client or the subscriber is dropped.
+func (server *Server) serveSubscription(s *streamWrap, svcID ServiceID, svcName string) error {
+	if svcName != "" && svcID.Name != svcName {
+		return newServerError(fmt.Errorf("rpc: service %s cannot be called using the %s protocol", svcID.Name, s.protocol()))
+	}
+	if err := server.checkAccess(s.remotePeer(), svcID); err != nil {
+		return err
+	}
+	_, mtype, err := server.getService(svcID)
+	if err != nil {
+		return err
+	}
+	if err := server.checkCodec(svcID); err != nil {
+		return err
+	}
+	ctx, argv, err := decodeRequestArgs(context.Background(), s, svcID, mtype)
+	if err != nil {
+		return err
+	}
+
+	// The subscription ends when the client closes the stream.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rwc := s.rwc
+	go func() {
+		p := make([]byte, 1)
+		rwc.Read(p)
+		cancel()
+	}()
+
+	sub, err := server.subscribe(withTransport(ctx, s), s.remotePeer(), svcID, argv)
+	if err != nil {
+		return err
+	}
+	defer server.unsubscribe(svcID, sub)
+	server.logger.Debugw("new subscriber", "peer", s.remotePeer(), "service", svcID.Name, "method", svcID.Method)
+
+	if err := sendResponse(s, &Response{Service: svcID}, nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.closed:
+			return sendResponse(s, newErrorResponse(svcID, newServerError(errSlowSubscriber)), nil)
+		case ev := <-sub.events:
+			if err := sendResponse(s, &Response{Service: svcID, Cursor: ev.cursor}, ev.event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Subscription is an active subscription made with Client.Subscribe().
+type Subscription struct {
+	// cursor is the cursor of the last event received, accessed
+	// atomically.
+	cursor uint64
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Cursor returns the cursor of the last event received, or the cursor
+// the subscription was resumed from (see WithCursor) before any, or 0.
+// It can be given to WithCursor to resume the subscription later, i.e.
+// once the Client restarted.
+func (sub *Subscription) Cursor() uint64 {
+	return atomic.LoadUint64(&sub.cursor)
+}
+
+// WithCursor makes Subscribe resume a subscription from the given
+// cursor, as returned by Subscription.Cursor: the events sent after it
+// are delivered first, or the subscription fails with ErrEventsLost when
+// the server does not have them anymore (see WithSubscriptionHistory).
+func WithCursor(cursor uint64) CallOption {
+	return func(o *callOptions) {
+		o.cursor = cursor
+	}
+}
+
+// WithResubscribe makes Subscribe re-establish the subscription when its
+// stream fails, i.e. on network blips, resuming it from the cursor of
+// the last event received (see WithCursor). Up to the given number of
+// attempts are made after every failure, waiting for the backoff
+// duration before the first one and twice longer before every other.
+// Subscriptions rejected by the server, i.e. with ErrEventsLost, are not
+// re-established.
+func WithResubscribe(attempts int, backoff time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.resubscribe = attempts
+		o.resubscribeBackoff = backoff
+	}
+}
+
+// Unsubscribe ends the subscription and waits until the events channel
+// is closed.
+func (sub *Subscription) Unsubscribe() {
+	sub.cancel()
+	<-sub.done
+}
+
+// Err returns the reason why the subscription ended, once the events
+// channel has been closed, or nil while it is active.
+func (sub *Subscription) Err() error {
+	select {
+	case <-sub.done:
+		return sub.err
+	default:
+		return nil
+	}
+}
+
+// errSubscriptionClosed is returned when the server ends a subscription.
+var errSubscriptionClosed = errors.New("subscription closed by the server")
+
+// Subscribe subscribes to the given method of the destination, which is
+// called with the given arguments to set up the subscription, and
+// delivers the events sent to the subscribers of the method to the given
+// channel, whose element type must match the events. The channel is
+// closed when the subscription ends: when the context is cancelled, when
+// Unsubscribe() is called or when the server closes it. Subscribe returns
+// once the subscription has been accepted by the server.
+//
+// Events are not queued in the client: a subscriber which does not read
+// them fast enough is eventually dropped by the server.
+func (c *Client) Subscribe(
+	ctx context.Context,
+	dest peer.ID,
+	svcName, svcMethod string,
+	args interface{},
+	events interface{},
+	opts ...CallOption,
+) (*Subscription, error) {
+	chv := reflect.ValueOf(events)
+	if chv.Kind() != reflect.Chan || chv.Type().ChanDir()&reflect.SendDir == 0 {
+		return nil, &clientError{"events must be a channel"}
+	}
+
+	call := newCall(ctx, dest, svcName, svcMethod, args, nil, nil, opts...)
+	call.SvcID.Subscribe = true
+	call.SvcID.Cursor = call.opts.cursor
+	c.prepareCall(call)
+	// Subscriptions are pending until they end, so that closing the
+	// Client ends them.
+	if !c.pending.add(call, time.Now()) {
+		call.cancel()
+		return nil, ErrClientClosed
+	}
+	fail := func(err error) (*Subscription, error) {
+		call.cancel()
+		c.pending.remove(call)
+		return nil, err
+	}
+	sub := &Subscription{
+		cursor: call.opts.cursor,
+		cancel: call.cancel,
+		done:   make(chan struct{}),
+	}
+
+	if c.conn != nil {
+		return fail(&clientError{"cannot subscribe over a connection"})
+	}
+	if dest == "" || c.host == nil || dest == c.host.ID() {
+		if c.server == nil {
+			return fail(&clientError{"Cannot make local calls: server not set"})
+		}
+		s, err := c.subscribeLocal(call)
+		if err != nil {
+			return fail(err)
+		}
+		go c.deliverLocal(call, s, chv, sub)
+		return sub, nil
+	}
+
+	sWrap, err := c.subscribeRemote(call)
+	if err != nil {
+		return fail(err)
+	}
+	go c.deliverRemote(call, sWrap, chv, sub)
+	return sub, nil
+}
+
+// subscriptionCancelled returns the error ending a subscription whose
+// context is done: ErrClientClosed when the Client was closed, or the
+// error of the context.
+func (c *Client) subscriptionCancelled(call *Call) error {
+	if c.pending.isClosed() {
+		return ErrClientClosed
+	}
+	return call.ctx.Err()
+}
+
+// subscribeLocal subscribes to a method of the local server.
+func (c *Client) subscribeLocal(call *Call) (*subscriber, error) {
+	_, mtype, err := c.server.getService(call.SvcID)
+	if err != nil {
+		return nil, err
+	}
+	argv := reflect.ValueOf(call.Args)
+	if !argv.IsValid() || !argv.Type().AssignableTo(mtype.ArgType) {
+		return nil, &clientError{fmt.Sprintf("%s.%s is being called with the wrong arg type", call.SvcID.Name, call.SvcID.Method)}
+	}
+	return c.server.subscribe(call.ctx, "", call.SvcID, argv)
+}
+
+// subscribeRemote sends a subscription request to the destination and
+// waits for it to be accepted.
+func (c *Client) subscribeRemote(call *Call) (*streamWrap, error) {
+	f := c.negotiate(call)
+	if f != nil && !f.Streaming {
+		return nil, &clientError{call.Dest.Pretty() + " does not support subscriptions"}
+	}
+	if err := c.adapt(call, f); err != nil {
+		return nil, err
+	}
+	s, err := c.openStream(call)
+	if err != nil {
+		return nil, newClientError(err)
+	}
+	c.setPeerProtocol(call.Dest, s.Protocol())
+	sWrap := c.wrap(s, codecFor(c.codecs, s.Protocol()))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go resetOnDone(call.ctx, sWrap, stop)
+
+	if err := c.authenticate(call, sWrap); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if err := sWrap.writeRequest(call.SvcID, call.Args, call.signKey, call.compressAbove); err != nil {
+		s.Reset()
+		return nil, newClientError(err)
+	}
+	if err := sWrap.w.Flush(); err != nil {
+		s.Reset()
+		return nil, newClientError(err)
+	}
+
+	var resp Response
+	if err := sWrap.readHeader(&resp); err != nil {
+		s.Reset()
+		return nil, newClientError(err)
+	}
+	var body interface{}
+	if _, err := sWrap.decodeResponseBody(&resp, &body); err != nil && err != io.EOF {
+		s.Reset()
+		return nil, newClientError(err)
+	}
+	if err := sWrap.responseToError(&resp); err != nil {
+		go helpers.FullClose(s)
+		return nil, err
+	}
+	return sWrap, nil
+}
+
+// deliverRemote reads the events arriving over the subscription stream
+// and sends them to the events channel until the subscription ends,
+// re-establishing it when allowed (see WithResubscribe).
+func (c *Client) deliverRemote(call *Call, s *streamWrap, chv reflect.Value, sub *Subscription) {
+	defer c.pending.remove(call)
+	defer close(sub.done)
+	defer chv.Close()
+	defer call.cancel()
+
+	for {
+		resumable, err := c.readEvents(call, s, chv, sub)
+		s.reset()
+		if resumable && call.opts.resubscribe > 0 {
+			c.logger.Debugw("resubscribing", "peer", call.Dest, "service", call.SvcID.Name, "method", call.SvcID.Method, "cursor", sub.Cursor(), "error", err)
+			var rerr error
+			if s, rerr = c.resubscribe(call, sub); rerr == nil {
+				continue
+			}
+			err = rerr
+		}
+		sub.err = err
+		return
+	}
+}
+
+// readEvents reads the events arriving over a subscription stream and
+// sends them to the events channel until the stream fails or the
+// subscription ends. It returns the error ending it, and whether the
+// subscription can be resumed, that is, when the stream failed.
+func (c *Client) readEvents(call *Call, s *streamWrap, chv reflect.Value, sub *Subscription) (bool, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go resetOnDone(call.ctx, s, stop)
+
+	elemType := chv.Type().Elem()
+	for {
+		var resp Response
+		if err := s.readHeader(&resp); err != nil {
+			if call.ctx.Err() != nil {
+				return false, c.subscriptionCancelled(call)
+			}
+			if err == io.EOF {
+				return true, &clientError{errSubscriptionClosed.Error()}
+			}
+			return true, newClientError(err)
+		}
+		if err := s.responseToError(&resp); err != nil {
+			var body interface{}
+			s.decodeResponseBody(&resp, &body)
+			return false, err
+		}
+		ev := reflect.New(elemType)
+		if _, err := s.decodeResponseBody(&resp, ev.Interface()); err != nil {
+			return false, newClientError(fmt.Errorf("cannot decode event as %s: %w", elemType, err))
+		}
+
+		if !sendEvent(call.ctx, chv, ev.Elem()) {
+			return false, c.subscriptionCancelled(call)
+		}
+		if resp.Cursor > 0 {
+			atomic.StoreUint64(&sub.cursor, resp.Cursor)
+		}
+	}
+}
+
+// resubscribe subscribes again from the cursor of the last event
+// received, after the stream of the subscription failed, making as
+// many attempts as allowed by WithResubscribe. It returns the new
+// subscription stream.
+func (c *Client) resubscribe(call *Call, sub *Subscription) (*streamWrap, error) {
+	backoff := call.opts.resubscribeBackoff
+	var err error
+	for attempt := 0; attempt < call.opts.resubscribe; attempt++ {
+		t := time.NewTimer(backoff)
+		select {
+		case <-call.ctx.Done():
+			t.Stop()
+			return nil, c.subscriptionCancelled(call)
+		case <-t.C:
+		}
+		backoff *= 2
+
+		call.SvcID.Cursor = sub.Cursor()
+		var s *streamWrap
+		if s, err = c.subscribeRemote(call); err == nil {
+			return s, nil
+		}
+		if call.ctx.Err() != nil {
+			return nil, c.subscriptionCancelled(call)
+		}
+		// Rejections by the server are final.
+		if !IsClientError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// deliverLocal sends the events of a local subscriber to the events
+// channel until the subscription ends.
+func (c *Client) deliverLocal(call *Call, s *subscriber, chv reflect.Value, sub *Subscription) {
+	defer c.pending.remove(call)
+	defer close(sub.done)
+	defer chv.Close()
+	defer call.cancel()
+	defer c.server.unsubscribe(call.SvcID, s)
+
+	elemType := chv.Type().Elem()
+	for {
+		select {
+		case <-call.ctx.Done():
+			sub.err = c.subscriptionCancelled(call)
+			return
+		case <-s.closed:
+			sub.err = newServerError(errSlowSubscriber)
+			return
+		case event := <-s.events:
+			ev := reflect.New(elemType)
+			if err := setReply(ev.Interface(), event.event); err != nil {
+				sub.err = newClientError(err)
+				return
+			}
+			if !sendEvent(call.ctx, chv, ev.Elem()) {
+				sub.err = c.subscriptionCancelled(call)
+				return
+			}
+			atomic.StoreUint64(&sub.cursor, event.cursor)
+		}
+	}
+}
+
+// resetOnDone resets the stream when the context is cancelled before
+// stop is closed.
+func resetOnDone(ctx context.Context, s *streamWrap, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		s.reset()
+	case <-stop:
+	}
+}
+
+// sendEvent sends an event to the events channel, unless the context
+// is cancelled first.
+func sendEvent(ctx context.Context, chv, ev reflect.Value) bool {
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: chv, Send: ev},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	})
+	return chosen == 0
+}
@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Calls to services or methods which are not registered fail with
+// ErrNoSuchService and ErrNoSuchMethod, along with the registered names
+// closest to the one requested, which are likely what the caller meant
+// when the name has a typo (see Suggestions). The suggestions are part
+// of the error message, and sent to clients in the detail of the error.
+
+// ErrNoSuchService is the server error returned by calls to services
+// which are not registered. Errors returned by such calls match it with
+// errors.Is.
+var ErrNoSuchService error = &serverError{msg: "rpc: can't find service"}
+
+// ErrNoSuchMethod is the server error returned by calls to methods
+// which are not registered in their service. Errors returned by such
+// calls match it with errors.Is.
+var ErrNoSuchMethod error = &serverError{msg: "rpc: can't find method"}
+
+// maxSuggestions is the maximum number of names suggested by errors for
+// unknown services and methods.
+const maxSuggestions = 3
+
+// newNoSuchError returns the server error for an unknown service or
+// method, kind being ErrNoSuchService or ErrNoSuchMethod, suggesting the
+// registered names closest to the given name.
+func newNoSuchError(kind error, name string, registered []string) error {
+	msg := kind.Error() + " " + name
+	suggestions := suggestNames(name, registered)
+	if len(suggestions) > 0 {
+		msg += " (did you mean " + strings.Join(suggestions, ", ") + "?)"
+	}
+	return &serverError{msg: msg, kind: kind, suggestions: suggestions}
+}
+
+// noSuchKind returns ErrNoSuchService or ErrNoSuchMethod when the
+// message of a server error is the one of such an error, or nil.
+func noSuchKind(msg string) error {
+	for _, kind := range []error{ErrNoSuchService, ErrNoSuchMethod} {
+		if strings.HasPrefix(msg, kind.Error()+" ") {
+			return kind
+		}
+	}
+	return nil
+}
+
+// Suggestions returns the registered names suggested by an error
+// matching ErrNoSuchService or ErrNoSuchMethod, closest first, or nil
+// when there are none.
+func Suggestions(err error) []string {
+	var se *serverError
+	if !errors.As(err, &se) {
+		return nil
+	}
+	return se.suggestions
+}
+
+// suggestNames returns the names closest to the given one, when they are
+// close enough to be a typo of it: the names which differ only in case,
+// and the ones a few edits away, depending on the length of the name.
+func suggestNames(name string, names []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	lower := strings.ToLower(name)
+	max := len(name)/4 + 1
+	var candidates []candidate
+	for _, n := range names {
+		if n == name {
+			continue
+		}
+		if d := editDistance(lower, strings.ToLower(n)); d <= max {
+			candidates = append(candidates, candidate{n, d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between two strings,
+// i.e. the number of bytes to insert, delete or replace to turn one into
+// the other.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// serviceNames returns the names of the registered services.
+func (server *Server) serviceNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range server.services() {
+		if !seen[s.name] {
+			seen[s.name] = true
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+// methodNames returns the names of the methods of a service.
+func (s *service) methodNames() []string {
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	return names
+}
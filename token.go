@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Capability tokens allow finer access control than peer IDs. A token is
+// issued by an authority, whose key is known to the servers, to a peer,
+// and lists the methods that the peer may call. Clients attach tokens to
+// their calls (see WithToken and WithClientToken), and servers requiring
+// them (see WithTokenAuthority) verify them before running the methods.
+
+// TokenClaims are the contents of a capability token.
+type TokenClaims struct {
+	// Subject is the peer allowed to use the token.
+	Subject peer.ID
+	// Scopes lists the methods that may be called with the token,
+	// as "Service.Method", "Service.*" for whole services, or "*"
+	// for every method.
+	Scopes []string
+	// Expires is the time after which the token is not valid. A
+	// zero time means that the token does not expire.
+	Expires time.Time
+}
+
+// Allows returns true when the scopes include the given method.
+func (tc *TokenClaims) Allows(svcName, svcMethod string) bool {
+	for _, scope := range tc.Scopes {
+		switch {
+		case scope == "*":
+			return true
+		case strings.HasSuffix(scope, ".*"):
+			if strings.TrimSuffix(scope, ".*") == svcName {
+				return true
+			}
+		case scope == svcName+"."+svcMethod:
+			return true
+		}
+	}
+	return false
+}
+
+// Token is a capability token: the encoded claims and their signature
+// by the issuing authority.
+type Token struct {
+	Claims    []byte
+	Signature []byte
+}
+
+// IssueToken returns a token with the given claims, signed with the key
+// of the authority.
+func IssueToken(key crypto.PrivKey, claims TokenClaims) (*Token, error) {
+	data, err := MsgpackCodec.Marshal(&claims)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{Claims: data, Signature: sig}, nil
+}
+
+// Verify checks that the token is signed by the given authority and has
+// not expired, and returns its claims.
+func (t *Token) Verify(authority crypto.PubKey) (*TokenClaims, error) {
+	ok, err := authority.Verify(t.Claims, t.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("invalid token signature")
+	}
+	var claims TokenClaims
+	if err := MsgpackCodec.Unmarshal(t.Claims, &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if !claims.Expires.IsZero() && time.Now().After(claims.Expires) {
+		return nil, errors.New("token expired")
+	}
+	return &claims, nil
+}
+
+// WithToken attaches a capability token to the call, which takes
+// precedence over the one given with WithClientToken. Tokens are not
+// used for local calls.
+func WithToken(t *Token) CallOption {
+	return func(o *callOptions) {
+		o.token = t
+	}
+}
+
+// WithClientToken attaches a capability token to all the remote calls
+// performed by the Client.
+func WithClientToken(t *Token) ClientOption {
+	return func(c *Client) {
+		c.token = t
+	}
+}
+
+// WithTokenAuthority makes the Server require a capability token issued
+// by the authority with the given key to the calling peer, and allowing
+// the method, for every remote call. Calls without such a token fail with
+// an authorization error. Calls made by the local Client are not checked.
+func WithTokenAuthority(key crypto.PubKey) ServerOption {
+	return func(s *Server) {
+		s.tokenAuthority = key
+	}
+}
+
+// checkToken verifies the token sent with a request by the given peer,
+// when the Server requires tokens.
+func (server *Server) checkToken(p peer.ID, svcID ServiceID) error {
+	if server.tokenAuthority == nil {
+		return nil
+	}
+	if svcID.Token == nil {
+		return newAuthorizationError(errors.New("a capability token is required"))
+	}
+	claims, err := svcID.Token.Verify(server.tokenAuthority)
+	if err != nil {
+		return newAuthorizationError(err)
+	}
+	if claims.Subject != p {
+		return newAuthorizationError(errors.New("the capability token was issued to another peer"))
+	}
+	if !claims.Allows(svcID.Name, svcID.Method) {
+		return newAuthorizationError(fmt.Errorf("the capability token does not allow %s.%s", svcID.Name, svcID.Method))
+	}
+	return nil
+}
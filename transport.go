@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Transport describes the stream over which a remote call arrived, so
+// that methods can take locality-aware decisions, i.e. refusing heavy
+// transfers over relays.
+type Transport struct {
+	// Peer is the caller.
+	Peer peer.ID
+	// LocalAddr and RemoteAddr are the addresses of the connection
+	// carrying the stream.
+	LocalAddr  ma.Multiaddr
+	RemoteAddr ma.Multiaddr
+	// Relayed is true when the connection goes through a relay.
+	Relayed bool
+	// Protocol is the protocol negotiated for the stream.
+	Protocol protocol.ID
+	// Stream and Conn are the statistics of the stream and of its
+	// connection, such as their direction and opening time.
+	Stream network.Stat
+	Conn   network.Stat
+}
+
+// GetTransport returns the transport of the call. It is meant to be used
+// by server methods on the context they receive. It returns nil for
+// local calls and for calls arriving over connections which are not
+// libp2p streams (see ServeConn).
+func GetTransport(ctx context.Context) *Transport {
+	t, _ := ctx.Value(transportKey).(*Transport)
+	return t
+}
+
+// withTransport returns a context carrying the transport of the given
+// stream and its remote peer (see GetRemotePeer), when it is a libp2p
+// stream.
+func withTransport(ctx context.Context, s *streamWrap) context.Context {
+	if s.stream == nil {
+		return ctx
+	}
+	conn := s.stream.Conn()
+	t := &Transport{
+		Peer:       conn.RemotePeer(),
+		LocalAddr:  conn.LocalMultiaddr(),
+		RemoteAddr: conn.RemoteMultiaddr(),
+		Relayed:    isRelayed(conn.RemoteMultiaddr()),
+		Protocol:   s.stream.Protocol(),
+		Stream:     s.stream.Stat(),
+		Conn:       conn.Stat(),
+	}
+	ctx = withRemotePeer(ctx, conn.RemotePeer(), conn.RemotePublicKey())
+	return context.WithValue(ctx, transportKey, t)
+}
@@ -0,0 +1,145 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TypedCall is a type-safe function to call a specific service method,
+// as returned by NewTypedCall. It performs a CallContext() to the given
+// destination and returns the reply.
+type TypedCall[A, R any] func(ctx context.Context, dest peer.ID, args A, opts ...CallOption) (R, error)
+
+// NewTypedCall returns a TypedCall which uses the given client to call
+// svcName.svcMethod, taking arguments of type A and obtaining replies of
+// type R (the server method must take a *R as reply argument).
+//
+// The given CallOptions are applied to every call, before the ones given
+// to it.
+//
+// Mistakes in the service and method names are detected when possible at
+// construction time: an error is returned if the names are empty and,
+// when the Client has a local Server where the service is registered (in
+// the version given with WithServiceVersion, if any), if the method does
+// not exist or its signature does not match A and R.
+func NewTypedCall[A, R any](c *Client, svcName, svcMethod string, opts ...CallOption) (TypedCall[A, R], error) {
+	if err := checkTypedNames(svcName, svcMethod); err != nil {
+		return nil, err
+	}
+	version := newCallOptions(opts).version
+	if err := checkTypedCall(c.server, svcName, svcMethod, version, reflect.TypeOf((*A)(nil)).Elem(), reflect.TypeOf((*R)(nil))); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, dest peer.ID, args A, callOpts ...CallOption) (R, error) {
+		var reply R
+		if len(opts) > 0 {
+			callOpts = append(opts[:len(opts):len(opts)], callOpts...)
+		}
+		err := c.CallContext(ctx, dest, svcName, svcMethod, args, &reply, callOpts...)
+		return reply, err
+	}, nil
+}
+
+// TypedResult is the outcome of one of the calls made by MultiCallT().
+type TypedResult[R any] struct {
+	// Index is the position of the destination in the given slice.
+	Index   int
+	Peer    peer.ID
+	Reply   R
+	Error   error
+	Latency time.Duration
+}
+
+// MultiCallT works like MultiCallContext() but allocates a reply of type
+// R for every destination (the server method must take a *R as reply
+// argument), and returns the results in the order of the destinations,
+// along with the latency of every call:
+//
+//	results, err := rpc.MultiCallT[Quotient](ctx, client, dests, "Arith", "Divide", &Args{7, 2})
+//	for _, res := range results {
+//		if res.Error == nil {
+//			fmt.Println(res.Peer, res.Reply.Quo)
+//		}
+//	}
+//
+// An error is returned, without making any call, when the names are
+// empty or, when the Client has a local Server where the service is
+// registered (in the version given with WithServiceVersion, if any),
+// when the method does not exist or its signature does not match the
+// arguments and R (see NewTypedCall). Errors of the calls are
+// reported in the results.
+func MultiCallT[R any](ctx context.Context, c *Client, dests []peer.ID, svcName, svcMethod string, args interface{}, opts ...CallOption) ([]TypedResult[R], error) {
+	if err := checkTypedNames(svcName, svcMethod); err != nil {
+		return nil, err
+	}
+	version := newCallOptions(opts).version
+	if err := checkTypedCall(c.server, svcName, svcMethod, version, reflect.TypeOf(args), reflect.TypeOf((*R)(nil))); err != nil {
+		return nil, err
+	}
+
+	ctxs := make([]context.Context, len(dests))
+	replies := make([]R, len(dests))
+	ptrs := make([]interface{}, len(dests))
+	for i := range dests {
+		ctxs[i] = ctx
+		ptrs[i] = &replies[i]
+	}
+	results := make([]TypedResult[R], len(dests))
+	for i, res := range c.MultiCallResults(ctxs, dests, svcName, svcMethod, args, ptrs, opts...) {
+		results[i] = TypedResult[R]{
+			Index:   res.Index,
+			Peer:    res.Peer,
+			Reply:   replies[res.Index],
+			Error:   res.Error,
+			Latency: res.Latency,
+		}
+	}
+	return results, nil
+}
+
+// checkTypedNames verifies that the given service and method names are
+// set. Method names are not required to be exported Go names, since
+// methods can be published under other names (see WithMethodNames and
+// RegisterFunc).
+func checkTypedNames(svcName, svcMethod string) error {
+	if svcName == "" {
+		return errors.New("rpc: service name is empty")
+	}
+	if svcMethod == "" {
+		return errors.New("rpc: method name is empty")
+	}
+	return nil
+}
+
+// checkTypedCall verifies, using the local server if available, that
+// the given method of the given version of the service exists and takes
+// the given argument and reply types.
+func checkTypedCall(s *Server, svcName, svcMethod, version string, argType, replyType reflect.Type) error {
+	if s == nil {
+		return nil
+	}
+
+	svc := s.services()[serviceKey(svcName, version)]
+	if svc == nil {
+		// The service may only be available in remote servers.
+		return nil
+	}
+
+	mtype := svc.method[svcMethod]
+	if mtype == nil {
+		return fmt.Errorf("rpc: service %s has no method %s", svcName, svcMethod)
+	}
+	if mtype.ArgType != argType {
+		return fmt.Errorf("rpc: %s.%s takes arguments of type %s, not %s", svcName, svcMethod, mtype.ArgType, argType)
+	}
+	if !mtype.async && mtype.ReplyType != replyType {
+		return fmt.Errorf("rpc: %s.%s takes replies of type %s, not %s", svcName, svcMethod, mtype.ReplyType, replyType)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// The arguments of calls can be validated by the Server once decoded,
+// before the method runs: arguments implementing Validator validate
+// themselves, and a function set with WithArgsValidator validates all
+// of them, i.e. from struct tags with a validation library:
+//
+//	validate := validator.New()
+//	server := rpc.NewServer(h, p, rpc.WithArgsValidator(func(ctx context.Context, args interface{}) error {
+//		if reflect.Indirect(reflect.ValueOf(args)).Kind() != reflect.Struct {
+//			return nil
+//		}
+//		return validate.StructCtx(ctx, args)
+//	}))
+//
+// Calls with invalid arguments fail with a client error matching
+// ErrInvalidArgs, without running the method. Validation functions
+// report the invalid fields by returning a FieldError or FieldErrors,
+// which are sent to the client (see InvalidFields).
+
+// Validator is implemented by arguments which validate themselves.
+type Validator interface {
+	Validate() error
+}
+
+// WithArgsValidator sets a function validating the arguments of all the
+// calls handled by the Server, after the ones implementing Validator
+// validated themselves.
+func WithArgsValidator(f func(ctx context.Context, args interface{}) error) ServerOption {
+	return func(s *Server) {
+		s.argsValidator = f
+	}
+}
+
+// FieldError describes an invalid field of the arguments of a call.
+type FieldError struct {
+	// Field is the path of the field, i.e. "Address.Port", or empty
+	// for the whole arguments.
+	Field   string
+	Message string
+}
+
+func (fe FieldError) Error() string {
+	if fe.Field == "" {
+		return fe.Message
+	}
+	return fe.Field + ": " + fe.Message
+}
+
+// FieldErrors describes the invalid fields of the arguments of a call.
+type FieldErrors []FieldError
+
+func (fes FieldErrors) Error() string {
+	msgs := make([]string, len(fes))
+	for i, fe := range fes {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// invalidArgsError is the client error returned by calls with invalid
+// arguments.
+type invalidArgsError struct {
+	msg    string
+	fields []FieldError
+}
+
+func (ie *invalidArgsError) Error() string {
+	return ie.msg
+}
+
+func (ie *invalidArgsError) Is(target error) bool {
+	return target == ErrInvalidArgs
+}
+
+// ErrInvalidArgs is the client error returned by calls whose arguments
+// failed to be validated by the Server. Errors returned by such calls
+// match it with errors.Is.
+var ErrInvalidArgs error = &invalidArgsError{msg: "rpc: invalid arguments"}
+
+// InvalidFields returns the invalid fields reported by an error matching
+// ErrInvalidArgs, or nil when there are none.
+func InvalidFields(err error) []FieldError {
+	var ie *invalidArgsError
+	if !errors.As(err, &ie) {
+		return nil
+	}
+	return ie.fields
+}
+
+// newInvalidArgsError returns the error for arguments which failed to be
+// validated with the given error.
+func newInvalidArgsError(err error) error {
+	ie := &invalidArgsError{msg: ErrInvalidArgs.Error() + ": " + err.Error()}
+	var fes FieldErrors
+	var fe FieldError
+	switch {
+	case errors.As(err, &fes):
+		ie.fields = fes
+	case errors.As(err, &fe):
+		ie.fields = []FieldError{fe}
+	}
+	return ie
+}
+
+// validateArgs validates the decoded arguments of a call.
+func (server *Server) validateArgs(ctx context.Context, argv reflect.Value) error {
+	args := argv.Interface()
+	v, ok := args.(Validator)
+	if ok && argv.Kind() == reflect.Ptr && argv.IsNil() {
+		ok = false
+	} else if !ok && argv.Kind() != reflect.Ptr {
+		// Validate may have a pointer receiver.
+		pv := reflect.New(argv.Type())
+		pv.Elem().Set(argv)
+		v, ok = pv.Interface().(Validator)
+	}
+	if ok {
+		if err := v.Validate(); err != nil {
+			return newInvalidArgsError(err)
+		}
+	}
+	if server.argsValidator != nil {
+		if err := server.argsValidator(ctx, args); err != nil {
+			return newInvalidArgsError(err)
+		}
+	}
+	return nil
+}
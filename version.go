@@ -0,0 +1,52 @@
+package rpc
+
+import "strings"
+
+// Services can be registered at several versions under the same name
+// (see WithVersion), so that method signatures can change during rolling
+// upgrades: clients request a version (see WithServiceVersion) and
+// servers dispatch the requests to the matching implementation. Requests
+// without a version go to the service registered without one.
+
+// ErrUnsupportedVersion is the server error returned by calls requesting
+// a version of a service which is not registered in the server, while
+// other versions are.
+var ErrUnsupportedVersion error = &serverError{msg: "rpc: unsupported service version"}
+
+// WithVersion registers the service at the given version. Services can be
+// registered at several versions, and without a version, at the same
+// time.
+func WithVersion(v string) RegisterOption {
+	return func(o *registerOptions) {
+		o.version = v
+	}
+}
+
+// WithServiceVersion makes the call request the given version of the
+// service (see WithVersion). Calls fail with ErrUnsupportedVersion when
+// the server does not have it.
+func WithServiceVersion(v string) CallOption {
+	return func(o *callOptions) {
+		o.version = v
+	}
+}
+
+// serviceKey returns the key of the given version of a service in the
+// service map.
+func serviceKey(name, version string) string {
+	if version == "" {
+		return name
+	}
+	return name + "@" + version
+}
+
+// hasService returns true when the service with the given name is
+// registered, at any version.
+func (server *Server) hasService(name string) bool {
+	for key := range server.services() {
+		if key == name || strings.HasPrefix(key, name+"@") {
+			return true
+		}
+	}
+	return false
+}